@@ -0,0 +1,351 @@
+// Package agent periodically writes CPU and heap profile snapshots of the running process to a directory, keeping a
+// limited number of them and an index, so that what a long-running processor was doing at a given time can be looked
+// up afterwards without an external profiling service.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the zero values of Config.
+const (
+	DefaultDir         = "./pprof/continuous"
+	DefaultInterval    = time.Minute
+	DefaultCPUDuration = 10 * time.Second
+	DefaultRetention   = 60
+)
+
+// IndexFile is the name of the index written to the snapshot directory.
+const IndexFile = "index.json"
+
+// timeFormat is the timestamp in snapshot file names. It sorts chronologically and includes milliseconds so that
+// short intervals do not collide.
+const timeFormat = "20060102-150405.000"
+
+// Config controls what the agent captures and how much of it is kept.
+type Config struct {
+	// Dir is the directory snapshots and the index are written to.
+	Dir string
+	// Interval is the time between the start of each round of snapshots.
+	Interval time.Duration
+	// CPUDuration is how long each CPU profile records for. It is capped at Interval.
+	CPUDuration time.Duration
+	// Profiles lists the profiles captured each round: "cpu", or any runtime/pprof profile such as "heap",
+	// "allocs", "goroutine", "block" or "mutex". Defaults to cpu and heap.
+	Profiles []string
+	// Retention is the number of snapshots of each profile kept; older ones are deleted.
+	Retention int
+}
+
+// withDefaults fills in the zero values of a Config.
+func (c Config) withDefaults() Config {
+	if c.Dir == "" {
+		c.Dir = DefaultDir
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultInterval
+	}
+	if c.CPUDuration <= 0 {
+		c.CPUDuration = DefaultCPUDuration
+	}
+	if c.CPUDuration > c.Interval {
+		c.CPUDuration = c.Interval
+	}
+	if len(c.Profiles) == 0 {
+		c.Profiles = []string{"cpu", "heap"}
+	}
+	if c.Retention <= 0 {
+		c.Retention = DefaultRetention
+	}
+	return c
+}
+
+// Snapshot is an entry of the index: a single profile written by the agent.
+type Snapshot struct {
+	Profile string    `json:"profile"`
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+	// Duration is how long a CPU profile recorded for. It is zero for point in time profiles like heap.
+	Duration time.Duration `json:"duration,omitempty"`
+	Size     int64         `json:"size"`
+}
+
+// Agent captures snapshots in the background until stopped.
+type Agent struct {
+	config Config
+
+	mu    sync.Mutex
+	index []Snapshot
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Start creates the snapshot directory and starts capturing snapshots in the background.
+//
+// Parameters:
+// - config: What to capture and how much of it to keep. Zero values are replaced by the defaults.
+//
+// Returns:
+// - *Agent: The running agent. Call Stop to end capturing.
+// - error: If the directory cannot be created or its existing index cannot be read, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - The first round is captured immediately. Snapshots listed in an existing index are kept, and count towards
+//     the retention limit, so restarting the agent continues the same history.
+//   - Only one CPU profile can be captured at a time. A round that overlaps another CPU profile, such as the
+//     per-function profiles of common.Wrap, skips its CPU snapshot and reports the error.
+func Start(config Config) (*Agent, error) {
+	a, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.done = make(chan struct{})
+	go a.run(ctx)
+	return a, nil
+}
+
+// New creates the snapshot directory and loads its index, without starting to capture. Use Capture to take
+// snapshots on demand.
+func New(config Config) (*Agent, error) {
+	config = config.withDefaults()
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	index, err := LoadIndex(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Agent{config: config, index: index}, nil
+}
+
+// Stop ends capturing, interrupting a CPU snapshot in progress, and waits for the current round to be written.
+func (a *Agent) Stop() {
+	if a.cancel == nil {
+		return
+	}
+	a.cancel()
+	<-a.done
+}
+
+// Index returns the snapshots currently kept, oldest first.
+func (a *Agent) Index() []Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Snapshot(nil), a.index...)
+}
+
+// run captures a round of snapshots every interval until the context is cancelled.
+func (a *Agent) run(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Capture(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "could not capture profile snapshots: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Capture takes one round of snapshots, deletes those beyond the retention limit and rewrites the index.
+//
+// Parameters:
+// - ctx: Cancelling it ends the CPU snapshot early. The snapshot is still kept.
+//
+// Returns:
+// - error: The errors of any profiles that could not be captured. The remaining profiles are still written.
+func (a *Agent) Capture(ctx context.Context) error {
+	var errs []error
+	for _, name := range a.config.Profiles {
+		snapshot, err := a.capture(ctx, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		a.mu.Lock()
+		a.index = append(a.index, snapshot)
+		a.mu.Unlock()
+	}
+
+	if err := a.prune(); err != nil {
+		errs = append(errs, err)
+	}
+	return joinErrors(errs)
+}
+
+// capture writes a single profile to a timestamped file in the snapshot directory.
+func (a *Agent) capture(ctx context.Context, name string) (Snapshot, error) {
+	started := time.Now()
+	snapshot := Snapshot{
+		Profile: name,
+		Path:    filepath.Join(a.config.Dir, name+"-"+started.Format(timeFormat)+".pprof"),
+		Started: started,
+	}
+
+	var lookup *pprof.Profile
+	if name != "cpu" {
+		if lookup = pprof.Lookup(name); lookup == nil {
+			return snapshot, errors.New("unknown profile")
+		}
+	}
+
+	f, err := os.Create(snapshot.Path)
+	if err != nil {
+		return snapshot, err
+	}
+	defer f.Close()
+
+	if name == "cpu" {
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			os.Remove(snapshot.Path)
+			return snapshot, err
+		}
+		timer := time.NewTimer(a.config.CPUDuration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		pprof.StopCPUProfile()
+		snapshot.Duration = time.Since(started)
+	} else {
+		if name == "heap" {
+			runtime.GC()
+		}
+		if err := lookup.WriteTo(f, 0); err != nil {
+			return snapshot, err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Size = info.Size()
+	return snapshot, nil
+}
+
+// prune deletes the oldest snapshots of each profile beyond the retention limit and rewrites the index.
+func (a *Agent) prune() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	sort.SliceStable(a.index, func(i, j int) bool { return a.index[i].Started.Before(a.index[j].Started) })
+	counts := map[string]int{}
+	for _, s := range a.index {
+		counts[s.Profile]++
+	}
+	var kept []Snapshot
+	var errs []error
+	for _, s := range a.index {
+		if counts[s.Profile] > a.config.Retention {
+			counts[s.Profile]--
+			if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+	a.index = kept
+
+	if err := writeIndex(a.config.Dir, a.index); err != nil {
+		errs = append(errs, err)
+	}
+	return joinErrors(errs)
+}
+
+// LoadIndex reads the index of a snapshot directory.
+//
+// Parameters:
+// - dir: The snapshot directory.
+//
+// Returns:
+// - []Snapshot: The snapshots listed in the index, oldest first. A directory without an index has none.
+// - error: If the index cannot be read or parsed, it returns the error. Otherwise, it returns nil.
+func LoadIndex(dir string) ([]Snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index []Snapshot
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("%s: %w", IndexFile, err)
+	}
+	return index, nil
+}
+
+// At returns the latest snapshot of a profile started at or before the given time, to look up what the process was
+// doing then.
+//
+// Parameters:
+// - index: The snapshots, as returned by LoadIndex.
+// - profile: The profile, such as "cpu" or "heap".
+// - t: The time of interest.
+//
+// Returns:
+// - Snapshot: The snapshot.
+// - bool: False if there is no snapshot of the profile at or before t.
+func At(index []Snapshot, profile string, t time.Time) (Snapshot, bool) {
+	var found Snapshot
+	ok := false
+	for _, s := range index {
+		if s.Profile == profile && !s.Started.After(t) && (!ok || s.Started.After(found.Started)) {
+			found, ok = s, true
+		}
+	}
+	return found, ok
+}
+
+// writeIndex writes the index to a temporary file and renames it into place, so a reader never sees a partial index.
+func writeIndex(dir string, index []Snapshot) error {
+	if index == nil {
+		index = []Snapshot{}
+	}
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, IndexFile+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, IndexFile))
+}
+
+// joinErrors combines errors into a single error, or returns nil if there are none.
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mwiater/golangpprof/profile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapture(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(Config{Dir: dir, CPUDuration: 50 * time.Millisecond, Profiles: []string{"cpu", "heap", "goroutine"}, Retention: 2})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, a.Capture(context.Background()))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	index := a.Index()
+	assert.Len(t, index, 6) // Two of each profile
+	for _, s := range index {
+		assert.FileExists(t, s.Path)
+		assert.True(t, s.Size > 0)
+		_, err := profile.ParseFile(s.Path)
+		assert.NoError(t, err, s.Path)
+	}
+	cpu, ok := At(index, "cpu", time.Now())
+	assert.True(t, ok)
+	assert.True(t, cpu.Duration >= 50*time.Millisecond)
+
+	// Pruned snapshots are deleted, leaving the kept ones and the index
+	files, err := filepath.Glob(filepath.Join(dir, "*.pprof"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 6)
+
+	loaded, err := LoadIndex(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, len(index), len(loaded))
+	assert.Equal(t, index[0].Path, loaded[0].Path)
+
+	// A new agent continues the same history
+	b, err := New(Config{Dir: dir})
+	assert.NoError(t, err)
+	assert.Len(t, b.Index(), 6)
+}
+
+func TestCaptureErrors(t *testing.T) {
+	a, err := New(Config{Dir: t.TempDir(), Profiles: []string{"nope", "heap"}})
+	assert.NoError(t, err)
+
+	err = a.Capture(context.Background())
+	assert.ErrorContains(t, err, "nope")
+	assert.Len(t, a.Index(), 1) // The heap profile is still written
+}
+
+func TestStartStop(t *testing.T) {
+	dir := t.TempDir()
+	a, err := Start(Config{Dir: dir, Interval: time.Hour})
+	assert.NoError(t, err)
+
+	// Stopping interrupts the first CPU snapshot rather than waiting out its duration
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	a.Stop()
+	assert.True(t, time.Since(start) < DefaultCPUDuration)
+	assert.Len(t, a.Index(), 2)
+
+	_, err = os.Stat(filepath.Join(dir, IndexFile))
+	assert.NoError(t, err)
+}
+
+func TestAt(t *testing.T) {
+	base := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	index := []Snapshot{
+		{Profile: "cpu", Path: "a", Started: base},
+		{Profile: "heap", Path: "b", Started: base.Add(time.Minute)},
+		{Profile: "cpu", Path: "c", Started: base.Add(2 * time.Minute)},
+	}
+
+	s, ok := At(index, "cpu", base.Add(90*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, "a", s.Path)
+	s, _ = At(index, "cpu", base.Add(time.Hour))
+	assert.Equal(t, "c", s.Path)
+	_, ok = At(index, "cpu", base.Add(-time.Second))
+	assert.False(t, ok)
+}
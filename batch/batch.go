@@ -0,0 +1,344 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/cache"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/live"
+	"github.com/mwiater/golangpprof/metrics"
+)
+
+// DefaultInclude matches the JPEG images the operations can decode.
+var DefaultInclude = []string{"*.jpg", "*.jpeg", "*.JPG", "*.JPEG"}
+
+// Config describes a batch: which images to process, the pipeline to run them through and how to split the work.
+type Config struct {
+	InputDir  string
+	OutputDir string
+
+	// Include and Exclude are glob patterns selecting the images in InputDir. See Find.
+	Include []string
+	Exclude []string
+
+	// Operations is the pipeline every image is run through, in order.
+	Operations []imageprocessing.Operation
+
+	// Concurrency is the number of images processed at the same time. It defaults to runtime.NumCPU().
+	Concurrency int
+
+	// Workers is the number of goroutines each image is split between by the optimized operations
+	// (imageprocessing.NumRoutines). 0 keeps the current value.
+	Workers int
+
+	// Manifest, if set, records the outcome of every image, and images it records as done with the same input
+	// checksum are skipped.
+	Manifest *Manifest
+
+	// Retries is the number of times a failed image is retried, waiting Backoff before the first retry and twice
+	// as long before each one after that.
+	Retries int
+	Backoff time.Duration
+
+	// Metrics is the registry every image that is not skipped is recorded in, under the pipeline's name. It
+	// defaults to metrics.Default.
+	Metrics *metrics.Registry
+
+	// Cache, if set, holds the results of previous images: an image whose content was already processed through the
+	// same pipeline has its result copied from the cache rather than processed again.
+	Cache *cache.Cache
+
+	// OnItem, if set, is called with each image's outcome as soon as it completes, from the goroutine that
+	// processed it.
+	OnItem func(Item)
+}
+
+// Item is the outcome of processing one image.
+type Item struct {
+	// Path is the image's path relative to the input directory, which is mirrored in the output directory.
+	Path   string
+	Output string
+
+	// Bytes is the size of the input file, and Pixels the number of pixels in the image.
+	Bytes  int64
+	Pixels int64
+
+	// Checksum is the hex encoded SHA-256 of the input file.
+	Checksum string
+
+	// Skipped is set for images the manifest records as already done, whose other fields are read from it.
+	Skipped bool
+
+	// Attempts is the number of times the image was processed, including retries.
+	Attempts int
+
+	// Cached is set for images whose result was copied from the cache.
+	Cached bool
+
+	Duration time.Duration
+	Err      error
+}
+
+// Summary is the outcome of a batch.
+type Summary struct {
+	Items       []Item
+	Processed   int
+	Skipped     int
+	Failed      int
+	Retries     int
+	Bytes       int64
+	Pixels      int64
+	Elapsed     time.Duration
+	Concurrency int
+	Workers     int
+}
+
+// Run processes every image in the input directory matching the configured patterns through the pipeline, writing
+// each result to the same relative path in the output directory.
+//
+// Parameters:
+// - ctx: Cancels the batch. Images that have not been started when it is cancelled fail with the context's error.
+// - cfg: The batch to run.
+//
+// Returns:
+// - Summary: One item per matched image, in the order of Find, and the totals of the batch.
+// - error: If the configuration is invalid or the input directory cannot be walked, it returns the error. Errors processing an image are recorded in its Item instead.
+//
+// Notes:
+//   - The images are processed by a pool of Concurrency goroutines, each of which splits its image between Workers
+//     goroutines in the optimized operations, so Concurrency x Workers goroutines are processing pixels at most.
+//   - imageprocessing.NumRoutines is global, so it is set for the whole batch and restored once it completes.
+//   - Skipped images count towards Skipped, but not Processed, Bytes or Pixels, so the throughput of a resumed batch
+//     only reflects the work it did.
+func Run(ctx context.Context, cfg Config) (Summary, error) {
+	if len(cfg.Operations) == 0 {
+		return Summary{}, errors.New("no operations to run")
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = runtime.NumCPU()
+	}
+	if cfg.Workers > 0 {
+		defer func(routines int) { imageprocessing.NumRoutines = routines }(imageprocessing.NumRoutines)
+		imageprocessing.NumRoutines = cfg.Workers
+	}
+
+	paths, err := Find(cfg.InputDir, cfg.OutputDir, cfg.Include, cfg.Exclude)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	summary := Summary{Items: make([]Item, len(paths)), Concurrency: cfg.Concurrency, Workers: imageprocessing.NumRoutines}
+	start := time.Now()
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				summary.Items[index] = Process(ctx, cfg, paths[index])
+			}
+		}()
+	}
+	for index, path := range paths {
+		if ctx.Err() != nil {
+			summary.Items[index] = Item{Path: path, Err: ctx.Err()}
+			continue
+		}
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+
+	summary.Elapsed = time.Since(start)
+	for _, item := range summary.Items {
+		summary.Add(item)
+	}
+	return summary, nil
+}
+
+// Add counts an item towards the totals of the summary. It does not append the item to Items.
+func (s *Summary) Add(item Item) {
+	if item.Attempts > 1 {
+		s.Retries += item.Attempts - 1
+	}
+	if item.Err != nil {
+		s.Failed++
+		return
+	}
+	if item.Skipped {
+		s.Skipped++
+		return
+	}
+	s.Processed++
+	s.Bytes += item.Bytes
+	s.Pixels += item.Pixels
+}
+
+// Process processes one image of a batch, as Run does for each image it finds, records it in the metrics and calls
+// OnItem with its outcome.
+//
+// Parameters:
+// - ctx: Cancels the processing of the image.
+// - cfg: The batch the image belongs to. Include, Exclude, Concurrency and Workers are ignored.
+// - path: The image's slash separated path relative to the input directory.
+//
+// Returns:
+// - Item: The outcome of the image.
+func Process(ctx context.Context, cfg Config, path string) Item {
+	item := processItem(ctx, cfg, path)
+	if !item.Skipped {
+		observe(cfg, item)
+	}
+	if cfg.OnItem != nil {
+		cfg.OnItem(item)
+	}
+	return item
+}
+
+// observe records an image in the metrics registry of the batch, with the size of its output if it succeeded.
+func observe(cfg Config, item Item) {
+	registry := cfg.Metrics
+	if registry == nil {
+		registry = metrics.Default
+	}
+	o := metrics.Observation{
+		Operation: imageprocessing.PipelineName(cfg.Operations),
+		BytesIn:   item.Bytes,
+		Duration:  item.Duration,
+		Err:       item.Err,
+		ErrorType: ErrorType(item.Err),
+	}
+	if item.Err == nil {
+		if info, err := os.Stat(item.Output); err == nil {
+			o.BytesOut = info.Size()
+		}
+	}
+	registry.Observe(o)
+}
+
+// processItem reads one image and, unless the manifest records it as done, processes it with retries and records
+// the outcome in the manifest. While it is processed, the image is listed as in flight on the live server.
+func processItem(ctx context.Context, cfg Config, path string) (item Item) {
+	item = Item{Path: path, Output: filepath.Join(cfg.OutputDir, filepath.FromSlash(path))}
+	start := time.Now()
+	defer func() { item.Duration = time.Since(start) }()
+
+	data, err := os.ReadFile(filepath.Join(cfg.InputDir, filepath.FromSlash(path)))
+	if err != nil {
+		item.Err = &StageError{Stage: imageprocessing.StageStat, Err: err}
+		return item
+	}
+	sum := sha256.Sum256(data)
+	item.Bytes = int64(len(data))
+	item.Checksum = hex.EncodeToString(sum[:])
+
+	if cfg.Manifest != nil {
+		if entry, ok := cfg.Manifest.Completed(path, item.Checksum, imageprocessing.PipelineName(cfg.Operations), cfg.OutputDir); ok {
+			item.Skipped = true
+			item.Output = entry.Output
+			item.Pixels = entry.Pixels
+			return item
+		}
+	}
+
+	end := live.Begin(path + " ops=" + imageprocessing.PipelineName(cfg.Operations))
+	defer func() { end(item.Bytes, item.Err) }()
+
+	backoff := cfg.Backoff
+	for {
+		item.Attempts++
+		item.Pixels, item.Cached, item.Err = processData(ctx, cfg, data, item.Checksum, item.Output)
+		if item.Err == nil || item.Attempts > cfg.Retries || !retryable(item.Err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	if cfg.Manifest != nil && !errors.Is(item.Err, context.Canceled) {
+		entry := Entry{
+			Path:       item.Path,
+			Status:     StatusDone,
+			Checksum:   item.Checksum,
+			Pipeline:   imageprocessing.PipelineName(cfg.Operations),
+			OutputDir:  cfg.OutputDir,
+			Output:     item.Output,
+			Bytes:      item.Bytes,
+			Pixels:     item.Pixels,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Attempts:   item.Attempts,
+			Finished:   time.Now(),
+		}
+		if item.Err != nil {
+			entry.Status, entry.Error, entry.ErrorType = StatusFailed, item.Err.Error(), ErrorType(item.Err)
+		}
+		if err := cfg.Manifest.Record(entry); err != nil && item.Err == nil {
+			item.Err = fmt.Errorf("manifest: %w", err)
+		}
+	}
+	return item
+}
+
+// processData decodes an image, runs it through the pipeline and encodes the result to the output path, or copies
+// the result from the cache if it holds one for the image's checksum and the pipeline.
+//
+// Returns:
+// - int64: The number of pixels in the image.
+// - bool: Whether the result was copied from the cache.
+// - error: A *StageError with the stage that failed. Otherwise, it returns nil.
+func processData(ctx context.Context, cfg Config, data []byte, checksum, outputPath string) (int64, bool, error) {
+	var key string
+	if cfg.Cache != nil {
+		key = cache.Key(checksum, cache.Spec(map[string]string{"ops": imageprocessing.PipelineName(cfg.Operations), "format": "jpeg"}))
+		if result, _, ok := cfg.Cache.Get(key); ok {
+			config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				return 0, true, &StageError{Stage: imageprocessing.StageDecode, Err: err}
+			}
+			if err := writeFile(outputPath, result); err != nil {
+				return 0, true, &StageError{Stage: imageprocessing.StageEncode, Err: err}
+			}
+			return int64(config.Width) * int64(config.Height), true, nil
+		}
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, false, &StageError{Stage: imageprocessing.StageDecode, Err: err}
+	}
+	bounds := img.Bounds()
+	pixels := int64(bounds.Dx()) * int64(bounds.Dy())
+
+	processed, err := imageprocessing.Pipeline(ctx, cfg.Operations, img)
+	if err != nil {
+		return pixels, false, &StageError{Stage: imageprocessing.StageProcess, Err: err}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, processed, nil); err != nil {
+		return pixels, false, &StageError{Stage: imageprocessing.StageEncode, Err: err}
+	}
+	if err := writeFile(outputPath, buf.Bytes()); err != nil {
+		return pixels, false, &StageError{Stage: imageprocessing.StageEncode, Err: err}
+	}
+	if cfg.Cache != nil {
+		cfg.Cache.Put(key, buf.Bytes())
+	}
+	return pixels, false, nil
+}
@@ -0,0 +1,350 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mwiater/golangpprof/cache"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/internal/testimage"
+	"github.com/mwiater/golangpprof/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTree creates an input tree with images at several depths, an excluded directory, a file that is not an
+// image and an image that cannot be decoded.
+func testTree(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "in")
+	for _, path := range []string{"one.jpg", "a/two.JPG", "a/b/three.jpeg", "thumbnails/four.jpg", "a/thumbnails/five.jpg"} {
+		testimage.WriteJPEG(t, filepath.Join(dir, filepath.FromSlash(path)))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "bad.jpg"), []byte("not a jpeg"), 0o644))
+	return dir
+}
+
+// expvarInt returns the value of a counter published by the live server.
+func expvarInt(name string) int64 {
+	return expvar.Get(name).(*expvar.Int).Value()
+}
+
+// TestFind ensures that images are selected by name or relative path, that excluded directories and the output
+// directory are skipped, and that Match agrees.
+func TestFind(t *testing.T) {
+	dir := testTree(t)
+
+	paths, err := Find(dir, "", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/three.jpeg", "a/bad.jpg", "a/thumbnails/five.jpg", "a/two.JPG", "one.jpg", "thumbnails/four.jpg"}, paths)
+
+	paths, err = Find(dir, "", []string{"*.jpg"}, []string{"thumbnails", "bad.*"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one.jpg"}, paths)
+
+	paths, err = Find(dir, "", []string{"a/*/*"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/three.jpeg", "a/thumbnails/five.jpg"}, paths)
+
+	paths, err = Find(dir, filepath.Join(dir, "a"), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one.jpg", "thumbnails/four.jpg"}, paths)
+
+	assert.True(t, Match("a/two.JPG", nil, []string{"bad.*"}))
+	assert.False(t, Match("a/thumbnails/five.jpg", nil, []string{"thumbnails"}))
+	assert.False(t, Match("notes.txt", nil, nil))
+
+	_, err = Find(dir, "", []string{"["}, nil)
+	assert.Error(t, err)
+	_, err = Find(filepath.Join(dir, "missing"), "", nil, nil)
+	assert.Error(t, err)
+}
+
+// TestRun ensures that every image is run through the pipeline into the mirrored output tree, that failures are
+// recorded per image and counted by the live server, and that NumRoutines is restored.
+func TestRun(t *testing.T) {
+	dir := testTree(t)
+	out := filepath.Join(filepath.Dir(dir), "out")
+	ops, err := imageprocessing.ParseOperations("grayscale,sharpen-optimized")
+	assert.NoError(t, err)
+
+	routines := imageprocessing.NumRoutines
+	images, bytesIn, failed := expvarInt("imagesProcessed"), expvarInt("bytesProcessed"), expvarInt("operationsFailed")
+	var mu sync.Mutex
+	var completed []string
+	registry := metrics.NewRegistry(metrics.DefaultBuckets)
+	summary, err := Run(context.Background(), Config{
+		InputDir:    dir,
+		OutputDir:   out,
+		Exclude:     []string{"thumbnails"},
+		Operations:  ops,
+		Concurrency: 2,
+		Workers:     3,
+		Metrics:     registry,
+		OnItem: func(item Item) {
+			mu.Lock()
+			completed = append(completed, item.Path)
+			mu.Unlock()
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, routines, imageprocessing.NumRoutines)
+
+	assert.Len(t, summary.Items, 4)
+	assert.ElementsMatch(t, []string{"a/b/three.jpeg", "a/bad.jpg", "a/two.JPG", "one.jpg"}, completed)
+	assert.Equal(t, 3, summary.Processed)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, int64(3*40*30), summary.Pixels)
+	assert.Equal(t, 2, summary.Concurrency)
+	assert.Equal(t, 3, summary.Workers)
+	assert.True(t, summary.Bytes > 0)
+	assert.True(t, summary.ThroughputPerDay() > 0)
+	assert.Equal(t, images+3, expvarInt("imagesProcessed"))
+	assert.Equal(t, bytesIn+summary.Bytes, expvarInt("bytesProcessed"))
+	assert.Equal(t, failed+1, expvarInt("operationsFailed"))
+
+	assert.Equal(t, "a/bad.jpg", summary.Items[1].Path)
+	assert.ErrorContains(t, summary.Items[1].Err, "decode: ")
+	assert.NoFileExists(t, filepath.Join(out, "a", "bad.jpg"))
+
+	f, err := os.Open(filepath.Join(out, "a", "b", "three.jpeg"))
+	assert.NoError(t, err)
+	defer f.Close()
+	config, err := jpeg.DecodeConfig(f)
+	assert.NoError(t, err)
+	assert.Equal(t, 40, config.Width)
+
+	entries, err := os.ReadDir(filepath.Join(out, "a"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2) // b/ and two.JPG, without leftover temporary files
+
+	var text bytes.Buffer
+	assert.NoError(t, registry.WriteText(&text))
+	assert.Contains(t, text.String(), `golangpprof_images_processed_total{operation="grayscale,sharpen-optimized",variant="default"} 3`)
+	assert.Contains(t, text.String(), `golangpprof_errors_total{operation="grayscale,sharpen-optimized",variant="default",type="decode: `)
+	assert.NotContains(t, text.String(), `golangpprof_bytes_out_total{operation="grayscale,sharpen-optimized",variant="default"} 0`)
+}
+
+// TestRunCancelled ensures that a cancelled batch reports every image as failed with the context's error.
+func TestRunCancelled(t *testing.T) {
+	dir := testTree(t)
+	ops, _ := imageprocessing.ParseOperations("grayscale")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	summary, err := Run(ctx, Config{InputDir: dir, OutputDir: filepath.Join(dir, "out"), Operations: ops, Concurrency: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, summary.Processed)
+	assert.Equal(t, 6, summary.Failed)
+	for _, item := range summary.Items {
+		assert.ErrorIs(t, item.Err, context.Canceled)
+	}
+
+	_, err = Run(context.Background(), Config{InputDir: dir})
+	assert.Error(t, err)
+}
+
+// TestManifest ensures that entries survive reopening the manifest, that the last entry of an image wins, and that a
+// partial last line is truncated.
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.jsonl")
+	output := filepath.Join(dir, "one.jpg")
+	assert.NoError(t, os.WriteFile(output, []byte("out"), 0o644))
+
+	m, err := OpenManifest(path)
+	assert.NoError(t, err)
+	assert.NoError(t, m.Record(Entry{Path: "one.jpg", Status: StatusFailed, Checksum: "abc", Pipeline: "grayscale", OutputDir: dir, Output: output, Attempts: 3, ErrorType: "encode: no space left on device"}))
+	assert.NoError(t, m.Record(Entry{Path: "one.jpg", Status: StatusDone, Checksum: "abc", Pipeline: "grayscale", OutputDir: dir, Output: output, Attempts: 1}))
+	assert.NoError(t, m.Record(Entry{Path: "two.jpg", Status: StatusDone, Checksum: "def", Pipeline: "grayscale", OutputDir: dir, Output: filepath.Join(dir, "two.jpg")}))
+	assert.NoError(t, m.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"path":"three.jpg","sta`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	m, err = OpenManifest(path)
+	assert.NoError(t, err)
+	defer m.Close()
+	entries := m.Entries()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "one.jpg", entries[0].Path)
+	assert.Equal(t, StatusDone, entries[0].Status)
+
+	_, ok := m.Completed("one.jpg", "abc", "grayscale", dir)
+	assert.True(t, ok)
+	_, ok = m.Completed("one.jpg", "changed", "grayscale", dir)
+	assert.False(t, ok)
+	_, ok = m.Completed("one.jpg", "abc", "sharpen", dir)
+	assert.False(t, ok)
+	_, ok = m.Completed("one.jpg", "abc", "grayscale", filepath.Join(dir, "other"))
+	assert.False(t, ok)
+	_, ok = m.Completed("two.jpg", "def", "grayscale", dir) // the output does not exist
+	assert.False(t, ok)
+	_, ok = m.Completed("three.jpg", "", "grayscale", dir)
+	assert.False(t, ok)
+
+	assert.NoError(t, m.Record(Entry{Path: "three.jpg", Status: StatusDone}))
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, bytes.Count(data, []byte("\n")))
+	assert.NotContains(t, string(data), `"sta{"path"`)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json\n"), 0o644))
+	_, err = OpenManifest(path)
+	assert.ErrorContains(t, err, "manifest.jsonl:1")
+}
+
+// TestRunResume ensures that a batch run again with the same manifest skips the images that are done, and
+// reprocesses those whose input changed or whose output was deleted, and every image once the pipeline changes.
+func TestRunResume(t *testing.T) {
+	dir := testTree(t)
+	out := filepath.Join(filepath.Dir(dir), "out")
+	ops, _ := imageprocessing.ParseOperations("grayscale")
+	assert.NoError(t, os.MkdirAll(out, 0o755))
+	manifest, err := OpenManifest(filepath.Join(out, ".batch-manifest.jsonl"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer manifest.Close()
+	cfg := Config{InputDir: dir, OutputDir: out, Exclude: []string{"thumbnails", "bad.jpg"}, Operations: ops, Manifest: manifest}
+
+	summary, err := Run(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, summary.Processed)
+	assert.Equal(t, 0, summary.Skipped)
+	assert.Len(t, manifest.Entries(), 3)
+	for _, entry := range manifest.Entries() {
+		assert.Equal(t, StatusDone, entry.Status)
+		assert.Len(t, entry.Checksum, 64)
+		assert.Equal(t, int64(40*30), entry.Pixels)
+	}
+
+	summary, err = Run(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, summary.Processed)
+	assert.Equal(t, 3, summary.Skipped)
+	assert.Equal(t, int64(0), summary.Bytes)
+	assert.True(t, summary.Items[0].Skipped)
+	assert.Equal(t, int64(40*30), summary.Items[0].Pixels)
+
+	assert.NoError(t, os.Remove(filepath.Join(out, "one.jpg")))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "two.JPG"), []byte("truncated"), 0o644))
+	summary, err = Run(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, summary.Processed)
+	assert.Equal(t, 1, summary.Skipped)
+	assert.Equal(t, 1, summary.Failed)
+	entry, _ := manifest.Lookup("a/two.JPG")
+	assert.Equal(t, StatusFailed, entry.Status)
+	assert.Equal(t, "decode: jpeg.FormatError", entry.ErrorType)
+	assert.Equal(t, 1, entry.Attempts)
+
+	cfg.Operations, _ = imageprocessing.ParseOperations("sharpen")
+	summary, err = Run(context.Background(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Processed)
+	assert.Equal(t, 0, summary.Skipped)
+	entry, _ = manifest.Lookup("one.jpg")
+	assert.Equal(t, "sharpen", entry.Pipeline)
+	assert.Equal(t, out, entry.OutputDir)
+}
+
+// TestRunRetries ensures that failures that may be transient are retried with backoff, and invalid images are not.
+func TestRunRetries(t *testing.T) {
+	dir := testTree(t)
+	out := filepath.Join(filepath.Dir(dir), "out")
+	ops, _ := imageprocessing.ParseOperations("grayscale")
+
+	// A non-empty directory in place of the output cannot be replaced, so encoding fails on every attempt
+	assert.NoError(t, os.MkdirAll(filepath.Join(out, "one.jpg", "keep"), 0o755))
+
+	start := time.Now()
+	summary, err := Run(context.Background(), Config{
+		InputDir:    dir,
+		OutputDir:   out,
+		Include:     []string{"one.jpg", "bad.jpg"},
+		Operations:  ops,
+		Concurrency: 2,
+		Retries:     2,
+		Backoff:     10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Equal(t, 2, summary.Retries)
+
+	assert.Equal(t, "a/bad.jpg", summary.Items[0].Path)
+	assert.Equal(t, 1, summary.Items[0].Attempts)
+	assert.Equal(t, "decode: jpeg.FormatError", ErrorType(summary.Items[0].Err))
+	assert.Equal(t, 3, summary.Items[1].Attempts)
+	assert.Equal(t, "encode: file exists", ErrorType(summary.Items[1].Err))
+}
+
+// TestRunCache ensures that images whose content was already processed through the same pipeline are copied from
+// the cache. The test tree's images are identical, so only the first one is processed.
+func TestRunCache(t *testing.T) {
+	dir := testTree(t)
+	out := filepath.Join(filepath.Dir(dir), "out")
+	ops, err := imageprocessing.ParseOperations("grayscale")
+	assert.NoError(t, err)
+	c, err := cache.New(cache.Config{})
+	assert.NoError(t, err)
+
+	summary, err := Run(context.Background(), Config{InputDir: dir, OutputDir: out, Exclude: []string{"thumbnails"}, Operations: ops, Concurrency: 1, Cache: c})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, summary.Processed)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, int64(3*40*30), summary.Pixels)
+
+	var cached []string
+	for _, item := range summary.Items {
+		if item.Cached {
+			cached = append(cached, item.Path)
+		}
+	}
+	assert.Equal(t, []string{"a/two.JPG", "one.jpg"}, cached)
+	first, err := os.ReadFile(filepath.Join(out, "a", "b", "three.jpeg"))
+	assert.NoError(t, err)
+	copied, err := os.ReadFile(filepath.Join(out, "one.jpg"))
+	assert.NoError(t, err)
+	assert.Equal(t, first, copied)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(2), stats.MemoryHits)
+	assert.Equal(t, int64(2), stats.Misses) // three.jpeg and bad.jpg
+	assert.Equal(t, 1, stats.MemoryEntries)
+
+	// A different pipeline is a different result
+	ops, _ = imageprocessing.ParseOperations("grayscale,sharpen")
+	_, err = Run(context.Background(), Config{InputDir: dir, OutputDir: out, Include: []string{"one.jpg"}, Operations: ops, Cache: c})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), c.Stats().Misses)
+}
+
+// TestErrorType ensures that errors are classified by stage and root cause, and that only transient ones are retried.
+func TestErrorType(t *testing.T) {
+	_, statErr := os.Stat(filepath.Join(t.TempDir(), "missing"))
+	err := &StageError{Stage: imageprocessing.StageStat, Err: statErr}
+	assert.Equal(t, "stat: no such file or directory", ErrorType(err))
+	assert.True(t, retryable(err))
+
+	err = &StageError{Stage: imageprocessing.StageProcess, Err: fmt.Errorf("grayscale: %w", context.Canceled)}
+	assert.Equal(t, "cancelled", ErrorType(err))
+	assert.False(t, retryable(err))
+	assert.Equal(t, "deadline exceeded", ErrorType(context.DeadlineExceeded))
+	assert.Equal(t, "", ErrorType(nil))
+
+	err = &StageError{Stage: imageprocessing.StageDecode, Err: jpeg.UnsupportedError("progressive")}
+	assert.Equal(t, "decode: unsupported JPEG feature: progressive", err.Error())
+	assert.False(t, retryable(err))
+}
@@ -0,0 +1,57 @@
+package batch
+
+import (
+	"context"
+	"errors"
+	"image/jpeg"
+
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/metrics"
+)
+
+// StageError is an error processing an image, with the stage it failed in.
+type StageError struct {
+	Stage imageprocessing.Stage
+	Err   error
+}
+
+// Error returns the stage followed by the underlying error, e.g. "decode: invalid JPEG format: missing SOI marker".
+func (e *StageError) Error() string {
+	return e.Stage.String() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorType classifies an error for the failure summary, by the stage it happened in and the type of its root
+// cause as classified by metrics.ErrorType, e.g. "decode: jpeg.FormatError" or "stat: no such file or directory".
+//
+// Notes:
+//   - Cancellations and deadlines are classified as "cancelled" and "deadline exceeded", whatever the stage.
+func ErrorType(err error) string {
+	kind := metrics.ErrorType(err)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return kind
+	}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage.String() + ": " + kind
+	}
+	return kind
+}
+
+// retryable reports whether an attempt that failed with err may succeed if it is retried.
+//
+// Notes:
+//   - Invalid and unsupported JPEGs fail the same way every time, and cancellations are deliberate, so neither is
+//     retried. Everything else, e.g. a file that is still being written or a full disk, is.
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var formatErr jpeg.FormatError
+	var unsupportedErr jpeg.UnsupportedError
+	return !errors.As(err, &formatErr) && !errors.As(err, &unsupportedErr)
+}
@@ -0,0 +1,130 @@
+package batch
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Find lists the images in a directory tree that match the include patterns and none of the exclude patterns.
+//
+// Parameters:
+// - inputDir: The directory to walk.
+// - outputDir: The output directory, which is skipped if it is inside inputDir so that results are not reprocessed.
+// - include: Glob patterns an image must match. If empty, DefaultInclude is used.
+// - exclude: Glob patterns an image must not match. A directory matching one is skipped entirely.
+//
+// Returns:
+// - []string: The matching images, as slash separated paths relative to inputDir, in lexical order.
+// - error: If the directory cannot be walked or a pattern is malformed, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - A pattern containing a slash is matched against the whole relative path, e.g. "2023/*/*.jpg", and any other
+//     pattern against the file or directory name alone, e.g. "*.jpg" or "thumbnails".
+func Find(inputDir, outputDir string, include, exclude []string) ([]string, error) {
+	if len(include) == 0 {
+		include = DefaultInclude
+	}
+	for _, pattern := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	skip := ""
+	if outputDir != "" {
+		if abs, err := filepath.Abs(outputDir); err == nil {
+			skip = abs
+		}
+	}
+
+	var paths []string
+	err := filepath.WalkDir(inputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(inputDir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if abs, err := filepath.Abs(p); err == nil && abs == skip {
+				return filepath.SkipDir
+			}
+			if matchAny(exclude, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && matchAny(include, rel) && !matchAny(exclude, rel) {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// Match reports whether Find would list a file, by its slash separated path relative to the input directory: it
+// matches an include pattern, and neither it nor any of its parent directories matches an exclude pattern.
+//
+// Notes:
+// - Unlike Find, Match does not check that the file exists or lies outside the output directory.
+func Match(rel string, include, exclude []string) bool {
+	if len(include) == 0 {
+		include = DefaultInclude
+	}
+	if !matchAny(include, rel) {
+		return false
+	}
+	for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+		if matchAny(exclude, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny reports whether the slash separated relative path matches any of the patterns.
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			name = rel
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes an encoded image to the given path, creating its directory first.
+//
+// Notes:
+//   - The image is written to a temporary file that is renamed into place, so a failed or interrupted batch never
+//     leaves a truncated image at the output path.
+func writeFile(outputPath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), outputPath)
+}
@@ -0,0 +1,176 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the outcome of an image recorded in a manifest.
+type Status string
+
+const (
+	StatusDone   Status = "done"
+	StatusFailed Status = "failed"
+)
+
+// Entry is the manifest record of one image's last attempt.
+type Entry struct {
+	Path       string    `json:"path"`
+	Status     Status    `json:"status"`
+	Checksum   string    `json:"checksum"`
+	Pipeline   string    `json:"pipeline"`
+	OutputDir  string    `json:"outputDir"`
+	Output     string    `json:"output"`
+	Bytes      int64     `json:"bytes"`
+	Pixels     int64     `json:"pixels"`
+	DurationMs float64   `json:"durationMs"`
+	Attempts   int       `json:"attempts"`
+	Error      string    `json:"error,omitempty"`
+	ErrorType  string    `json:"errorType,omitempty"`
+	Finished   time.Time `json:"finished"`
+}
+
+// Manifest is an append-only JSONL log of the outcome of every image of a batch, which lets an interrupted batch
+// resume where it stopped.
+//
+// Notes:
+//   - Each record is written and synced before the next image is reported, so a crash loses at most the images
+//     that were in flight.
+//   - A Manifest is safe for concurrent use.
+type Manifest struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]Entry
+}
+
+// OpenManifest loads the manifest at the given path, creating it if it does not exist, and opens it for appending.
+//
+// Parameters:
+// - path: Path to the JSONL manifest.
+//
+// Returns:
+// - *Manifest: The manifest, holding the last entry of every image recorded in it.
+// - error: If the file cannot be read, written or parsed, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - A partial last line, left by a crash in the middle of a write, is truncated rather than treated as an error.
+func OpenManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	complete := data[:bytes.LastIndexByte(data, '\n')+1]
+	entries := map[string]Entry{}
+	for i, line := range bytes.Split(complete, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		entries[entry.Path] = entry
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(int64(len(complete))); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Manifest{path: path, file: file, entries: entries}, nil
+}
+
+// Path returns the path of the manifest file.
+func (m *Manifest) Path() string {
+	return m.path
+}
+
+// Record appends an entry to the manifest and syncs it to disk.
+//
+// Parameters:
+// - entry: The outcome of an image's last attempt. It replaces any earlier entry of the same path.
+//
+// Returns:
+// - error: If the entry cannot be written, it returns the error. Otherwise, it returns nil.
+func (m *Manifest) Record(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+	m.entries[entry.Path] = entry
+	return nil
+}
+
+// Lookup returns the last recorded entry of an image.
+func (m *Manifest) Lookup(path string) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[path]
+	return entry, ok
+}
+
+// Completed reports whether an image was processed successfully with the same input checksum, through the same
+// pipeline into the same output directory, and its output still exists.
+//
+// Parameters:
+// - path: The image's slash separated path relative to the input directory.
+// - checksum: The hex encoded SHA-256 checksum of the image.
+// - pipeline: The name of the pipeline, as returned by imageprocessing.PipelineName.
+// - outputDir: The directory the output is written to.
+//
+// Returns:
+// - Entry: The entry of the image, if it is completed.
+// - bool: Whether the image is completed.
+func (m *Manifest) Completed(path, checksum, pipeline, outputDir string) (Entry, bool) {
+	entry, ok := m.Lookup(path)
+	if !ok || entry.Status != StatusDone || entry.Checksum != checksum || entry.Pipeline != pipeline || entry.OutputDir != outputDir {
+		return Entry{}, false
+	}
+	if _, err := os.Stat(entry.Output); err != nil {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Entries returns the last entry of every image, sorted by path.
+func (m *Manifest) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]Entry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Close closes the manifest file.
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
@@ -0,0 +1,85 @@
+package batch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mwiater/golangpprof/common"
+)
+
+// ThroughputPerDay extrapolates the batch to the number of gigabytes of images that could be processed in a day,
+// as common.ThroughputPerDay does for a single call.
+//
+// Notes:
+//   - The batch's wall time is used, so the throughput reflects the concurrency of the batch and not the sum of the
+//     time spent on each image.
+func (s Summary) ThroughputPerDay() float64 {
+	return common.ThroughputPerDay(s.Bytes, float64(s.Elapsed.Microseconds())/1000)
+}
+
+// ImagesPerSecond returns the number of images processed per second of wall time.
+func (s Summary) ImagesPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Processed) / s.Elapsed.Seconds()
+}
+
+// PrintSummary prints the totals of a batch in a tabulated format, followed by the number of failures of each
+// ErrorType and the images that failed.
+//
+// Parameters:
+// - s: The summary returned by Run.
+func PrintSummary(s Summary) {
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Images", "Skipped", "Failed", "Retries", "Input Size", "Megapixels", "Wall Time", "Images/s", "Concurrency", "Workers")
+	fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d Bytes\t%.1f\t%.0fms\t%.2f\t%d\t%d\n", s.Processed, s.Skipped, s.Failed, s.Retries, s.Bytes, float64(s.Pixels)/1e6, float64(s.Elapsed.Microseconds())/1000, s.ImagesPerSecond(), s.Concurrency, s.Workers)
+	w.Flush()
+	fmt.Println()
+	fmt.Printf("Max Batch Throughput Per Day (GB): %.2f\n", s.ThroughputPerDay())
+	fmt.Println()
+
+	if s.Failed == 0 {
+		return
+	}
+	var failed []Item
+	types := map[string]int{}
+	for _, item := range s.Items {
+		if item.Err != nil {
+			failed = append(failed, item)
+			types[ErrorType(item.Err)]++
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if types[names[i]] != types[names[j]] {
+			return types[names[i]] > types[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	w = tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	fmt.Fprintf(w, "%s\t%s\n", "Error Type", "Failures")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%d\n", name, types[name])
+	}
+	w.Flush()
+	fmt.Println()
+
+	fmt.Println("Failed:")
+	for _, item := range failed {
+		if item.Attempts > 1 {
+			fmt.Printf("  %s: %v (%d attempts)\n", item.Path, item.Err, item.Attempts)
+			continue
+		}
+		fmt.Printf("  %s: %v\n", item.Path, item.Err)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,137 @@
+package benchstat
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oldOutput = `goos: linux
+goarch: amd64
+pkg: github.com/mwiater/golangpprof/imageprocessing
+BenchmarkGrayscale/serial/320x240-8   	     100	   1000000 ns/op	 300.00 MB/s	 2000 B/op	  20 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     100	   1010000 ns/op	 297.00 MB/s	 2000 B/op	  20 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     100	   1020000 ns/op	 294.00 MB/s	 2000 B/op	  20 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     100	   1030000 ns/op	 291.00 MB/s	 2000 B/op	  20 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     100	   1040000 ns/op	 288.00 MB/s	 2000 B/op	  20 allocs/op
+BenchmarkSharpen/serial/320x240-8     	      10	  10000000 ns/op
+BenchmarkSharpen/serial/320x240-8     	      10	  10100000 ns/op
+BenchmarkRemoved-8                    	      10	  10100000 ns/op
+PASS
+ok  	github.com/mwiater/golangpprof/imageprocessing	12.345s
+`
+
+const newOutput = `BenchmarkGrayscale/serial/320x240-8   	     200	    500000 ns/op	 600.00 MB/s	 1000 B/op	  10 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     200	    510000 ns/op	 594.00 MB/s	 1000 B/op	  10 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     200	    520000 ns/op	 588.00 MB/s	 1000 B/op	  10 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     200	    530000 ns/op	 582.00 MB/s	 1000 B/op	  10 allocs/op
+BenchmarkGrayscale/serial/320x240-8   	     200	    540000 ns/op	 576.00 MB/s	 1000 B/op	  10 allocs/op
+BenchmarkSharpen/serial/320x240-8     	      10	  10050000 ns/op
+BenchmarkSharpen/serial/320x240-8     	      10	  10000000 ns/op
+`
+
+func parse(t *testing.T, output string) *Set {
+	s, err := Parse(strings.NewReader(output))
+	assert.NoError(t, err)
+	return s
+}
+
+func TestParse(t *testing.T) {
+	s := parse(t, oldOutput)
+	assert.Equal(t, []string{"Grayscale/serial/320x240", "Sharpen/serial/320x240", "Removed"}, s.Names)
+	assert.Equal(t, []string{"ns/op", "MB/s", "B/op", "allocs/op"}, s.Units)
+	assert.Len(t, s.Values["Grayscale/serial/320x240"]["ns/op"], 5)
+
+	m, ok := s.Median("Grayscale/serial/320x240", "ns/op")
+	assert.True(t, ok)
+	assert.Equal(t, 1020000.0, m)
+	m, _ = s.Median("Sharpen/serial/320x240", "ns/op")
+	assert.Equal(t, 10050000.0, m)
+	_, ok = s.Median("Sharpen/serial/320x240", "B/op")
+	assert.False(t, ok)
+
+	_, err := Parse(strings.NewReader("BenchmarkBad-8 10 abc ns/op\n"))
+	assert.Error(t, err)
+}
+
+func TestMannWhitneyU(t *testing.T) {
+	// Completely separated samples of 5: the smallest possible p-value is 2/252
+	u, p := MannWhitneyU([]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10})
+	assert.Equal(t, 0.0, u)
+	assert.InDelta(t, 2.0/252, p, 1e-9)
+
+	u, p = MannWhitneyU([]float64{6, 7, 8, 9, 10}, []float64{1, 2, 3, 4, 5})
+	assert.Equal(t, 25.0, u)
+	assert.InDelta(t, 2.0/252, p, 1e-9)
+
+	// Interleaved samples are not significant
+	_, p = MannWhitneyU([]float64{1, 3, 5, 7}, []float64{2, 4, 6, 8})
+	assert.True(t, p > 0.5)
+
+	// Ties use the normal approximation
+	u, p = MannWhitneyU([]float64{1, 1, 2, 2, 3}, []float64{2, 3, 3, 4, 4})
+	assert.Equal(t, 3.0, u)
+	assert.InDelta(t, 0.0524, p, 1e-4)
+
+	_, p = MannWhitneyU([]float64{2, 2}, []float64{2, 2})
+	assert.Equal(t, 1.0, p)
+	_, p = MannWhitneyU(nil, []float64{1})
+	assert.Equal(t, 1.0, p)
+}
+
+func TestCompare(t *testing.T) {
+	c := Compare(parse(t, oldOutput), parse(t, newOutput), 0)
+	assert.Equal(t, DefaultAlpha, c.Alpha)
+	assert.Equal(t, []string{"ns/op", "MB/s", "B/op", "allocs/op"}, c.Units)
+
+	gray, sharpen := c.Rows[0], c.Rows[1]
+	assert.Equal(t, "Grayscale/serial/320x240", gray.Name)
+	assert.InDelta(t, -0.49, gray.Delta, 0.001)
+	assert.True(t, gray.Significant)
+	assert.Equal(t, 5, gray.Old.N)
+	assert.InDelta(t, 0.0196, gray.Old.Spread, 0.0001)
+
+	assert.Equal(t, "Sharpen/serial/320x240", sharpen.Name)
+	assert.False(t, sharpen.Significant) // Too few samples
+
+	// ns/op geomean of 1.02ms, 10.05ms -> 0.52ms, 10.025ms
+	assert.Equal(t, "ns/op", c.Geomeans[0].Unit)
+	assert.InDelta(t, -0.2864, c.Geomeans[0].Delta, 0.001)
+
+	var text bytes.Buffer
+	c.WriteText(&text)
+	assert.Contains(t, text.String(), "1.02ms ±2%")
+	assert.Contains(t, text.String(), "-49.02% (p=0.008 n=5+5)")
+	assert.Contains(t, text.String(), "~ (p=1.000 n=2+2)")
+	assert.Contains(t, text.String(), "[Geo mean]")
+	assert.NotContains(t, text.String(), "Removed")
+
+	var encoded bytes.Buffer
+	assert.NoError(t, c.WriteJSON(&encoded))
+	var decoded Comparison
+	assert.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+	assert.Equal(t, len(c.Rows), len(decoded.Rows))
+}
+
+func TestResults(t *testing.T) {
+	results := parse(t, oldOutput).Results()
+	assert.Len(t, results, 3)
+
+	r := results[0]
+	assert.Equal(t, "BenchmarkGrayscale/serial/320x240", r.FunctionName)
+	assert.Equal(t, 1.02, r.Duration)
+	assert.Equal(t, uint64(2000), r.BytesAllocated)
+	assert.Equal(t, uint64(20), r.Allocations)
+	assert.Equal(t, int64(294*1.02*1e3), r.FileSize)
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "1.52ms", FormatValue(1520000, "ns/op"))
+	assert.Equal(t, "850.00ns", FormatValue(850, "ns/op"))
+	assert.Equal(t, "2.50KiB", FormatValue(2560, "B/op"))
+	assert.Equal(t, "20.68M", FormatValue(20676052, "allocs/op"))
+	assert.Equal(t, "17.41", FormatValue(17.41, "MB/s"))
+}
@@ -0,0 +1,194 @@
+package benchstat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+)
+
+// DefaultAlpha is the significance level below which a difference is reported.
+const DefaultAlpha = 0.05
+
+// Summary describes the samples of one benchmark in one unit.
+type Summary struct {
+	N      int     `json:"n"`
+	Median float64 `json:"median"`
+	// Spread is the largest distance of a sample from the median, as a fraction of the median.
+	Spread float64 `json:"spread"`
+}
+
+// Row compares one benchmark in one unit between the old and new runs.
+type Row struct {
+	Name string  `json:"name"`
+	Unit string  `json:"unit"`
+	Old  Summary `json:"old"`
+	New  Summary `json:"new"`
+	// Delta is the change of the new median from the old one, as a fraction of the old median.
+	Delta float64 `json:"delta"`
+	P     float64 `json:"p"`
+	// Significant is set when P is below the comparison's Alpha.
+	Significant bool `json:"significant"`
+}
+
+// Geomean is the geometric mean of the medians of the benchmarks present in both runs, for one unit. Benchmarks
+// with a zero median, such as 0 allocs/op, are left out.
+type Geomean struct {
+	Unit  string  `json:"unit"`
+	Old   float64 `json:"old"`
+	New   float64 `json:"new"`
+	Delta float64 `json:"delta"`
+}
+
+// Comparison is the result of comparing two runs.
+type Comparison struct {
+	Alpha    float64   `json:"alpha"`
+	Units    []string  `json:"units"`
+	Rows     []Row     `json:"rows"`
+	Geomeans []Geomean `json:"geomeans"`
+}
+
+// Compare compares every benchmark and unit present in both runs.
+//
+// Parameters:
+// - old, current: The parsed runs.
+// - alpha: The significance level. DefaultAlpha is used if it is not positive.
+//
+// Returns:
+//   - Comparison: A row per benchmark and unit, in the order of the old run, and a geometric mean per unit.
+//     Benchmarks present in only one run are left out.
+func Compare(old, current *Set, alpha float64) Comparison {
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	c := Comparison{Alpha: alpha}
+
+	for _, unit := range old.Units {
+		var logOld, logNew float64
+		rows, count := 0, 0
+		for _, name := range old.Names {
+			oldValues, newValues := old.Values[name][unit], current.Values[name][unit]
+			if len(oldValues) == 0 || len(newValues) == 0 {
+				continue
+			}
+			row := Row{Name: name, Unit: unit, Old: summarize(oldValues), New: summarize(newValues)}
+			if row.Old.Median != 0 {
+				row.Delta = (row.New.Median - row.Old.Median) / row.Old.Median
+			}
+			_, row.P = MannWhitneyU(oldValues, newValues)
+			row.Significant = row.P < alpha
+			c.Rows = append(c.Rows, row)
+			rows++
+
+			if row.Old.Median > 0 && row.New.Median > 0 {
+				logOld += math.Log(row.Old.Median)
+				logNew += math.Log(row.New.Median)
+				count++
+			}
+		}
+		if rows > 0 {
+			c.Units = append(c.Units, unit)
+		}
+		if count == 0 {
+			continue
+		}
+		g := Geomean{Unit: unit, Old: math.Exp(logOld / float64(count)), New: math.Exp(logNew / float64(count))}
+		g.Delta = (g.New - g.Old) / g.Old
+		c.Geomeans = append(c.Geomeans, g)
+	}
+	return c
+}
+
+// summarize computes the median and spread of a non-empty slice of samples.
+func summarize(values []float64) Summary {
+	s := Summary{N: len(values), Median: median(values)}
+	if s.Median == 0 {
+		return s
+	}
+	for _, v := range values {
+		if spread := math.Abs(v-s.Median) / math.Abs(s.Median); spread > s.Spread {
+			s.Spread = spread
+		}
+	}
+	return s
+}
+
+// WriteText writes a table per unit, in the style of benchstat.
+//
+// Parameters:
+// - w: The writer to print the tables to.
+//
+// Notes:
+//   - Each row shows the median and spread of both runs, then the delta with its p-value and sample sizes. Deltas
+//     that are not significant are shown as "~".
+//   - Each table ends with the geometric mean of the medians.
+func (c Comparison) WriteText(w io.Writer) {
+	for i, unit := range c.Units {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', tabwriter.Debug)
+		fmt.Fprintf(tw, "%s\told %s\tnew %s\tdelta\n", "name", unit, unit)
+		for _, row := range c.Rows {
+			if row.Unit != unit {
+				continue
+			}
+			delta := "~"
+			if row.Significant {
+				delta = fmt.Sprintf("%+.2f%%", row.Delta*100)
+			}
+			fmt.Fprintf(tw, "%s\t%s ±%.0f%%\t%s ±%.0f%%\t%s (p=%.3f n=%d+%d)\n", row.Name,
+				FormatValue(row.Old.Median, unit), row.Old.Spread*100, FormatValue(row.New.Median, unit), row.New.Spread*100,
+				delta, row.P, row.Old.N, row.New.N)
+		}
+		for _, g := range c.Geomeans {
+			if g.Unit == unit {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%+.2f%%\n", "[Geo mean]", FormatValue(g.Old, unit), FormatValue(g.New, unit), g.Delta*100)
+			}
+		}
+		tw.Flush()
+	}
+}
+
+// WriteJSON writes the comparison as indented JSON.
+func (c Comparison) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(c)
+}
+
+// FormatValue formats a benchmark value with a scaled unit, e.g. 1.52ms for 1520000 ns/op or 12.0MB for B/op.
+func FormatValue(v float64, unit string) string {
+	switch unit {
+	case "ns/op":
+		switch {
+		case v >= 1e9:
+			return fmt.Sprintf("%.2fs", v/1e9)
+		case v >= 1e6:
+			return fmt.Sprintf("%.2fms", v/1e6)
+		case v >= 1e3:
+			return fmt.Sprintf("%.2fµs", v/1e3)
+		}
+		return fmt.Sprintf("%.2fns", v)
+	case "B/op":
+		switch {
+		case v >= 1<<30:
+			return fmt.Sprintf("%.2fGiB", v/(1<<30))
+		case v >= 1<<20:
+			return fmt.Sprintf("%.2fMiB", v/(1<<20))
+		case v >= 1<<10:
+			return fmt.Sprintf("%.2fKiB", v/(1<<10))
+		}
+		return fmt.Sprintf("%.0fB", v)
+	case "allocs/op":
+		switch {
+		case v >= 1e6:
+			return fmt.Sprintf("%.2fM", v/1e6)
+		case v >= 1e3:
+			return fmt.Sprintf("%.2fk", v/1e3)
+		}
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.4g", v)
+}
@@ -0,0 +1,122 @@
+package benchstat
+
+import (
+	"math"
+	"sort"
+)
+
+// exactLimit is the largest sample size for which the exact distribution of U is used, when there are no ties.
+const exactLimit = 20
+
+// MannWhitneyU tests whether two samples come from the same distribution, without assuming it is normal.
+//
+// Parameters:
+// - x, y: The samples, such as the ns/op of each run of the old and new version of a benchmark.
+//
+// Returns:
+// - float64: The U statistic of x, the number of pairs in which the value from x is larger, counting ties as half.
+// - float64: The two-sided p-value, or 1 if either sample is empty.
+//
+// Notes:
+//   - Small samples without ties use the exact distribution of U. Others use the normal approximation with a tie
+//     and continuity correction. The smallest possible p-value for 5 runs of each is 0.008, so use -count 5 or more
+//     for differences to be reported as significant.
+func MannWhitneyU(x, y []float64) (float64, float64) {
+	n1, n2 := len(x), len(y)
+	if n1 == 0 || n2 == 0 {
+		return 0, 1
+	}
+
+	type value struct {
+		v     float64
+		fromX bool
+	}
+	all := make([]value, 0, n1+n2)
+	for _, v := range x {
+		all = append(all, value{v, true})
+	}
+	for _, v := range y {
+		all = append(all, value{v, false})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].v < all[j].v })
+
+	// Rank the values, giving tied values the average of their ranks
+	var rankSumX, tieCorrection float64
+	ties := false
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if all[k].fromX {
+				rankSumX += rank
+			}
+		}
+		if t := float64(j - i); t > 1 {
+			ties = true
+			tieCorrection += t*t*t - t
+		}
+		i = j
+	}
+	u := rankSumX - float64(n1*(n1+1))/2
+
+	if !ties && n1 <= exactLimit && n2 <= exactLimit {
+		return u, exactP(n1, n2, u)
+	}
+
+	n := float64(n1 + n2)
+	mean := float64(n1*n2) / 2
+	variance := float64(n1*n2) / 12 * ((n + 1) - tieCorrection/(n*(n-1)))
+	if variance <= 0 {
+		return u, 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return u, math.Min(1, math.Erfc(z/math.Sqrt2))
+}
+
+// exactP returns the two-sided p-value of U from its exact distribution for samples of n1 and n2 values.
+func exactP(n1, n2 int, u float64) float64 {
+	counts := uCounts(n1, n2)
+	var total, below, above float64
+	for k, c := range counts {
+		total += c
+		if float64(k) <= u {
+			below += c
+		}
+		if float64(k) >= u {
+			above += c
+		}
+	}
+	return math.Min(1, 2*math.Min(below, above)/total)
+}
+
+// uCounts returns the number of orderings of n1 and n2 distinct values giving each value of U, from 0 to n1*n2.
+// It uses the recurrence f(n1, n2, u) = f(n1-1, n2, u-n2) + f(n1, n2-1, u), on whether the largest value is from x.
+func uCounts(n1, n2 int) []float64 {
+	// table[i][j] holds the counts for samples of i and j values
+	table := make([][][]float64, n1+1)
+	for i := range table {
+		table[i] = make([][]float64, n2+1)
+		for j := range table[i] {
+			counts := make([]float64, i*j+1)
+			switch {
+			case i == 0 || j == 0:
+				counts[0] = 1
+			default:
+				for k, c := range table[i-1][j] {
+					counts[k+j] += c
+				}
+				for k, c := range table[i][j-1] {
+					counts[k] += c
+				}
+			}
+			table[i][j] = counts
+		}
+	}
+	return table[n1][n2]
+}
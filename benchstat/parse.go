@@ -0,0 +1,137 @@
+// Package benchstat compares the output of two go test -bench runs, in the style of golang.org/x/perf/cmd/benchstat:
+// per-benchmark delta tables with a Mann-Whitney U significance test and a geometric mean summary.
+package benchstat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mwiater/golangpprof/common"
+)
+
+// procsSuffix matches the -GOMAXPROCS suffix go test adds to benchmark names, e.g. the "-8" of BenchmarkSharpen-8.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// Set is the samples of each benchmark and unit in a go test -bench output.
+type Set struct {
+	// Names lists the benchmarks in the order they first appear, without the Benchmark prefix or -GOMAXPROCS suffix.
+	Names []string
+	// Units lists the units in the order they first appear, such as ns/op, MB/s, B/op and allocs/op.
+	Units []string
+	// Values maps each benchmark and unit to its samples, one per run (-count).
+	Values map[string]map[string][]float64
+}
+
+// ParseFile reads and parses a go test -bench output file.
+func ParseFile(path string) (*Set, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// Parse parses go test -bench output.
+//
+// Parameters:
+// - r: The output, which may also contain test output, goos/goarch/pkg lines and PASS/ok lines. They are ignored.
+//
+// Returns:
+// - *Set: The samples of each benchmark.
+// - error: If the output cannot be read or a benchmark line is malformed, it returns the error. Otherwise, it returns nil.
+func Parse(r io.Reader) (*Set, error) {
+	s := &Set{Values: map[string]map[string][]float64{}}
+	units := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") || len(fields)%2 != 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := procsSuffix.ReplaceAllString(strings.TrimPrefix(fields[0], "Benchmark"), "")
+		if _, ok := s.Values[name]; !ok {
+			s.Names = append(s.Names, name)
+			s.Values[name] = map[string][]float64{}
+		}
+		for i := 2; i < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q: %w", line, fields[i], err)
+			}
+			unit := fields[i+1]
+			if !units[unit] {
+				units[unit] = true
+				s.Units = append(s.Units, unit)
+			}
+			s.Values[name][unit] = append(s.Values[name][unit], value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Median returns the median of a benchmark's samples in a unit, and false if there are none.
+func (s *Set) Median(name, unit string) (float64, bool) {
+	values := s.Values[name][unit]
+	if len(values) == 0 {
+		return 0, false
+	}
+	return median(values), true
+}
+
+// Results converts each benchmark to a FunctionResult, so that benchmark runs can be checked against and saved to
+// the same baseline store as common.PrintResults.
+//
+// Returns:
+//   - []common.FunctionResult: One result per benchmark with an ns/op figure, named Benchmark<name>. Duration is the
+//     median ns/op in milliseconds, BytesAllocated and Allocations are the medians of B/op and allocs/op, and FileSize
+//     is derived from MB/s, so that the baseline's throughput matches the benchmark's.
+func (s *Set) Results() []common.FunctionResult {
+	var results []common.FunctionResult
+	for _, name := range s.Names {
+		nsPerOp, ok := s.Median(name, "ns/op")
+		if !ok {
+			continue
+		}
+		result := common.FunctionResult{
+			FunctionName: "Benchmark" + name,
+			Duration:     nsPerOp / 1e6,
+		}
+		if v, ok := s.Median(name, "B/op"); ok {
+			result.BytesAllocated = uint64(v)
+		}
+		if v, ok := s.Median(name, "allocs/op"); ok {
+			result.Allocations = uint64(v)
+		}
+		if v, ok := s.Median(name, "MB/s"); ok {
+			result.FileSize = int64(v * 1e6 * nsPerOp / 1e9)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// median returns the median of a non-empty slice of values, without modifying it.
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,274 @@
+// Package cache keeps processed images so that the same operations on the same input are only run once. Results
+// are addressed by the content of their input and a canonical spec of the operations and parameters applied to it,
+// and kept in a size-bounded in-memory LRU tier backed by an optional size-bounded on-disk tier.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Defaults of the Config sizes.
+const (
+	DefaultMaxMemoryBytes = 64 << 20
+	DefaultMaxDiskBytes   = 1 << 30
+)
+
+// Tier is where a cached result was found.
+type Tier string
+
+const (
+	TierMemory Tier = "memory"
+	TierDisk   Tier = "disk"
+)
+
+// Checksum returns the hex encoded SHA-256 of an input, as Key expects it.
+func Checksum(input []byte) string {
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+// Spec returns the canonical spec of the parameters a result depends on, e.g. "format=png;ops=grayscale,sharpen",
+// so that the same parameters always give the same spec whatever order they were given in.
+//
+// Parameters:
+// - params: The parameters, such as the pipeline's operations and the output format. Empty values are left out.
+func Spec(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + params[name]
+	}
+	return strings.Join(parts, ";")
+}
+
+// Key returns the address of a result: the hex encoded SHA-256 of the input's checksum and the spec.
+//
+// Parameters:
+// - checksum: The hex encoded SHA-256 of the input, as returned by Checksum.
+// - spec: The canonical spec of the operations and parameters, as returned by Spec.
+func Key(checksum, spec string) string {
+	return Checksum([]byte(checksum + "\n" + spec))
+}
+
+// Config configures a Cache.
+type Config struct {
+	// MaxMemoryBytes bounds the size of the results kept in memory. It defaults to DefaultMaxMemoryBytes, and a
+	// negative value disables the memory tier.
+	MaxMemoryBytes int64
+
+	// Dir, if set, is the directory of the disk tier, which keeps the results evicted from memory, and those of
+	// previous runs.
+	Dir string
+
+	// MaxDiskBytes bounds the size of the results kept in Dir. It defaults to DefaultMaxDiskBytes.
+	MaxDiskBytes int64
+}
+
+// Stats counts the lookups of a cache and the results it holds.
+type Stats struct {
+	MemoryHits int64
+	DiskHits   int64
+	Misses     int64
+
+	// Evictions counts the results evicted from either tier to stay within its size.
+	Evictions int64
+
+	MemoryEntries int
+	MemoryBytes   int64
+	DiskEntries   int
+	DiskBytes     int64
+}
+
+// Hits returns the number of lookups that found a result in either tier.
+func (s Stats) Hits() int64 {
+	return s.MemoryHits + s.DiskHits
+}
+
+// HitRatio returns the share of lookups that found a result, between 0 and 1.
+func (s Stats) HitRatio() float64 {
+	lookups := s.Hits() + s.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits()) / float64(lookups)
+}
+
+// lruEntry is a result held by a tier, along with its size.
+type lruEntry struct {
+	key   string
+	value []byte
+	size  int64
+}
+
+// lru is a size-bounded list of entries, the most recently used first.
+type lru struct {
+	max      int64
+	size     int64
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, order: list.New(), elements: map[string]*list.Element{}}
+}
+
+// get returns an entry and marks it as the most recently used.
+func (l *lru) get(key string) (*lruEntry, bool) {
+	element, ok := l.elements[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruEntry), true
+}
+
+// add adds or replaces an entry as the most recently used, and returns the entries evicted to stay within max.
+// An entry larger than max is not added.
+func (l *lru) add(e *lruEntry) []*lruEntry {
+	if e.size > l.max {
+		return nil
+	}
+	if element, ok := l.elements[e.key]; ok {
+		l.size -= element.Value.(*lruEntry).size
+		element.Value = e
+		l.order.MoveToFront(element)
+	} else {
+		l.elements[e.key] = l.order.PushFront(e)
+	}
+	l.size += e.size
+
+	var evicted []*lruEntry
+	for l.size > l.max {
+		oldest := l.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		l.remove(entry.key)
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
+
+// remove removes an entry, if it is held.
+func (l *lru) remove(key string) {
+	element, ok := l.elements[key]
+	if !ok {
+		return
+	}
+	l.size -= element.Value.(*lruEntry).size
+	l.order.Remove(element)
+	delete(l.elements, key)
+}
+
+// Cache is a two-tier cache of processed images.
+//
+// Notes:
+//   - A Cache is safe for concurrent use. Results are shared between the callers, who must not modify them.
+//   - Results found on disk are promoted to memory. Results evicted from memory stay on disk, and results evicted
+//     from disk are deleted.
+type Cache struct {
+	mu     sync.Mutex
+	memory *lru
+	disk   *disk
+	stats  Stats
+}
+
+// New returns a cache, loading the index of its disk tier if it has one.
+//
+// Parameters:
+// - cfg: The sizes of the tiers, and the directory of the disk tier. Zero values are replaced by the defaults.
+//
+// Returns:
+// - *Cache: The cache.
+// - error: If the directory cannot be created or read, it returns the error. Otherwise, it returns nil.
+func New(cfg Config) (*Cache, error) {
+	if cfg.MaxMemoryBytes == 0 {
+		cfg.MaxMemoryBytes = DefaultMaxMemoryBytes
+	}
+	if cfg.MaxDiskBytes <= 0 {
+		cfg.MaxDiskBytes = DefaultMaxDiskBytes
+	}
+	c := &Cache{memory: newLRU(cfg.MaxMemoryBytes)}
+	if cfg.Dir != "" {
+		d, err := openDisk(cfg.Dir, cfg.MaxDiskBytes)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = d
+	}
+	return c, nil
+}
+
+// Get looks a result up in memory, then on disk.
+//
+// Returns:
+// - []byte: The result, which must not be modified.
+// - Tier: The tier the result was found in.
+// - bool: Whether the result was found.
+func (c *Cache) Get(key string) ([]byte, Tier, bool) {
+	c.mu.Lock()
+	if e, ok := c.memory.get(key); ok {
+		c.stats.MemoryHits++
+		c.mu.Unlock()
+		return e.value, TierMemory, true
+	}
+	c.mu.Unlock()
+
+	if c.disk != nil {
+		if value, ok := c.disk.get(key); ok {
+			c.mu.Lock()
+			c.stats.DiskHits++
+			c.addMemory(key, value)
+			c.mu.Unlock()
+			return value, TierDisk, true
+		}
+	}
+
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+	return nil, "", false
+}
+
+// Put adds a result to both tiers.
+//
+// Notes:
+//   - Errors writing the disk tier are not returned: the result is still kept in memory, and a result missing from
+//     disk is only a miss.
+func (c *Cache) Put(key string, value []byte) {
+	c.mu.Lock()
+	c.addMemory(key, value)
+	c.mu.Unlock()
+	if c.disk != nil {
+		c.disk.put(key, value)
+	}
+}
+
+// addMemory adds a result to the memory tier. c.mu must be held.
+func (c *Cache) addMemory(key string, value []byte) {
+	evicted := c.memory.add(&lruEntry{key: key, value: value, size: int64(len(value))})
+	c.stats.Evictions += int64(len(evicted))
+}
+
+// Stats returns the lookups of the cache so far, and the results it holds.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	stats := c.stats
+	stats.MemoryEntries, stats.MemoryBytes = len(c.memory.elements), c.memory.size
+	c.mu.Unlock()
+	if c.disk != nil {
+		var evictions int64
+		stats.DiskEntries, stats.DiskBytes, evictions = c.disk.stats()
+		stats.Evictions += evictions
+	}
+	return stats
+}
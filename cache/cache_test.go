@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestKey ensures that keys depend on the input's content and on the parameters, but not on their order.
+func TestKey(t *testing.T) {
+	spec := Spec(map[string]string{"ops": "grayscale,sharpen", "format": "png", "quality": ""})
+	assert.Equal(t, "format=png;ops=grayscale,sharpen", spec)
+	assert.Equal(t, spec, Spec(map[string]string{"format": "png", "ops": "grayscale,sharpen"}))
+
+	key := Key(Checksum([]byte("image")), spec)
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, Key(Checksum([]byte("image")), spec))
+	assert.NotEqual(t, key, Key(Checksum([]byte("other image")), spec))
+	assert.NotEqual(t, key, Key(Checksum([]byte("image")), Spec(map[string]string{"ops": "sharpen,grayscale", "format": "png"})))
+}
+
+// TestMemory ensures that the memory tier keeps the most recently used results within its size.
+func TestMemory(t *testing.T) {
+	c, err := New(Config{MaxMemoryBytes: 10})
+	assert.NoError(t, err)
+
+	c.Put("a", []byte("aaaa"))
+	c.Put("b", []byte("bbbb"))
+	_, tier, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, TierMemory, tier)
+
+	// b is the least recently used, so it is evicted to make room for c
+	c.Put("c", []byte("cccc"))
+	_, _, ok = c.Get("b")
+	assert.False(t, ok)
+	value, _, ok := c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, "cccc", string(value))
+
+	// Results larger than the tier are not kept
+	c.Put("d", []byte("ddddddddddd"))
+	_, _, ok = c.Get("d")
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, Stats{MemoryHits: 2, Misses: 2, Evictions: 1, MemoryEntries: 2, MemoryBytes: 8}, stats)
+	assert.Equal(t, 0.5, stats.HitRatio())
+
+	disabled, err := New(Config{MaxMemoryBytes: -1})
+	assert.NoError(t, err)
+	disabled.Put("a", []byte("a"))
+	_, _, ok = disabled.Get("a")
+	assert.False(t, ok)
+}
+
+// TestDisk ensures that the disk tier keeps the results evicted from memory within its size, promotes the results
+// it finds to memory, and is reloaded in least recently used order.
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New(Config{MaxMemoryBytes: 4, Dir: dir, MaxDiskBytes: 12})
+	assert.NoError(t, err)
+
+	keys := []string{Key("a", ""), Key("b", ""), Key("c", "")}
+	for i, key := range keys {
+		c.Put(key, bytes.Repeat([]byte{'a' + byte(i)}, 4))
+	}
+	assert.FileExists(t, filepath.Join(dir, keys[0][:2], keys[0]))
+
+	// Only c fits in memory, so a is read from disk and promoted
+	value, tier, ok := c.Get(keys[0])
+	assert.True(t, ok)
+	assert.Equal(t, TierDisk, tier)
+	assert.Equal(t, "aaaa", string(value))
+	_, tier, _ = c.Get(keys[0])
+	assert.Equal(t, TierMemory, tier)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.DiskHits)
+	assert.Equal(t, 3, stats.DiskEntries)
+	assert.Equal(t, int64(12), stats.DiskBytes)
+
+	// Reopening keeps the order the results were used in: b is the least recently used, so it is evicted first
+	os.Chtimes(filepath.Join(dir, keys[1][:2], keys[1]), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, keys[0][:2], "."+keys[0]+".123"), []byte("partial"), 0o644))
+	c, err = New(Config{MaxMemoryBytes: -1, Dir: dir, MaxDiskBytes: 12})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, keys[0][:2], "."+keys[0]+".123"))
+	c.Put(Key("d", ""), []byte("dddd"))
+	_, _, ok = c.Get(keys[1])
+	assert.False(t, ok)
+	assert.NoFileExists(t, filepath.Join(dir, keys[1][:2], keys[1]))
+	for _, key := range []string{keys[0], keys[2], Key("d", "")} {
+		_, tier, ok := c.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, TierDisk, tier)
+	}
+	assert.Equal(t, int64(1), c.Stats().Evictions)
+
+	// A result removed from the directory is a miss
+	assert.NoError(t, os.Remove(filepath.Join(dir, keys[2][:2], keys[2])))
+	_, _, ok = c.Get(keys[2])
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.Stats().DiskEntries)
+}
+
+// TestConcurrent ensures that the cache can be used from many goroutines at once. Run with -race.
+func TestConcurrent(t *testing.T) {
+	c, err := New(Config{MaxMemoryBytes: 64, Dir: t.TempDir(), MaxDiskBytes: 256})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := Key(fmt.Sprint(i%20), "")
+				want := []byte(fmt.Sprintf("result %02d", i%20))
+				if value, _, ok := c.Get(key); ok {
+					assert.Equal(t, want, value)
+					continue
+				}
+				c.Put(key, want)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	assert.Equal(t, int64(800), stats.Hits()+stats.Misses)
+	assert.True(t, stats.MemoryBytes <= 64)
+	assert.True(t, stats.DiskBytes <= 256)
+}
+
+// TestWriteText ensures that the stats are written in the Prometheus text format.
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, WriteText(&buf, Stats{MemoryHits: 3, DiskHits: 2, Misses: 1, DiskBytes: 100}))
+	assert.Contains(t, buf.String(), "# TYPE golangpprof_cache_hits_total counter\n")
+	assert.Contains(t, buf.String(), `golangpprof_cache_hits_total{tier="disk"} 2`+"\n")
+	assert.Contains(t, buf.String(), "golangpprof_cache_misses_total 1\n")
+	assert.Contains(t, buf.String(), `golangpprof_cache_bytes{tier="disk"} 100`+"\n")
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// disk is the on-disk tier of a cache: each result is a file named after its key, in a subdirectory named after
+// the key's first two characters so that no directory grows too large.
+//
+// Notes:
+//   - The index of the files is held in memory, in least recently used order, and rebuilt from the files'
+//     modification times when the tier is opened. Reading a result touches its file, so the order survives restarts.
+type disk struct {
+	dir string
+
+	mu        sync.Mutex
+	index     *lru
+	evictions int64
+}
+
+// openDisk creates the directory of a disk tier if needed, and indexes the results it holds, evicting the least
+// recently used if they exceed max.
+func openDisk(dir string, max int64) (*disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || len(entry.Name()) < 2 {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			// A temporary file left by a crash in the middle of a write
+			os.Remove(path)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{key: entry.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &disk{dir: dir, index: newLRU(max)}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		d.evict(d.index.add(&lruEntry{key: f.key, size: f.size}))
+	}
+	return d, nil
+}
+
+// get reads a result, and marks it as the most recently used.
+func (d *disk) get(key string) ([]byte, bool) {
+	d.mu.Lock()
+	_, ok := d.index.get(key)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	path := d.path(key)
+	value, err := os.ReadFile(path)
+	if err != nil {
+		// Evicted since it was looked up, or removed from the directory
+		d.mu.Lock()
+		d.index.remove(key)
+		d.mu.Unlock()
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return value, true
+}
+
+// put writes a result, evicting the least recently used results to stay within the size of the tier.
+func (d *disk) put(key string, value []byte) {
+	d.mu.Lock()
+	_, exists := d.index.get(key)
+	d.mu.Unlock()
+	if exists || int64(len(value)) > d.index.max {
+		return
+	}
+	if err := d.write(key, value); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(d.index.add(&lruEntry{key: key, size: int64(len(value))}))
+}
+
+// evict deletes the files of evicted results. d.mu must be held.
+func (d *disk) evict(evicted []*lruEntry) {
+	for _, e := range evicted {
+		os.Remove(d.path(e.key))
+		d.evictions++
+	}
+}
+
+// stats returns the number of results on disk, their total size, and the number of results evicted.
+func (d *disk) stats() (int, int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index.elements), d.index.size, d.evictions
+}
+
+// path returns the path of a result's file.
+func (d *disk) path(key string) string {
+	return filepath.Join(d.dir, key[:2], key)
+}
+
+// write writes a result's file atomically, through a temporary file renamed over it, so that a crash never leaves
+// a partial result behind.
+func (d *disk) write(key string, value []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+key+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// PrintStats prints the lookups of a cache and the results it holds in a tabulated format.
+//
+// Parameters:
+// - s: The stats returned by Cache.Stats.
+func PrintStats(s Stats) {
+	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Cache Hits", "Memory Hits", "Disk Hits", "Misses", "Hit Ratio", "Evictions", "Cached")
+	fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%.1f%%\t%d\t%d in memory (%d Bytes), %d on disk (%d Bytes)\n",
+		s.Hits(), s.MemoryHits, s.DiskHits, s.Misses, 100*s.HitRatio(), s.Evictions, s.MemoryEntries, s.MemoryBytes, s.DiskEntries, s.DiskBytes)
+	w.Flush()
+	fmt.Println()
+}
+
+// WriteText writes the stats in the Prometheus text exposition format.
+//
+// Returns:
+// - error: The first error writing to w. Otherwise, it returns nil.
+func WriteText(w io.Writer, s Stats) error {
+	_, err := fmt.Fprintf(w, `# HELP golangpprof_cache_hits_total Cache lookups that found a result, by tier.
+# TYPE golangpprof_cache_hits_total counter
+golangpprof_cache_hits_total{tier="memory"} %d
+golangpprof_cache_hits_total{tier="disk"} %d
+# HELP golangpprof_cache_misses_total Cache lookups that found no result.
+# TYPE golangpprof_cache_misses_total counter
+golangpprof_cache_misses_total %d
+# HELP golangpprof_cache_evictions_total Results evicted from the cache to stay within its size, from either tier.
+# TYPE golangpprof_cache_evictions_total counter
+golangpprof_cache_evictions_total %d
+# HELP golangpprof_cache_entries Results held by the cache, by tier.
+# TYPE golangpprof_cache_entries gauge
+golangpprof_cache_entries{tier="memory"} %d
+golangpprof_cache_entries{tier="disk"} %d
+# HELP golangpprof_cache_bytes Size of the results held by the cache, by tier.
+# TYPE golangpprof_cache_bytes gauge
+golangpprof_cache_bytes{tier="memory"} %d
+golangpprof_cache_bytes{tier="disk"} %d
+`, s.MemoryHits, s.DiskHits, s.Misses, s.Evictions, s.MemoryEntries, s.DiskEntries, s.MemoryBytes, s.DiskBytes)
+	return err
+}
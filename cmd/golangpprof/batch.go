@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/batch"
+	"github.com/mwiater/golangpprof/imageprocessing"
+)
+
+// runBatch processes every matching image in a directory tree through a pipeline of operations, and prints the
+// throughput of the batch.
+//
+// Notes:
+//   - The batch is not wrapped with common.Wrap: its images are processed concurrently, so per-stage timings summed
+//     across them would be meaningless, and observing each stage would slow the batch down. Use -serve or -agent to
+//     profile it instead.
+//   - An interrupt cancels the batch; the images already written are kept, and the rest are reported as failed.
+//   - The outcome of each image is recorded in a manifest, so running the same batch again skips the images that
+//     are already done and retries the rest.
+//   - The batch exits with status 1 if any image failed.
+func runBatch(fs *flag.FlagSet, args []string) int {
+	batchOptions := addBatchFlags(fs)
+	verbose := fs.Bool("v", false, "print the outcome and time of each image as it completes")
+	observe := addObserveFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fail(errors.New("batch requires an input and an output directory"))
+	}
+	cfg, err := batchOptions.config(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.Manifest != nil {
+		defer cfg.Manifest.Close()
+	}
+
+	if *verbose {
+		var mu sync.Mutex
+		cfg.OnItem = func(item batch.Item) {
+			mu.Lock()
+			defer mu.Unlock()
+			printItem("  ", item)
+		}
+	}
+
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	defer stop()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	summary, err := batch.Run(ctx, cfg)
+	if err != nil {
+		return fail(fmt.Errorf("could not run batch: %v", err))
+	}
+
+	batch.PrintSummary(summary)
+	printCacheStats(cfg.Cache)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// batchFlags are the flags selecting the images of a directory tree and the pipeline they are run through, shared
+// by the batch and watch commands.
+type batchFlags struct {
+	include     *string
+	exclude     *string
+	ops         *string
+	concurrency *int
+	workers     *int
+	manifest    *string
+	retries     *int
+	backoff     *time.Duration
+	cache       *cacheFlags
+}
+
+// addBatchFlags adds the batch flags to the flag set.
+func addBatchFlags(fs *flag.FlagSet) *batchFlags {
+	return &batchFlags{
+		include:     fs.String("include", strings.Join(batch.DefaultInclude, ","), "comma separated glob patterns of the images to process; patterns with a / match the path relative to the input directory"),
+		exclude:     fs.String("exclude", "", "comma separated glob patterns of the images and directories to skip"),
+		ops:         fs.String("ops", "grayscale", "comma separated pipeline of operations each image is run through, in order: "+strings.Join(imageprocessing.OperationNames(), ", ")),
+		concurrency: fs.Int("concurrency", runtime.NumCPU(), "number of images processed at the same time"),
+		workers:     fs.Int("workers", 1, "number of goroutines the optimized operations split each image between"),
+		manifest:    fs.String("manifest", "", "path of the JSONL manifest used to resume the batch, or none; defaults to .batch-manifest.jsonl in the output directory"),
+		retries:     fs.Int("retries", 2, "number of times a failed image is retried"),
+		backoff:     fs.Duration("backoff", 500*time.Millisecond, "delay before the first retry of an image, doubled for each retry after it"),
+		cache:       addCacheFlags(fs),
+	}
+}
+
+// config validates the batch flags and returns the configuration they describe, with its manifest open.
+//
+// Parameters:
+// - inputDir: The directory tree the images are read from.
+// - outputDir: The directory the results are written to, mirroring inputDir.
+//
+// Returns:
+// - batch.Config: The configuration. The caller closes its Manifest, if set.
+// - error: If the flags are invalid, or the cache or manifest cannot be opened, it returns the error. Otherwise, it returns nil.
+func (f *batchFlags) config(inputDir, outputDir string) (batch.Config, error) {
+	if *f.concurrency < 1 || *f.workers < 1 {
+		return batch.Config{}, errors.New("-concurrency and -workers must be positive")
+	}
+	if *f.retries < 0 || *f.backoff < 0 {
+		return batch.Config{}, errors.New("-retries and -backoff must not be negative")
+	}
+	pipeline, err := imageprocessing.ParseOperations(*f.ops)
+	if err != nil {
+		return batch.Config{}, fmt.Errorf("invalid -ops: %v", err)
+	}
+	c, err := f.cache.open()
+	if err != nil {
+		return batch.Config{}, err
+	}
+
+	cfg := batch.Config{
+		InputDir:    inputDir,
+		OutputDir:   outputDir,
+		Include:     splitList(*f.include),
+		Exclude:     splitList(*f.exclude),
+		Operations:  pipeline,
+		Concurrency: *f.concurrency,
+		Workers:     *f.workers,
+		Retries:     *f.retries,
+		Backoff:     *f.backoff,
+		Cache:       c,
+	}
+	if *f.manifest == "none" {
+		return cfg, nil
+	}
+	path := *f.manifest
+	if path == "" {
+		path = filepath.Join(outputDir, ".batch-manifest.jsonl")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return batch.Config{}, fmt.Errorf("could not create manifest directory: %v", err)
+	}
+	manifest, err := batch.OpenManifest(path)
+	if err != nil {
+		return batch.Config{}, fmt.Errorf("could not open manifest: %v", err)
+	}
+	cfg.Manifest = manifest
+	fmt.Printf("Manifest: %s\n", manifest.Path())
+	return cfg, nil
+}
+
+// printItem prints the outcome and time of an image, after the given prefix.
+func printItem(prefix string, item batch.Item) {
+	switch {
+	case item.Err != nil:
+		fmt.Printf("%s%s: %v\n", prefix, item.Path, item.Err)
+	case item.Skipped:
+		fmt.Printf("%s%s (done, skipped)\n", prefix, item.Path)
+	case item.Cached:
+		fmt.Printf("%s%s (%d Bytes, cached, %.0fms)\n", prefix, item.Path, item.Bytes, float64(item.Duration.Microseconds())/1000)
+	default:
+		fmt.Printf("%s%s (%d Bytes, %.0fms)\n", prefix, item.Path, item.Bytes, float64(item.Duration.Microseconds())/1000)
+	}
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mwiater/golangpprof/benchstat"
+	"github.com/mwiater/golangpprof/profile"
+)
+
+// runCompare diffs two profiles, or with -bench compares two go test -bench outputs.
+//
+// Notes:
+//   - With -bench and -check-baseline or -update-baseline, the old output may be omitted, and the new output is
+//     only checked against or saved to the baseline file.
+func runCompare(fs *flag.FlagSet, args []string) int {
+	bench := fs.Bool("bench", false, "compare go test -bench outputs instead of profiles")
+	normalize := fs.String("normalize", "samples", "normalize the diffed profiles by total samples, wall time or not at all: samples, time or none")
+	top := fs.Int("top", 20, "number of functions and lines to print in the profile diff; 0 prints all of them")
+	alpha := fs.Float64("alpha", benchstat.DefaultAlpha, "with -bench, significance level of the Mann-Whitney U test")
+	asJSON := fs.Bool("json", false, "print the diff or comparison as JSON instead of text")
+	baselines := addBaselineFlags(fs)
+	fs.Parse(args)
+
+	if *bench {
+		return compareBenchmarks(fs.Args(), *alpha, *asJSON, baselines)
+	}
+	if fs.NArg() != 2 {
+		return fail(errors.New("compare requires an old and a new profile"))
+	}
+	if err := compareProfiles(fs.Arg(0), fs.Arg(1), *normalize, *top, *asJSON); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+// compareProfiles loads two profiles and prints the per-function and per-line deltas between them.
+func compareProfiles(basePath, newPath, normalize string, top int, asJSON bool) error {
+	base, err := profile.ParseFile(basePath)
+	if err != nil {
+		return fmt.Errorf("could not load base profile: %v", err)
+	}
+	current, err := profile.ParseFile(newPath)
+	if err != nil {
+		return fmt.Errorf("could not load new profile: %v", err)
+	}
+
+	diff, err := profile.Compare(base, current, "", profile.Normalization(normalize))
+	if err != nil {
+		return fmt.Errorf("could not diff profiles: %v", err)
+	}
+	if asJSON {
+		if err := diff.WriteJSON(os.Stdout); err != nil {
+			return fmt.Errorf("could not write diff: %v", err)
+		}
+		return nil
+	}
+	fmt.Printf("Base: %s\nNew:  %s\n", basePath, newPath)
+	diff.WriteText(os.Stdout, top)
+	return nil
+}
+
+// compareBenchmarks compares two go test -bench outputs, if two are given, and checks or saves the last one against
+// the baseline file, and returns the exit status of the command.
+func compareBenchmarks(paths []string, alpha float64, asJSON bool, baselines *baselineFlags) int {
+	switch {
+	case len(paths) == 2:
+	case len(paths) == 1 && (baselines.check || baselines.update):
+	default:
+		return fail(errors.New("compare -bench requires an old and a new benchmark output, or only a new one with -check-baseline or -update-baseline"))
+	}
+
+	newSet, err := benchstat.ParseFile(paths[len(paths)-1])
+	if err != nil {
+		return fail(fmt.Errorf("could not parse benchmarks: %v", err))
+	}
+
+	if len(paths) == 2 {
+		oldSet, err := benchstat.ParseFile(paths[0])
+		if err != nil {
+			return fail(fmt.Errorf("could not parse benchmarks: %v", err))
+		}
+		comparison := benchstat.Compare(oldSet, newSet, alpha)
+		if asJSON {
+			if err := comparison.WriteJSON(os.Stdout); err != nil {
+				return fail(fmt.Errorf("could not write comparison: %v", err))
+			}
+		} else {
+			comparison.WriteText(os.Stdout)
+			fmt.Println()
+		}
+	}
+
+	return baselines.run(newSet.Results()...)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mwiater/golangpprof/agent"
+	"github.com/mwiater/golangpprof/cache"
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/export"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/live"
+	"github.com/mwiater/golangpprof/metrics"
+	"github.com/mwiater/golangpprof/report"
+)
+
+// operationFlags selects the input image, the operations to run on it and where their output is written.
+type operationFlags struct {
+	input     string
+	outputDir string
+	ops       string
+}
+
+// addOperationFlags adds the -input, -output-dir and -ops flags to the flag set.
+func addOperationFlags(fs *flag.FlagSet, defaultOps []string) *operationFlags {
+	f := &operationFlags{}
+	fs.StringVar(&f.input, "input", imageprocessing.DefaultInputPath, "path of the JPEG image to process")
+	fs.StringVar(&f.outputDir, "output-dir", imageprocessing.DefaultOutputDir, "directory the processed images are written to")
+	fs.StringVar(&f.ops, "ops", strings.Join(defaultOps, ","), "comma separated operations to run: "+strings.Join(imageprocessing.OperationNames(), ", "))
+	return f
+}
+
+// operations parses -ops and creates the output directory, returning an error if either fails.
+func (f *operationFlags) operations() ([]imageprocessing.Operation, error) {
+	ops, err := imageprocessing.ParseOperations(f.ops)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -ops: %v", err)
+	}
+	if err := os.MkdirAll(f.outputDir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create output directory: %v", err)
+	}
+	return ops, nil
+}
+
+// addWorkersFlag adds the -workers flag, which sets the number of goroutines used by the optimized operations.
+func addWorkersFlag(fs *flag.FlagSet) {
+	fs.IntVar(&imageprocessing.NumRoutines, "workers", imageprocessing.NumRoutines, "number of goroutines the optimized operations split each image between")
+}
+
+// checkWorkers returns an error if -workers is not positive.
+func checkWorkers() error {
+	if imageprocessing.NumRoutines < 1 {
+		return fmt.Errorf("invalid -workers: %d is not positive", imageprocessing.NumRoutines)
+	}
+	return nil
+}
+
+// profilingFlags selects the profiles captured for each wrapped call and the summaries printed from them.
+type profilingFlags struct {
+	profiles string
+	dir      string
+}
+
+// addProfilingFlags adds the -profiles and -profile-dir flags, and the flags that set the common package's
+// summary and runtime metrics options.
+func addProfilingFlags(fs *flag.FlagSet) *profilingFlags {
+	f := &profilingFlags{}
+	fs.StringVar(&f.profiles, "profiles", "cpu", "comma separated profiles to capture for each operation: cpu, heap or none; cpu is turned off when -agent captures CPU snapshots, and should be disabled to capture CPU profiles from -serve")
+	fs.StringVar(&f.dir, "profile-dir", "./pprof", "directory the profiles are written to, as <type>-<FunctionName>.pprof")
+	fs.IntVar(&common.SummaryTopN, "top", 0, "print the top N functions of each CPU profile after it is captured")
+	fs.StringVar(&common.SummaryList, "list", "", "print a per-line listing of the functions matching this regular expression after each CPU profile is captured")
+	fs.StringVar(&common.SummaryTagFocus, "tagfocus", "", "restrict -top and -list to samples with a matching pprof label, e.g. stage=process or worker=0")
+	fs.DurationVar(&common.MetricsInterval, "metrics-interval", common.MetricsInterval, "interval at which runtime/metrics are sampled during each operation; 0 disables sampling")
+	return f
+}
+
+// apply sets the profiles the common package captures and creates the directory they are written to, returning an
+// error on an unknown profile type.
+func (f *profilingFlags) apply() error {
+	common.CaptureCPUProfile = false
+	common.CaptureHeapProfile = false
+	for _, profile := range strings.Split(f.profiles, ",") {
+		switch strings.TrimSpace(profile) {
+		case "cpu":
+			common.CaptureCPUProfile = true
+		case "heap":
+			common.CaptureHeapProfile = true
+		case "none", "":
+		default:
+			return fmt.Errorf("invalid -profiles: unknown profile %q (expected cpu, heap or none)", profile)
+		}
+	}
+	if err := os.MkdirAll(f.dir, 0o755); err != nil {
+		return fmt.Errorf("could not create profile directory: %v", err)
+	}
+	common.ProfileExporters = []export.Exporter{export.Filesystem{Dir: f.dir}}
+	return nil
+}
+
+// observeFlags configures the live profiling server, the continuous profiling agent, the profile exporter and the
+// metrics endpoint, which run alongside the operations.
+type observeFlags struct {
+	serveAddr      string
+	serveWait      bool
+	agentDir       string
+	agentInterval  time.Duration
+	agentCPU       time.Duration
+	agentProfiles  string
+	agentRetention int
+	exportURL      string
+	exportService  string
+	exportLabels   string
+	metricsAddr    string
+	metricsPath    string
+	metricsVariant string
+}
+
+// addObserveFlags adds the -serve, -agent, -export and -metrics flags to the flag set.
+func addObserveFlags(fs *flag.FlagSet) *observeFlags {
+	f := &observeFlags{}
+	fs.StringVar(&f.serveAddr, "serve", "", "serve net/http/pprof, expvar counters and a status page on this address while running, e.g. "+live.DefaultAddr)
+	fs.BoolVar(&f.serveWait, "serve-wait", false, "with -serve, keep serving after the run until interrupted")
+	fs.StringVar(&f.agentDir, "agent", "", "continuously write CPU and heap profile snapshots to this directory while running, e.g. "+agent.DefaultDir)
+	fs.DurationVar(&f.agentInterval, "agent-interval", agent.DefaultInterval, "with -agent, time between snapshots")
+	fs.DurationVar(&f.agentCPU, "agent-cpu", agent.DefaultCPUDuration, "with -agent, duration of each CPU profile snapshot")
+	fs.StringVar(&f.agentProfiles, "agent-profiles", "cpu,heap", "with -agent, comma separated profiles to snapshot: cpu, heap, allocs, goroutine, block or mutex")
+	fs.IntVar(&f.agentRetention, "agent-retention", agent.DefaultRetention, "with -agent, number of snapshots of each profile to keep")
+	fs.StringVar(&f.exportURL, "export-url", "", "also upload every captured profile to this profile collector endpoint")
+	fs.StringVar(&f.exportService, "export-service", "golangpprof", "with -export-url, service label attached to uploaded profiles")
+	fs.StringVar(&f.exportLabels, "export-labels", "", "with -export-url, comma separated key=value labels attached to uploaded profiles")
+	fs.StringVar(&f.metricsAddr, "metrics-addr", "", "serve Prometheus metrics of the processed images on this address while running, e.g. "+metrics.DefaultAddr)
+	fs.StringVar(&f.metricsPath, "metrics-path", metrics.DefaultPath, "with -metrics-addr, path the metrics are served on")
+	fs.StringVar(&f.metricsVariant, "metrics-variant", metrics.DefaultVariant, "variant label of the metrics recorded by this run, e.g. a build or configuration name")
+	return f
+}
+
+// start records every wrapped call in the metrics, starts the exporter, agent, metrics server and live server that
+// were requested, and returns a func that stops them in reverse order.
+//
+// Returns:
+// - func(): Stops everything that was started, in reverse order.
+// - error: If anything cannot be started, it returns the error, after stopping what was already started. Otherwise, it returns nil.
+//
+// Notes:
+//   - The agent and the metrics server are started before the live server, so that they keep running while
+//     -serve-wait waits for an interrupt.
+//   - Only one CPU profile can be captured at a time, so when the agent snapshots CPU profiles, the per-operation
+//     CPU profiles of -profiles are turned off. Call start after profilingFlags.apply.
+func (f *observeFlags) start() (func(), error) {
+	stops := []func(){metrics.Default.SetVariant(f.metricsVariant), common.AddCallObserver(observeMetrics)}
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+
+	if f.agentCapturesCPU() && common.CaptureCPUProfile {
+		common.CaptureCPUProfile = false
+		fmt.Println("CPU profiles are captured by -agent, so they are not captured per operation")
+	}
+
+	if f.exportURL != "" {
+		exporter, err := startExporter(f.exportURL, f.exportService, f.exportLabels)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		stops = append(stops, func() { stopExporter(exporter) })
+	}
+
+	if f.agentDir != "" {
+		a, err := agent.Start(agent.Config{
+			Dir:         f.agentDir,
+			Interval:    f.agentInterval,
+			CPUDuration: f.agentCPU,
+			Profiles:    strings.Split(f.agentProfiles, ","),
+			Retention:   f.agentRetention,
+		})
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("could not start profiling agent: %v", err)
+		}
+		stops = append(stops, a.Stop)
+	}
+
+	if f.metricsAddr != "" {
+		server, err := startMetricsServer(f.metricsAddr, f.metricsPath)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		stops = append(stops, func() { stopMetricsServer(server) })
+	}
+
+	if f.serveAddr != "" {
+		server, restore, err := startLiveServer(f.serveAddr)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		stops = append(stops, restore, func() { stopLiveServer(server, f.serveWait) })
+	}
+
+	return stop, nil
+}
+
+// agentCapturesCPU reports whether the agent was requested with CPU snapshots.
+func (f *observeFlags) agentCapturesCPU() bool {
+	if f.agentDir == "" {
+		return false
+	}
+	for _, profile := range strings.Split(f.agentProfiles, ",") {
+		if strings.TrimSpace(profile) == "cpu" {
+			return true
+		}
+	}
+	return false
+}
+
+// startExporter adds an HTTP exporter uploading every captured profile to the collector at url.
+func startExporter(url, service, labelList string) (*export.HTTP, error) {
+	labels := map[string]string{}
+	for _, label := range strings.Split(labelList, ",") {
+		if label == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(label, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -export-labels: %q is not key=value", label)
+		}
+		labels[key] = value
+	}
+	exporter := export.NewHTTP(export.HTTPConfig{URL: url, Service: service, Labels: labels})
+	common.ProfileExporters = append(common.ProfileExporters, exporter)
+	return exporter, nil
+}
+
+// stopExporter waits for the queued profiles to be uploaded and prints the outcome.
+func stopExporter(exporter *export.HTTP) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := exporter.Close(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "could not upload all profiles: %v\n", err)
+	}
+	stats := exporter.Stats()
+	fmt.Printf("Profiles uploaded: %d, failed: %d, dropped: %d, retries: %d\n", stats.Sent, stats.Failed, stats.Dropped, stats.Retries)
+}
+
+// observeMetrics records a wrapped call in the metrics, with the sizes of the image it read and wrote.
+func observeMetrics(name string) func(common.FunctionResult, error) {
+	return func(result common.FunctionResult, err error) {
+		metrics.Default.Observe(metrics.Observation{
+			Operation: name,
+			BytesIn:   result.FileSize,
+			BytesOut:  result.OutputSize,
+			Duration:  time.Duration(result.Duration * float64(time.Millisecond)),
+			Err:       err,
+		})
+	}
+}
+
+// startMetricsServer serves the metrics of the run on addr.
+func startMetricsServer(addr, path string) (*metrics.Server, error) {
+	server, err := metrics.Start(addr, path, metrics.Default)
+	if err != nil {
+		return nil, fmt.Errorf("could not start metrics server: %v", err)
+	}
+	fmt.Printf("Metrics served on http://%s%s\n\n", server.Addr(), path)
+	return server, nil
+}
+
+// stopMetricsServer shuts the metrics server down.
+func stopMetricsServer(server *metrics.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// startLiveServer starts the live profiling server and tracks every wrapped call on its status page.
+//
+// Returns:
+// - *live.Server: The running server.
+// - func(): Stops tracking wrapped calls.
+// - error: If the server cannot be started, it returns the error. Otherwise, it returns nil.
+func startLiveServer(addr string) (*live.Server, func(), error) {
+	server, err := live.Start(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not start live server: %v", err)
+	}
+	restore := common.AddCallObserver(func(name string) func(common.FunctionResult, error) {
+		end := live.Begin(name)
+		return func(result common.FunctionResult, err error) {
+			end(result.FileSize, err)
+		}
+	})
+	fmt.Printf("Live profiling server listening on http://%s/ (go tool pprof http://%s/debug/pprof/heap)\n\n", server.Addr(), server.Addr())
+	return server, restore, nil
+}
+
+// stopLiveServer shuts the live server down, first waiting for an interrupt if wait is set.
+func stopLiveServer(server *live.Server, wait bool) {
+	if wait {
+		fmt.Printf("Still serving on http://%s/, press Ctrl+C to exit\n", server.Addr())
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
+
+// baselineFlags selects the baseline file results are checked against or saved to.
+type baselineFlags struct {
+	path   string
+	check  bool
+	update bool
+}
+
+// addBaselineFlags adds the -baseline, -check-baseline and -update-baseline flags to the flag set.
+func addBaselineFlags(fs *flag.FlagSet) *baselineFlags {
+	f := &baselineFlags{}
+	fs.StringVar(&f.path, "baseline", common.DefaultBaselinePath, "baseline JSON file to compare results against")
+	fs.BoolVar(&f.check, "check-baseline", false, "compare results against the baseline file and exit non-zero on regressions")
+	fs.BoolVar(&f.update, "update-baseline", false, "save the results of this run into the baseline file")
+	return f
+}
+
+// run compares the results against the baseline file and/or saves them to it.
+//
+// Returns:
+// - int: The exit status: 1 on regressions, 2 if the baseline file cannot be loaded or saved, and 0 otherwise.
+func (f *baselineFlags) run(results ...common.FunctionResult) int {
+	if !f.check && !f.update {
+		return 0
+	}
+
+	store, err := common.LoadBaselines(f.path)
+	if err != nil {
+		return fail(fmt.Errorf("could not load baselines: %v", err))
+	}
+
+	regressed := false
+	if f.check {
+		comparisons := store.Compare(results...)
+		common.PrintBaselineReport(comparisons)
+		regressed = common.HasRegressions(comparisons)
+	}
+
+	if f.update {
+		store.Update(results...)
+		if err := store.Save(f.path); err != nil {
+			return fail(fmt.Errorf("could not save baselines: %v", err))
+		}
+		fmt.Println("Baselines saved to " + f.path)
+	}
+
+	if regressed {
+		fmt.Fprintln(os.Stderr, "performance regression detected")
+		return 1
+	}
+	return 0
+}
+
+// reportFlags requests an HTML report of the run.
+type reportFlags struct {
+	enabled bool
+	path    string
+}
+
+// addReportFlags adds the -report and -report-path flags to the flag set.
+func addReportFlags(fs *flag.FlagSet) *reportFlags {
+	f := &reportFlags{}
+	fs.BoolVar(&f.enabled, "report", false, "write a self-contained HTML report of this run, with flame graphs of every captured profile")
+	fs.StringVar(&f.path, "report-path", "", "path of the HTML report (default: <profile dir>/report-<timestamp>.html)")
+	return f
+}
+
+// save writes the HTML report of the session, if one was requested.
+func (f *reportFlags) save(session report.Session, dir string) error {
+	if !f.enabled {
+		return nil
+	}
+	path := f.path
+	if path == "" {
+		path = reportPath(dir, session.Started)
+	}
+	return saveReport(path, session)
+}
+
+// reportPath returns the timestamped report path of a session in the given directory.
+func reportPath(dir string, started time.Time) string {
+	return filepath.Join(dir, filepath.Base(report.DefaultPath(started)))
+}
+
+// saveReport writes the HTML report of the session.
+func saveReport(path string, session report.Session) error {
+	if err := report.Save(path, session); err != nil {
+		return fmt.Errorf("could not save report: %v", err)
+	}
+	fmt.Println("Report saved to " + path)
+	return nil
+}
+
+// cacheFlags configures the result cache shared by the images processed by a command.
+type cacheFlags struct {
+	memory int64
+	dir    string
+	disk   int64
+}
+
+// addCacheFlags adds the -cache-memory, -cache-dir and -cache-disk flags to the flag set.
+func addCacheFlags(fs *flag.FlagSet) *cacheFlags {
+	f := &cacheFlags{}
+	fs.Int64Var(&f.memory, "cache-memory", cache.DefaultMaxMemoryBytes, "size of the results cached in memory, in bytes, or 0 to disable the memory cache")
+	fs.StringVar(&f.dir, "cache-dir", "", "directory results are cached in across runs, in addition to memory (default: no disk cache)")
+	fs.Int64Var(&f.disk, "cache-disk", cache.DefaultMaxDiskBytes, "size of the results cached in -cache-dir, in bytes")
+	return f
+}
+
+// open returns the cache described by the flags.
+//
+// Returns:
+// - *cache.Cache: The cache, or nil if both its memory and disk tiers are disabled.
+// - error: If the sizes are negative, or the directory cannot be opened, it returns the error. Otherwise, it returns nil.
+func (f *cacheFlags) open() (*cache.Cache, error) {
+	if f.memory < 0 || f.disk < 1 {
+		return nil, errors.New("-cache-memory must not be negative and -cache-disk must be positive")
+	}
+	if f.memory == 0 && f.dir == "" {
+		return nil, nil
+	}
+	maxMemory := f.memory
+	if maxMemory == 0 {
+		maxMemory = -1
+	}
+	c, err := cache.New(cache.Config{MaxMemoryBytes: maxMemory, Dir: f.dir, MaxDiskBytes: f.disk})
+	if err != nil {
+		return nil, fmt.Errorf("could not open cache: %v", err)
+	}
+	if f.dir != "" {
+		fmt.Println("Cache: " + f.dir)
+	}
+	return c, nil
+}
+
+// printCacheStats prints the stats of a cache, if there is one.
+func printCacheStats(c *cache.Cache) {
+	if c != nil {
+		cache.PrintStats(c.Stats())
+	}
+}
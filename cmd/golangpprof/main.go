@@ -0,0 +1,105 @@
+// Command golangpprof runs, profiles and compares the image processing functions.
+//
+// Usage:
+//
+//	golangpprof <command> [flags] [arguments]
+//
+// Run golangpprof <command> -h for the flags of each command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// command is a subcommand of the binary.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) int
+}
+
+// commands lists every subcommand, in the order they are printed by usage.
+var commands = []command{
+	{name: "process", usage: "[flags]", summary: "run operations on an image without profiling them", run: runProcess},
+	{name: "profile", usage: "[flags]", summary: "run operations with CPU and heap profiling, and print their results", run: runProfile},
+	{name: "batch", usage: "[flags] <input dir> <output dir>", summary: "process every image in a directory tree through a pipeline of operations", run: runBatch},
+	{name: "watch", usage: "[flags] <input dir> <output dir>", summary: "process images through a pipeline of operations as they appear in a directory", run: runWatch},
+	{name: "serve", usage: "[flags]", summary: "run an HTTP service processing posted images through a pipeline of operations", run: runServe},
+	{name: "compare", usage: "[flags] <old> <new>", summary: "compare two profiles, or two go test -bench outputs with -bench", run: runCompare},
+	{name: "sweep", usage: "[flags]", summary: "run operations across a matrix of worker counts and GOMAXPROCS values", run: runSweep},
+	{name: "run", usage: "[flags] <scenario>", summary: "run a YAML or JSON scenario file describing a profiling session", run: runScenario},
+	{name: "report", usage: "[flags] [profile ...]", summary: "write a self-contained HTML report with flame graphs of captured profiles", run: runReport},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the subcommand named by the first argument, and returns the exit status of the binary.
+//
+// Notes:
+//   - The subcommands return their exit status rather than calling os.Exit, so that their deferred cleanup, such as
+//     flushing uploads and stopping servers, runs before the binary exits.
+func run(args []string) int {
+	if len(args) < 1 {
+		usage(os.Stderr)
+		return 2
+	}
+
+	name := args[0]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage(os.Stdout)
+		return 0
+	}
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage(os.Stderr)
+		return 2
+	}
+	return cmd.run(newFlagSet(cmd), args[1:])
+}
+
+// fail prints the error that stopped a subcommand, and returns exit status 2.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 2
+}
+
+// lookupCommand returns the subcommand with the given name.
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// usage prints the list of subcommands.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: golangpprof <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run golangpprof <command> -h for the flags of a command.")
+}
+
+// newFlagSet returns an empty flag set for the subcommand, whose usage message includes the command's summary.
+// Each subcommand adds its own flags before parsing its arguments.
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: golangpprof %s %s\n\n%s.\n\nFlags:\n", cmd.name, cmd.usage, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/internal/testimage"
+	"github.com/stretchr/testify/assert"
+)
+
+// runCommand runs the named subcommand with the given arguments, and returns its exit status.
+func runCommand(t *testing.T, name string, args ...string) int {
+	cmd, ok := lookupCommand(name)
+	assert.True(t, ok)
+	return cmd.run(newFlagSet(cmd), args)
+}
+
+// TestLookupCommand ensures that every subcommand can be looked up by name, and its flag set is named after it.
+func TestLookupCommand(t *testing.T) {
+	for _, name := range []string{"process", "profile", "batch", "watch", "serve", "compare", "sweep", "run", "report"} {
+		cmd, ok := lookupCommand(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, name, newFlagSet(cmd).Name())
+		assert.Equal(t, flag.ExitOnError, newFlagSet(cmd).ErrorHandling())
+	}
+	_, ok := lookupCommand("steps")
+	assert.False(t, ok)
+}
+
+// TestRun ensures that run returns status 2 for a missing or unknown command, and the status of the command
+// otherwise.
+func TestRun(t *testing.T) {
+	assert.Equal(t, 2, run(nil))
+	assert.Equal(t, 2, run([]string{"steps"}))
+	assert.Equal(t, 0, run([]string{"help"}))
+	assert.Equal(t, 2, run([]string{"compare", "only-one.pprof"}))
+}
+
+// TestProcess ensures that process writes the output of each selected operation to the output directory.
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.jpg")
+	testimage.WriteJPEG(t, input)
+	outputDir := filepath.Join(dir, "outputs")
+
+	assert.Equal(t, 0, runCommand(t, "process", "-input", input, "-output-dir", outputDir, "-ops", "grayscale,sharpen-optimized", "-workers", "3"))
+
+	assert.FileExists(t, filepath.Join(outputDir, "grayscaleProcessed.jpg"))
+	assert.FileExists(t, filepath.Join(outputDir, "sharpenProcessedOptimized.jpg"))
+	assert.NoFileExists(t, filepath.Join(outputDir, "sharpenProcessed.jpg"))
+}
+
+// TestProfileAndReport ensures that profile writes the selected profiles and baselines, and that report renders the
+// profiles it finds.
+func TestProfileAndReport(t *testing.T) {
+	cpu, heap, exporters := common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters
+	defer func() {
+		common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters = cpu, heap, exporters
+	}()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.jpg")
+	testimage.WriteJPEG(t, input)
+	profileDir := filepath.Join(dir, "pprof")
+	baselines := filepath.Join(dir, "baselines.json")
+
+	assert.Equal(t, 0, runCommand(t, "profile", "-input", input, "-output-dir", filepath.Join(dir, "outputs"), "-ops", "grayscale",
+		"-profiles", "heap", "-profile-dir", profileDir, "-metrics-interval", "0", "-update-baseline", "-baseline", baselines))
+
+	assert.False(t, common.CaptureCPUProfile)
+	assert.FileExists(t, filepath.Join(profileDir, "heap-ProcessImageGrayscale.pprof"))
+	assert.NoFileExists(t, filepath.Join(profileDir, "cpu-ProcessImageGrayscale.pprof"))
+	store, err := common.LoadBaselines(baselines)
+	assert.NoError(t, err)
+	assert.Contains(t, store.Baselines, "ProcessImageGrayscale")
+
+	reportPath := filepath.Join(dir, "report.html")
+	assert.Equal(t, 0, runCommand(t, "report", "-dir", profileDir, "-path", reportPath))
+	report, err := os.ReadFile(reportPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(report), "heap-ProcessImageGrayscale.pprof")
+}
+
+// TestProfileWithAgent ensures that profile leaves CPU profiles to the agent when it snapshots them, so that the
+// operation and the agent do not compete for the CPU profiler.
+func TestProfileWithAgent(t *testing.T) {
+	cpu, heap := common.CaptureCPUProfile, common.CaptureHeapProfile
+	defer func() { common.CaptureCPUProfile, common.CaptureHeapProfile = cpu, heap }()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.jpg")
+	testimage.WriteJPEG(t, input)
+	profileDir := filepath.Join(dir, "pprof")
+
+	assert.Equal(t, 0, runCommand(t, "profile", "-input", input, "-output-dir", filepath.Join(dir, "outputs"), "-ops", "grayscale",
+		"-profiles", "cpu,heap", "-profile-dir", profileDir, "-metrics-interval", "0",
+		"-agent", filepath.Join(dir, "agent"), "-agent-profiles", "cpu"))
+
+	assert.False(t, common.CaptureCPUProfile)
+	assert.True(t, common.CaptureHeapProfile)
+	assert.NoFileExists(t, filepath.Join(profileDir, "cpu-ProcessImageGrayscale.pprof"))
+	assert.FileExists(t, filepath.Join(profileDir, "heap-ProcessImageGrayscale.pprof"))
+	assert.Equal(t, []string{"heap"}, withoutProfile([]string{"cpu", "heap"}, "cpu"))
+}
+
+// TestProfileInvalidInput ensures that profile exits with status 1, rather than panicking, when an operation fails
+// on an input that is not a JPEG image.
+func TestProfileInvalidInput(t *testing.T) {
+	cpu, heap, exporters := common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters
+	defer func() {
+		common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters = cpu, heap, exporters
+	}()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.jpg")
+	assert.NoError(t, os.WriteFile(input, []byte("not a jpeg"), 0o644))
+
+	assert.Equal(t, 1, runCommand(t, "profile", "-input", input, "-output-dir", filepath.Join(dir, "outputs"), "-ops", "grayscale",
+		"-profiles", "none", "-profile-dir", filepath.Join(dir, "pprof"), "-metrics-interval", "0"))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runProcess runs the selected operations on the input image, without wrapping or profiling them.
+//
+// Notes:
+// - This is the plain program the profiling in the other commands starts from; it only prints each output path.
+// - The first failing operation exits with status 1.
+func runProcess(fs *flag.FlagSet, args []string) int {
+	opFlags := addOperationFlags(fs, []string{"grayscale"})
+	addWorkersFlag(fs)
+	fs.Parse(args)
+	if err := checkWorkers(); err != nil {
+		return fail(err)
+	}
+	ops, err := opFlags.operations()
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, op := range ops {
+		outputPath := op.OutputPath(opFlags.outputDir)
+		start := time.Now()
+		size, err := op.Func(context.Background(), opFlags.input, outputPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", op.Name, err)
+			return 1
+		}
+		fmt.Printf("%s: %s (%d Bytes, %.0fms)\n", op.Name, outputPath, size, float64(time.Since(start).Microseconds())/1000)
+	}
+	fmt.Println("Success")
+	return 0
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/report"
+)
+
+// runProfile wraps each selected operation with common.WrapFile, prints the results table, and optionally
+// writes an HTML report and checks or updates the baselines.
+//
+// Notes:
+//   - The results table pairs each serial operation with its optimized variant, so gains are only shown for the
+//     optimized operations whose serial operation was also run.
+//   - The first failing operation exits with status 1, e.g. for an input that is not a JPEG image.
+func runProfile(fs *flag.FlagSet, args []string) int {
+	opFlags := addOperationFlags(fs, imageprocessing.OperationNames())
+	addWorkersFlag(fs)
+	profiling := addProfilingFlags(fs)
+	observe := addObserveFlags(fs)
+	baselines := addBaselineFlags(fs)
+	reportOptions := addReportFlags(fs)
+	fs.Parse(args)
+	if err := checkWorkers(); err != nil {
+		return fail(err)
+	}
+	if err := profiling.apply(); err != nil {
+		return fail(err)
+	}
+	ops, err := opFlags.operations()
+	if err != nil {
+		return fail(err)
+	}
+
+	session := report.Session{Title: "golangpprof report", Started: time.Now()}
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	defer stop()
+
+	// PrintResults takes one result per slot of imageprocessing.Operations
+	var slots [4]common.FunctionResult
+	for _, op := range ops {
+		fmt.Println("Profiling: " + common.FunctionName(op.Func) + "()")
+		result, err := common.WrapFile(op.Func)(context.Background(), opFlags.input, op.OutputPath(opFlags.outputDir))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", op.Name, err)
+			return 1
+		}
+		fmt.Print("  ...Complete\n\n")
+		slots[imageprocessing.OperationIndex(op.Name)] = result
+		session.Results = append(session.Results, result)
+	}
+
+	common.PrintResults(slots[0], slots[1], slots[2], slots[3])
+	if err := reportOptions.save(session, profiling.dir); err != nil {
+		return fail(err)
+	}
+	return baselines.run(session.Results...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/mwiater/golangpprof/report"
+)
+
+// runReport writes an HTML report with a flame graph of each profile given as an argument, or of every profile in
+// -dir if none are given.
+//
+// Notes:
+//   - Unlike the reports of profile -report, the report has no results table, since the profiles are all that is
+//     kept of earlier runs.
+func runReport(fs *flag.FlagSet, args []string) int {
+	dir := fs.String("dir", "./pprof", "directory whose .pprof files are reported when no profiles are given")
+	path := fs.String("path", "", "path of the HTML report (default: <dir>/report-<timestamp>.html)")
+	title := fs.String("title", "golangpprof report", "title of the HTML report")
+	fs.Parse(args)
+
+	profiles := fs.Args()
+	if len(profiles) == 0 {
+		matches, err := filepath.Glob(filepath.Join(*dir, "*.pprof"))
+		if err != nil {
+			return fail(fmt.Errorf("could not list profiles: %v", err))
+		}
+		if len(matches) == 0 {
+			return fail(fmt.Errorf("no profiles found in %s", *dir))
+		}
+		profiles = matches
+	}
+
+	session := report.Session{Title: *title, Started: time.Now(), Profiles: profiles}
+	if *path == "" {
+		*path = reportPath(*dir, session.Started)
+	}
+	if err := saveReport(*path, session); err != nil {
+		return fail(err)
+	}
+	return 0
+}
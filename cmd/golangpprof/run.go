@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/report"
+	"github.com/mwiater/golangpprof/scenario"
+)
+
+// runScenario runs a scenario file end to end: its results tables, profiles, baselines and report.
+//
+// Notes:
+//   - -check-baseline and -update-baseline are combined with the scenario's own baseline settings, so a CI job can
+//     check any scenario without editing it.
+//   - Each variant's operations are recorded in the metrics under the variant's name, rather than -metrics-variant.
+//   - When -agent captures CPU snapshots, the scenario's per-operation CPU profiles are turned off, as only one CPU
+//     profile can be captured at a time.
+func runScenario(fs *flag.FlagSet, args []string) int {
+	check := fs.Bool("check-baseline", false, "also compare results against the scenario's baseline file and exit non-zero on regressions")
+	update := fs.Bool("update-baseline", false, "also save the results of this run into the scenario's baseline file")
+	observe := addObserveFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fail(errors.New("run requires a scenario file"))
+	}
+
+	s, err := scenario.Load(fs.Arg(0))
+	if err != nil {
+		return fail(fmt.Errorf("could not load scenario: %v", err))
+	}
+	if s.Description != "" {
+		fmt.Println(s.Description)
+		fmt.Println()
+	}
+
+	if observe.agentCapturesCPU() {
+		s.Profiles = withoutProfile(s.Profiles, "cpu")
+	}
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	session := report.Session{Title: s.Name, Started: time.Now()}
+	results, err := s.Run()
+	stop()
+	if err != nil {
+		return fail(fmt.Errorf("could not run scenario: %v", err))
+	}
+	for _, r := range results {
+		session.Results = append(session.Results, r.Results...)
+	}
+
+	reportOptions := &reportFlags{enabled: s.Report, path: s.ReportPath}
+	if err := reportOptions.save(session, s.ProfileDir); err != nil {
+		return fail(err)
+	}
+
+	baselines := &baselineFlags{path: s.Baseline.Path, check: s.Baseline.Check || *check, update: s.Baseline.Update || *update}
+	if baselines.path == "" {
+		baselines.path = common.DefaultBaselinePath
+	}
+	return baselines.run(s.BaselineResults(results)...)
+}
+
+// withoutProfile returns the profile types without the given one.
+func withoutProfile(profiles []string, profile string) []string {
+	var kept []string
+	for _, p := range profiles {
+		if p != profile {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mwiater/golangpprof/jobs"
+	"github.com/mwiater/golangpprof/service"
+)
+
+// runServe runs the image processing service until it is interrupted.
+//
+// Notes:
+//   - Requests are not profiled individually, as CPU profiles cannot overlap. Use -serve or -agent to profile the
+//     service while it handles requests.
+//   - An interrupt stops accepting requests, and waits up to the request timeout for those in progress. Running jobs
+//     are interrupted, and processed again from the start on the next run with the same -jobs-dir.
+//   - With -grpc-addr, the same operations are also served over gRPC, sharing the limits, cache and metrics of the
+//     HTTP routes.
+func runServe(fs *flag.FlagSet, args []string) int {
+	addr := fs.String("addr", service.DefaultAddr, "address the service listens on")
+	grpcAddr := fs.String("grpc-addr", "", "address the gRPC API of the service listens on (default: no gRPC API)")
+	maxBytes := fs.Int64("max-bytes", service.DefaultMaxBytes, "largest request body accepted, in bytes")
+	maxPixels := fs.Int64("max-pixels", service.DefaultMaxPixels, "largest image accepted, in pixels")
+	timeout := fs.Duration("timeout", service.DefaultTimeout, "time allowed to process each request or job")
+	jobsDir := fs.String("jobs-dir", jobs.DefaultDir, `directory the jobs submitted to /jobs are persisted in, or "none" to disable /jobs`)
+	jobConcurrency := fs.Int("job-concurrency", 1, "number of jobs processed at the same time")
+	maxQueued := fs.Int("max-queued", jobs.DefaultMaxQueued, "number of jobs that can wait to be processed before submissions are refused")
+	jobRetention := fs.Duration("job-retention", jobs.DefaultRetention, "how long finished jobs and their results are kept, or a negative value to keep them")
+	maxFinished := fs.Int("max-finished", jobs.DefaultMaxFinished, "number of finished jobs and results kept, the oldest being removed first, or a negative value to keep them all")
+	webhookHosts := fs.String("webhook-hosts", "", "comma separated hosts job webhooks may be posted to although they are loopback, private or link-local addresses, which are refused otherwise")
+	cacheOptions := addCacheFlags(fs)
+	addWorkersFlag(fs)
+	observe := addObserveFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return fail(errors.New("serve takes no arguments"))
+	}
+	if err := checkWorkers(); err != nil {
+		return fail(err)
+	}
+	if *maxBytes < 1 || *maxPixels < 1 || *timeout <= 0 || *jobConcurrency < 1 || *maxQueued < 1 {
+		return fail(errors.New("-max-bytes, -max-pixels, -timeout, -job-concurrency and -max-queued must be positive"))
+	}
+	if *jobRetention == 0 || *maxFinished == 0 {
+		return fail(errors.New("-job-retention and -max-finished must not be zero"))
+	}
+	c, err := cacheOptions.open()
+	if err != nil {
+		return fail(err)
+	}
+
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	defer stop()
+
+	cfg := service.Config{MaxBytes: *maxBytes, MaxPixels: *maxPixels, Timeout: *timeout, Cache: c, WebhookHosts: splitList(*webhookHosts)}
+	routes := "POST /process?ops=..., GET /metrics"
+	if *jobsDir != "none" {
+		queue, err := jobs.Open(jobs.Config{
+			Dir:         *jobsDir,
+			Process:     service.JobProcessor(cfg),
+			Concurrency: *jobConcurrency,
+			MaxQueued:   *maxQueued,
+			Retention:   *jobRetention,
+			MaxFinished: *maxFinished,
+			Client:      service.WebhookClient(cfg),
+		})
+		if err != nil {
+			return fail(fmt.Errorf("could not open job queue: %v", err))
+		}
+		defer closeJobs(queue, *timeout)
+		cfg.Jobs = queue
+		routes += ", POST /jobs?ops=..."
+		fmt.Println("Jobs: " + *jobsDir)
+	}
+
+	server, err := service.Start(*addr, cfg)
+	if err != nil {
+		return fail(fmt.Errorf("could not start service: %v", err))
+	}
+	var grpcServer *service.GRPCServer
+	if *grpcAddr != "" {
+		grpcServer, err = service.StartGRPC(*grpcAddr, cfg)
+		if err != nil {
+			server.Shutdown(context.Background())
+			return fail(fmt.Errorf("could not start gRPC service: %v", err))
+		}
+		fmt.Printf("Serving gRPC on %s (golangpprof.service.ImageProcessor)\n", grpcServer.Addr())
+	}
+	fmt.Printf("Serving on http://%s/ (%s), press Ctrl+C to stop\n", server.Addr(), routes)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	<-ctx.Done()
+	cancel()
+
+	fmt.Println("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *timeout+time.Second)
+	defer cancelShutdown()
+	if grpcServer != nil {
+		if err := grpcServer.Shutdown(shutdownCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "could not shut down gRPC service: %v\n", err)
+		}
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fail(fmt.Errorf("could not shut down service: %v", err))
+	}
+	printCacheStats(cfg.Cache)
+	return 0
+}
+
+// closeJobs stops the job queue, interrupting the running jobs so that they are processed again on the next start,
+// and waits for the webhooks in flight.
+func closeJobs(queue *jobs.Queue, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := queue.Close(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "could not close job queue: %v\n", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/mwiater/golangpprof/report"
+	"github.com/mwiater/golangpprof/sweep"
+)
+
+// runSweep runs the selected operations across the requested worker counts and GOMAXPROCS values, prints the
+// scaling table and saves the scaling chart.
+func runSweep(fs *flag.FlagSet, args []string) int {
+	opFlags := addOperationFlags(fs, []string{"grayscale-optimized", "sharpen-optimized"})
+	workersList := fs.String("workers", "", "comma separated worker counts to sweep (default: powers of two up to 2x NumCPU)")
+	procsList := fs.String("procs", "", "comma separated GOMAXPROCS values to sweep (default: powers of two up to NumCPU)")
+	repeats := fs.Int("repeats", 3, "number of runs per sweep point; the median is recorded")
+	svgPath := fs.String("svg", "./pprof/sweep.svg", "path where the sweep scaling chart will be saved")
+	observe := addObserveFlags(fs)
+	reportOptions := addReportFlags(fs)
+	fs.Parse(args)
+
+	workers := sweep.DefaultCounts(runtime.NumCPU() * 2)
+	procs := sweep.DefaultCounts(runtime.NumCPU())
+	var err error
+	if *workersList != "" {
+		if workers, err = sweep.ParseCounts(*workersList); err != nil {
+			return fail(fmt.Errorf("invalid -workers: %v", err))
+		}
+	}
+	if *procsList != "" {
+		if procs, err = sweep.ParseCounts(*procsList); err != nil {
+			return fail(fmt.Errorf("invalid -procs: %v", err))
+		}
+	}
+
+	selected, err := opFlags.operations()
+	if err != nil {
+		return fail(err)
+	}
+	var ops []sweep.Operation
+	for _, op := range selected {
+		ops = append(ops, sweep.Operation{Name: op.Name, Fn: op.Func, OutputPath: op.OutputPath(opFlags.outputDir)})
+	}
+
+	session := report.Session{Title: "golangpprof sweep report", Started: time.Now()}
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	defer stop()
+
+	points, err := sweep.Run(ops, opFlags.input, sweep.Config{Workers: workers, MaxProcs: procs, Repeats: *repeats})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sweep failed: %v\n", err)
+		return 1
+	}
+
+	sweep.PrintTable(points)
+	if err := sweep.SaveSVG(*svgPath, points); err != nil {
+		return fail(fmt.Errorf("could not save sweep chart: %v", err))
+	}
+	fmt.Println("Scaling chart saved to " + *svgPath)
+
+	session.Sweep = points
+	if err := reportOptions.save(session, "./pprof"); err != nil {
+		return fail(err)
+	}
+	return 0
+}
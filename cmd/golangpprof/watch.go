@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/batch"
+	"github.com/mwiater/golangpprof/watch"
+)
+
+// runWatch processes the images already in a directory tree and then every image that appears in it, until it is
+// interrupted, logging the outcome and time of each image.
+//
+// Notes:
+//   - The session is not wrapped with common.Wrap, as a watcher runs for hours and the profiles, runtime metrics and
+//     stage timings of a single call would grow for as long. Each image is logged and recorded in the metrics as it
+//     completes instead, and -serve or -agent profile the watcher while it runs.
+//   - The watcher exits with status 1 if any image failed.
+func runWatch(fs *flag.FlagSet, args []string) int {
+	batchOptions := addBatchFlags(fs)
+	settle := fs.Duration("settle", watch.DefaultSettle, "how long a new image's size must stay unchanged before it is processed")
+	poll := fs.Bool("poll", false, "poll the directory instead of using inotify, e.g. on network filesystems")
+	pollInterval := fs.Duration("poll-interval", watch.DefaultPollInterval, "time between two scans of the directory when polling")
+	observe := addObserveFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return fail(errors.New("watch requires an input and an output directory"))
+	}
+	if *settle <= 0 || *pollInterval <= 0 {
+		return fail(errors.New("-settle and -poll-interval must be positive"))
+	}
+	cfg, err := batchOptions.config(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return fail(err)
+	}
+	if cfg.Manifest != nil {
+		defer cfg.Manifest.Close()
+	}
+
+	var mu sync.Mutex
+	cfg.OnItem = func(item batch.Item) {
+		mu.Lock()
+		defer mu.Unlock()
+		printItem(time.Now().Format("15:04:05")+" ", item)
+	}
+
+	watcher, err := watch.New(watch.Config{Batch: cfg, Settle: *settle, Poll: *poll, PollInterval: *pollInterval})
+	if err != nil {
+		return fail(fmt.Errorf("could not watch %s: %v", cfg.InputDir, err))
+	}
+
+	stop, err := observe.start()
+	if err != nil {
+		return fail(err)
+	}
+	defer stop()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	fmt.Printf("Watching %s (%s), press Ctrl+C to stop\n", cfg.InputDir, watcher.Method())
+	summary, err := watcher.Run(ctx)
+	if err != nil {
+		return fail(fmt.Errorf("could not watch %s: %v", cfg.InputDir, err))
+	}
+
+	batch.PrintSummary(summary)
+	printCacheStats(cfg.Cache)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
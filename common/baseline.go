@@ -0,0 +1,242 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// DefaultBaselinePath is the baseline store checked into the repository.
+	DefaultBaselinePath = "./baselines/baselines.json"
+
+	// DefaultTolerance is the allowed slowdown (as a fraction) for functions without their own tolerance.
+	DefaultTolerance = 0.10
+)
+
+// Baseline is a stored measurement of a wrapped function that later runs are compared against.
+type Baseline struct {
+	FileSize       int64     `json:"fileSize"`
+	Duration       float64   `json:"durationMs"`
+	BytesAllocated uint64    `json:"bytesAllocated"`
+	Allocations    uint64    `json:"allocations"`
+	Throughput     float64   `json:"throughputGBPerDay"`
+	Tolerance      float64   `json:"tolerance,omitempty"`
+	RecordedAt     time.Time `json:"recordedAt"`
+}
+
+// BaselineStore holds the baselines for every wrapped function, keyed by function name.
+type BaselineStore struct {
+	DefaultTolerance float64             `json:"defaultTolerance"`
+	Baselines        map[string]Baseline `json:"baselines"`
+}
+
+// BaselineComparison is the result of comparing a FunctionResult against its stored baseline.
+type BaselineComparison struct {
+	FunctionName string
+	Old          Baseline
+	New          Baseline
+	HasBaseline  bool
+	Tolerance    float64
+	Regressions  []string
+}
+
+// Regressed reports whether the comparison exceeded the function's tolerance.
+func (c BaselineComparison) Regressed() bool {
+	return len(c.Regressions) > 0
+}
+
+// NewBaselineStore returns an empty store using DefaultTolerance.
+func NewBaselineStore() *BaselineStore {
+	return &BaselineStore{
+		DefaultTolerance: DefaultTolerance,
+		Baselines:        map[string]Baseline{},
+	}
+}
+
+// LoadBaselines reads a baseline store from a JSON file.
+//
+// Parameters:
+// - path: Path to the baseline JSON file.
+//
+// Returns:
+// - *BaselineStore: The loaded store. If the file does not exist yet, an empty store is returned.
+// - error: If the file cannot be read or parsed, it returns the error. Otherwise, it returns nil.
+func LoadBaselines(path string) (*BaselineStore, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewBaselineStore(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store := NewBaselineStore()
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("could not parse baselines %s: %w", path, err)
+	}
+	if store.Baselines == nil {
+		store.Baselines = map[string]Baseline{}
+	}
+	return store, nil
+}
+
+// Save writes the baseline store to a JSON file, creating its directory if needed.
+//
+// Parameters:
+// - path: Path to the baseline JSON file.
+//
+// Returns:
+// - error: If any error occurs while writing, it returns the error. Otherwise, it returns nil.
+func (s *BaselineStore) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Update records the given results as the new baselines. Per-function tolerances already in the store are kept.
+//
+// Parameters:
+// - results: FunctionResults to store. Empty placeholder results are skipped.
+func (s *BaselineStore) Update(results ...FunctionResult) {
+	for _, result := range results {
+		if result.FunctionName == "" {
+			continue
+		}
+		baseline := baselineFromResult(result)
+		baseline.Tolerance = s.Baselines[result.FunctionName].Tolerance
+		s.Baselines[result.FunctionName] = baseline
+	}
+}
+
+// Compare checks the given results against their stored baselines.
+//
+// Parameters:
+// - results: FunctionResults to compare. Empty placeholder results are skipped.
+//
+// Returns:
+// - []BaselineComparison: One comparison per result, in the order given.
+//
+// Notes:
+// - A result regresses when its execution time or bytes allocated grow by more than the tolerance.
+// - Allocation figures of zero in the baseline are treated as "not recorded" and are not compared.
+func (s *BaselineStore) Compare(results ...FunctionResult) []BaselineComparison {
+	var comparisons []BaselineComparison
+	for _, result := range results {
+		if result.FunctionName == "" {
+			continue
+		}
+		old, ok := s.Baselines[result.FunctionName]
+		comparison := BaselineComparison{
+			FunctionName: result.FunctionName,
+			Old:          old,
+			New:          baselineFromResult(result),
+			HasBaseline:  ok,
+			Tolerance:    s.tolerance(old),
+		}
+		if ok {
+			if exceeds(old.Duration, comparison.New.Duration, comparison.Tolerance) {
+				comparison.Regressions = append(comparison.Regressions, "time")
+			}
+			if exceeds(float64(old.BytesAllocated), float64(comparison.New.BytesAllocated), comparison.Tolerance) {
+				comparison.Regressions = append(comparison.Regressions, "allocations")
+			}
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	return comparisons
+}
+
+// tolerance returns the tolerance that applies to a baseline.
+func (s *BaselineStore) tolerance(b Baseline) float64 {
+	if b.Tolerance > 0 {
+		return b.Tolerance
+	}
+	if s.DefaultTolerance > 0 {
+		return s.DefaultTolerance
+	}
+	return DefaultTolerance
+}
+
+// exceeds reports whether new is more than tolerance above old. An old value of zero is never exceeded.
+func exceeds(old, new, tolerance float64) bool {
+	if old <= 0 {
+		return false
+	}
+	return new > old*(1+tolerance)
+}
+
+// baselineFromResult converts a FunctionResult into a Baseline recorded now.
+func baselineFromResult(result FunctionResult) Baseline {
+	return Baseline{
+		FileSize:       result.FileSize,
+		Duration:       result.Duration,
+		BytesAllocated: result.BytesAllocated,
+		Allocations:    result.Allocations,
+		Throughput:     ThroughputPerDay(result.FileSize, result.Duration),
+		RecordedAt:     time.Now().UTC(),
+	}
+}
+
+// HasRegressions reports whether any of the comparisons regressed.
+func HasRegressions(comparisons []BaselineComparison) bool {
+	for _, c := range comparisons {
+		if c.Regressed() {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintBaselineReport prints old vs new time, allocations and throughput for each comparison in a tabulated format.
+//
+// Parameters:
+// - comparisons: The comparisons returned by BaselineStore.Compare.
+func PrintBaselineReport(comparisons []BaselineComparison) {
+	sorted := append([]BaselineComparison(nil), comparisons...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Regressed() && !sorted[j].Regressed() })
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Function", "Execution Time", "Bytes Allocated", "Allocations", "Throughput (GB/day)", "Tolerance", "Status")
+	for _, c := range sorted {
+		if !c.HasBaseline {
+			fmt.Fprintf(w, "%s\t%.0fms\t%d\t%d\t%.2f\t%s\t%s\n", c.FunctionName, c.New.Duration, c.New.BytesAllocated, c.New.Allocations, c.New.Throughput, "-", "(no baseline)")
+			continue
+		}
+		status := "ok"
+		if c.Regressed() {
+			status = "REGRESSION"
+			for _, r := range c.Regressions {
+				status += " " + r
+			}
+		}
+		fmt.Fprintf(w, "%s\t%.0fms -> %.0fms (%s)\t%d -> %d (%s)\t%d -> %d (%s)\t%.2f -> %.2f (%s)\t%.0f%%\t%s\n",
+			c.FunctionName,
+			c.Old.Duration, c.New.Duration, percentChange(c.Old.Duration, c.New.Duration),
+			c.Old.BytesAllocated, c.New.BytesAllocated, percentChange(float64(c.Old.BytesAllocated), float64(c.New.BytesAllocated)),
+			c.Old.Allocations, c.New.Allocations, percentChange(float64(c.Old.Allocations), float64(c.New.Allocations)),
+			c.Old.Throughput, c.New.Throughput, percentChange(c.Old.Throughput, c.New.Throughput),
+			c.Tolerance*100, status)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// percentChange formats the relative change from old to new, or "n/a" when old is zero.
+func percentChange(old, new float64) string {
+	if old == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", (new-old)/old*100)
+}
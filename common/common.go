@@ -1,7 +1,10 @@
 package common
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"image"
 	"os"
 	"reflect"
 	"runtime"
@@ -11,17 +14,44 @@ import (
 	"time"
 
 	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/runtimestats"
 )
 
 // FunctionResult is a structure representing the result from an image processing function.
 type FunctionResult struct {
 	FunctionName string
 	FileSize     int64
-	Duration     float64
+	// OutputSize is the number of bytes the call wrote, when known, e.g. the size of the processed image file.
+	OutputSize     int64
+	Duration       float64
+	BytesAllocated uint64
+	Allocations    uint64
+
+	// Pixels is the number of pixels in the input image, for per-pixel allocation figures.
+	Pixels int64
+	// PeakHeap is the largest heap in use, in bytes, seen during the call. NumGC is the number of GC cycles it triggered.
+	PeakHeap uint64
+	NumGC    uint32
+
+	CPUProfilePath  string
+	HeapProfilePath string
+
+	// Stages breaks Duration down into file stat, decode, pixel processing and encode.
+	Stages imageprocessing.StageTimings
+
+	// Metrics is the runtime/metrics time series sampled during the call: heap size, goroutines, GC activity,
+	// scheduler latencies and CPU time by class.
+	Metrics runtimestats.Series
 }
 
+// CaptureHeapProfile enables writing a heap profile to ./pprof/heap-<FunctionName>.pprof after each wrapped call.
+var CaptureHeapProfile = false
+
+// MetricsInterval is the interval at which runtime/metrics are sampled during each wrapped call. Zero disables sampling.
+var MetricsInterval = runtimestats.DefaultInterval
+
 // WrappedImageProcessingFunction is a function signature for image processing functions that can be wrapped by the TimerWrapper.
-type WrappedImageProcessingFunction func(string, string) (int64, error)
+type WrappedImageProcessingFunction func(context.Context, string, string) (int64, error)
 
 // TimerWrapper takes an image processing function and wraps it to measure and report its execution time and CPU profiling.
 //
@@ -30,48 +60,140 @@ type WrappedImageProcessingFunction func(string, string) (int64, error)
 //
 // Returns:
 // - A new function with the same signature as the input function, but returns a FunctionResult instead of the usual (int64, error).
+//
+// Dependencies:
+// - WrapFile: Profiles the call. TimerWrapper is a convenience for the file based functions of the imageprocessing package.
+//
+// Notes:
+//   - If fn fails, or the CPU profile cannot be started, TimerWrapper panics. Use WrapFile to handle the error
+//     instead. Profiles that cannot be exported are reported on stderr, and their paths are left empty.
 func TimerWrapper(fn WrappedImageProcessingFunction) func(string, string) FunctionResult {
+	wrapped := WrapFile(fn)
 	return func(inputPath string, outputPath string) FunctionResult {
-		functionName := getFunctionName(fn)
-		fmt.Println("Profiling: " + functionName + "()")
-		cpuprofile1 := "./pprof/cpu-" + functionName + ".pprof"
-		f, err := os.Create(cpuprofile1)
+		result, err := wrapped(context.Background(), inputPath, outputPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "could not create CPU profile: %v\n", err)
 			panic(err)
 		}
-		if err := pprof.StartCPUProfile(f); err != nil {
-			fmt.Fprintf(os.Stderr, "could not start CPU profile: %v\n", err)
-			panic(err)
+		return result
+	}
+}
+
+// WrapFile wraps a file based image processing function with Wrap, named after the function.
+//
+// Parameters:
+// - fn: The image processing function to be wrapped.
+//
+// Returns:
+//   - A function running fn on the input path and writing to the output path, which returns the FunctionResult of the
+//     call and the error of fn or of starting the CPU profile, if any. Profiles that cannot be exported are
+//     reported on stderr, and their paths are left empty.
+//
+// Notes:
+//   - The result's FileSize is the size returned by fn, its OutputSize is the size of the file written to outputPath
+//     and its Pixels are read from the input image's header.
+func WrapFile(fn WrappedImageProcessingFunction) func(ctx context.Context, inputPath, outputPath string) (FunctionResult, error) {
+	wrapped := Wrap(FunctionName(fn), func(ctx context.Context, paths [2]string) (fileSizes, error) {
+		size, err := fn(ctx, paths[0], paths[1])
+		if err != nil {
+			return fileSizes{input: size}, err
+		}
+		sizes := fileSizes{input: size}
+		if info, err := os.Stat(paths[1]); err == nil {
+			sizes.output = info.Size()
 		}
-		start := time.Now()
-		fileSize, err := fn(inputPath, outputPath)
+		return sizes, nil
+	}, func(_ [2]string, sizes fileSizes) int64 {
+		return sizes.input
+	})
+
+	return func(ctx context.Context, inputPath, outputPath string) (FunctionResult, error) {
+		_, result, err := wrapped(ctx, [2]string{inputPath, outputPath})
 		if err != nil {
-			panic(err)
+			return result, err
+		}
+		if result.Pixels, err = imagePixels(inputPath); err != nil {
+			fmt.Fprintf(os.Stderr, "could not read image dimensions: %v\n", err)
 		}
-		elapsed := time.Since(start)
-		duration := float64(elapsed.Milliseconds())
+		return result, nil
+	}
+}
 
-		pprof.StopCPUProfile()
-		fmt.Println("  ...Complete")
-		fmt.Println()
+// fileSizes are the sizes returned by a file based function and of the file it wrote.
+type fileSizes struct {
+	input  int64
+	output int64
+}
 
-		return FunctionResult{
-			FunctionName: functionName,
-			FileSize:     fileSize,
-			Duration:     duration,
-		}
+// OutputBytes returns the size of the written file, for Wrap to record as the result's OutputSize.
+func (s fileSizes) OutputBytes() int64 {
+	return s.output
+}
+
+// imagePixels returns the number of pixels in an image, reading only its header.
+//
+// Parameters:
+// - path: Path of the image.
+//
+// Returns:
+// - int64: The width times the height of the image.
+// - error: If the image cannot be opened or its format is not recognised, it returns the error. Otherwise, it returns nil.
+func imagePixels(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, err
+	}
+	return int64(config.Width) * int64(config.Height), nil
+}
+
+// BytesPerPixel returns the bytes allocated by the call per pixel of the input image, or 0 if the pixel count is unknown.
+func (r FunctionResult) BytesPerPixel() float64 {
+	if r.Pixels <= 0 {
+		return 0
+	}
+	return float64(r.BytesAllocated) / float64(r.Pixels)
+}
+
+// AllocsPerPixel returns the number of allocations made by the call per pixel of the input image, or 0 if the pixel
+// count is unknown.
+func (r FunctionResult) AllocsPerPixel() float64 {
+	if r.Pixels <= 0 {
+		return 0
+	}
+	return float64(r.Allocations) / float64(r.Pixels)
+}
+
+// heapProfile captures a heap profile.
+//
+// Returns:
+// - []byte: The profile, in the gzipped protobuf format.
+// - error: If any error occurs while writing, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - A GC is run first so that the in-use figures are up to date. The alloc_space and alloc_objects
+//     figures are cumulative since the program started, not just for the wrapped call.
+func heapProfile() ([]byte, error) {
+	var buf bytes.Buffer
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(&buf); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
 }
 
-// getFunctionName retrieves the name of the provided function.
+// FunctionName retrieves the name of the provided function, e.g. ProcessImageGrayscale, as wrapped calls are named.
 //
 // Parameters:
 // - i: The interface whose underlying function name is to be retrieved.
 //
 // Returns:
 // - string: The name of the function.
-func getFunctionName(i interface{}) string {
+func FunctionName(i interface{}) string {
 	ptr := runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 	return strings.Split(ptr, ".")[len(strings.Split(ptr, "."))-1]
 }
@@ -79,35 +201,148 @@ func getFunctionName(i interface{}) string {
 // PrintResults prints out the results of the image processing functions in a tabulated format.
 //
 // Parameters:
-// - result1, result2, result3, result4: FunctionResults to be printed.
+// - result1, result2, result3, result4: FunctionResults to be printed. Pass an empty FunctionResult for any that were not run.
+//
+// Notes:
+//   - Bytes/Pixel and Allocs/Pixel divide the call's allocations by the number of pixels in the input image, which
+//     exposes per-pixel allocations in the processing loops.
+//   - Performance gains are computed end to end, and for the pixel processing stage alone, which excludes
+//     the file stat, decode and encode stages the baseline and optimized functions share.
 func PrintResults(result1 FunctionResult, result2 FunctionResult, result3 FunctionResult, result4 FunctionResult) {
 	fmt.Println()
 	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
-	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", "Function", "File Size", "Execution Time", "Performance Gain", "Concurrency")
-	fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%d\n", result1.FunctionName, result1.FileSize, result1.Duration, "(baseline)", 1)
-	if (result2 != FunctionResult{}) {
-		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%.2fx\t%d\n", result2.FunctionName, result2.FileSize, result2.Duration, result1.Duration/result2.Duration, imageprocessing.NumRoutines)
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Function", "File Size", "Execution Time", "Performance Gain", "Processing Time", "Processing Gain", "Bytes/Pixel", "Allocs/Pixel", "Concurrency")
+	if result1.FunctionName != "" {
+		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%.0fms\t%s\t%.1f\t%.2f\t%d\n", result1.FunctionName, result1.FileSize, result1.Duration, "(baseline)", processingTime(result1), "(baseline)", result1.BytesPerPixel(), result1.AllocsPerPixel(), 1)
 	}
-	if (result3 != FunctionResult{}) {
-		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%d\n", result3.FunctionName, result3.FileSize, result3.Duration, "(baseline)", 1)
+	if result2.FunctionName != "" {
+		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%.0fms\t%s\t%.1f\t%.2f\t%d\n", result2.FunctionName, result2.FileSize, result2.Duration, performanceGain(result1, result2), processingTime(result2), processingGain(result1, result2), result2.BytesPerPixel(), result2.AllocsPerPixel(), imageprocessing.NumRoutines)
 	}
-	if (result4 != FunctionResult{}) {
-		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%.2fx\t%d\n", result4.FunctionName, result4.FileSize, result4.Duration, result3.Duration/result4.Duration, imageprocessing.NumRoutines)
+	if result3.FunctionName != "" {
+		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%.0fms\t%s\t%.1f\t%.2f\t%d\n", result3.FunctionName, result3.FileSize, result3.Duration, "(baseline)", processingTime(result3), "(baseline)", result3.BytesPerPixel(), result3.AllocsPerPixel(), 1)
+	}
+	if result4.FunctionName != "" {
+		fmt.Fprintf(w, "%s\t%d Bytes\t%.0fms\t%s\t%.0fms\t%s\t%.1f\t%.2f\t%d\n", result4.FunctionName, result4.FileSize, result4.Duration, performanceGain(result3, result4), processingTime(result4), processingGain(result3, result4), result4.BytesPerPixel(), result4.AllocsPerPixel(), imageprocessing.NumRoutines)
 	}
 	w.Flush()
 
-	if (result2 != FunctionResult{} && result3 != FunctionResult{} && result4 != FunctionResult{}) {
+	if result1.FunctionName != "" && result2.FunctionName != "" && result3.FunctionName != "" && result4.FunctionName != "" {
 		fmt.Println()
 		totalBytesProcessedBaseline := result1.FileSize + result3.FileSize
 		totalBytesOptimizedOptimized := result2.FileSize + result4.FileSize
 		totalTimeBaseline := result1.Duration + result3.Duration
 		totalTimeOptimized := result2.Duration + result4.Duration
 
-		bytesPerMillisecondBaseline := float64(totalBytesProcessedBaseline) / totalTimeBaseline
-		bytesPerMillisecondOptimized := float64(totalBytesOptimizedOptimized) / totalTimeOptimized
-
-		fmt.Printf("Max Baseline Throughput Per Day (GB):  %.2f\n", (bytesPerMillisecondBaseline*86400000)/1073741824)
-		fmt.Printf("Max Optimized Throughput Per Day (GB): %.2f\n", (bytesPerMillisecondOptimized*86400000)/1073741824)
+		fmt.Printf("Max Baseline Throughput Per Day (GB):  %.2f\n", ThroughputPerDay(totalBytesProcessedBaseline, totalTimeBaseline))
+		fmt.Printf("Max Optimized Throughput Per Day (GB): %.2f\n", ThroughputPerDay(totalBytesOptimizedOptimized, totalTimeOptimized))
 	}
 	fmt.Println()
+
+	PrintStageBreakdown(result1, result2, result3, result4)
+	PrintRuntimeSummary(result1, result2, result3, result4)
+}
+
+// PrintStageBreakdown prints the time and allocations of each stage of the given results in a tabulated format.
+//
+// Parameters:
+// - results: FunctionResults to be printed. Results without stage timings are skipped.
+func PrintStageBreakdown(results ...FunctionResult) {
+	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	header := "Function"
+	for stage := imageprocessing.Stage(0); stage < imageprocessing.NumStages; stage++ {
+		header += "\t" + stage.String()
+	}
+	printed := false
+	for _, result := range results {
+		if result.FunctionName == "" || result.Stages == (imageprocessing.StageTimings{}) {
+			continue
+		}
+		if !printed {
+			fmt.Fprintln(w, header)
+			printed = true
+		}
+		fmt.Fprint(w, result.FunctionName)
+		for _, timing := range result.Stages {
+			fmt.Fprintf(w, "\t%.1fms / %d allocs", milliseconds(timing.Duration), timing.Allocations)
+		}
+		fmt.Fprintln(w)
+	}
+	if printed {
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+// PrintRuntimeSummary prints the GC and scheduler overhead of the given results in a tabulated format.
+//
+// Parameters:
+// - results: FunctionResults to be printed. Results without runtime metrics are skipped.
+//
+// Notes:
+//   - GC CPU is the runtime's estimate of CPU time spent on garbage collection, and GC overhead is its share of
+//     all non-idle CPU time during the call. See runtimestats.Series.Summary.
+func PrintRuntimeSummary(results ...FunctionResult) {
+	w := tabwriter.NewWriter(os.Stdout, 10, 1, 3, ' ', tabwriter.Debug)
+	printed := false
+	for _, result := range results {
+		if result.FunctionName == "" || len(result.Metrics.Samples) == 0 {
+			continue
+		}
+		if !printed {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", "Function", "GC Cycles", "GC Pauses", "GC CPU", "GC Overhead", "Peak Heap", "Peak Goroutines", "Sched Latency p50/p99")
+			printed = true
+		}
+		summary := result.Metrics.Summary()
+		fmt.Fprintf(w, "%s\t%d\t%d (%.2fms)\t%.1fms\t%.1f%%\t%.1fMB\t%d\t%s / %s\n",
+			result.FunctionName, summary.GCCycles, summary.GCPauses, milliseconds(summary.GCPauseTotal),
+			summary.CPU.GC*1000, summary.GCOverhead*100, float64(summary.PeakHeapBytes)/(1<<20), summary.PeakGoroutines,
+			summary.SchedLatencyP50, summary.SchedLatencyP99)
+	}
+	if printed {
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+// processingTime returns the duration of the pixel processing stage of a result, in milliseconds.
+func processingTime(result FunctionResult) float64 {
+	return milliseconds(result.Stages[imageprocessing.StageProcess].Duration)
+}
+
+// performanceGain formats the end to end speedup of the optimized result over the baseline's.
+func performanceGain(baseline FunctionResult, optimized FunctionResult) string {
+	if baseline.FunctionName == "" || optimized.Duration == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", baseline.Duration/optimized.Duration)
+}
+
+// processingGain formats the speedup of the optimized result's pixel processing stage over the baseline's.
+func processingGain(baseline FunctionResult, optimized FunctionResult) string {
+	optimizedTime := processingTime(optimized)
+	if baseline.FunctionName == "" || optimizedTime == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", processingTime(baseline)/optimizedTime)
+}
+
+// milliseconds converts a duration to fractional milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ThroughputPerDay extrapolates a measured run to the number of gigabytes that could be processed in a day.
+//
+// Parameters:
+// - bytes: The number of bytes processed.
+// - durationMs: The time taken to process them, in milliseconds.
+//
+// Returns:
+// - float64: The projected throughput in GB per day, or 0 if the duration is not positive.
+func ThroughputPerDay(bytes int64, durationMs float64) float64 {
+	if durationMs <= 0 {
+		return 0
+	}
+	bytesPerMillisecond := float64(bytes) / durationMs
+	return (bytesPerMillisecond * 86400000) / 1073741824
 }
@@ -2,10 +2,16 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
 	"os"
+	"path/filepath"
+	"runtime/pprof"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mwiater/golangpprof/imageprocessing"
 	"github.com/stretchr/testify/assert"
@@ -22,7 +28,7 @@ func mockFunction(input, output string) (int64, error) {
 }
 
 func TestGetFunctionName(t *testing.T) {
-	assert.Equal(t, "mockFunction", getFunctionName(mockFunction))
+	assert.Equal(t, "mockFunction", FunctionName(mockFunction))
 }
 
 func TestPrintResults(t *testing.T) {
@@ -31,6 +37,10 @@ func TestPrintResults(t *testing.T) {
 		FunctionName: "Function1",
 		FileSize:     1000,
 		Duration:     10,
+
+		BytesAllocated: 4800,
+		Allocations:    300,
+		Pixels:         100,
 	}
 
 	result2 := FunctionResult{
@@ -38,6 +48,8 @@ func TestPrintResults(t *testing.T) {
 		FileSize:     2000,
 		Duration:     5,
 	}
+	result1.Stages[imageprocessing.StageProcess].Duration = 8 * time.Millisecond
+	result2.Stages[imageprocessing.StageProcess].Duration = 2 * time.Millisecond
 
 	// Redirect standard output to capture the printed results
 	oldStdout := os.Stdout
@@ -68,4 +80,228 @@ func TestPrintResults(t *testing.T) {
 	assert.Contains(t, output, "5ms")
 	assert.True(t, strings.Contains(output, "2.00x"))                   // Performance gain for Function2
 	assert.Contains(t, output, fmt.Sprint(imageprocessing.NumRoutines)) // Concurrency for Function2
+	assert.Contains(t, output, "4.00x")                                 // Processing gain for Function2
+	assert.Contains(t, output, "48.0")                                  // Bytes per pixel for Function1
+	assert.Contains(t, output, "3.00")                                  // Allocs per pixel for Function1
+	assert.Contains(t, output, "8.0ms")                                 // Stage breakdown for Function1
+}
+
+// inTempDir runs the test from a temporary directory with a ./pprof directory, for functions that write profiles.
+func inTempDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "pprof"), 0o755))
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestWrap(t *testing.T) {
+	inTempDir(t)
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+
+	grayscale := Wrap("GrayscaleOptimized", imageprocessing.GrayscaleOptimized, ImageBytes[*image.Gray])
+	gray, result, err := grayscale(context.Background(), img)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Bounds(), gray.Bounds())
+	assert.Equal(t, "GrayscaleOptimized", result.FunctionName)
+	assert.Equal(t, int64(64*32*4), result.FileSize)
+	assert.Equal(t, int64(64*32), result.Pixels)
+	assert.True(t, result.Allocations > 0)
+	assert.True(t, result.Stages[imageprocessing.StageProcess].Duration > 0)
+	assert.FileExists(t, result.CPUProfilePath)
+
+	// Errors are returned along with the measurements of the failed call
+	failure := errors.New("failed")
+	failing := Wrap("Failing", func(ctx context.Context, in string) (int, error) { return 0, failure }, nil)
+	_, result, err = failing(context.Background(), "input")
+	assert.Equal(t, failure, err)
+	assert.Equal(t, "Failing", result.FunctionName)
+	assert.Equal(t, int64(0), result.Pixels)
+}
+
+// TestWrapConcurrent ensures that a wrapped call made while another is in progress fails without running.
+func TestWrapConcurrent(t *testing.T) {
+	inTempDir(t)
+	CaptureCPUProfile = false
+	defer func() { CaptureCPUProfile = true }()
+
+	ran := false
+	inner := Wrap("Inner", func(ctx context.Context, in int) (int, error) { ran = true; return in, nil }, nil)
+	outer := Wrap("Outer", func(ctx context.Context, in int) (int, error) {
+		_, _, err := inner(ctx, in)
+		return in, err
+	}, nil)
+	_, _, err := outer(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrConcurrentCall)
+	assert.False(t, ran)
+
+	// Once the call is over, the next one runs
+	_, _, err = inner(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.True(t, ran)
+}
+
+// TestWrapPanic ensures that a panicking call stops the CPU profile and restores the stage observer, so that the
+// next call can profile again.
+func TestWrapPanic(t *testing.T) {
+	inTempDir(t)
+
+	var observed []imageprocessing.Stage
+	restore := imageprocessing.SetStageObserver(func(stage imageprocessing.Stage, _ imageprocessing.StageTiming) {
+		observed = append(observed, stage)
+	})
+	defer restore()
+
+	panicking := Wrap("Panicking", func(ctx context.Context, in int) (int, error) { panic("corrupt image") }, nil)
+	assert.PanicsWithValue(t, "corrupt image", func() { panicking(context.Background(), 1) })
+
+	var buf bytes.Buffer
+	assert.NoError(t, pprof.StartCPUProfile(&buf))
+	pprof.StopCPUProfile()
+
+	_, err := imageprocessing.Grayscale(context.Background(), image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, observed)
+}
+
+func TestSetCallObserver(t *testing.T) {
+	inTempDir(t)
+	CaptureCPUProfile = false
+	defer func() { CaptureCPUProfile = true }()
+
+	var started []string
+	var ended []FunctionResult
+	restore := SetCallObserver(func(name string) func(FunctionResult, error) {
+		started = append(started, name)
+		return func(result FunctionResult, err error) {
+			assert.NoError(t, err)
+			ended = append(ended, result)
+		}
+	})
+
+	identity := Wrap("Identity", func(ctx context.Context, in int) (int, error) { return in, nil }, func(in, _ int) int64 { return int64(in) })
+	_, result, err := identity(context.Background(), 42)
+	assert.NoError(t, err)
+	restore()
+	_, _, err = identity(context.Background(), 7)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"Identity"}, started)
+	assert.Equal(t, []FunctionResult{result}, ended)
+	assert.Equal(t, int64(42), ended[0].FileSize)
+	assert.Equal(t, "", result.CPUProfilePath)
+
+	// Added observers are notified alongside the installed one, until they are restored
+	restore = SetCallObserver(func(name string) func(FunctionResult, error) {
+		started = append(started, "set:"+name)
+		return func(FunctionResult, error) {}
+	})
+	restoreAdded := AddCallObserver(func(name string) func(FunctionResult, error) {
+		started = append(started, "added:"+name)
+		return func(FunctionResult, error) {}
+	})
+	_, _, err = identity(context.Background(), 1)
+	assert.NoError(t, err)
+	restoreAdded()
+	_, _, err = identity(context.Background(), 2)
+	assert.NoError(t, err)
+	restore()
+	assert.Equal(t, []string{"Identity", "set:Identity", "added:Identity", "set:Identity"}, started)
+}
+
+// outputSize is a wrapped function's output reporting the bytes it wrote.
+type outputSize int64
+
+func (s outputSize) OutputBytes() int64 {
+	return int64(s)
+}
+
+// TestWrapOutputSize ensures that the output size is recorded from outputs with an OutputBytes method, and from
+// the files written by TimerWrapper's functions.
+func TestWrapOutputSize(t *testing.T) {
+	inTempDir(t)
+	CaptureCPUProfile = false
+	defer func() { CaptureCPUProfile = true }()
+
+	double := Wrap("Double", func(ctx context.Context, in int) (outputSize, error) { return outputSize(2 * in), nil }, nil)
+	_, result, err := double(context.Background(), 21)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), result.OutputSize)
+
+	write := func(ctx context.Context, inputPath, outputPath string) (int64, error) {
+		return 10, os.WriteFile(outputPath, []byte("processed"), 0o644)
+	}
+	result = TimerWrapper(write)("missing.jpg", "output.jpg")
+	assert.Equal(t, int64(10), result.FileSize)
+	assert.Equal(t, int64(len("processed")), result.OutputSize)
+}
+
+// TestWrapFileError ensures that WrapFile returns the error of a failing function, where TimerWrapper panics.
+func TestWrapFileError(t *testing.T) {
+	inTempDir(t)
+	CaptureCPUProfile = false
+	defer func() { CaptureCPUProfile = true }()
+
+	fail := func(ctx context.Context, inputPath, outputPath string) (int64, error) {
+		return 0, errors.New("corrupt image")
+	}
+	_, err := WrapFile(fail)(context.Background(), "input.jpg", "output.jpg")
+	assert.EqualError(t, err, "corrupt image")
+	assert.Panics(t, func() { TimerWrapper(fail)("input.jpg", "output.jpg") })
+}
+
+func TestPerPixel(t *testing.T) {
+	result := FunctionResult{BytesAllocated: 1200, Allocations: 30, Pixels: 12}
+	assert.Equal(t, 100.0, result.BytesPerPixel())
+	assert.Equal(t, 2.5, result.AllocsPerPixel())
+
+	// Unknown pixel counts do not divide by zero
+	result.Pixels = 0
+	assert.Equal(t, 0.0, result.BytesPerPixel())
+	assert.Equal(t, 0.0, result.AllocsPerPixel())
+}
+
+func TestImagePixels(t *testing.T) {
+	pixels, err := imagePixels("../imageprocessing/inputs/input.jpg")
+	assert.NoError(t, err)
+	assert.True(t, pixels > 0)
+
+	_, err = imagePixels("../imageprocessing/inputs/nope.jpg")
+	assert.Error(t, err)
+}
+
+func TestBaselineStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "baselines.json")
+
+	store, err := LoadBaselines(path)
+	assert.NoError(t, err)
+	assert.Empty(t, store.Baselines)
+
+	store.Update(FunctionResult{FunctionName: "Function1", FileSize: 1000, Duration: 10, BytesAllocated: 500, Allocations: 5})
+	assert.NoError(t, store.Save(path))
+
+	loaded, err := LoadBaselines(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10.0, loaded.Baselines["Function1"].Duration)
+	assert.Equal(t, uint64(500), loaded.Baselines["Function1"].BytesAllocated)
+}
+
+func TestBaselineStoreCompare(t *testing.T) {
+	store := NewBaselineStore()
+	store.Baselines["Function1"] = Baseline{Duration: 100, BytesAllocated: 1000, Tolerance: 0.5}
+	store.Baselines["Function2"] = Baseline{Duration: 100, BytesAllocated: 1000}
+
+	comparisons := store.Compare(
+		FunctionResult{FunctionName: "Function1", Duration: 140, BytesAllocated: 1000},
+		FunctionResult{FunctionName: "Function2", Duration: 140, BytesAllocated: 1000},
+		FunctionResult{FunctionName: "Function3", Duration: 140},
+		FunctionResult{},
+	)
+
+	assert.Len(t, comparisons, 3)
+	assert.False(t, comparisons[0].Regressed()) // Within its own 50% tolerance
+	assert.Equal(t, []string{"time"}, comparisons[1].Regressions)
+	assert.False(t, comparisons[2].HasBaseline)
+	assert.True(t, HasRegressions(comparisons))
 }
@@ -0,0 +1,267 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/export"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/runtimestats"
+)
+
+// Func is any function that can be profiled by Wrap, such as the in-memory functions of the imageprocessing package.
+type Func[In, Out any] func(ctx context.Context, in In) (Out, error)
+
+// BytesProcessed reports how many bytes a call processed, given its input and output.
+type BytesProcessed[In, Out any] func(in In, out Out) int64
+
+// CallObserver is called as each wrapped call starts, with the name it was wrapped under, and returns a function
+// that is called with the call's result once it ends.
+type CallObserver func(name string) func(result FunctionResult, err error)
+
+var (
+	callObserverMu sync.RWMutex
+	callObservers  []CallObserver
+)
+
+// ErrConcurrentCall is returned by a wrapped function called while another wrapped call is in progress.
+var ErrConcurrentCall = errors.New("another wrapped call is in progress")
+
+// wrapMu is held for the duration of each wrapped call, since the CPU profile and the stage observer it installs
+// are process wide.
+var wrapMu sync.Mutex
+
+// CaptureCPUProfile enables capturing a CPU profile of each wrapped call and exporting it to ProfileExporters.
+var CaptureCPUProfile = true
+
+// ProfileExporters receive every CPU and heap profile captured by wrapped calls. By default profiles are written to
+// ./pprof/<type>-<name>.pprof.
+var ProfileExporters = []export.Exporter{export.Filesystem{Dir: "./pprof"}}
+
+// SetCallObserver installs an observer that is notified as each wrapped call starts and ends, for example to track
+// in-flight operations, replacing any installed observers.
+//
+// Parameters:
+// - observer: The observer to install, or nil to stop observing.
+//
+// Returns:
+// - func(): Restores the previously installed observers.
+func SetCallObserver(observer CallObserver) func() {
+	var observers []CallObserver
+	if observer != nil {
+		observers = []CallObserver{observer}
+	}
+	return setCallObservers(observers)
+}
+
+// AddCallObserver installs an observer alongside the installed ones, so that, for example, the live server and the
+// metrics can both observe wrapped calls.
+//
+// Parameters:
+// - observer: The observer to add.
+//
+// Returns:
+// - func(): Restores the previously installed observers.
+func AddCallObserver(observer CallObserver) func() {
+	callObserverMu.RLock()
+	observers := append(append([]CallObserver(nil), callObservers...), observer)
+	callObserverMu.RUnlock()
+	return setCallObservers(observers)
+}
+
+// setCallObservers replaces the installed observers, and returns a func that restores the previous ones.
+func setCallObservers(observers []CallObserver) func() {
+	callObserverMu.Lock()
+	previous := callObservers
+	callObservers = observers
+	callObserverMu.Unlock()
+
+	return func() {
+		callObserverMu.Lock()
+		callObservers = previous
+		callObserverMu.Unlock()
+	}
+}
+
+// Wrap takes any function and wraps it to measure and report its execution time, allocations and CPU profile.
+//
+// Parameters:
+// - name: The name of the function, used for its profile paths, its pprof label and FunctionResult.FunctionName.
+// - fn: The function to be wrapped.
+// - bytesProcessed: Reports the bytes processed by a call, recorded as FunctionResult.FileSize. May be nil.
+//
+// Returns:
+//   - A new function that calls fn with the given context and input, and also returns the FunctionResult of the call.
+//     The FunctionResult is filled in even if fn fails.
+//
+// Notes:
+//   - Wrapped calls must not overlap: the CPU profile and the imageprocessing stage observer they install are
+//     process wide, so concurrent calls would lose each other's stage timings. A call made while another is in
+//     progress fails with ErrConcurrentCall, without calling fn.
+//   - If fn panics, the CPU profile, the stage observer and the runtime/metrics sampler are stopped before the panic
+//     propagates, so a recovered panic leaves nothing running.
+//   - While CaptureCPUProfile is set, the CPU profile is exported to ProfileExporters, by default to
+//     ./pprof/cpu-<name>.pprof, and the CPU profile endpoint of the live server is unavailable.
+//   - Nothing is printed, apart from the profile summary requested by SummaryTopN or SummaryList, so callers
+//     announce the call themselves.
+//   - The result's CPUProfilePath and HeapProfilePath are the first local paths returned by the exporters.
+//   - The installed CallObservers are notified as the call starts and ends.
+//   - The call runs under an "operation" pprof label set to name, which every goroutine it starts inherits,
+//     so profiles can be filtered with -tagfocus=operation=<name> even for functions outside imageprocessing.
+//   - Allocation figures are ReadMemStats deltas around the call. PeakHeap is the largest heap seen before, after and,
+//     while MetricsInterval is positive, during the call, so without sampling it can miss a peak in the middle.
+//   - While MetricsInterval is positive, runtime/metrics are sampled for the duration of the call and stored in
+//     the result's Metrics.
+//   - If the input has a Bounds method, like image.Image, the result's Pixels are taken from it, and if the output
+//     has an OutputBytes method, the result's OutputSize is.
+func Wrap[In, Out any](name string, fn Func[In, Out], bytesProcessed BytesProcessed[In, Out]) func(context.Context, In) (Out, FunctionResult, error) {
+	return func(ctx context.Context, in In) (out Out, result FunctionResult, err error) {
+		result = FunctionResult{FunctionName: name, Pixels: inputPixels(in)}
+		if !wrapMu.TryLock() {
+			return out, result, ErrConcurrentCall
+		}
+		defer wrapMu.Unlock()
+
+		callObserverMu.RLock()
+		observers := callObservers
+		callObserverMu.RUnlock()
+		for _, observer := range observers {
+			end := observer(name)
+			defer func() { end(result, err) }()
+		}
+
+		var cpuProfile bytes.Buffer
+		cpuProfiling := false
+		if CaptureCPUProfile {
+			if err = pprof.StartCPUProfile(&cpuProfile); err != nil {
+				fmt.Fprintf(os.Stderr, "could not start CPU profile: %v\n", err)
+				return out, result, err
+			}
+			cpuProfiling = true
+			defer func() {
+				if cpuProfiling {
+					pprof.StopCPUProfile()
+				}
+			}()
+		}
+		var stagesMu sync.Mutex
+		restoreObserver := imageprocessing.SetStageObserver(func(stage imageprocessing.Stage, timing imageprocessing.StageTiming) {
+			stagesMu.Lock()
+			result.Stages[stage] = result.Stages[stage].Add(timing)
+			stagesMu.Unlock()
+		})
+		defer restoreObserver()
+
+		var memBefore, memAfter runtime.MemStats
+		runtime.ReadMemStats(&memBefore)
+		var sampler *runtimestats.Sampler
+		if MetricsInterval > 0 {
+			sampler = runtimestats.Start(MetricsInterval)
+			defer sampler.Stop()
+		}
+		start := time.Now()
+		pprof.Do(ctx, imageprocessing.OperationLabels(name), func(ctx context.Context) {
+			out, err = fn(ctx, in)
+		})
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&memAfter)
+		if sampler != nil {
+			result.Metrics = sampler.Stop()
+		}
+
+		if cpuProfiling {
+			pprof.StopCPUProfile()
+			cpuProfiling = false
+			result.CPUProfilePath = exportProfile(ctx, export.Profile{
+				Type:      "cpu",
+				Operation: name,
+				Started:   start,
+				Duration:  elapsed,
+				Data:      cpuProfile.Bytes(),
+			})
+		}
+
+		result.Duration = float64(elapsed.Milliseconds())
+		result.BytesAllocated = memAfter.TotalAlloc - memBefore.TotalAlloc
+		result.Allocations = memAfter.Mallocs - memBefore.Mallocs
+		result.NumGC = memAfter.NumGC - memBefore.NumGC
+		result.PeakHeap = memBefore.HeapAlloc
+		if memAfter.HeapAlloc > result.PeakHeap {
+			result.PeakHeap = memAfter.HeapAlloc
+		}
+		if sampled := result.Metrics.Summary().PeakHeapBytes; sampled > result.PeakHeap {
+			result.PeakHeap = sampled
+		}
+		if err != nil {
+			return out, result, err
+		}
+		if bytesProcessed != nil {
+			result.FileSize = bytesProcessed(in, out)
+		}
+		if sized, ok := any(out).(interface{ OutputBytes() int64 }); ok {
+			result.OutputSize = sized.OutputBytes()
+		}
+
+		if CaptureHeapProfile {
+			heapStarted := time.Now()
+			if data, err := heapProfile(); err != nil {
+				fmt.Fprintf(os.Stderr, "could not write heap profile: %v\n", err)
+			} else {
+				result.HeapProfilePath = exportProfile(ctx, export.Profile{Type: "heap", Operation: name, Started: heapStarted, Data: data})
+			}
+		}
+		if result.CPUProfilePath != "" && (SummaryTopN > 0 || SummaryList != "") {
+			if err := PrintProfileSummary(result.CPUProfilePath, SummaryTopN, SummaryList); err != nil {
+				fmt.Fprintf(os.Stderr, "could not summarise CPU profile: %v\n", err)
+			}
+		}
+
+		return out, result, nil
+	}
+}
+
+// exportProfile sends a profile to every exporter in ProfileExporters.
+//
+// Returns:
+// - string: The first local path the profile was written to, or an empty string if none of the exporters wrote it locally.
+//
+// Notes:
+// - Export errors are printed rather than returned, so that a failing exporter does not fail the wrapped call.
+func exportProfile(ctx context.Context, p export.Profile) string {
+	path := ""
+	for _, exporter := range ProfileExporters {
+		location, err := exporter.Export(ctx, p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not export %s profile: %v\n", p.Type, err)
+			continue
+		}
+		if path == "" {
+			path = location
+		}
+	}
+	return path
+}
+
+// inputPixels returns the number of pixels of an input with a Bounds method, like image.Image, or 0 for other inputs.
+func inputPixels(in any) int64 {
+	bounded, ok := in.(interface{ Bounds() image.Rectangle })
+	if !ok {
+		return 0
+	}
+	bounds := bounded.Bounds()
+	return int64(bounds.Dx()) * int64(bounds.Dy())
+}
+
+// ImageBytes reports the bytes processed by an in-memory image function as the size of its input's pixel data,
+// assuming 4 bytes per pixel. It can be passed to Wrap for functions taking an image.Image.
+func ImageBytes[Out any](in image.Image, _ Out) int64 {
+	return inputPixels(in) * 4
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mwiater/golangpprof/profile"
+)
+
+// SummaryTopN is the number of functions printed in the profile summary after each wrapped call. 0 disables it.
+var SummaryTopN = 0
+
+// SummaryList is a regular expression of functions whose per-line listing is printed after each wrapped call,
+// like the list command of go tool pprof. An empty pattern disables it.
+var SummaryList = ""
+
+// SummaryTagFocus restricts the profile summary to samples with a matching pprof label, written as key=regex
+// (for example stage=process or worker=0), like the -tagfocus option of go tool pprof. Empty keeps every sample.
+var SummaryTagFocus = ""
+
+// PrintProfileSummary parses a CPU profile written by TimerWrapper and prints a top-N flat/cum summary
+// and a per-line listing of the chosen functions.
+//
+// Parameters:
+// - profilePath: Path to the profile to summarise.
+// - topN: The number of functions to print in the top summary. 0 skips it.
+// - list: Regular expression of functions to list line by line. An empty pattern skips it.
+//
+// Returns:
+// - error: If the profile cannot be parsed or the pattern is invalid, it returns the error. Otherwise, it returns nil.
+func PrintProfileSummary(profilePath string, topN int, list string) error {
+	p, err := profile.ParseFile(profilePath)
+	if err != nil {
+		return err
+	}
+	index, err := p.SampleIndex("")
+	if err != nil {
+		return err
+	}
+	if SummaryTagFocus != "" {
+		key, value, ok := strings.Cut(SummaryTagFocus, "=")
+		if !ok {
+			return fmt.Errorf("invalid tag focus %q: expected key=regex", SummaryTagFocus)
+		}
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid tag focus pattern: %w", err)
+		}
+		p = p.FocusLabel(key, pattern)
+		fmt.Printf("  Tag focus: %s\n", SummaryTagFocus)
+	}
+
+	fmt.Printf("  Type: %s, Duration: %s, Total samples = %s\n", p.SampleTypes[index].Type, p.Duration.Round(10e6), profile.FormatValue(p.Total(index), p.SampleTypes[index].Unit))
+	if topN > 0 {
+		p.WriteTop(os.Stdout, index, topN)
+	}
+	if list != "" {
+		pattern, err := regexp.Compile(list)
+		if err != nil {
+			return fmt.Errorf("invalid list pattern: %w", err)
+		}
+		p.WriteList(os.Stdout, index, pattern)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Package export sends the profiles captured by the profiling harness to where they are kept: the local filesystem,
+// or a profile collector accepting pprof uploads over HTTP.
+package export
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Profile is a captured profile, in the gzipped protobuf format written by runtime/pprof.
+type Profile struct {
+	// Type is the kind of profile, such as "cpu" or "heap".
+	Type string
+	// Operation is the name of the profiled function.
+	Operation string
+	Started   time.Time
+	// Duration is how long a CPU profile recorded for. It is zero for point in time profiles like heap.
+	Duration time.Duration
+	Data     []byte
+}
+
+// Exporter sends profiles somewhere.
+type Exporter interface {
+	// Export sends a profile, returning the local path it was written to, or an empty string if it was sent
+	// elsewhere.
+	Export(ctx context.Context, p Profile) (string, error)
+}
+
+// Filesystem writes each profile to <Dir>/<Type>-<Operation>.pprof, overwriting the previous profile of the
+// same operation. It is the harness's default exporter.
+type Filesystem struct {
+	Dir string
+}
+
+// Export writes the profile to the directory and returns its path.
+func (fs Filesystem) Export(_ context.Context, p Profile) (string, error) {
+	path := filepath.Join(fs.Dir, p.Type+"-"+p.Operation+".pprof")
+	if err := os.WriteFile(path, p.Data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,140 @@
+package export
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testProfile = Profile{
+	Type:      "cpu",
+	Operation: "ProcessImageGrayscaleOptimized",
+	Started:   time.Unix(1696161600, 0),
+	Duration:  2 * time.Second,
+	Data:      []byte("profile data"),
+}
+
+// collector is an httptest stand-in for a profile collector. It fails the first failures uploads with status.
+type collector struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	uploads  []url.Values
+	bodies   []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		w.WriteHeader(c.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	c.uploads = append(c.uploads, r.URL.Query())
+	c.bodies = append(c.bodies, string(body))
+}
+
+func TestFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	path, err := Filesystem{Dir: dir}.Export(context.Background(), testProfile)
+	assert.NoError(t, err)
+	assert.Equal(t, dir+"/cpu-ProcessImageGrayscaleOptimized.pprof", path)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, testProfile.Data, data)
+
+	_, err = Filesystem{Dir: dir + "/nope"}.Export(context.Background(), testProfile)
+	assert.Error(t, err)
+}
+
+func TestHTTP(t *testing.T) {
+	c := &collector{failures: 2, status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	e := NewHTTP(HTTPConfig{
+		URL:     server.URL + "/ingest?format=pprof",
+		Service: "imageprocessing",
+		Host:    "worker-1",
+		Labels:  map[string]string{"env": "test"},
+		Backoff: time.Millisecond,
+	})
+	path, err := e.Export(context.Background(), testProfile)
+	assert.NoError(t, err)
+	assert.Equal(t, "", path)
+	assert.NoError(t, e.Close(context.Background()))
+
+	assert.Equal(t, HTTPStats{Sent: 1, Retries: 2}, e.Stats())
+	assert.Len(t, c.uploads, 1)
+	assert.Equal(t, "profile data", c.bodies[0])
+	q := c.uploads[0]
+	assert.Equal(t, "imageprocessing", q.Get("service"))
+	assert.Equal(t, "ProcessImageGrayscaleOptimized", q.Get("operation"))
+	assert.Equal(t, "worker-1", q.Get("host"))
+	assert.Equal(t, "test", q.Get("env"))
+	assert.Equal(t, "pprof", q.Get("format"))
+	assert.Equal(t, "cpu", q.Get("profile"))
+	assert.Equal(t, "1696161600", q.Get("start"))
+	assert.Equal(t, "1696161602", q.Get("end"))
+
+	_, err = e.Export(context.Background(), testProfile)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestHTTPFailures(t *testing.T) {
+	// Client errors are not retried
+	c := &collector{failures: 1, status: http.StatusBadRequest}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	e := NewHTTP(HTTPConfig{URL: server.URL, Backoff: time.Millisecond})
+	e.Export(context.Background(), testProfile)
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, HTTPStats{Failed: 1}, e.Stats())
+
+	// Server errors are retried up to MaxRetries times
+	c = &collector{failures: 10, status: http.StatusInternalServerError}
+	server2 := httptest.NewServer(c)
+	defer server2.Close()
+
+	e = NewHTTP(HTTPConfig{URL: server2.URL, MaxRetries: 2, Backoff: time.Millisecond})
+	e.Export(context.Background(), testProfile)
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, HTTPStats{Failed: 1, Retries: 2}, e.Stats())
+}
+
+func TestHTTPQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	e := NewHTTP(HTTPConfig{URL: server.URL, QueueSize: 1})
+	var dropped int
+	for i := 0; i < 5; i++ {
+		if _, err := e.Export(context.Background(), testProfile); err == ErrQueueFull {
+			dropped++
+		}
+	}
+	assert.True(t, dropped >= 3) // One is being sent and one is queued
+	assert.Equal(t, dropped, e.Stats().Dropped)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, e.Close(ctx), context.DeadlineExceeded)
+
+	close(release)
+	assert.NoError(t, e.Close(context.Background()))
+	assert.Equal(t, 5-dropped, e.Stats().Sent)
+}
@@ -0,0 +1,227 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Defaults for the zero values of HTTPConfig.
+const (
+	DefaultQueueSize  = 64
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultTimeout    = 10 * time.Second
+)
+
+// ErrQueueFull is returned by HTTP.Export when the queue is full and the profile is dropped.
+var ErrQueueFull = errors.New("export queue full")
+
+// ErrClosed is returned by HTTP.Export after the exporter has been closed.
+var ErrClosed = errors.New("exporter closed")
+
+// HTTPConfig configures an HTTP exporter.
+type HTTPConfig struct {
+	// URL is the collector's upload endpoint.
+	URL string
+	// Service names the service the profiles belong to.
+	Service string
+	// Host defaults to the machine's hostname.
+	Host string
+	// Labels are attached to every upload along with service, operation and host.
+	Labels map[string]string
+
+	// QueueSize is the number of profiles buffered while waiting to be sent.
+	QueueSize int
+	// MaxRetries is the number of times a failed upload is retried, with exponential backoff starting at Backoff.
+	// Negative disables retries.
+	MaxRetries int
+	Backoff    time.Duration
+	// Client defaults to an http.Client with DefaultTimeout.
+	Client *http.Client
+}
+
+// HTTPStats counts the outcomes of an HTTP exporter's uploads.
+type HTTPStats struct {
+	Sent    int
+	Failed  int
+	Dropped int
+	Retries int
+}
+
+// HTTP pushes profiles to a collector with a POST per profile, from a background goroutine fed by an in-memory queue.
+//
+// Each upload's body is the profile's gzipped protobuf data, with the labels as query parameters:
+//   - service, operation and host, plus any extra labels from HTTPConfig.Labels.
+//   - profile: The profile type, such as cpu or heap.
+//   - start and end: The Unix times, in seconds, the profile covers.
+type HTTP struct {
+	config HTTPConfig
+	queue  chan Profile
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	stats  HTTPStats
+}
+
+// NewHTTP starts an HTTP exporter.
+//
+// Parameters:
+// - config: The collector's URL and labels, and how uploads are queued and retried. Zero values are replaced by the defaults.
+//
+// Returns:
+// - *HTTP: The running exporter. Call Close to send the queued profiles and stop it.
+func NewHTTP(config HTTPConfig) *HTTP {
+	if config.Host == "" {
+		config.Host, _ = os.Hostname()
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = DefaultBackoff
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	e := &HTTP{
+		config: config,
+		queue:  make(chan Profile, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues the profile to be sent. It returns an empty path, since the profile is not written locally.
+//
+// Notes:
+//   - Export never blocks on the collector. If the queue is full the profile is dropped and ErrQueueFull returned.
+func (e *HTTP) Export(_ context.Context, p Profile) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return "", ErrClosed
+	}
+	select {
+	case e.queue <- p:
+		return "", nil
+	default:
+		e.stats.Dropped++
+		return "", ErrQueueFull
+	}
+}
+
+// Close stops accepting profiles and waits for the queued ones to be sent, or for the context to be done.
+func (e *HTTP) Close(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the outcomes of the uploads so far.
+func (e *HTTP) Stats() HTTPStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
+
+// run sends queued profiles until the queue is closed.
+func (e *HTTP) run() {
+	defer close(e.done)
+	for p := range e.queue {
+		err := e.send(p)
+		e.mu.Lock()
+		if err != nil {
+			e.stats.Failed++
+		} else {
+			e.stats.Sent++
+		}
+		e.mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not export %s profile of %s: %v\n", p.Type, p.Operation, err)
+		}
+	}
+}
+
+// send uploads a profile, retrying network errors, 429s and 5xx responses with exponential backoff.
+func (e *HTTP) send(p Profile) error {
+	backoff := e.config.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = e.post(p)
+		if err == nil || !retry || attempt >= e.config.MaxRetries {
+			return err
+		}
+		e.mu.Lock()
+		e.stats.Retries++
+		e.mu.Unlock()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes a single upload attempt, reporting whether a failure is worth retrying.
+func (e *HTTP) post(p Profile) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, e.uploadURL(p), bytes.NewReader(p.Data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := e.config.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("collector responded %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// uploadURL adds the profile's labels to the collector's URL as query parameters.
+func (e *HTTP) uploadURL(p Profile) string {
+	u, err := url.Parse(e.config.URL)
+	if err != nil {
+		return e.config.URL
+	}
+	q := u.Query()
+	for k, v := range e.config.Labels {
+		q.Set(k, v)
+	}
+	q.Set("service", e.config.Service)
+	q.Set("operation", p.Operation)
+	q.Set("host", e.config.Host)
+	q.Set("profile", p.Type)
+	q.Set("start", strconv.FormatInt(p.Started.Unix(), 10))
+	q.Set("end", strconv.FormatInt(p.Started.Add(p.Duration).Unix(), 10))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
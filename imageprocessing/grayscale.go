@@ -1,8 +1,10 @@
 package imageprocessing
 
 import (
+	"context"
 	"image"
 	"image/color"
+	"runtime/pprof"
 	"sync"
 )
 
@@ -11,6 +13,7 @@ import (
 // ProcessImageGrayscale converts an image to grayscale and saves the result to the specified output path.
 //
 // Parameters:
+// - ctx: Cancels the processing, and carries pprof labels that are added to the operation's labels.
 // - inputPath: Path to the source image which needs to be converted to grayscale.
 // - outputPath: Path where the grayscale image will be saved.
 //
@@ -22,34 +25,33 @@ import (
 // - The function relies on external functions:
 //   - getFileSize: Retrieves the size of a file.
 //   - decodeJPEG: Decodes a JPEG image from a given path.
+//   - grayscale: Converts the decoded image to grayscale.
 //   - saveProcessedGrayScaleJPEG: Saves the grayscale processed image to the given path.
+//   - withOperation: Labels the call with the caller's labels plus the operation name for CPU profiles.
 //
 // Notes:
 // - The function assumes the image is in JPEG format. If used with another format, it may fail or produce unexpected results.
 // - The conversion method retrieves the red channel from the original color, assuming that it's representative of the grayscale.
 //   More sophisticated methods for grayscale conversion might consider weighted averages of RGB values.
-func ProcessImageGrayscale(inputPath string, outputPath string) (int64, error) {
-	size, err := getFileSize(inputPath)
+func ProcessImageGrayscale(ctx context.Context, inputPath string, outputPath string) (int64, error) {
+	ctx, endOperation := withOperation(ctx, "ProcessImageGrayscale")
+	defer endOperation()
+
+	size, err := getFileSize(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
-	img, err := decodeJPEG(inputPath)
+	img, err := decodeJPEG(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
 
-	bounds := img.Bounds()
-	processedImage := image.NewGray(bounds)
-
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			c := img.At(x, y)
-			gray, _, _, _ := c.RGBA()
-			processedImage.Set(x, y, color.Gray{Y: uint8(gray >> 8)})
-		}
+	processedImage, err := grayscale(ctx, img)
+	if err != nil {
+		return 0, err
 	}
 
-	err = saveProcessedGrayScaleJPEG(outputPath, processedImage)
+	err = saveProcessedGrayScaleJPEG(ctx, outputPath, processedImage)
 	if err != nil {
 		return 0, err
 	}
@@ -62,6 +64,7 @@ func ProcessImageGrayscale(inputPath string, outputPath string) (int64, error) {
 // splits the image into sections and processes them concurrently for faster results.
 //
 // Parameters:
+// - ctx: Cancels the processing, and carries pprof labels that are added to the operation's labels.
 // - inputPath: Path to the source image which needs to be converted to grayscale.
 // - outputPath: Path where the grayscale image will be saved.
 //
@@ -73,23 +76,109 @@ func ProcessImageGrayscale(inputPath string, outputPath string) (int64, error) {
 // - The function relies on external functions, variables, and constants:
 //   - getFileSize: Retrieves the size of a file.
 //   - decodeJPEG: Decodes a JPEG image from a given path.
+//   - grayscaleOptimized: Converts the decoded image to grayscale concurrently.
 //   - saveProcessedGrayScaleJPEG: Saves the grayscale processed image to the given path.
-//   - NumRoutines: Constant that dictates how many goroutines should be spawned for concurrent processing.
+//   - withOperation: Labels the call with the caller's labels plus the operation name for CPU profiles.
 //
 // Notes:
 // - This optimized function breaks the image into sections and processes them concurrently for faster results.
 // - The conversion method retrieves the red channel from the original color,
 //   assuming that it's representative of the grayscale. Advanced grayscale conversion might consider weighted averages of RGB values.
-func ProcessImageGrayscaleOptimized(inputPath string, outputPath string) (int64, error) {
-	size, err := getFileSize(inputPath)
+func ProcessImageGrayscaleOptimized(ctx context.Context, inputPath string, outputPath string) (int64, error) {
+	ctx, endOperation := withOperation(ctx, "ProcessImageGrayscaleOptimized")
+	defer endOperation()
+
+	size, err := getFileSize(ctx, inputPath)
+	if err != nil {
+		return 0, err
+	}
+	img, err := decodeJPEG(ctx, inputPath)
+	if err != nil {
+		return 0, err
+	}
+
+	processedImage, err := grayscaleOptimized(ctx, img)
 	if err != nil {
 		return 0, err
 	}
-	img, err := decodeJPEG(inputPath)
+
+	err = saveProcessedGrayScaleJPEG(ctx, outputPath, processedImage)
 	if err != nil {
 		return 0, err
 	}
 
+	return size, nil
+}
+
+// Grayscale converts an in-memory image to grayscale, without any file I/O.
+//
+// Parameters:
+// - ctx: Cancels the conversion, and carries pprof labels that are added to the operation's labels.
+// - img: The image to convert.
+//
+// Returns:
+// - *image.Gray: The grayscale image.
+// - error: The context's error if it is cancelled before the conversion completes. Otherwise, it returns nil.
+//
+// Notes:
+// - The conversion is the same as ProcessImageGrayscale's, and the process stage is reported to the installed StageObserver.
+func Grayscale(ctx context.Context, img image.Image) (*image.Gray, error) {
+	ctx, endOperation := withOperation(ctx, "Grayscale")
+	defer endOperation()
+
+	return grayscale(ctx, img)
+}
+
+// GrayscaleOptimized converts an in-memory image to grayscale concurrently, without any file I/O.
+//
+// Parameters:
+// - ctx: Cancels the conversion, and carries pprof labels that are added to the operation's labels.
+// - img: The image to convert.
+//
+// Returns:
+// - *image.Gray: The grayscale image.
+// - error: The context's error if it is cancelled before the conversion completes. Otherwise, it returns nil.
+//
+// Notes:
+// - The image is split between NumRoutines goroutines, as in ProcessImageGrayscaleOptimized.
+func GrayscaleOptimized(ctx context.Context, img image.Image) (*image.Gray, error) {
+	ctx, endOperation := withOperation(ctx, "GrayscaleOptimized")
+	defer endOperation()
+
+	return grayscaleOptimized(ctx, img)
+}
+
+// grayscale is the pixel processing stage of ProcessImageGrayscale and Grayscale.
+//
+// Notes:
+// - Cancellation is checked once per row.
+func grayscale(ctx context.Context, img image.Image) (*image.Gray, error) {
+	defer startStage(ctx, StageProcess)()
+
+	bounds := img.Bounds()
+	processedImage := image.NewGray(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			gray, _, _, _ := c.RGBA()
+			processedImage.Set(x, y, color.Gray{Y: uint8(gray >> 8)})
+		}
+	}
+
+	return processedImage, nil
+}
+
+// grayscaleOptimized is the pixel processing stage of ProcessImageGrayscaleOptimized and GrayscaleOptimized.
+//
+// Notes:
+// - Each worker checks for cancellation once per row, and the context's error is returned once all have stopped.
+func grayscaleOptimized(ctx context.Context, img image.Image) (*image.Gray, error) {
+	defer startStage(ctx, StageProcess)()
+
 	bounds := img.Bounds()
 	processedImage := image.NewGray(bounds)
 
@@ -103,22 +192,22 @@ func ProcessImageGrayscaleOptimized(inputPath string, outputPath string) (int64,
 			endY = bounds.Max.Y
 		}
 		wg.Add(1)
-		go toGrayscaleConcurrent(img, startY, endY, &wg, processedImage)
+		go toGrayscaleConcurrent(ctx, i, img, startY, endY, &wg, processedImage)
 	}
 	wg.Wait()
 
-	err = saveProcessedGrayScaleJPEG(outputPath, processedImage)
-	if err != nil {
-		return 0, err
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	return size, nil
+	return processedImage, nil
 }
 
 // toGrayscaleConcurrent is a helper function for ProcessImageGrayscaleOptimized.
 // It processes a section of the image to convert it to grayscale concurrently.
 //
 // Parameters:
+// - ctx: The operation's context, whose labels the worker's labels are added to.
+// - worker: Index of the worker, used to label its samples in CPU profiles.
 // - img: The original image that needs to be converted.
 // - start: Starting row of the section to be processed.
 // - end: Ending row of the section to be processed.
@@ -127,15 +216,22 @@ func ProcessImageGrayscaleOptimized(inputPath string, outputPath string) (int64,
 //
 // Notes:
 // - This function is intended to be used as a goroutine.
-func toGrayscaleConcurrent(img image.Image, start, end int, wg *sync.WaitGroup, grayImage *image.Gray) {
+// - Samples are labelled with the operation, the process stage, the worker index and its row range.
+func toGrayscaleConcurrent(ctx context.Context, worker int, img image.Image, start, end int, wg *sync.WaitGroup, grayImage *image.Gray) {
 	defer wg.Done()
 
-	bounds := img.Bounds()
-	for y := start; y < end; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			c := img.At(x, y)
-			gray, _, _, _ := c.RGBA()
-			grayImage.Set(x, y, color.Gray{Y: uint8(gray >> 8)})
+	ctx = pprof.WithLabels(ctx, pprof.Labels(LabelStage, StageProcess.String()))
+	pprof.Do(ctx, WorkerLabels(worker, start, end), func(ctx context.Context) {
+		bounds := img.Bounds()
+		for y := start; y < end; y++ {
+			if ctx.Err() != nil {
+				return
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := img.At(x, y)
+				gray, _, _, _ := c.RGBA()
+				grayImage.Set(x, y, color.Gray{Y: uint8(gray >> 8)})
+			}
 		}
-	}
+	})
 }
@@ -1,6 +1,7 @@
 package imageprocessing
 
 import (
+	"context"
 	"image"
 	"image/jpeg"
 	"os"
@@ -9,12 +10,15 @@ import (
 // getFileSize retrieves the size of the file located at the specified path.
 //
 // Parameters:
+// - ctx: The operation's context, used to label the stat stage.
 // - inputPath: Path to the target file.
 //
 // Returns:
 // - int64: The size of the file in bytes.
 // - error: If any error occurs during retrieval, it returns the error. Otherwise, it returns nil.
-func getFileSize(inputPath string) (int64, error) {
+func getFileSize(ctx context.Context, inputPath string) (int64, error) {
+	defer startStage(ctx, StageStat)()
+
 	fi, err := os.Stat(inputPath)
 	if err != nil {
 		return 0, err
@@ -25,12 +29,15 @@ func getFileSize(inputPath string) (int64, error) {
 // decodeJPEG decodes a JPEG image located at the specified path.
 //
 // Parameters:
+// - ctx: The operation's context, used to label the decode stage.
 // - inputPath: Path to the source JPEG image.
 //
 // Returns:
 // - image.Image: The decoded image.
 // - error: If any error occurs during decoding, it returns the error. Otherwise, it returns nil.
-func decodeJPEG(inputPath string) (image.Image, error) {
+func decodeJPEG(ctx context.Context, inputPath string) (image.Image, error) {
+	defer startStage(ctx, StageDecode)()
+
 	input, err := os.Open(inputPath)
 	if err != nil {
 		return nil, err
@@ -48,12 +55,15 @@ func decodeJPEG(inputPath string) (image.Image, error) {
 // saveProcessedJPEG saves the given RGBA image as a JPEG to the specified path.
 //
 // Parameters:
+// - ctx: The operation's context, used to label the encode stage.
 // - outputPath: Path where the image will be saved.
 // - processedImage: The RGBA image to be saved.
 //
 // Returns:
 // - error: If any error occurs during saving, it returns the error. Otherwise, it returns nil.
-func saveProcessedJPEG(outputPath string, processedImage *image.RGBA) error {
+func saveProcessedJPEG(ctx context.Context, outputPath string, processedImage *image.RGBA) error {
+	defer startStage(ctx, StageEncode)()
+
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		return err
@@ -71,12 +81,15 @@ func saveProcessedJPEG(outputPath string, processedImage *image.RGBA) error {
 // saveProcessedGrayScaleJPEG saves the given grayscale image as a JPEG to the specified path.
 //
 // Parameters:
+// - ctx: The operation's context, used to label the encode stage.
 // - outputPath: Path where the grayscale image will be saved.
 // - processedImage: The grayscale image to be saved.
 //
 // Returns:
 // - error: If any error occurs during saving, it returns the error. Otherwise, it returns nil.
-func saveProcessedGrayScaleJPEG(outputPath string, processedImage *image.Gray) error {
+func saveProcessedGrayScaleJPEG(ctx context.Context, outputPath string, processedImage *image.Gray) error {
+	defer startStage(ctx, StageEncode)()
+
 	outputFile, err := os.Create(outputPath)
 	if err != nil {
 		return err
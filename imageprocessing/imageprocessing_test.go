@@ -2,10 +2,18 @@ package imageprocessing
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
 	"image/jpeg"
 	"os"
+	"path/filepath"
+	"runtime/pprof"
 	"testing"
+	"time"
 
+	"github.com/mwiater/golangpprof/internal/testimage"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,11 +59,11 @@ func isGrayscale(imgPath string) (bool, error) {
 // of the two images. If an error occurs during decoding or encoding, the function
 // assumes the images are not equal and returns false.
 func imagesAreEqual(imgPath1, imgPath2 string) bool {
-	img1, err := decodeJPEG(imgPath1)
+	img1, err := decodeJPEG(context.Background(), imgPath1)
 	if err != nil {
 		return false
 	}
-	img2, err := decodeJPEG(imgPath2)
+	img2, err := decodeJPEG(context.Background(), imgPath2)
 	if err != nil {
 		return false
 	}
@@ -80,23 +88,23 @@ func imagesAreEqual(imgPath1, imgPath2 string) bool {
 // TestProcessImageSharpen_Decode verifies that a valid image can be decoded
 // and that an error is returned for a non-existent image.
 func TestProcessImageSharpen_Decode(t *testing.T) {
-	_, err := decodeJPEG(testInput)
+	_, err := decodeJPEG(context.Background(), testInput)
 	assert.NoError(t, err)
 
-	_, err = decodeJPEG(nonExistentImage)
+	_, err = decodeJPEG(context.Background(), nonExistentImage)
 	assert.Error(t, err)
 }
 
 // TestProcessImageSharpen_Processing ensures that the sharpening process
 // completes without errors for a valid input image.
 func TestProcessImageSharpen_Processing(t *testing.T) {
-	_, err := ProcessImageSharpen(testInput, testOutput)
+	_, err := ProcessImageSharpen(context.Background(), testInput, testOutput)
 	assert.NoError(t, err)
 }
 
 // TestProcessImageSharpen_OutputSize checks that the output image has a non-zero size.
 func TestProcessImageSharpen_OutputSize(t *testing.T) {
-	size, err := getFileSize(testOutput)
+	size, err := getFileSize(context.Background(), testOutput)
 	assert.NoError(t, err)
 	assert.True(t, size > 0)
 }
@@ -112,23 +120,23 @@ func TestProcessImageSharpen_DifferentFromInput(t *testing.T) {
 // TestProcessImageSharpenOptimized_Decode verifies decoding functionality
 // for the optimized sharpening function.
 func TestProcessImageSharpenOptimized_Decode(t *testing.T) {
-	_, err := decodeJPEG(testInput)
+	_, err := decodeJPEG(context.Background(), testInput)
 	assert.NoError(t, err)
 
-	_, err = decodeJPEG(nonExistentImage)
+	_, err = decodeJPEG(context.Background(), nonExistentImage)
 	assert.Error(t, err)
 }
 
 // TestProcessImageSharpenOptimized_Processing tests the optimized sharpening process.
 func TestProcessImageSharpenOptimized_Processing(t *testing.T) {
-	_, err := ProcessImageSharpenOptimized(testInput, testOutput)
+	_, err := ProcessImageSharpenOptimized(context.Background(), testInput, testOutput)
 	assert.NoError(t, err)
 }
 
 // TestProcessImageSharpenOptimized_OutputSize checks the size of the output
 // image for the optimized sharpening function.
 func TestProcessImageSharpenOptimized_OutputSize(t *testing.T) {
-	size, err := getFileSize(testOutput)
+	size, err := getFileSize(context.Background(), testOutput)
 	assert.NoError(t, err)
 	assert.True(t, size > 0)
 }
@@ -144,10 +152,10 @@ func TestProcessImageSharpenOptimized_DifferentFromInput(t *testing.T) {
 // TestProcessImageGrayscale_Decode tests the decoding step for the grayscale function
 // and ensures an error is returned for a non-existent image.
 func TestProcessImageGrayscale_Decode(t *testing.T) {
-	_, err := ProcessImageGrayscale(nonExistentImage, testOutput)
+	_, err := ProcessImageGrayscale(context.Background(), nonExistentImage, testOutput)
 	assert.Error(t, err)
 
-	_, err = ProcessImageGrayscale(testInput, testOutput)
+	_, err = ProcessImageGrayscale(context.Background(), testInput, testOutput)
 	assert.NoError(t, err)
 }
 
@@ -172,10 +180,10 @@ func TestProcessImageGrayscale_GrayscaleOutput(t *testing.T) {
 // TestProcessImageGrayscaleOptimized_Decode tests the decoding step for the
 // optimized grayscale function.
 func TestProcessImageGrayscaleOptimized_Decode(t *testing.T) {
-	_, err := ProcessImageGrayscaleOptimized(nonExistentImage, testOutput)
+	_, err := ProcessImageGrayscaleOptimized(context.Background(), nonExistentImage, testOutput)
 	assert.Error(t, err)
 
-	_, err = ProcessImageGrayscaleOptimized(testInput, testOutput)
+	_, err = ProcessImageGrayscaleOptimized(context.Background(), testInput, testOutput)
 	assert.NoError(t, err)
 }
 
@@ -194,3 +202,319 @@ func TestProcessImageGrayscaleOptimized_GrayscaleOutput(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, grayscale)
 }
+
+// Tests for stage timings
+
+// TestSetStageObserver ensures that every stage of a processing function is reported
+// to the installed observer, and that nothing is reported once it is restored.
+func TestSetStageObserver(t *testing.T) {
+	var stages StageTimings
+	calls := 0
+	restore := SetStageObserver(func(stage Stage, timing StageTiming) {
+		stages[stage] = stages[stage].Add(timing)
+		calls++
+	})
+
+	_, err := ProcessImageGrayscaleOptimized(context.Background(), testInput, testOutput)
+	assert.NoError(t, err)
+	restore()
+
+	assert.Equal(t, int(NumStages), calls)
+	assert.True(t, stages[StageDecode].Duration > 0)
+	assert.True(t, stages[StageProcess].Duration > 0)
+	assert.True(t, stages[StageProcess].Allocations > 0)
+	assert.Equal(t, "process", StageProcess.String())
+
+	_, err = ProcessImageGrayscale(context.Background(), testInput, testOutput)
+	assert.NoError(t, err)
+	assert.Equal(t, int(NumStages), calls)
+}
+
+// Tests for profiler labels
+
+// TestLabels ensures that operation and worker label sets carry the expected keys and values.
+func TestLabels(t *testing.T) {
+	ctx := pprof.WithLabels(context.Background(), OperationLabels("ProcessImageSharpenOptimized"))
+	ctx = pprof.WithLabels(ctx, WorkerLabels(3, 300, 400))
+
+	operation, ok := pprof.Label(ctx, LabelOperation)
+	assert.True(t, ok)
+	assert.Equal(t, "ProcessImageSharpenOptimized", operation)
+
+	worker, _ := pprof.Label(ctx, LabelWorker)
+	rows, _ := pprof.Label(ctx, LabelRows)
+	assert.Equal(t, "3", worker)
+	assert.Equal(t, "300-400", rows)
+}
+
+// TestCallerLabels ensures that the file based functions add the operation to the caller's labels, and restore the
+// caller's labels once they return.
+func TestCallerLabels(t *testing.T) {
+	pprof.Do(context.Background(), pprof.Labels("caller", "test"), func(ctx context.Context) {
+		labelled, end := withOperation(ctx, "ProcessImageGrayscale")
+		caller, _ := pprof.Label(labelled, "caller")
+		operation, _ := pprof.Label(labelled, LabelOperation)
+		assert.Equal(t, "test", caller)
+		assert.Equal(t, "ProcessImageGrayscale", operation)
+		end()
+
+		_, err := ProcessImageGrayscale(ctx, testInput, testOutput)
+		assert.NoError(t, err)
+		var goroutines bytes.Buffer
+		assert.NoError(t, pprof.Lookup("goroutine").WriteTo(&goroutines, 1))
+		assert.Contains(t, goroutines.String(), `# labels: {"caller":"test"}`)
+		assert.NotContains(t, goroutines.String(), `"operation":"ProcessImageGrayscale"`)
+	})
+}
+
+// Tests for the in-memory functions
+
+// TestInMemory ensures that the in-memory functions produce the same images as each other,
+// and stop with the context's error once it is cancelled.
+func TestInMemory(t *testing.T) {
+	img := testimage.Image()
+	ctx := context.Background()
+
+	gray, err := Grayscale(ctx, img)
+	assert.NoError(t, err)
+	grayOptimized, err := GrayscaleOptimized(ctx, img)
+	assert.NoError(t, err)
+	assert.Equal(t, gray.Pix, grayOptimized.Pix)
+	assert.Equal(t, uint8(60), gray.GrayAt(10, 5).Y)
+
+	sharp, err := Sharpen(ctx, img)
+	assert.NoError(t, err)
+	sharpOptimized, err := SharpenOptimized(ctx, img)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Bounds(), sharp.Bounds())
+	assert.Equal(t, sharp.RGBAAt(20, 15), sharpOptimized.RGBAAt(20, 15))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = GrayscaleOptimized(cancelled, img)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = Sharpen(cancelled, img)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// TestParseOperations ensures that operations are looked up by name, in the order they are listed.
+func TestParseOperations(t *testing.T) {
+	ops, err := ParseOperations("sharpen-optimized, grayscale,")
+	assert.NoError(t, err)
+	assert.Len(t, ops, 2)
+	assert.Equal(t, "sharpen-optimized", ops[0].Name)
+	assert.True(t, ops[0].Optimized)
+	assert.Equal(t, filepath.Join("out", "sharpenProcessedOptimized.jpg"), ops[0].OutputPath("out"))
+	assert.Equal(t, "grayscale", ops[1].Name)
+	assert.False(t, ops[1].Optimized)
+	assert.Equal(t, "sharpen-optimized,grayscale", PipelineName(ops))
+
+	_, err = ParseOperations("grayscale,blur")
+	assert.ErrorContains(t, err, `unknown operation "blur"`)
+	_, err = ParseOperations(" , ")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"grayscale", "grayscale-optimized", "sharpen", "sharpen-optimized"}, OperationNames())
+	assert.Equal(t, 3, OperationIndex("sharpen-optimized"))
+	assert.Equal(t, -1, OperationIndex("blur"))
+}
+
+// TestPipeline ensures that a pipeline applies its operations in order, and stops at the first that fails.
+func TestPipeline(t *testing.T) {
+	img := testimage.Image()
+	ctx := context.Background()
+	ops, err := ParseOperations("grayscale-optimized,sharpen")
+	assert.NoError(t, err)
+
+	processed, err := Pipeline(ctx, ops, img)
+	assert.NoError(t, err)
+	gray, _ := Grayscale(ctx, img)
+	expected, _ := Sharpen(ctx, gray)
+	assert.True(t, bytes.Equal(expected.Pix, processed.(*image.RGBA).Pix))
+
+	unchanged, err := Pipeline(ctx, nil, img)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Image(img), unchanged)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	processed, err = Pipeline(cancelled, ops, img)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorContains(t, err, "grayscale-optimized: ")
+	assert.Nil(t, processed)
+}
+
+// Benchmarks
+//
+// Sub-benchmarks are named <variant>/<width>x<height>[/workers=<n>], so that a single case can be selected for
+// profiling, e.g. go test -bench 'BenchmarkSharpen/optimized/1920x1080/workers=4$' -cpuprofile cpu.pprof.
+
+// benchSizes are the synthetic image sizes each operation is benchmarked at.
+var benchSizes = []image.Point{{X: 320, Y: 240}, {X: 1280, Y: 720}, {X: 1920, Y: 1080}}
+
+// benchWorkers are the values of NumRoutines the optimized variants are benchmarked with.
+var benchWorkers = []int{1, 2, 4, 8}
+
+// benchImages caches the synthetic images by size, so each is only generated once per run.
+var benchImages = map[image.Point]image.Image{}
+
+// benchImage returns a synthetic image of the given size. It is round tripped through JPEG so that,
+// like the decoded input of the Process functions, it is an *image.YCbCr.
+func benchImage(b *testing.B, size image.Point) image.Image {
+	if img, ok := benchImages[size]; ok {
+		return img
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			rgba.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, rgba, nil); err != nil {
+		b.Fatal(err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchImages[size] = img
+	return img
+}
+
+// sizeName formats a size for a sub-benchmark name.
+func sizeName(size image.Point) string {
+	return fmt.Sprintf("%dx%d", size.X, size.Y)
+}
+
+// withWorkers runs a sub-benchmark for each of benchWorkers, with NumRoutines set accordingly.
+func withWorkers(b *testing.B, run func(b *testing.B)) {
+	for _, workers := range benchWorkers {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			previous := NumRoutines
+			NumRoutines = workers
+			defer func() { NumRoutines = previous }()
+			run(b)
+		})
+	}
+}
+
+// benchmarkLoop runs op b.N times and reports its throughput in MB/s of the given bytes, and its time per pixel.
+func benchmarkLoop(b *testing.B, pixels, bytes int64, op func() error) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := op(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	b.ReportMetric(float64(bytes)*float64(b.N)/elapsed.Seconds()/1e6, "MB/s")
+	b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N)/float64(pixels), "ns/pixel")
+}
+
+// benchmarkInMemory benchmarks an in-memory operation at every size. Throughput is measured in decoded
+// pixel data, at 4 bytes per pixel.
+func benchmarkInMemory(b *testing.B, fn func(context.Context, image.Image) error, optimized bool) {
+	for _, size := range benchSizes {
+		img := benchImage(b, size)
+		pixels := int64(size.X) * int64(size.Y)
+		run := func(b *testing.B) {
+			benchmarkLoop(b, pixels, pixels*4, func() error { return fn(context.Background(), img) })
+		}
+		if optimized {
+			b.Run(sizeName(size), func(b *testing.B) { withWorkers(b, run) })
+		} else {
+			b.Run(sizeName(size), run)
+		}
+	}
+}
+
+func BenchmarkGrayscale(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		benchmarkInMemory(b, func(ctx context.Context, img image.Image) error {
+			_, err := Grayscale(ctx, img)
+			return err
+		}, false)
+	})
+	b.Run("optimized", func(b *testing.B) {
+		benchmarkInMemory(b, func(ctx context.Context, img image.Image) error {
+			_, err := GrayscaleOptimized(ctx, img)
+			return err
+		}, true)
+	})
+}
+
+func BenchmarkSharpen(b *testing.B) {
+	b.Run("serial", func(b *testing.B) {
+		benchmarkInMemory(b, func(ctx context.Context, img image.Image) error {
+			_, err := Sharpen(ctx, img)
+			return err
+		}, false)
+	})
+	b.Run("optimized", func(b *testing.B) {
+		benchmarkInMemory(b, func(ctx context.Context, img image.Image) error {
+			_, err := SharpenOptimized(ctx, img)
+			return err
+		}, true)
+	})
+}
+
+// BenchmarkProcessImage benchmarks the file based functions end to end: stat, decode, process and encode.
+// Throughput is measured in input file bytes, as in common.ThroughputPerDay.
+func BenchmarkProcessImage(b *testing.B) {
+	functions := []struct {
+		name      string
+		fn        func(context.Context, string, string) (int64, error)
+		optimized bool
+	}{
+		{"ProcessImageGrayscale", ProcessImageGrayscale, false},
+		{"ProcessImageGrayscaleOptimized", ProcessImageGrayscaleOptimized, true},
+		{"ProcessImageSharpen", ProcessImageSharpen, false},
+		{"ProcessImageSharpenOptimized", ProcessImageSharpenOptimized, true},
+	}
+
+	dir := b.TempDir()
+	inputs := map[image.Point]string{}
+	for _, size := range benchSizes {
+		inputs[size] = filepath.Join(dir, sizeName(size)+".jpg")
+		f, err := os.Create(inputs[size])
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = jpeg.Encode(f, benchImage(b, size), nil)
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	output := filepath.Join(dir, "output.jpg")
+
+	for _, function := range functions {
+		function := function
+		b.Run(function.name, func(b *testing.B) {
+			for _, size := range benchSizes {
+				input := inputs[size]
+				info, err := os.Stat(input)
+				if err != nil {
+					b.Fatal(err)
+				}
+				pixels := int64(size.X) * int64(size.Y)
+				run := func(b *testing.B) {
+					benchmarkLoop(b, pixels, info.Size(), func() error {
+						_, err := function.fn(context.Background(), input, output)
+						return err
+					})
+				}
+				if function.optimized {
+					b.Run(sizeName(size), func(b *testing.B) { withWorkers(b, run) })
+				} else {
+					b.Run(sizeName(size), run)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package imageprocessing
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"strconv"
+)
+
+// Label keys attached to samples in CPU profiles, for filtering with go tool pprof -tagfocus, e.g.
+// -tagfocus=stage=process or -tagfocus=worker=3.
+const (
+	LabelOperation = "operation"
+	LabelStage     = "stage"
+	LabelWorker    = "worker"
+	LabelRows      = "rows"
+)
+
+// OperationLabels returns the labels identifying an operation, such as ProcessImageGrayscaleOptimized.
+func OperationLabels(operation string) pprof.LabelSet {
+	return pprof.Labels(LabelOperation, operation)
+}
+
+// WorkerLabels returns the labels identifying a worker goroutine and the range of rows [start, end) it processes.
+func WorkerLabels(worker, start, end int) pprof.LabelSet {
+	return pprof.Labels(LabelWorker, strconv.Itoa(worker), LabelRows, fmt.Sprintf("%d-%d", start, end))
+}
+
+// withOperation labels the calling goroutine with the caller's labels plus the operation name, so that every stage
+// and worker goroutine of the operation carries them.
+//
+// Parameters:
+// - ctx: The caller's context.
+// - operation: The name of the operation, matching the exported function name.
+//
+// Returns:
+// - context.Context: The labelled context, to derive stage and worker labels from.
+// - func(): Restores the goroutine's labels to those of ctx. Intended to be deferred.
+func withOperation(ctx context.Context, operation string) (context.Context, func()) {
+	labelled := pprof.WithLabels(ctx, OperationLabels(operation))
+	pprof.SetGoroutineLabels(labelled)
+	return labelled, func() { pprof.SetGoroutineLabels(ctx) }
+}
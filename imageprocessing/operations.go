@@ -0,0 +1,146 @@
+package imageprocessing
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+// Operation is a file based image processing function, as selected by name on the command line.
+type Operation struct {
+	// Name is the short name of the operation, e.g. grayscale or sharpen-optimized.
+	Name string
+
+	// Func reads the image at its first argument and writes the processed image to its second.
+	Func func(ctx context.Context, inputPath string, outputPath string) (int64, error)
+
+	// Apply processes an in-memory image, without any file I/O, e.g. as one step of a pipeline.
+	Apply func(ctx context.Context, img image.Image) (image.Image, error)
+
+	// OutputName is the default file name of the processed image.
+	OutputName string
+
+	// Optimized is set for the concurrent variants, which split the image between NumRoutines goroutines.
+	Optimized bool
+}
+
+// Operations lists every operation, each serial variant followed by its optimized variant.
+var Operations = []Operation{
+	{Name: "grayscale", Func: ProcessImageGrayscale, Apply: applyFunc(Grayscale), OutputName: "grayscaleProcessed.jpg"},
+	{Name: "grayscale-optimized", Func: ProcessImageGrayscaleOptimized, Apply: applyFunc(GrayscaleOptimized), OutputName: "grayscaleProcessedOptimized.jpg", Optimized: true},
+	{Name: "sharpen", Func: ProcessImageSharpen, Apply: applyFunc(Sharpen), OutputName: "sharpenProcessed.jpg"},
+	{Name: "sharpen-optimized", Func: ProcessImageSharpenOptimized, Apply: applyFunc(SharpenOptimized), OutputName: "sharpenProcessedOptimized.jpg", Optimized: true},
+}
+
+// applyFunc adapts an in-memory function to Operation.Apply.
+//
+// Notes:
+// - A failed call returns a nil image.Image, rather than an interface holding a nil pointer.
+func applyFunc[T image.Image](fn func(context.Context, image.Image) (T, error)) func(context.Context, image.Image) (image.Image, error) {
+	return func(ctx context.Context, img image.Image) (image.Image, error) {
+		processed, err := fn(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		return processed, nil
+	}
+}
+
+// Pipeline applies each operation's in-memory function in turn, passing the result of each to the next.
+//
+// Parameters:
+// - ctx: Cancels the pipeline, and carries pprof labels that are added to each operation's labels.
+// - ops: The operations to apply, in order.
+// - img: The image to process.
+//
+// Returns:
+// - image.Image: The result of the last operation, or img if ops is empty.
+// - error: The error of the first operation that fails. Otherwise, it returns nil.
+func Pipeline(ctx context.Context, ops []Operation, img image.Image) (image.Image, error) {
+	for _, op := range ops {
+		processed, err := op.Apply(ctx, img)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op.Name, err)
+		}
+		img = processed
+	}
+	return img, nil
+}
+
+// OutputPath returns the path of the operation's processed image in the given directory.
+func (op Operation) OutputPath(dir string) string {
+	return filepath.Join(dir, op.OutputName)
+}
+
+// OperationNames returns the names of every operation, in the order of Operations.
+func OperationNames() []string {
+	names := make([]string, len(Operations))
+	for i, op := range Operations {
+		names[i] = op.Name
+	}
+	return names
+}
+
+// PipelineName returns the comma separated names of a pipeline's operations, as they are written in -ops, e.g.
+// grayscale,sharpen-optimized.
+func PipelineName(ops []Operation) string {
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Name
+	}
+	return strings.Join(names, ",")
+}
+
+// OperationIndex returns the index of the named operation in Operations, or -1 if there is no such operation.
+func OperationIndex(name string) int {
+	for i, op := range Operations {
+		if op.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// LookupOperation returns the operation with the given name.
+//
+// Parameters:
+// - name: The operation's short name, e.g. sharpen-optimized.
+//
+// Returns:
+// - Operation: The named operation.
+// - bool: False if there is no operation with that name.
+func LookupOperation(name string) (Operation, bool) {
+	if i := OperationIndex(name); i >= 0 {
+		return Operations[i], true
+	}
+	return Operation{}, false
+}
+
+// ParseOperations parses a comma separated list of operation names.
+//
+// Parameters:
+// - list: Operation names separated by commas, e.g. "grayscale,sharpen-optimized". Empty names are ignored.
+//
+// Returns:
+// - []Operation: The named operations, in the order they were listed.
+// - error: If a name is unknown or the list names no operations, it returns an error. Otherwise, it returns nil.
+func ParseOperations(list string) ([]Operation, error) {
+	var ops []Operation
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		op, ok := LookupOperation(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %q (expected one of %s)", name, strings.Join(OperationNames(), ", "))
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("no operations in %q", list)
+	}
+	return ops, nil
+}
@@ -1,8 +1,10 @@
 package imageprocessing
 
 import (
+	"context"
 	"image"
 	"image/color"
+	"runtime/pprof"
 	"sync"
 )
 
@@ -18,6 +20,7 @@ var sharpenKernel = [3][3]int{
 // operation using a sharpening kernel. The result is saved to the specified output path.
 //
 // Parameters:
+// - ctx: Cancels the processing, and carries pprof labels that are added to the operation's labels.
 // - inputPath: Path to the source image which needs to be sharpened.
 // - outputPath: Path where the sharpened image will be saved.
 //
@@ -29,48 +32,34 @@ var sharpenKernel = [3][3]int{
 // - The function relies on external functions and variables:
 //   - getFileSize: Retrieves the size of a file.
 //   - decodeJPEG: Decodes a JPEG image from a given path.
-//   - sharpenKernel: A 3x3 array containing the kernel values for the sharpening operation.
+//   - sharpen: Applies the sharpening kernel to the decoded image.
 //   - saveProcessedJPEG: Saves the processed image to the given path.
+//   - withOperation: Labels the call with the caller's labels plus the operation name for CPU profiles.
 //
 // Notes:
 // - The image sharpening method used here is a basic convolution with a sharpening kernel.
 // - Advanced sharpening techniques might provide better results for specific use cases.
 // - The function assumes the image is in JPEG format. If used with another format, it may fail or produce unexpected results.
 // - The sharpening kernel values are crucial to the results. A different kernel might produce varied sharpening effects.
-func ProcessImageSharpen(inputPath string, outputPath string) (int64, error) {
-	size, err := getFileSize(inputPath)
+func ProcessImageSharpen(ctx context.Context, inputPath string, outputPath string) (int64, error) {
+	ctx, endOperation := withOperation(ctx, "ProcessImageSharpen")
+	defer endOperation()
+
+	size, err := getFileSize(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
-	img, err := decodeJPEG(inputPath)
+	img, err := decodeJPEG(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
 
-	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	processedImage := image.NewRGBA(bounds)
-
-	for y := 1; y < height-1; y++ {
-		for x := 1; x < width-1; x++ {
-			var rSum, gSum, bSum int
-			for ky := -1; ky <= 1; ky++ {
-				for kx := -1; kx <= 1; kx++ {
-					r, g, b, _ := img.At(x+kx, y+ky).RGBA()
-					kernelValue := sharpenKernel[ky+1][kx+1]
-					rSum += int(r) * kernelValue
-					gSum += int(g) * kernelValue
-					bSum += int(b) * kernelValue
-				}
-			}
-			rValue := uint8(min(max(rSum>>8, 0), 255))
-			gValue := uint8(min(max(gSum>>8, 0), 255))
-			bValue := uint8(min(max(bSum>>8, 0), 255))
-			processedImage.Set(x, y, color.RGBA{R: rValue, G: gValue, B: bValue, A: 255})
-		}
+	processedImage, err := sharpen(ctx, img)
+	if err != nil {
+		return 0, err
 	}
 
-	err = saveProcessedJPEG(outputPath, processedImage)
+	err = saveProcessedJPEG(ctx, outputPath, processedImage)
 	if err != nil {
 		return 0, err
 	}
@@ -84,6 +73,7 @@ func ProcessImageSharpen(inputPath string, outputPath string) (int64, error) {
 // and processing them concurrently with goroutines.
 //
 // Parameters:
+// - ctx: Cancels the processing, and carries pprof labels that are added to the operation's labels.
 // - inputPath: Path to the source image which needs to be sharpened.
 // - outputPath: Path where the sharpened image will be saved.
 //
@@ -95,23 +85,120 @@ func ProcessImageSharpen(inputPath string, outputPath string) (int64, error) {
 // - The function relies on external functions, variables, and constants:
 //   - getFileSize: Retrieves the size of a file.
 //   - decodeJPEG: Decodes a JPEG image from a given path.
-//   - sharpenKernel: A 3x3 array containing the kernel values for the sharpening operation.
+//   - sharpenOptimized: Applies the sharpening kernel to the decoded image concurrently.
 //   - saveProcessedJPEG: Saves the processed image to the given path.
-//   - NumRoutines: Constant that dictates how many goroutines should be spawned for concurrent processing.
+//   - withOperation: Labels the call with the caller's labels plus the operation name for CPU profiles.
 //
 // Notes:
 // - This optimized function breaks the image into sections and processes them concurrently for faster results.
 // - The sharpening kernel values remain crucial to the results. A different kernel might produce varied sharpening effects.
-func ProcessImageSharpenOptimized(inputPath string, outputPath string) (int64, error) {
-	size, err := getFileSize(inputPath)
+func ProcessImageSharpenOptimized(ctx context.Context, inputPath string, outputPath string) (int64, error) {
+	ctx, endOperation := withOperation(ctx, "ProcessImageSharpenOptimized")
+	defer endOperation()
+
+	size, err := getFileSize(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
-	img, err := decodeJPEG(inputPath)
+	img, err := decodeJPEG(ctx, inputPath)
 	if err != nil {
 		return 0, err
 	}
 
+	processedImage, err := sharpenOptimized(ctx, img)
+	if err != nil {
+		return 0, err
+	}
+
+	err = saveProcessedJPEG(ctx, outputPath, processedImage)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// Sharpen sharpens an in-memory image with the sharpening kernel, without any file I/O.
+//
+// Parameters:
+// - ctx: Cancels the operation, and carries pprof labels that are added to the operation's labels.
+// - img: The image to sharpen.
+//
+// Returns:
+// - *image.RGBA: The sharpened image.
+// - error: The context's error if it is cancelled before the operation completes. Otherwise, it returns nil.
+//
+// Notes:
+// - The convolution is the same as ProcessImageSharpen's, and the process stage is reported to the installed StageObserver.
+func Sharpen(ctx context.Context, img image.Image) (*image.RGBA, error) {
+	ctx, endOperation := withOperation(ctx, "Sharpen")
+	defer endOperation()
+
+	return sharpen(ctx, img)
+}
+
+// SharpenOptimized sharpens an in-memory image with the sharpening kernel concurrently, without any file I/O.
+//
+// Parameters:
+// - ctx: Cancels the operation, and carries pprof labels that are added to the operation's labels.
+// - img: The image to sharpen.
+//
+// Returns:
+// - *image.RGBA: The sharpened image.
+// - error: The context's error if it is cancelled before the operation completes. Otherwise, it returns nil.
+//
+// Notes:
+// - The image is split between NumRoutines goroutines, as in ProcessImageSharpenOptimized.
+func SharpenOptimized(ctx context.Context, img image.Image) (*image.RGBA, error) {
+	ctx, endOperation := withOperation(ctx, "SharpenOptimized")
+	defer endOperation()
+
+	return sharpenOptimized(ctx, img)
+}
+
+// sharpen is the pixel processing stage of ProcessImageSharpen and Sharpen.
+//
+// Notes:
+// - Cancellation is checked once per row.
+func sharpen(ctx context.Context, img image.Image) (*image.RGBA, error) {
+	defer startStage(ctx, StageProcess)()
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	processedImage := image.NewRGBA(bounds)
+
+	for y := 1; y < height-1; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := 1; x < width-1; x++ {
+			var rSum, gSum, bSum int
+			for ky := -1; ky <= 1; ky++ {
+				for kx := -1; kx <= 1; kx++ {
+					r, g, b, _ := img.At(x+kx, y+ky).RGBA()
+					kernelValue := sharpenKernel[ky+1][kx+1]
+					rSum += int(r) * kernelValue
+					gSum += int(g) * kernelValue
+					bSum += int(b) * kernelValue
+				}
+			}
+			rValue := uint8(min(max(rSum>>8, 0), 255))
+			gValue := uint8(min(max(gSum>>8, 0), 255))
+			bValue := uint8(min(max(bSum>>8, 0), 255))
+			processedImage.Set(x, y, color.RGBA{R: rValue, G: gValue, B: bValue, A: 255})
+		}
+	}
+
+	return processedImage, nil
+}
+
+// sharpenOptimized is the pixel processing stage of ProcessImageSharpenOptimized and SharpenOptimized.
+//
+// Notes:
+// - Each worker checks for cancellation once per row, and the context's error is returned once all have stopped.
+func sharpenOptimized(ctx context.Context, img image.Image) (*image.RGBA, error) {
+	defer startStage(ctx, StageProcess)()
+
 	bounds := img.Bounds()
 	processedImage := image.NewRGBA(bounds)
 
@@ -125,16 +212,14 @@ func ProcessImageSharpenOptimized(inputPath string, outputPath string) (int64, e
 			endY = bounds.Max.Y
 		}
 		wg.Add(1)
-		go sharpenConcurrent(img, startY, endY, &wg, processedImage)
+		go sharpenConcurrent(ctx, i, img, startY, endY, &wg, processedImage)
 	}
 	wg.Wait()
 
-	err = saveProcessedJPEG(outputPath, processedImage)
-	if err != nil {
-		return 0, err
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-
-	return size, nil
+	return processedImage, nil
 }
 
 // sharpenConcurrent is a helper function for ProcessImageSharpenOptimized.
@@ -142,6 +227,8 @@ func ProcessImageSharpenOptimized(inputPath string, outputPath string) (int64, e
 // from start to end rows concurrently.
 //
 // Parameters:
+// - ctx: The operation's context, whose labels the worker's labels are added to.
+// - worker: Index of the worker, used to label its samples in CPU profiles.
 // - img: The original image that needs sharpening.
 // - start: Starting row of the section to be processed.
 // - end: Ending row of the section to be processed.
@@ -154,27 +241,35 @@ func ProcessImageSharpenOptimized(inputPath string, outputPath string) (int64, e
 // Notes:
 // - This function is intended to be used as a goroutine.
 // - The function doesn't handle border rows since they don't have enough neighbors for convolution.
-func sharpenConcurrent(img image.Image, start, end int, wg *sync.WaitGroup, output *image.RGBA) {
+// - Samples are labelled with the operation, the process stage, the worker index and its row range.
+func sharpenConcurrent(ctx context.Context, worker int, img image.Image, start, end int, wg *sync.WaitGroup, output *image.RGBA) {
 	defer wg.Done()
-	bounds := img.Bounds()
-	width := bounds.Dx()
 
-	for y := start; y < end; y++ {
-		for x := 1; x < width-1; x++ {
-			var rSum, gSum, bSum int
-			for ky := -1; ky <= 1; ky++ {
-				for kx := -1; kx <= 1; kx++ {
-					r, g, b, _ := img.At(x+kx, y+ky).RGBA()
-					kernelValue := sharpenKernel[ky+1][kx+1]
-					rSum += int(r) * kernelValue
-					gSum += int(g) * kernelValue
-					bSum += int(b) * kernelValue
+	ctx = pprof.WithLabels(ctx, pprof.Labels(LabelStage, StageProcess.String()))
+	pprof.Do(ctx, WorkerLabels(worker, start, end), func(ctx context.Context) {
+		bounds := img.Bounds()
+		width := bounds.Dx()
+
+		for y := start; y < end; y++ {
+			if ctx.Err() != nil {
+				return
+			}
+			for x := 1; x < width-1; x++ {
+				var rSum, gSum, bSum int
+				for ky := -1; ky <= 1; ky++ {
+					for kx := -1; kx <= 1; kx++ {
+						r, g, b, _ := img.At(x+kx, y+ky).RGBA()
+						kernelValue := sharpenKernel[ky+1][kx+1]
+						rSum += int(r) * kernelValue
+						gSum += int(g) * kernelValue
+						bSum += int(b) * kernelValue
+					}
 				}
+				rValue := uint8(min(max(rSum>>8, 0), 255))
+				gValue := uint8(min(max(gSum>>8, 0), 255))
+				bValue := uint8(min(max(bSum>>8, 0), 255))
+				output.Set(x, y, color.RGBA{R: rValue, G: gValue, B: bValue, A: 255})
 			}
-			rValue := uint8(min(max(rSum>>8, 0), 255))
-			gValue := uint8(min(max(gSum>>8, 0), 255))
-			bValue := uint8(min(max(bSum>>8, 0), 255))
-			output.Set(x, y, color.RGBA{R: rValue, G: gValue, B: bValue, A: 255})
 		}
-	}
+	})
 }
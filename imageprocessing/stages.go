@@ -0,0 +1,121 @@
+package imageprocessing
+
+import (
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// Stage is one step of an image processing function: file stat, decode, pixel processing or encode.
+type Stage int
+
+const (
+	StageStat Stage = iota
+	StageDecode
+	StageProcess
+	StageEncode
+
+	// NumStages is the number of stages, for sizing StageTimings.
+	NumStages
+)
+
+// stageNames are the display names of each stage, indexed by Stage.
+var stageNames = [NumStages]string{"stat", "decode", "process", "encode"}
+
+// String returns the display name of the stage.
+func (s Stage) String() string {
+	if s < 0 || s >= NumStages {
+		return "unknown"
+	}
+	return stageNames[s]
+}
+
+// StageTiming is the time taken and memory allocated by a single stage.
+type StageTiming struct {
+	Duration       time.Duration
+	BytesAllocated uint64
+	Allocations    uint64
+}
+
+// Add returns the sum of two timings, for stages that run more than once.
+func (t StageTiming) Add(other StageTiming) StageTiming {
+	return StageTiming{
+		Duration:       t.Duration + other.Duration,
+		BytesAllocated: t.BytesAllocated + other.BytesAllocated,
+		Allocations:    t.Allocations + other.Allocations,
+	}
+}
+
+// StageTimings holds a StageTiming for every stage, indexed by Stage.
+type StageTimings [NumStages]StageTiming
+
+// StageObserver is called with the timing of each stage once it completes.
+type StageObserver func(stage Stage, timing StageTiming)
+
+var (
+	stageObserverMu sync.RWMutex
+	stageObserver   StageObserver
+)
+
+// SetStageObserver installs an observer that is called as each stage of the processing functions completes.
+//
+// Parameters:
+// - observer: The observer to install, or nil to stop observing.
+//
+// Returns:
+// - func(): Restores the previously installed observer.
+//
+// Notes:
+//   - Stages are only timed while an observer is installed, since measuring allocations requires runtime.ReadMemStats.
+//   - The observer is package wide. Allocation figures include anything allocated by other goroutines during the stage,
+//     so timings are only meaningful when one processing function runs at a time, as under common.Wrap.
+func SetStageObserver(observer StageObserver) func() {
+	stageObserverMu.Lock()
+	previous := stageObserver
+	stageObserver = observer
+	stageObserverMu.Unlock()
+
+	return func() {
+		stageObserverMu.Lock()
+		stageObserver = previous
+		stageObserverMu.Unlock()
+	}
+}
+
+// startStage labels the calling goroutine with a stage and starts timing it.
+//
+// Parameters:
+// - ctx: The operation's context, as returned by withOperation.
+// - stage: The stage being started.
+//
+// Returns:
+//   - func(): Ends the stage, restores the goroutine's labels to ctx and reports the stage's timing to the installed
+//     observer. Intended to be deferred, or called once the stage's work is done.
+func startStage(ctx context.Context, stage Stage) func() {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(LabelStage, stage.String())))
+
+	stageObserverMu.RLock()
+	observer := stageObserver
+	stageObserverMu.RUnlock()
+	if observer == nil {
+		return func() { pprof.SetGoroutineLabels(ctx) }
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	return func() {
+		elapsed := time.Since(start)
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		pprof.SetGoroutineLabels(ctx)
+		observer(stage, StageTiming{
+			Duration:       elapsed,
+			BytesAllocated: after.TotalAlloc - before.TotalAlloc,
+			Allocations:    after.Mallocs - before.Mallocs,
+		})
+	}
+}
@@ -3,11 +3,8 @@ package imageprocessing
 import "runtime"
 
 const (
-	InputPath                    = "./imageprocessing/inputs/input.jpg"
-	OutputGrayscalePath          = "./imageprocessing/outputs/grayscaleProcessed.jpg"
-	OutputGrayscaleOptimizedPath = "./imageprocessing/outputs/grayscaleProcessedOptimized.jpg"
-	OutputSharpenPath            = "./imageprocessing/outputs/sharpenProcessed.jpg"
-	OutputSharpenOptimizedPath   = "./imageprocessing/outputs/sharpenProcessedOptimized.jpg"
+	DefaultInputPath = "./imageprocessing/inputs/input.jpg"
+	DefaultOutputDir = "./imageprocessing/outputs"
 )
 
 var NumRoutines = runtime.NumCPU()
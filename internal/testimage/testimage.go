@@ -0,0 +1,61 @@
+// Package testimage provides the small synthetic image that the tests of the other packages process.
+package testimage
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Width and Height are the dimensions of the test image, in pixels.
+const (
+	Width  = 40
+	Height = 30
+)
+
+// Image returns the test image: a Width x Height gradient, red across and green down.
+func Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, Width, Height))
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), G: uint8(y * 8), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// Encode returns the test image encoded with the given function, e.g. png.Encode. It fails the test if the image
+// cannot be encoded.
+func Encode(t testing.TB, encode func(io.Writer, image.Image) error) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encode(&buf, Image()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// JPEG returns the test image encoded as a JPEG with the default options.
+func JPEG(t testing.TB) []byte {
+	t.Helper()
+	return Encode(t, func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, nil)
+	})
+}
+
+// WriteJPEG writes the test image, encoded as a JPEG, to the given path, creating its directory first. It fails
+// the test if the file cannot be written.
+func WriteJPEG(t testing.TB, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, JPEG(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
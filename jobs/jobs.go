@@ -0,0 +1,573 @@
+// Package jobs runs long operations asynchronously: a job is submitted with its input, queued by priority, processed
+// by a bounded pool of workers and kept on local disk with its result, so that callers can poll its status, fetch
+// its result or be notified by a webhook instead of waiting for it.
+package jobs
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults of the Config options.
+const (
+	DefaultDir            = "./jobs"
+	DefaultMaxQueued      = 1000
+	DefaultRetention      = 24 * time.Hour
+	DefaultMaxFinished    = 1000
+	DefaultWebhookRetries = 3
+	DefaultWebhookBackoff = time.Second
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNotFound is returned for an unknown job ID.
+	ErrNotFound = errors.New("job not found")
+
+	// ErrNotDone is returned by Result for a job that has not completed successfully.
+	ErrNotDone = errors.New("job is not done")
+
+	// ErrFinished is returned by Cancel for a job that has already finished.
+	ErrFinished = errors.New("job has already finished")
+
+	// ErrQueueFull is returned by Submit when MaxQueued jobs are already waiting.
+	ErrQueueFull = errors.New("job queue full")
+
+	// ErrClosed is returned by Submit after the queue has been closed.
+	ErrClosed = errors.New("job queue closed")
+)
+
+// Status is the state of a job.
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusDone      Status = "done"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Finished reports whether a job in this state will not change anymore.
+func (s Status) Finished() bool {
+	return s == StatusDone || s == StatusFailed || s == StatusCancelled
+}
+
+// Request is a job to submit.
+type Request struct {
+	// Operations and Format describe the work to the Process func, e.g. a pipeline and an output format.
+	Operations string
+	Format     string
+
+	// Priority orders the queue: jobs with a higher priority are started first, and jobs with the same priority in
+	// the order they were submitted.
+	Priority int
+
+	// Webhook, if set, is the URL the job is posted to as JSON once it has finished.
+	Webhook string
+
+	Input []byte
+}
+
+// Job is the state of a submitted job, as persisted to disk and returned by the queue's operations.
+type Job struct {
+	ID         string `json:"id"`
+	Status     Status `json:"status"`
+	Operations string `json:"operations"`
+	Format     string `json:"format,omitempty"`
+	Priority   int    `json:"priority"`
+	Webhook    string `json:"webhook,omitempty"`
+
+	InputBytes  int64  `json:"inputBytes"`
+	OutputBytes int64  `json:"outputBytes,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	// WebhookStatus is the HTTP status code of the last webhook delivery, and WebhookError why it failed.
+	WebhookStatus int    `json:"webhookStatus,omitempty"`
+	WebhookError  string `json:"webhookError,omitempty"`
+
+	// seq orders the jobs submitted with the same priority.
+	seq uint64
+}
+
+// ProcessFunc processes the input of a job, and returns the result with its content type. It must return promptly
+// once its context is done.
+type ProcessFunc func(ctx context.Context, job Job, input []byte) ([]byte, string, error)
+
+// Config configures a Queue.
+type Config struct {
+	// Dir is the directory the jobs, their inputs and their results are persisted in. It defaults to DefaultDir.
+	Dir string
+
+	// Process processes each job. It is required.
+	Process ProcessFunc
+
+	// Concurrency is the number of jobs processed at the same time. It defaults to runtime.NumCPU().
+	Concurrency int
+
+	// MaxQueued is the number of jobs that can wait to be started before Submit fails with ErrQueueFull. It
+	// defaults to DefaultMaxQueued.
+	MaxQueued int
+
+	// Retention is how long finished jobs are kept, with their input and result, and MaxFinished how many of them
+	// are kept at most, the oldest being removed first. They default to DefaultRetention and DefaultMaxFinished, and
+	// negative values disable the limit.
+	Retention   time.Duration
+	MaxFinished int
+
+	// WebhookRetries is the number of times a failed webhook delivery is retried, with exponential backoff
+	// starting at WebhookBackoff. Negative disables retries.
+	WebhookRetries int
+	WebhookBackoff time.Duration
+
+	// Client posts the webhooks. It defaults to an http.Client with DefaultWebhookTimeout.
+	Client *http.Client
+}
+
+// entry is a job held by the queue.
+type entry struct {
+	job    Job
+	cancel context.CancelFunc
+
+	// cancelled is set when Cancel stops the running job, so that it is not mistaken for a shutdown.
+	cancelled bool
+
+	// index is the position of a queued job in the pending heap, or -1.
+	index int
+}
+
+// Queue is an in-process job queue, persisted to disk.
+//
+// Notes:
+//   - A Queue is safe for concurrent use.
+//   - Jobs that were queued or running when the previous queue over the same directory was closed or crashed are
+//     queued again when it is opened, and processed from the start.
+//   - Finished jobs are removed from memory and disk, with their input and result, once they are older than
+//     Retention or more than MaxFinished jobs have finished after them. They are pruned whenever a job finishes,
+//     and when the queue is opened.
+type Queue struct {
+	cfg   Config
+	store *store
+
+	ctx      context.Context
+	shutdown context.CancelFunc
+	workers  sync.WaitGroup
+	webhooks sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    map[string]*entry
+	pending pendingHeap
+	seq     uint64
+	closed  bool
+}
+
+// Open loads the jobs persisted in the configured directory, creating it if needed, and starts the workers.
+//
+// Parameters:
+// - cfg: The directory, the processing func and the limits of the queue. Zero values are replaced by the defaults.
+//
+// Returns:
+// - *Queue: The running queue. Call Close to stop it.
+// - error: If Process is not set or the directory cannot be created or read, it returns the error. Otherwise, it returns nil.
+func Open(cfg Config) (*Queue, error) {
+	if cfg.Process == nil {
+		return nil, errors.New("no process func")
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDir
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = runtime.NumCPU()
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = DefaultMaxQueued
+	}
+	if cfg.Retention == 0 {
+		cfg.Retention = DefaultRetention
+	}
+	if cfg.MaxFinished == 0 {
+		cfg.MaxFinished = DefaultMaxFinished
+	}
+	if cfg.WebhookRetries < 0 {
+		cfg.WebhookRetries = 0
+	} else if cfg.WebhookRetries == 0 {
+		cfg.WebhookRetries = DefaultWebhookRetries
+	}
+	if cfg.WebhookBackoff <= 0 {
+		cfg.WebhookBackoff = DefaultWebhookBackoff
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+
+	st, err := openStore(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := st.load()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{cfg: cfg, store: st, jobs: map[string]*entry{}}
+	q.cond = sync.NewCond(&q.mu)
+	q.ctx, q.shutdown = context.WithCancel(context.Background())
+
+	// Jobs are requeued in the order they were submitted
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Submitted.Before(loaded[j].Submitted) })
+	for _, job := range loaded {
+		q.seq++
+		job.seq = q.seq
+		e := &entry{job: job, index: -1}
+		q.jobs[job.ID] = e
+		if job.Status.Finished() {
+			continue
+		}
+		e.job.Status, e.job.Started = StatusQueued, nil
+		if err := q.store.save(e.job); err != nil {
+			return nil, err
+		}
+		heap.Push(&q.pending, e)
+	}
+	q.pruneLocked(time.Now())
+
+	for i := 0; i < cfg.Concurrency; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// Submit persists a job and queues it.
+//
+// Returns:
+// - Job: The queued job, with its ID.
+// - error: ErrQueueFull or ErrClosed if the job cannot be queued, or the error persisting it. Otherwise, it returns nil.
+//
+// Notes:
+//   - The input and the job are written to disk before the queue is locked, so that a large upload does not hold up
+//     the other calls and the workers. They are removed again if the queue closed or filled up in the meantime.
+func (q *Queue) Submit(req Request) (Job, error) {
+	if err := q.accepting(); err != nil {
+		return Job{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := Job{
+		ID:         id,
+		Status:     StatusQueued,
+		Operations: req.Operations,
+		Format:     req.Format,
+		Priority:   req.Priority,
+		Webhook:    req.Webhook,
+		InputBytes: int64(len(req.Input)),
+		Submitted:  time.Now(),
+	}
+	if err := q.store.saveInput(id, req.Input); err != nil {
+		return Job{}, err
+	}
+	if err := q.store.save(job); err != nil {
+		q.store.remove(id)
+		return Job{}, err
+	}
+
+	q.mu.Lock()
+	if err := q.acceptingLocked(); err != nil {
+		q.mu.Unlock()
+		q.store.remove(id)
+		return Job{}, err
+	}
+	q.seq++
+	job.seq = q.seq
+	e := &entry{job: job, index: -1}
+	q.jobs[id] = e
+	heap.Push(&q.pending, e)
+	q.cond.Signal()
+	q.mu.Unlock()
+	return job, nil
+}
+
+// accepting returns ErrClosed if the queue is closed, or ErrQueueFull if it holds MaxQueued pending jobs.
+func (q *Queue) accepting() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.acceptingLocked()
+}
+
+// acceptingLocked is accepting, for callers holding q.mu.
+func (q *Queue) acceptingLocked() error {
+	if q.closed {
+		return ErrClosed
+	}
+	if q.pending.Len() >= q.cfg.MaxQueued {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Status returns the current state of a job, or ErrNotFound.
+func (q *Queue) Status(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return e.job, nil
+}
+
+// Jobs returns the state of every job, in the order they were submitted.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, e := range q.jobs {
+		jobs = append(jobs, e.job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].seq < jobs[j].seq })
+	return jobs
+}
+
+// Result returns the result of a job that is done, along with its state.
+//
+// Returns:
+// - []byte: The result, with the content type recorded in Job.ContentType.
+// - Job: The state of the job.
+// - error: ErrNotFound, ErrNotDone if the job is not done, or the error reading the result. Otherwise, it returns nil.
+func (q *Queue) Result(id string) ([]byte, Job, error) {
+	job, err := q.Status(id)
+	if err != nil {
+		return nil, job, err
+	}
+	if job.Status != StatusDone {
+		return nil, job, ErrNotDone
+	}
+	data, err := q.store.readResult(id)
+	return data, job, err
+}
+
+// Cancel cancels a job. A queued job is cancelled immediately, and a running one as soon as its ProcessFunc returns,
+// unless it succeeds anyway.
+//
+// Returns:
+// - Job: The state of the job, cancelled if it was queued, and still running if it was running.
+// - error: ErrNotFound, ErrFinished if the job has already finished, or the error persisting it. Otherwise, it returns nil.
+func (q *Queue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	switch e.job.Status {
+	case StatusQueued:
+		heap.Remove(&q.pending, e.index)
+		q.finish(e, StatusCancelled, nil, "", nil)
+		return e.job, q.store.save(e.job)
+	case StatusRunning:
+		e.cancelled = true
+		e.cancel()
+		return e.job, nil
+	default:
+		return e.job, ErrFinished
+	}
+}
+
+// Close stops starting jobs, interrupts the running ones and waits for the workers and the webhooks in flight to
+// return, or for the context to be done.
+//
+// Notes:
+//   - Interrupted jobs are persisted as queued, so that they are processed again when the directory is reopened.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		q.webhooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work processes queued jobs until the queue is closed.
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for {
+		q.mu.Lock()
+		for q.pending.Len() == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		e := heap.Pop(&q.pending).(*entry)
+		ctx, cancel := context.WithCancel(q.ctx)
+		now := time.Now()
+		e.job.Status, e.job.Started, e.cancel = StatusRunning, &now, cancel
+		job := e.job
+		q.saveLocked(e.job)
+		q.mu.Unlock()
+
+		q.run(ctx, e, job)
+		cancel()
+	}
+}
+
+// run processes one job and records its outcome.
+func (q *Queue) run(ctx context.Context, e *entry, job Job) {
+	var output []byte
+	var contentType string
+	input, err := q.store.readInput(job.ID)
+	if err == nil {
+		output, contentType, err = q.cfg.Process(ctx, job, input)
+	}
+	if err == nil {
+		err = q.store.saveResult(job.ID, output)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case err == nil:
+		// A job that completed while it was cancelled or the queue was closed is done, as its result is saved
+		q.finish(e, StatusDone, output, contentType, nil)
+	case e.cancelled:
+		q.finish(e, StatusCancelled, nil, "", nil)
+	case q.ctx.Err() != nil:
+		// Interrupted by Close: left queued on disk, to be processed again once reopened
+		e.job.Status, e.job.Started = StatusQueued, nil
+	default:
+		q.finish(e, StatusFailed, nil, "", err)
+	}
+	e.cancel = nil
+	q.saveLocked(e.job)
+}
+
+// finish records the outcome of a job, with the error it failed with, and, if it has a webhook, starts delivering
+// it. It then prunes the finished jobs. q.mu must be held.
+func (q *Queue) finish(e *entry, status Status, output []byte, contentType string, err error) {
+	now := time.Now()
+	e.job.Status, e.job.Finished = status, &now
+	e.job.OutputBytes, e.job.ContentType = int64(len(output)), contentType
+	if err != nil {
+		e.job.Error = err.Error()
+	}
+	if e.job.Webhook != "" {
+		q.webhooks.Add(1)
+		go q.notify(e.job)
+	}
+	q.pruneLocked(now)
+}
+
+// pruneLocked removes the finished jobs that are older than Retention, or beyond the MaxFinished most recent ones,
+// from memory and disk. q.mu must be held.
+func (q *Queue) pruneLocked(now time.Time) {
+	var finished []*entry
+	for _, e := range q.jobs {
+		if e.job.Status.Finished() {
+			finished = append(finished, e)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finishedAt(finished[i].job).Before(finishedAt(finished[j].job)) })
+
+	// The oldest jobs come first, so the first one kept is followed by no job to remove
+	for i, e := range finished {
+		expired := q.cfg.Retention > 0 && now.Sub(finishedAt(e.job)) > q.cfg.Retention
+		excess := q.cfg.MaxFinished > 0 && len(finished)-i > q.cfg.MaxFinished
+		if !expired && !excess {
+			return
+		}
+		delete(q.jobs, e.job.ID)
+		q.store.remove(e.job.ID)
+	}
+}
+
+// finishedAt returns when a finished job finished, or when it was submitted for jobs loaded as failed without
+// having run.
+func finishedAt(job Job) time.Time {
+	if job.Finished != nil {
+		return *job.Finished
+	}
+	return job.Submitted
+}
+
+// saveLocked persists a job, reporting failures on the job's state rather than to a caller. q.mu must be held.
+func (q *Queue) saveLocked(job Job) {
+	if err := q.store.save(job); err != nil {
+		fmt.Fprintf(os.Stderr, "could not save job %s: %v\n", job.ID, err)
+	}
+}
+
+// newID returns a random job ID.
+func newID() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// pendingHeap orders the queued jobs by priority, then submission. It implements heap.Interface.
+type pendingHeap []*entry
+
+func (h pendingHeap) Len() int {
+	return len(h)
+}
+
+func (h pendingHeap) Less(i, j int) bool {
+	if h[i].job.Priority != h[j].job.Priority {
+		return h[i].job.Priority > h[j].job.Priority
+	}
+	return h[i].job.seq < h[j].job.seq
+}
+
+func (h pendingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *pendingHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *pendingHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,427 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// upper is a ProcessFunc returning its input in upper case.
+func upper(ctx context.Context, job Job, input []byte) ([]byte, string, error) {
+	return bytes.ToUpper(input), "text/plain", nil
+}
+
+// open opens a queue over a temporary directory, and closes it when the test ends.
+func open(t *testing.T, cfg Config) *Queue {
+	if cfg.Dir == "" {
+		cfg.Dir = t.TempDir()
+	}
+	q, err := Open(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { q.Close(context.Background()) })
+	return q
+}
+
+// wait waits for a job to reach the given status.
+func wait(t *testing.T, q *Queue, id string, status Status) Job {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := q.Status(id)
+		assert.NoError(t, err)
+		if job.Status == status || time.Now().After(deadline) {
+			assert.Equal(t, status, job.Status, id)
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestQueue ensures that submitted jobs are processed, and that their status and result can be retrieved.
+func TestQueue(t *testing.T) {
+	failure := errors.New("failed")
+	q := open(t, Config{Process: func(ctx context.Context, job Job, input []byte) ([]byte, string, error) {
+		if job.Operations == "fail" {
+			return nil, "", failure
+		}
+		return upper(ctx, job, input)
+	}})
+
+	job, err := q.Submit(Request{Operations: "upper", Format: "text", Input: []byte("hello")})
+	assert.NoError(t, err)
+	assert.Len(t, job.ID, 16)
+	assert.Equal(t, StatusQueued, job.Status)
+	assert.Equal(t, int64(5), job.InputBytes)
+
+	job = wait(t, q, job.ID, StatusDone)
+	assert.Equal(t, int64(5), job.OutputBytes)
+	assert.NotNil(t, job.Started)
+	assert.NotNil(t, job.Finished)
+	data, resultJob, err := q.Result(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "HELLO", string(data))
+	assert.Equal(t, "text/plain", resultJob.ContentType)
+
+	failed, err := q.Submit(Request{Operations: "fail", Input: []byte("hello")})
+	assert.NoError(t, err)
+	failed = wait(t, q, failed.ID, StatusFailed)
+	assert.Equal(t, "failed", failed.Error)
+	_, _, err = q.Result(failed.ID)
+	assert.ErrorIs(t, err, ErrNotDone)
+
+	_, err = q.Status("nope")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, _, err = q.Result("nope")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = q.Cancel("nope")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = q.Cancel(job.ID)
+	assert.ErrorIs(t, err, ErrFinished)
+
+	jobs := q.Jobs()
+	if assert.Len(t, jobs, 2) {
+		assert.Equal(t, job.ID, jobs[0].ID)
+		assert.Equal(t, failed.ID, jobs[1].ID)
+	}
+
+	_, err = Open(Config{Dir: t.TempDir()})
+	assert.Error(t, err)
+}
+
+// blocker is a ProcessFunc that records the jobs it starts, and blocks each one until it is released or cancelled.
+type blocker struct {
+	mu      sync.Mutex
+	started []string
+	running int
+	peak    int
+	release chan struct{}
+}
+
+func newBlocker() *blocker {
+	return &blocker{release: make(chan struct{})}
+}
+
+func (b *blocker) process(ctx context.Context, job Job, input []byte) ([]byte, string, error) {
+	b.mu.Lock()
+	b.started = append(b.started, job.Operations)
+	b.running++
+	if b.running > b.peak {
+		b.peak = b.running
+	}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.running--
+		b.mu.Unlock()
+	}()
+
+	select {
+	case <-b.release:
+		return input, "text/plain", nil
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+}
+
+// TestPriority ensures that queued jobs are started by priority, then in the order they were submitted.
+func TestPriority(t *testing.T) {
+	b := newBlocker()
+	q := open(t, Config{Process: b.process, Concurrency: 1})
+
+	first, _ := q.Submit(Request{Operations: "first", Priority: -5})
+	wait(t, q, first.ID, StatusRunning)
+
+	var ids []string
+	for _, req := range []Request{
+		{Operations: "low", Priority: -1},
+		{Operations: "normal"},
+		{Operations: "high", Priority: 10},
+		{Operations: "normal again"},
+	} {
+		job, err := q.Submit(req)
+		assert.NoError(t, err)
+		ids = append(ids, job.ID)
+	}
+	close(b.release)
+	for _, id := range ids {
+		wait(t, q, id, StatusDone)
+	}
+	assert.Equal(t, []string{"first", "high", "normal", "normal again", "low"}, b.started)
+}
+
+// TestConcurrency ensures that no more than Concurrency jobs run at the same time.
+func TestConcurrency(t *testing.T) {
+	b := newBlocker()
+	q := open(t, Config{Process: b.process, Concurrency: 2})
+
+	var jobs []Job
+	for i := 0; i < 5; i++ {
+		job, err := q.Submit(Request{})
+		assert.NoError(t, err)
+		jobs = append(jobs, job)
+	}
+	wait(t, q, jobs[0].ID, StatusRunning)
+	wait(t, q, jobs[1].ID, StatusRunning)
+	time.Sleep(10 * time.Millisecond)
+	job, _ := q.Status(jobs[2].ID)
+	assert.Equal(t, StatusQueued, job.Status)
+
+	close(b.release)
+	for _, job := range jobs {
+		wait(t, q, job.ID, StatusDone)
+	}
+	assert.Equal(t, 2, b.peak)
+}
+
+// TestCancel ensures that queued and running jobs can be cancelled.
+func TestCancel(t *testing.T) {
+	b := newBlocker()
+	q := open(t, Config{Process: b.process, Concurrency: 1})
+
+	running, _ := q.Submit(Request{Operations: "running"})
+	queued, _ := q.Submit(Request{Operations: "queued"})
+	wait(t, q, running.ID, StatusRunning)
+
+	job, err := q.Cancel(queued.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCancelled, job.Status)
+
+	job, err = q.Cancel(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRunning, job.Status)
+	job = wait(t, q, running.ID, StatusCancelled)
+	assert.Empty(t, job.Error)
+
+	_, err = q.Cancel(running.ID)
+	assert.ErrorIs(t, err, ErrFinished)
+	assert.Equal(t, []string{"running"}, b.started)
+}
+
+// TestQueueFull ensures that Submit fails once MaxQueued jobs are waiting, and after the queue is closed, without
+// leaving the rejected jobs' files behind.
+func TestQueueFull(t *testing.T) {
+	b := newBlocker()
+	dir := t.TempDir()
+	q := open(t, Config{Dir: dir, Process: b.process, Concurrency: 1, MaxQueued: 1})
+
+	running, _ := q.Submit(Request{})
+	wait(t, q, running.ID, StatusRunning)
+	_, err := q.Submit(Request{})
+	assert.NoError(t, err)
+	files, _ := os.ReadDir(dir)
+	_, err = q.Submit(Request{Input: []byte("rejected")})
+	assert.ErrorIs(t, err, ErrQueueFull)
+	after, _ := os.ReadDir(dir)
+	assert.Len(t, after, len(files))
+
+	assert.NoError(t, q.Close(context.Background()))
+	_, err = q.Submit(Request{})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+// TestPersistence ensures that jobs survive the queue being closed and reopened: finished jobs keep their results,
+// and interrupted jobs are processed again.
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(Config{Dir: dir, Process: upper})
+	assert.NoError(t, err)
+	done, _ := q.Submit(Request{Operations: "done", Input: []byte("done")})
+	wait(t, q, done.ID, StatusDone)
+	assert.NoError(t, q.Close(context.Background()))
+
+	b := newBlocker()
+	q, err = Open(Config{Dir: dir, Process: b.process, Concurrency: 1})
+	assert.NoError(t, err)
+	interrupted, _ := q.Submit(Request{Operations: "interrupted", Input: []byte("interrupted")})
+	queued, _ := q.Submit(Request{Operations: "queued", Priority: -1, Input: []byte("queued")})
+	wait(t, q, interrupted.ID, StatusRunning)
+	assert.NoError(t, q.Close(context.Background()))
+
+	// A crash leaves temporary files and the state of unfinished jobs behind
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".crash.json.123"), []byte("{"), 0o644))
+	lost := Job{ID: "lost", Status: StatusRunning, Submitted: time.Now()}
+	data, _ := json.Marshal(lost)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "lost.json"), data, 0o644))
+
+	q = open(t, Config{Dir: dir, Process: upper})
+	wait(t, q, interrupted.ID, StatusDone)
+	wait(t, q, queued.ID, StatusDone)
+	for id, want := range map[string]string{done.ID: "DONE", interrupted.ID: "INTERRUPTED", queued.ID: "QUEUED"} {
+		result, _, err := q.Result(id)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(result))
+	}
+	job, err := q.Status("lost")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusFailed, job.Status)
+	assert.Contains(t, job.Error, "input lost")
+	assert.Len(t, q.Jobs(), 4)
+}
+
+// TestCloseCompleted ensures that a job that completes while the queue is closing is done, rather than queued
+// again and processed a second time once the queue is reopened.
+func TestCloseCompleted(t *testing.T) {
+	dir := t.TempDir()
+	started := make(chan struct{})
+	q, err := Open(Config{Dir: dir, Process: func(ctx context.Context, job Job, input []byte) ([]byte, string, error) {
+		close(started)
+		<-ctx.Done()
+		return upper(ctx, job, input)
+	}})
+	assert.NoError(t, err)
+	job, _ := q.Submit(Request{Input: []byte("late")})
+	<-started
+	assert.NoError(t, q.Close(context.Background()))
+
+	q = open(t, Config{Dir: dir, Process: func(ctx context.Context, job Job, input []byte) ([]byte, string, error) {
+		t.Errorf("job %s processed again", job.ID)
+		return nil, "", nil
+	}})
+	job, err = q.Status(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusDone, job.Status)
+	result, _, err := q.Result(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "LATE", string(result))
+}
+
+// TestRetention ensures that finished jobs are removed from memory and disk beyond MaxFinished, and once they are
+// older than Retention, while queued jobs are kept.
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, Config{Dir: dir, Process: upper, MaxFinished: 2, Retention: -1})
+	var ids []string
+	for _, input := range []string{"a", "b", "c"} {
+		job, err := q.Submit(Request{Input: []byte(input)})
+		assert.NoError(t, err)
+		wait(t, q, job.ID, StatusDone)
+		ids = append(ids, job.ID)
+	}
+	_, err := q.Status(ids[0])
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoFileExists(t, filepath.Join(dir, ids[0]+".json"))
+	assert.NoFileExists(t, filepath.Join(dir, ids[0]+".input"))
+	assert.NoFileExists(t, filepath.Join(dir, ids[0]+".result"))
+	assert.FileExists(t, filepath.Join(dir, ids[1]+".result"))
+	assert.Len(t, q.Jobs(), 2)
+
+	dir = t.TempDir()
+	b := newBlocker()
+	q = open(t, Config{Dir: dir, Process: b.process, Concurrency: 1, Retention: 20 * time.Millisecond, MaxFinished: -1})
+	old, _ := q.Submit(Request{Input: []byte("old")})
+	wait(t, q, old.ID, StatusRunning)
+	queued, _ := q.Submit(Request{Input: []byte("queued")})
+	b.release <- struct{}{}
+	wait(t, q, old.ID, StatusDone)
+	time.Sleep(50 * time.Millisecond)
+	b.release <- struct{}{}
+	wait(t, q, queued.ID, StatusDone)
+	_, err = q.Status(old.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoFileExists(t, filepath.Join(dir, old.ID+".input"))
+	assert.Len(t, q.Jobs(), 1)
+}
+
+// TestWebhook ensures that finished jobs are posted to their webhook, and that failed deliveries are retried.
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []Job
+	var events []string
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var job Job
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&job))
+		received = append(received, job)
+		events = append(events, r.Header.Get(WebhookEvent))
+	}))
+	defer receiver.Close()
+
+	b := newBlocker()
+	close(b.release)
+	q := open(t, Config{Process: b.process, WebhookBackoff: time.Millisecond})
+	job, err := q.Submit(Request{Operations: "notified", Webhook: receiver.URL + "/hook", Input: []byte("x")})
+	assert.NoError(t, err)
+	wait(t, q, job.ID, StatusDone)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, _ = q.Status(job.ID)
+		if job.WebhookStatus == http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, http.StatusOK, job.WebhookStatus)
+	assert.Empty(t, job.WebhookError)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, calls)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, job.ID, received[0].ID)
+		assert.Equal(t, StatusDone, received[0].Status)
+		assert.Equal(t, int64(1), received[0].OutputBytes)
+	}
+	assert.Equal(t, []string{"job.done"}, events)
+}
+
+// TestWebhookFailure ensures that a delivery that is not worth retrying is recorded on the job.
+func TestWebhookFailure(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	q := open(t, Config{Process: upper, WebhookBackoff: time.Millisecond})
+	job, _ := q.Submit(Request{Webhook: receiver.URL})
+	deadline := time.Now().Add(5 * time.Second)
+	for job.WebhookStatus == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		job, _ = q.Status(job.ID)
+	}
+	assert.Equal(t, http.StatusBadRequest, job.WebhookStatus)
+	assert.Equal(t, "webhook responded 400 Bad Request", job.WebhookError)
+}
+
+// TestWebhookClose ensures that Close cancels the deliveries in flight rather than waiting for the client's timeout.
+func TestWebhookClose(t *testing.T) {
+	received := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(unblock)
+
+	q, err := Open(Config{Dir: t.TempDir(), Process: upper, Client: &http.Client{Timeout: time.Minute}})
+	assert.NoError(t, err)
+	q.Submit(Request{Webhook: receiver.URL})
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, q.Close(ctx))
+}
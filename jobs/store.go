@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// store persists jobs in a directory: <id>.json holds a job's state, <id>.input its input and <id>.result its
+// result.
+type store struct {
+	dir string
+}
+
+// openStore creates the directory of a store if it does not exist.
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &store{dir: dir}, nil
+}
+
+// load reads the state of every job in the directory.
+//
+// Notes:
+//   - A job without its input can never run, so unfinished jobs whose input is missing are loaded as failed.
+func (s *store) load() ([]Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []Job
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || id == entry.Name() || strings.HasPrefix(id, ".") {
+			continue
+		}
+		data, err := os.ReadFile(s.path(id, ".json"))
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.path(id, ".json"), err)
+		}
+		if !job.Status.Finished() {
+			if _, err := os.Stat(s.path(id, ".input")); err != nil {
+				job.Status, job.Error = StatusFailed, fmt.Sprintf("input lost: %v", err)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// save writes the state of a job.
+func (s *store) save(job Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.write(job.ID, ".json", append(data, '\n'))
+}
+
+// saveInput writes the input of a job.
+func (s *store) saveInput(id string, input []byte) error {
+	return s.write(id, ".input", input)
+}
+
+// saveResult writes the result of a job.
+func (s *store) saveResult(id string, result []byte) error {
+	return s.write(id, ".result", result)
+}
+
+// readInput reads the input of a job.
+func (s *store) readInput(id string) ([]byte, error) {
+	return os.ReadFile(s.path(id, ".input"))
+}
+
+// readResult reads the result of a job.
+func (s *store) readResult(id string) ([]byte, error) {
+	return os.ReadFile(s.path(id, ".result"))
+}
+
+// remove deletes every file of a job.
+func (s *store) remove(id string) {
+	for _, ext := range []string{".json", ".input", ".result"} {
+		os.Remove(s.path(id, ext))
+	}
+}
+
+// path returns the path of one of a job's files.
+func (s *store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// write replaces a job's file atomically, through a temporary file renamed over it, so that a crash never leaves
+// a partial file behind.
+func (s *store) write(id, ext string, data []byte) error {
+	tmp, err := os.CreateTemp(s.dir, "."+id+ext+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(id, ext))
+}
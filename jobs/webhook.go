@@ -0,0 +1,84 @@
+package jobs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookEvent is the X-Job-Event header of webhook deliveries, e.g. job.done.
+const WebhookEvent = "X-Job-Event"
+
+// notify posts a finished job to its webhook, retrying network errors, 429s and 5xx responses with exponential
+// backoff, and records the outcome of the last attempt on the job.
+//
+// Notes:
+//   - Deliveries are cancelled and retries stop when the queue is closed, so that Close does not wait out the
+//     client's timeout or the backoff.
+//   - The outcome is not recorded if the job was pruned in the meantime.
+func (q *Queue) notify(job Job) {
+	defer q.webhooks.Done()
+
+	status, err := 0, error(nil)
+	backoff := q.cfg.WebhookBackoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		status, retry, err = q.post(job)
+		if err == nil || !retry || attempt >= q.cfg.WebhookRetries {
+			break
+		}
+		select {
+		case <-q.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if q.ctx.Err() != nil {
+			break
+		}
+		backoff *= 2
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.jobs[job.ID]
+	if !ok {
+		return
+	}
+	e.job.WebhookStatus, e.job.WebhookError = status, ""
+	if err != nil {
+		e.job.WebhookError = err.Error()
+	}
+	q.saveLocked(e.job)
+}
+
+// post makes a single webhook delivery attempt.
+//
+// Returns:
+// - int: The HTTP status code of the response, or 0 if there was none.
+// - bool: Whether a failure is worth retrying.
+// - error: If the request failed or was not answered with a 2xx status code, it returns the error. Otherwise, it returns nil.
+func (q *Queue) post(job Job) (int, bool, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return 0, false, err
+	}
+	req, err := http.NewRequestWithContext(q.ctx, http.MethodPost, job.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEvent, "job."+string(job.Status))
+
+	resp, err := q.cfg.Client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	err = fmt.Errorf("webhook responded %s", resp.Status)
+	return resp.StatusCode, resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
@@ -0,0 +1,206 @@
+// Package live serves net/http/pprof, expvar counters and a status page of in-flight operations while the binary
+// runs, so that go tool pprof can be attached to long batch jobs instead of only reading the files written afterwards.
+package live
+
+import (
+	"context"
+	"expvar"
+	"html/template"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultAddr is the address the live server listens on when none is given. It only accepts local connections.
+const DefaultAddr = "localhost:6060"
+
+// Counters published at /debug/vars.
+var (
+	imagesProcessed  = expvar.NewInt("imagesProcessed")
+	bytesProcessed   = expvar.NewInt("bytesProcessed")
+	operationsFailed = expvar.NewInt("operationsFailed")
+)
+
+// started is when the process started, for the throughput counter.
+var started = time.Now()
+
+func init() {
+	expvar.Publish("bytesPerSecond", expvar.Func(func() interface{} {
+		return float64(bytesProcessed.Value()) / time.Since(started).Seconds()
+	}))
+	expvar.Publish("inFlight", expvar.Func(func() interface{} {
+		return len(InFlight())
+	}))
+}
+
+// Operation is an operation that is currently running.
+type Operation struct {
+	ID      uint64
+	Name    string
+	Started time.Time
+}
+
+// Elapsed returns how long the operation has been running.
+func (o Operation) Elapsed() time.Duration {
+	return time.Since(o.Started).Round(time.Millisecond)
+}
+
+var (
+	inFlightMu sync.Mutex
+	inFlight   = map[uint64]Operation{}
+	nextID     uint64
+)
+
+// Begin records the start of an operation, listing it on the status page until it ends.
+//
+// Parameters:
+// - name: The name of the operation, such as ProcessImageGrayscaleOptimized.
+//
+// Returns:
+//   - func(bytes int64, err error): Ends the operation. A successful operation counts as one image processed and adds
+//     bytes to the bytes processed; a failed one is counted in operationsFailed.
+func Begin(name string) func(bytes int64, err error) {
+	inFlightMu.Lock()
+	nextID++
+	id := nextID
+	inFlight[id] = Operation{ID: id, Name: name, Started: time.Now()}
+	inFlightMu.Unlock()
+
+	return func(bytes int64, err error) {
+		inFlightMu.Lock()
+		delete(inFlight, id)
+		inFlightMu.Unlock()
+
+		if err != nil {
+			operationsFailed.Add(1)
+			return
+		}
+		imagesProcessed.Add(1)
+		bytesProcessed.Add(bytes)
+	}
+}
+
+// InFlight returns the operations that are currently running, oldest first.
+func InFlight() []Operation {
+	inFlightMu.Lock()
+	operations := make([]Operation, 0, len(inFlight))
+	for _, op := range inFlight {
+		operations = append(operations, op)
+	}
+	inFlightMu.Unlock()
+
+	sort.Slice(operations, func(i, j int) bool { return operations[i].ID < operations[j].ID })
+	return operations
+}
+
+// Handler returns the live server's routes:
+//   - /: The status page, listing in-flight operations and the counters.
+//   - /debug/pprof/: The net/http/pprof endpoints, for go tool pprof http://<addr>/debug/pprof/<profile>.
+//   - /debug/vars: The expvar counters as JSON.
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/", status)
+	return mux
+}
+
+// Server is a running live server.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Start starts the live server in the background.
+//
+// Parameters:
+// - addr: The address to listen on, such as DefaultAddr. Use port 0 to pick a free port.
+//
+// Returns:
+// - *Server: The running server.
+// - error: If the address cannot be listened on, it returns the error. Otherwise, it returns nil.
+func Start(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		server:   &http.Server{Handler: Handler(), ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops the server, waiting for in-progress requests until the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// statusPage is the data the status template is executed with.
+type statusPage struct {
+	Uptime           time.Duration
+	InFlight         []Operation
+	ImagesProcessed  int64
+	BytesProcessed   int64
+	OperationsFailed int64
+	BytesPerSecond   float64
+}
+
+// statusTemplate lists in-flight operations and the counters. It refreshes itself every second.
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="1">
+<title>golangpprof status</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+table { border-collapse: collapse; margin: 12px 0 24px; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>golangpprof status</h1>
+<p>Up {{.Uptime}}. Images processed: {{.ImagesProcessed}}, bytes processed: {{.BytesProcessed}} ({{printf "%.0f" .BytesPerSecond}} bytes/s), failed operations: {{.OperationsFailed}}.</p>
+<h2>In-flight operations</h2>
+{{if .InFlight}}<table>
+<tr><th>Operation</th><th>Started</th><th>Elapsed</th></tr>
+{{range .InFlight}}<tr><td>{{.Name}}</td><td>{{.Started.Format "15:04:05.000"}}</td><td>{{.Elapsed}}</td></tr>
+{{end}}</table>
+{{else}}<p>None.</p>
+{{end}}
+<p><a href="/debug/pprof/">/debug/pprof/</a> &middot; <a href="/debug/vars">/debug/vars</a></p>
+</body>
+</html>
+`))
+
+// status renders the status page.
+func status(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	page := statusPage{
+		Uptime:           time.Since(started).Round(time.Second),
+		InFlight:         InFlight(),
+		ImagesProcessed:  imagesProcessed.Value(),
+		BytesProcessed:   bytesProcessed.Value(),
+		OperationsFailed: operationsFailed.Value(),
+	}
+	page.BytesPerSecond = float64(page.BytesProcessed) / time.Since(started).Seconds()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusTemplate.Execute(w, page)
+}
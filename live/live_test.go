@@ -0,0 +1,77 @@
+package live
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// get requests a path from the handler and returns the status code and body.
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	body, err := io.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+	return recorder.Code, string(body)
+}
+
+func TestBegin(t *testing.T) {
+	handler := Handler()
+	images, bytes, failed := imagesProcessed.Value(), bytesProcessed.Value(), operationsFailed.Value()
+
+	end := Begin("ProcessImageSharpenOptimized")
+	assert.Len(t, InFlight(), 1)
+	code, body := get(t, handler, "/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "<td>ProcessImageSharpenOptimized</td>")
+
+	end(1000, nil)
+	assert.Len(t, InFlight(), 0)
+	assert.Equal(t, images+1, imagesProcessed.Value())
+	assert.Equal(t, bytes+1000, bytesProcessed.Value())
+
+	Begin("ProcessImageGrayscale")(1000, errors.New("failed"))
+	assert.Equal(t, images+1, imagesProcessed.Value())
+	assert.Equal(t, failed+1, operationsFailed.Value())
+
+	_, body = get(t, handler, "/")
+	assert.Contains(t, body, "None.")
+}
+
+func TestHandler(t *testing.T) {
+	handler := Handler()
+
+	code, body := get(t, handler, "/debug/vars")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"imagesProcessed"`)
+	assert.Contains(t, body, `"bytesPerSecond"`)
+
+	code, body = get(t, handler, "/debug/pprof/")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, "goroutine")
+
+	code, _ = get(t, handler, "/debug/pprof/heap")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get(t, handler, "/nope")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestStart(t *testing.T) {
+	server, err := Start("localhost:0")
+	assert.NoError(t, err)
+
+	resp, err := http.Get("http://" + server.Addr() + "/debug/vars")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	_, err = Start(server.Addr() + "x")
+	assert.Error(t, err)
+}
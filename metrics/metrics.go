@@ -0,0 +1,330 @@
+// Package metrics counts the images processed by every operation, with their bytes, errors and latencies, and
+// exposes them in the Prometheus text exposition format so that they can be scraped while the binary runs.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultAddr and DefaultPath are where the metrics are served when no other address or path is given.
+const (
+	DefaultAddr = "localhost:9090"
+	DefaultPath = "/metrics"
+)
+
+// DefaultVariant labels the observations made while no variant is set.
+const DefaultVariant = "default"
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histogram buckets, from 5ms to 30s.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry the binary records its observations in.
+var Default = NewRegistry(DefaultBuckets)
+
+// Observation is one call of an operation.
+type Observation struct {
+	// Operation names what was run, such as ProcessImageGrayscaleOptimized or a pipeline like grayscale,sharpen.
+	Operation string
+
+	// Variant names the configuration it was run with, such as a scenario variant. If empty, the registry's
+	// current variant is used.
+	Variant string
+
+	// BytesIn and BytesOut are the bytes read and written by the call, when known.
+	BytesIn  int64
+	BytesOut int64
+
+	Duration time.Duration
+	Err      error
+
+	// ErrorType classifies Err in the errors counter. If empty, ErrorType(Err) is used.
+	ErrorType string
+}
+
+// key identifies the series of an operation and variant.
+type key struct {
+	operation string
+	variant   string
+}
+
+// series holds the metrics of an operation and variant.
+type series struct {
+	images   int64
+	bytesIn  int64
+	bytesOut int64
+	errors   map[string]int64
+
+	// buckets counts the observations of each latency bucket, not cumulated, with a last bucket for +Inf.
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// Registry holds the metrics of every operation and variant observed.
+//
+// Notes:
+// - A Registry is safe for concurrent use.
+type Registry struct {
+	buckets []float64
+
+	mu      sync.Mutex
+	variant string
+	series  map[key]*series
+}
+
+// NewRegistry returns an empty registry.
+//
+// Parameters:
+// - buckets: The upper bounds of the latency histogram buckets, in seconds, in increasing order.
+func NewRegistry(buckets []float64) *Registry {
+	return &Registry{buckets: buckets, variant: DefaultVariant, series: map[key]*series{}}
+}
+
+// SetVariant sets the variant of the observations that do not name one, and returns a func that restores the
+// previous variant.
+func (r *Registry) SetVariant(variant string) func() {
+	if variant == "" {
+		variant = DefaultVariant
+	}
+	r.mu.Lock()
+	previous := r.variant
+	r.variant = variant
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		r.variant = previous
+		r.mu.Unlock()
+	}
+}
+
+// Observe records a call: a processed image if it succeeded, and an error of its type if it failed. Its duration
+// is recorded either way.
+func (r *Registry) Observe(o Observation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if o.Variant == "" {
+		o.Variant = r.variant
+	}
+	k := key{operation: o.Operation, variant: o.Variant}
+	s, ok := r.series[k]
+	if !ok {
+		s = &series{errors: map[string]int64{}, buckets: make([]int64, len(r.buckets)+1)}
+		r.series[k] = s
+	}
+
+	if o.Err != nil {
+		errorType := o.ErrorType
+		if errorType == "" {
+			errorType = ErrorType(o.Err)
+		}
+		s.errors[errorType]++
+	} else {
+		s.images++
+	}
+	s.bytesIn += o.BytesIn
+	s.bytesOut += o.BytesOut
+
+	seconds := o.Duration.Seconds()
+	s.buckets[sort.SearchFloat64s(r.buckets, seconds)]++
+	s.count++
+	s.sum += seconds
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format.
+//
+// Returns:
+// - error: The first error writing to w. Otherwise, it returns nil.
+//
+// Notes:
+//   - The series are sorted by operation and variant, so that the output is stable.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]key, 0, len(r.series))
+	for k := range r.series {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].operation != keys[j].operation {
+			return keys[i].operation < keys[j].operation
+		}
+		return keys[i].variant < keys[j].variant
+	})
+
+	tw := &textWriter{w: w}
+	tw.header("golangpprof_images_processed_total", "counter", "Images processed successfully, by operation and variant.")
+	for _, k := range keys {
+		tw.sample("golangpprof_images_processed_total", labels(k), float64(r.series[k].images))
+	}
+	tw.header("golangpprof_bytes_in_total", "counter", "Bytes read by the operations, by operation and variant.")
+	for _, k := range keys {
+		tw.sample("golangpprof_bytes_in_total", labels(k), float64(r.series[k].bytesIn))
+	}
+	tw.header("golangpprof_bytes_out_total", "counter", "Bytes written by the operations, by operation and variant.")
+	for _, k := range keys {
+		tw.sample("golangpprof_bytes_out_total", labels(k), float64(r.series[k].bytesOut))
+	}
+
+	tw.header("golangpprof_errors_total", "counter", "Failed operations, by operation, variant and error type.")
+	for _, k := range keys {
+		s := r.series[k]
+		types := make([]string, 0, len(s.errors))
+		for errorType := range s.errors {
+			types = append(types, errorType)
+		}
+		sort.Strings(types)
+		for _, errorType := range types {
+			tw.sample("golangpprof_errors_total", labels(k, "type", errorType), float64(s.errors[errorType]))
+		}
+	}
+
+	tw.header("golangpprof_operation_duration_seconds", "histogram", "Duration of the operations, by operation and variant.")
+	for _, k := range keys {
+		s := r.series[k]
+		var cumulative int64
+		for i, bound := range r.buckets {
+			cumulative += s.buckets[i]
+			tw.sample("golangpprof_operation_duration_seconds_bucket", labels(k, "le", formatFloat(bound)), float64(cumulative))
+		}
+		tw.sample("golangpprof_operation_duration_seconds_bucket", labels(k, "le", "+Inf"), float64(s.count))
+		tw.sample("golangpprof_operation_duration_seconds_sum", labels(k), s.sum)
+		tw.sample("golangpprof_operation_duration_seconds_count", labels(k), float64(s.count))
+	}
+	return tw.err
+}
+
+// Handler returns a handler serving the metrics in the Prometheus text exposition format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteText(w)
+	})
+}
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// textWriter writes samples, keeping the first error.
+type textWriter struct {
+	w   io.Writer
+	err error
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (tw *textWriter) header(name, metricType, help string) {
+	tw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// sample writes one sample line.
+func (tw *textWriter) sample(name, labels string, value float64) {
+	tw.printf("%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+func (tw *textWriter) printf(format string, args ...interface{}) {
+	if tw.err == nil {
+		_, tw.err = fmt.Fprintf(tw.w, format, args...)
+	}
+}
+
+// labels formats the labels of a series, followed by extra name and value pairs.
+func labels(k key, extra ...string) string {
+	pairs := append([]string{"operation", k.operation, "variant", k.variant}, extra...)
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatFloat formats a sample value or bucket bound as Prometheus expects, e.g. 0.005, 12 or 1e+06.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ErrorType classifies an error by the type of its root cause, e.g. "jpeg.FormatError".
+//
+// Notes:
+//   - Cancellations and deadlines are classified as "cancelled" and "deadline exceeded".
+//   - System call errors all share one type, so they are classified by their message instead, e.g.
+//     "no such file or directory".
+func ErrorType(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline exceeded"
+	}
+
+	root := err
+	for {
+		next := errors.Unwrap(root)
+		if next == nil {
+			break
+		}
+		root = next
+	}
+	if errno, ok := root.(syscall.Errno); ok {
+		return errno.Error()
+	}
+	return fmt.Sprintf("%T", root)
+}
+
+// Server is a running metrics server.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Start serves the registry's metrics in the background.
+//
+// Parameters:
+// - addr: The address to listen on, such as DefaultAddr. Use port 0 to pick a free port.
+// - path: The path the metrics are served on, such as DefaultPath.
+// - r: The registry to serve.
+//
+// Returns:
+// - *Server: The running server.
+// - error: If the address cannot be listened on, it returns the error. Otherwise, it returns nil.
+func Start(addr, path string, r *Registry) (*Server, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("metrics path %q does not start with /", path)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, r.Handler())
+	s := &Server{
+		server:   &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops the server, waiting for in-progress requests until the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWriteText ensures that observations are counted by operation and variant, with their bytes, errors and
+// latency buckets.
+func TestWriteText(t *testing.T) {
+	r := NewRegistry([]float64{0.01, 0.1, 1})
+	r.Observe(Observation{Operation: "grayscale", BytesIn: 100, BytesOut: 40, Duration: 5 * time.Millisecond})
+	r.Observe(Observation{Operation: "grayscale", BytesIn: 100, BytesOut: 40, Duration: 50 * time.Millisecond})
+	r.Observe(Observation{Operation: "grayscale", BytesIn: 100, Duration: 2 * time.Second, Err: jpeg.FormatError("bad")})
+	restore := r.SetVariant("fast")
+	r.Observe(Observation{Operation: "grayscale", Duration: time.Millisecond, Err: errors.New("failed"), ErrorType: "decode: failed"})
+	restore()
+	r.Observe(Observation{Operation: "blur", Variant: "slow", Duration: 100 * time.Millisecond})
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WriteText(&buf))
+	text := buf.String()
+
+	assert.Contains(t, text, "# TYPE golangpprof_images_processed_total counter\n")
+	assert.Contains(t, text, `golangpprof_images_processed_total{operation="grayscale",variant="default"} 2`+"\n")
+	assert.Contains(t, text, `golangpprof_images_processed_total{operation="grayscale",variant="fast"} 0`+"\n")
+	assert.Contains(t, text, `golangpprof_bytes_in_total{operation="grayscale",variant="default"} 300`+"\n")
+	assert.Contains(t, text, `golangpprof_bytes_out_total{operation="grayscale",variant="default"} 80`+"\n")
+	assert.Contains(t, text, `golangpprof_errors_total{operation="grayscale",variant="default",type="jpeg.FormatError"} 1`+"\n")
+	assert.Contains(t, text, `golangpprof_errors_total{operation="grayscale",variant="fast",type="decode: failed"} 1`+"\n")
+
+	assert.Contains(t, text, "# TYPE golangpprof_operation_duration_seconds histogram\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_bucket{operation="grayscale",variant="default",le="0.01"} 1`+"\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_bucket{operation="grayscale",variant="default",le="0.1"} 2`+"\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_bucket{operation="grayscale",variant="default",le="1"} 2`+"\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_bucket{operation="grayscale",variant="default",le="+Inf"} 3`+"\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_sum{operation="grayscale",variant="default"} 2.055`+"\n")
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_count{operation="grayscale",variant="default"} 3`+"\n")
+
+	// Bounds are inclusive, and series are sorted by operation
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_bucket{operation="blur",variant="slow",le="0.1"} 1`+"\n")
+	assert.Less(t, bytes.Index(buf.Bytes(), []byte(`operation="blur"`)), bytes.Index(buf.Bytes(), []byte(`operation="grayscale"`)))
+
+	// Output is stable
+	var again bytes.Buffer
+	assert.NoError(t, r.WriteText(&again))
+	assert.Equal(t, text, again.String())
+}
+
+// TestErrorType ensures that errors are classified by their root cause.
+func TestErrorType(t *testing.T) {
+	_, statErr := os.Stat("nope.jpg")
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: ""},
+		{err: context.Canceled, want: "cancelled"},
+		{err: fmt.Errorf("processing: %w", context.DeadlineExceeded), want: "deadline exceeded"},
+		{err: fmt.Errorf("decoding: %w", jpeg.UnsupportedError("progressive")), want: "jpeg.UnsupportedError"},
+		{err: statErr, want: "no such file or directory"},
+		{err: io.ErrUnexpectedEOF, want: "*errors.errorString"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, ErrorType(c.err), fmt.Sprint(c.err))
+	}
+}
+
+// TestStart ensures that the metrics are served on the given path.
+func TestStart(t *testing.T) {
+	r := NewRegistry(DefaultBuckets)
+	r.Observe(Observation{Operation: "grayscale", Duration: time.Millisecond})
+
+	_, err := Start("localhost:0", "metrics", r)
+	assert.Error(t, err)
+
+	server, err := Start("localhost:0", "/custom", r)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Shutdown(context.Background())
+
+	response, err := http.Get("http://" + server.Addr() + "/custom")
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, ContentType, response.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `golangpprof_images_processed_total{operation="grayscale",variant="default"} 1`)
+	}
+
+	response, err = http.Get("http://" + server.Addr() + "/metrics")
+	if assert.NoError(t, err) {
+		response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+}
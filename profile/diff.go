@@ -0,0 +1,273 @@
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+)
+
+// Normalization controls how the values of two profiles are made comparable before they are diffed.
+type Normalization string
+
+const (
+	// NormalizeNone compares raw sample values.
+	NormalizeNone Normalization = "none"
+	// NormalizeSamples scales the new profile so that its total matches the base profile's total,
+	// so deltas show how each function's share of the profile changed.
+	NormalizeSamples Normalization = "samples"
+	// NormalizeTime scales the new profile by the ratio of the profiles' wall time durations,
+	// so deltas show how much each function costs per unit of wall time.
+	NormalizeTime Normalization = "time"
+)
+
+// matchAll matches every function name.
+var matchAll = regexp.MustCompile("")
+
+// FunctionDelta is the change in flat and cumulative value of a single function between two profiles.
+type FunctionDelta struct {
+	Name      string `json:"name"`
+	BaseFlat  int64  `json:"baseFlat"`
+	NewFlat   int64  `json:"newFlat"`
+	BaseCum   int64  `json:"baseCum"`
+	NewCum    int64  `json:"newCum"`
+	FlatDelta int64  `json:"flatDelta"`
+	CumDelta  int64  `json:"cumDelta"`
+}
+
+// LineDelta is the change in flat and cumulative value of a single source line between two profiles.
+type LineDelta struct {
+	Function  string `json:"function"`
+	Filename  string `json:"filename"`
+	Line      int64  `json:"line"`
+	BaseFlat  int64  `json:"baseFlat"`
+	NewFlat   int64  `json:"newFlat"`
+	BaseCum   int64  `json:"baseCum"`
+	NewCum    int64  `json:"newCum"`
+	FlatDelta int64  `json:"flatDelta"`
+	CumDelta  int64  `json:"cumDelta"`
+}
+
+// Diff is the comparison of two profiles, with per-function and per-line deltas sorted by impact.
+type Diff struct {
+	SampleType    string          `json:"sampleType"`
+	Unit          string          `json:"unit"`
+	Normalization Normalization   `json:"normalization"`
+	Scale         float64         `json:"scale"`
+	BaseTotal     int64           `json:"baseTotal"`
+	NewTotal      int64           `json:"newTotal"`
+	Functions     []FunctionDelta `json:"functions"`
+	Lines         []LineDelta     `json:"lines"`
+}
+
+// Compare diffs two profiles of the same type.
+//
+// Parameters:
+// - base: The profile to compare against, such as cpu-ProcessImageSharpen.pprof or yesterday's run.
+// - current: The profile being compared, such as cpu-ProcessImageSharpenOptimized.pprof or today's run.
+// - sampleType: The sample type to compare. An empty name selects the default sample type.
+// - norm: How the current profile's values are scaled before comparing.
+//
+// Returns:
+// - *Diff: The per-function and per-line deltas, sorted by the absolute flat delta and then the absolute cum delta.
+// - error: If either profile lacks the sample type, or the normalization is unknown, it returns the error.
+//
+// Notes:
+// - All new values (and NewTotal) are reported after scaling, so the deltas are directly comparable.
+// - Functions and lines are matched by short function name, since the two profiles may come from different builds.
+func Compare(base, current *Profile, sampleType string, norm Normalization) (*Diff, error) {
+	baseIndex, err := base.SampleIndex(sampleType)
+	if err != nil {
+		return nil, fmt.Errorf("base: %w", err)
+	}
+	if sampleType == "" {
+		sampleType = base.SampleTypes[baseIndex].Type
+	}
+	newIndex, err := current.SampleIndex(sampleType)
+	if err != nil {
+		return nil, fmt.Errorf("new: %w", err)
+	}
+
+	baseTotal, newTotal := base.Total(baseIndex), current.Total(newIndex)
+	scale := 1.0
+	switch norm {
+	case NormalizeNone, "":
+		norm = NormalizeNone
+	case NormalizeSamples:
+		if newTotal != 0 {
+			scale = float64(baseTotal) / float64(newTotal)
+		}
+	case NormalizeTime:
+		if base.Duration <= 0 || current.Duration <= 0 {
+			return nil, fmt.Errorf("cannot normalize by wall time: a profile has no duration")
+		}
+		scale = float64(base.Duration) / float64(current.Duration)
+	default:
+		return nil, fmt.Errorf("unknown normalization %q: expected none, samples or time", norm)
+	}
+	scaled := func(v int64) int64 { return int64(float64(v)*scale + 0.5) }
+
+	d := &Diff{
+		SampleType:    sampleType,
+		Unit:          base.SampleTypes[baseIndex].Unit,
+		Normalization: norm,
+		Scale:         scale,
+		BaseTotal:     baseTotal,
+		NewTotal:      scaled(newTotal),
+	}
+
+	functions := map[string]*FunctionDelta{}
+	function := func(name string) *FunctionDelta {
+		fd, ok := functions[name]
+		if !ok {
+			fd = &FunctionDelta{Name: name}
+			functions[name] = fd
+		}
+		return fd
+	}
+	for _, s := range base.Top(baseIndex) {
+		fd := function(s.Name)
+		fd.BaseFlat, fd.BaseCum = s.Flat, s.Cum
+	}
+	for _, s := range current.Top(newIndex) {
+		fd := function(s.Name)
+		fd.NewFlat, fd.NewCum = scaled(s.Flat), scaled(s.Cum)
+	}
+	for _, fd := range functions {
+		fd.FlatDelta = fd.NewFlat - fd.BaseFlat
+		fd.CumDelta = fd.NewCum - fd.BaseCum
+		d.Functions = append(d.Functions, *fd)
+	}
+	sort.Slice(d.Functions, func(i, j int) bool {
+		a, b := d.Functions[i], d.Functions[j]
+		return byImpact(a.FlatDelta, b.FlatDelta, a.CumDelta, b.CumDelta, a.Name < b.Name)
+	})
+
+	type lineKey struct {
+		function string
+		line     int64
+	}
+	lines := map[lineKey]*LineDelta{}
+	line := func(name string, f *Function, n int64) *LineDelta {
+		key := lineKey{name, n}
+		ld, ok := lines[key]
+		if !ok {
+			ld = &LineDelta{Function: name, Filename: f.Filename, Line: n}
+			lines[key] = ld
+		}
+		return ld
+	}
+	baseLines, baseFunctions := base.Lines(baseIndex, matchAll)
+	for name, stats := range baseLines {
+		for n, ls := range stats {
+			ld := line(name, baseFunctions[name], n)
+			ld.BaseFlat, ld.BaseCum = ls.Flat, ls.Cum
+		}
+	}
+	newLines, newFunctions := current.Lines(newIndex, matchAll)
+	for name, stats := range newLines {
+		for n, ls := range stats {
+			ld := line(name, newFunctions[name], n)
+			ld.NewFlat, ld.NewCum = scaled(ls.Flat), scaled(ls.Cum)
+		}
+	}
+	for _, ld := range lines {
+		ld.FlatDelta = ld.NewFlat - ld.BaseFlat
+		ld.CumDelta = ld.NewCum - ld.BaseCum
+		d.Lines = append(d.Lines, *ld)
+	}
+	sort.Slice(d.Lines, func(i, j int) bool {
+		a, b := d.Lines[i], d.Lines[j]
+		less := a.Function < b.Function || (a.Function == b.Function && a.Line < b.Line)
+		return byImpact(a.FlatDelta, b.FlatDelta, a.CumDelta, b.CumDelta, less)
+	})
+
+	return d, nil
+}
+
+// byImpact orders deltas by absolute flat delta, then absolute cum delta, falling back to tie.
+func byImpact(flatA, flatB, cumA, cumB int64, tie bool) bool {
+	if abs(flatA) != abs(flatB) {
+		return abs(flatA) > abs(flatB)
+	}
+	if abs(cumA) != abs(cumB) {
+		return abs(cumA) > abs(cumB)
+	}
+	return tie
+}
+
+// abs returns the absolute value of v.
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// WriteText writes the n most impactful function and line deltas in a tabulated format.
+//
+// Parameters:
+// - w: The writer to print the diff to.
+// - n: The number of functions and lines to print. Zero or less prints all of them.
+func (d *Diff) WriteText(w io.Writer, n int) {
+	fmt.Fprintf(w, "Type: %s, normalized by %s (scale %.3f)\n", d.SampleType, d.Normalization, d.Scale)
+	fmt.Fprintf(w, "Total: %s -> %s (%s)\n\n", FormatValue(d.BaseTotal, d.Unit), FormatValue(d.NewTotal, d.Unit), signedPercent(d.NewTotal-d.BaseTotal, d.BaseTotal))
+
+	functions := d.Functions
+	if n > 0 && n < len(functions) {
+		functions = functions[:n]
+	}
+	tw := tabwriter.NewWriter(w, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat delta\tflat\tcum delta\tcum\t\n")
+	for _, fd := range functions {
+		fmt.Fprintf(tw, "%s\t%s -> %s\t%s\t%s -> %s\t  %s\n",
+			signed(fd.FlatDelta, d.Unit), FormatValue(fd.BaseFlat, d.Unit), FormatValue(fd.NewFlat, d.Unit),
+			signed(fd.CumDelta, d.Unit), FormatValue(fd.BaseCum, d.Unit), FormatValue(fd.NewCum, d.Unit), fd.Name)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	lines := d.Lines
+	if n > 0 && n < len(lines) {
+		lines = lines[:n]
+	}
+	tw = tabwriter.NewWriter(w, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat delta\tflat\tcum delta\tcum\t\n")
+	for _, ld := range lines {
+		fmt.Fprintf(tw, "%s\t%s -> %s\t%s\t%s -> %s\t  %s:%d\n",
+			signed(ld.FlatDelta, d.Unit), FormatValue(ld.BaseFlat, d.Unit), FormatValue(ld.NewFlat, d.Unit),
+			signed(ld.CumDelta, d.Unit), FormatValue(ld.BaseCum, d.Unit), FormatValue(ld.NewCum, d.Unit), ld.Function, ld.Line)
+	}
+	tw.Flush()
+}
+
+// WriteJSON writes the full diff as indented JSON.
+//
+// Parameters:
+// - w: The writer to encode the diff to.
+//
+// Returns:
+// - error: If encoding fails, it returns the error. Otherwise, it returns nil.
+func (d *Diff) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// signed formats a delta with an explicit sign.
+func signed(v int64, unit string) string {
+	if v > 0 {
+		return "+" + FormatValue(v, unit)
+	}
+	return FormatValue(v, unit)
+}
+
+// signedPercent formats v as a signed percentage of total.
+func signedPercent(v, total int64) string {
+	if total == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.2f%%", float64(v)/float64(total)*100)
+}
@@ -0,0 +1,540 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Profile is a parsed pprof profile, as written by runtime/pprof.
+type Profile struct {
+	SampleTypes []ValueType
+	Samples     []*Sample
+	Locations   []*Location
+	Functions   []*Function
+	PeriodType  ValueType
+	Period      int64
+	Time        time.Time
+	Duration    time.Duration
+	Comments    []string
+
+	// DefaultSampleType is the name of the sample type shown by default, if the profile set one.
+	DefaultSampleType string
+}
+
+// ValueType describes the type and unit of a sample value, such as cpu/nanoseconds.
+type ValueType struct {
+	Type string
+	Unit string
+}
+
+// Sample is a single stack trace with its values and labels.
+type Sample struct {
+	// Locations are ordered from the leaf (the function that was running) to the root.
+	Locations []*Location
+	Values    []int64
+	Labels    map[string][]string
+	NumLabels map[string][]int64
+}
+
+// Location is a program counter, with the (possibly inlined) source lines it maps to.
+type Location struct {
+	ID      uint64
+	Address uint64
+	// Lines are ordered from the innermost inlined function to the outermost caller.
+	Lines []Line
+}
+
+// Line is a source line within a function.
+type Line struct {
+	Function *Function
+	Line     int64
+}
+
+// Function is a function referenced by the profile.
+type Function struct {
+	ID         uint64
+	Name       string
+	SystemName string
+	Filename   string
+	StartLine  int64
+}
+
+// ShortName returns the function name without its package path, as go tool pprof displays it.
+// For example, "github.com/mwiater/golangpprof/imageprocessing.decodeJPEG" becomes "imageprocessing.decodeJPEG".
+func (f *Function) ShortName() string {
+	return ShortName(f.Name)
+}
+
+// ShortName strips the package path from a fully qualified function name.
+func ShortName(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// ParseFile reads and parses a pprof profile from disk.
+//
+// Parameters:
+// - path: Path to the profile, such as ./pprof/cpu-ProcessImageGrayscale.pprof.
+//
+// Returns:
+// - *Profile: The parsed profile.
+// - error: If any error occurs while reading or parsing, it returns the error. Otherwise, it returns nil.
+func ParseFile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParseData(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Parse reads and parses a pprof profile.
+//
+// Parameters:
+// - r: Reader for the profile, gzipped or not.
+//
+// Returns:
+// - *Profile: The parsed profile.
+// - error: If any error occurs while reading or parsing, it returns the error. Otherwise, it returns nil.
+func Parse(r io.Reader) (*Profile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseData(data)
+}
+
+// ParseData parses a pprof profile from its encoded bytes.
+//
+// Parameters:
+// - data: The profile, either gzipped (as written by runtime/pprof) or as a raw protobuf message.
+//
+// Returns:
+// - *Profile: The parsed profile.
+// - error: If the profile is malformed, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - This implements just enough of the profile.proto format to produce reports without the go tool.
+//     Mappings are not retained, since profiles written by Go programs already carry symbolized function names.
+func ParseData(data []byte) (*Profile, error) {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(gz)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decodeProfile(data)
+}
+
+// rawSample, rawLocation and rawFunction hold string table indexes and IDs until the whole message has been read,
+// since profile.proto does not guarantee the string table or referenced messages come first.
+type rawSample struct {
+	locationIDs []uint64
+	values      []int64
+	labels      []rawLabel
+}
+
+type rawLabel struct {
+	key, str, num int64
+}
+
+type rawLine struct {
+	functionID uint64
+	line       int64
+}
+
+type rawLocation struct {
+	id, address uint64
+	lines       []rawLine
+}
+
+type rawFunction struct {
+	id                         uint64
+	name, systemName, filename int64
+	startLine                  int64
+}
+
+// decodeProfile decodes the top level Profile message and resolves all references.
+func decodeProfile(data []byte) (*Profile, error) {
+	var (
+		sampleTypes         [][2]int64
+		samples             []rawSample
+		locations           []rawLocation
+		functions           []rawFunction
+		strs                []string
+		comments            []int64
+		periodType          [2]int64
+		period              int64
+		timeNanos, durNanos int64
+		defaultSampleType   int64
+	)
+
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		switch d.field {
+		case 1:
+			vt, err := decodeValueType(d.bytes)
+			if err != nil {
+				return nil, err
+			}
+			sampleTypes = append(sampleTypes, vt)
+		case 2:
+			s, err := decodeSample(d.bytes)
+			if err != nil {
+				return nil, err
+			}
+			samples = append(samples, s)
+		case 4:
+			l, err := decodeLocation(d.bytes)
+			if err != nil {
+				return nil, err
+			}
+			locations = append(locations, l)
+		case 5:
+			f, err := decodeFunction(d.bytes)
+			if err != nil {
+				return nil, err
+			}
+			functions = append(functions, f)
+		case 6:
+			strs = append(strs, string(d.bytes))
+		case 9:
+			timeNanos = int64(d.u64)
+		case 10:
+			durNanos = int64(d.u64)
+		case 11:
+			if periodType, err = decodeValueType(d.bytes); err != nil {
+				return nil, err
+			}
+		case 12:
+			period = int64(d.u64)
+		case 13:
+			if comments, err = d.int64s(comments); err != nil {
+				return nil, err
+			}
+		case 14:
+			defaultSampleType = int64(d.u64)
+		}
+	}
+
+	str := func(i int64) (string, error) {
+		if i < 0 || int(i) >= len(strs) {
+			return "", fmt.Errorf("profile: string index %d out of range", i)
+		}
+		return strs[i], nil
+	}
+
+	p := &Profile{Period: period}
+	if timeNanos != 0 {
+		p.Time = time.Unix(0, timeNanos)
+	}
+	p.Duration = time.Duration(durNanos)
+
+	var err error
+	for _, vt := range sampleTypes {
+		var t ValueType
+		if t.Type, err = str(vt[0]); err != nil {
+			return nil, err
+		}
+		if t.Unit, err = str(vt[1]); err != nil {
+			return nil, err
+		}
+		p.SampleTypes = append(p.SampleTypes, t)
+	}
+	if p.PeriodType.Type, err = str(periodType[0]); err != nil {
+		return nil, err
+	}
+	if p.PeriodType.Unit, err = str(periodType[1]); err != nil {
+		return nil, err
+	}
+	if p.DefaultSampleType, err = str(defaultSampleType); err != nil {
+		return nil, err
+	}
+	for _, c := range comments {
+		s, err := str(c)
+		if err != nil {
+			return nil, err
+		}
+		p.Comments = append(p.Comments, s)
+	}
+
+	functionsByID := map[uint64]*Function{}
+	for _, rf := range functions {
+		f := &Function{ID: rf.id, StartLine: rf.startLine}
+		if f.Name, err = str(rf.name); err != nil {
+			return nil, err
+		}
+		if f.SystemName, err = str(rf.systemName); err != nil {
+			return nil, err
+		}
+		if f.Filename, err = str(rf.filename); err != nil {
+			return nil, err
+		}
+		functionsByID[f.ID] = f
+		p.Functions = append(p.Functions, f)
+	}
+
+	locationsByID := map[uint64]*Location{}
+	for _, rl := range locations {
+		l := &Location{ID: rl.id, Address: rl.address}
+		for _, line := range rl.lines {
+			f, ok := functionsByID[line.functionID]
+			if !ok {
+				return nil, fmt.Errorf("profile: location %d references unknown function %d", rl.id, line.functionID)
+			}
+			l.Lines = append(l.Lines, Line{Function: f, Line: line.line})
+		}
+		locationsByID[l.ID] = l
+		p.Locations = append(p.Locations, l)
+	}
+
+	for _, rs := range samples {
+		s := &Sample{Values: rs.values}
+		for _, id := range rs.locationIDs {
+			l, ok := locationsByID[id]
+			if !ok {
+				return nil, fmt.Errorf("profile: sample references unknown location %d", id)
+			}
+			s.Locations = append(s.Locations, l)
+		}
+		for _, label := range rs.labels {
+			key, err := str(label.key)
+			if err != nil {
+				return nil, err
+			}
+			if label.str != 0 {
+				value, err := str(label.str)
+				if err != nil {
+					return nil, err
+				}
+				if s.Labels == nil {
+					s.Labels = map[string][]string{}
+				}
+				s.Labels[key] = append(s.Labels[key], value)
+			} else {
+				if s.NumLabels == nil {
+					s.NumLabels = map[string][]int64{}
+				}
+				s.NumLabels[key] = append(s.NumLabels[key], label.num)
+			}
+		}
+		p.Samples = append(p.Samples, s)
+	}
+
+	return p, nil
+}
+
+// decodeValueType decodes a ValueType message into its type and unit string indexes.
+func decodeValueType(data []byte) ([2]int64, error) {
+	var vt [2]int64
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return vt, err
+		}
+		switch d.field {
+		case 1:
+			vt[0] = int64(d.u64)
+		case 2:
+			vt[1] = int64(d.u64)
+		}
+	}
+}
+
+// decodeSample decodes a Sample message.
+func decodeSample(data []byte) (rawSample, error) {
+	var s rawSample
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return s, err
+		}
+		switch d.field {
+		case 1:
+			s.locationIDs, err = d.uint64s(s.locationIDs)
+		case 2:
+			s.values, err = d.int64s(s.values)
+		case 3:
+			var label rawLabel
+			label, err = decodeLabel(d.bytes)
+			s.labels = append(s.labels, label)
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+}
+
+// decodeLabel decodes a Label message.
+func decodeLabel(data []byte) (rawLabel, error) {
+	var l rawLabel
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return l, err
+		}
+		switch d.field {
+		case 1:
+			l.key = int64(d.u64)
+		case 2:
+			l.str = int64(d.u64)
+		case 3:
+			l.num = int64(d.u64)
+		}
+	}
+}
+
+// decodeLocation decodes a Location message, including its Line messages.
+func decodeLocation(data []byte) (rawLocation, error) {
+	var l rawLocation
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return l, err
+		}
+		switch d.field {
+		case 1:
+			l.id = d.u64
+		case 3:
+			l.address = d.u64
+		case 4:
+			var line rawLine
+			line, err = decodeLine(d.bytes)
+			if err != nil {
+				return l, err
+			}
+			l.lines = append(l.lines, line)
+		}
+	}
+}
+
+// decodeLine decodes a Line message.
+func decodeLine(data []byte) (rawLine, error) {
+	var l rawLine
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return l, err
+		}
+		switch d.field {
+		case 1:
+			l.functionID = d.u64
+		case 2:
+			l.line = int64(d.u64)
+		}
+	}
+}
+
+// decodeFunction decodes a Function message.
+func decodeFunction(data []byte) (rawFunction, error) {
+	var f rawFunction
+	d := decoder{data: data}
+	for {
+		ok, err := d.next()
+		if err != nil || !ok {
+			return f, err
+		}
+		switch d.field {
+		case 1:
+			f.id = d.u64
+		case 2:
+			f.name = int64(d.u64)
+		case 3:
+			f.systemName = int64(d.u64)
+		case 4:
+			f.filename = int64(d.u64)
+		case 5:
+			f.startLine = int64(d.u64)
+		}
+	}
+}
+
+// SampleIndex returns the index of the named sample type, such as "cpu" or "alloc_space".
+//
+// Parameters:
+// - name: The sample type to find. An empty name selects the profile's default sample type.
+//
+// Returns:
+// - int: The index into Sample.Values.
+// - error: If the profile has no such sample type, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+// - Without a name or a default sample type, the last sample type is used, matching go tool pprof.
+func (p *Profile) SampleIndex(name string) (int, error) {
+	if len(p.SampleTypes) == 0 {
+		return 0, fmt.Errorf("profile has no sample types")
+	}
+	if name == "" {
+		name = p.DefaultSampleType
+	}
+	if name == "" {
+		return len(p.SampleTypes) - 1, nil
+	}
+	for i, st := range p.SampleTypes {
+		if st.Type == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("profile has no sample type %q", name)
+}
+
+// Total returns the sum of the given sample value across all samples.
+func (p *Profile) Total(index int) int64 {
+	var total int64
+	for _, s := range p.Samples {
+		if index < len(s.Values) {
+			total += s.Values[index]
+		}
+	}
+	return total
+}
+
+// FocusLabel returns a copy of the profile keeping only the samples with a label matching the pattern,
+// like the -tagfocus option of go tool pprof.
+//
+// Parameters:
+// - key: The label key, such as "stage" or "worker".
+// - pattern: Regular expression the label's value must match.
+//
+// Returns:
+// - *Profile: A shallow copy of the profile with the matching samples.
+func (p *Profile) FocusLabel(key string, pattern *regexp.Regexp) *Profile {
+	focused := *p
+	focused.Samples = nil
+	for _, s := range p.Samples {
+		for _, value := range s.Labels[key] {
+			if pattern.MatchString(value) {
+				focused.Samples = append(focused.Samples, s)
+				break
+			}
+		}
+	}
+	return &focused
+}
@@ -0,0 +1,165 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testProfile     = "../pprof-examples/cpu-ProcessImageGrayscaleOptimized.pprof"
+	testSharpen     = "../pprof-examples/cpu-ProcessImageSharpen.pprof"
+	testOptimized   = "../pprof-examples/cpu-ProcessImageSharpenOptimized.pprof"
+	nonExistentFile = "../pprof-examples/nope.pprof"
+)
+
+// statFor returns the FunctionStat of the named function, or an empty stat if it is not in the profile.
+func statFor(stats []FunctionStat, name string) FunctionStat {
+	for _, s := range stats {
+		if s.Name == name {
+			return s
+		}
+	}
+	return FunctionStat{}
+}
+
+func TestParseFile(t *testing.T) {
+	p, err := ParseFile(testProfile)
+	assert.NoError(t, err)
+	assert.Equal(t, []ValueType{{"samples", "count"}, {"cpu", "nanoseconds"}}, p.SampleTypes)
+	assert.Equal(t, ValueType{"cpu", "nanoseconds"}, p.PeriodType)
+	assert.NotEmpty(t, p.Samples)
+	assert.NotEmpty(t, p.Functions)
+
+	_, err = ParseFile(nonExistentFile)
+	assert.Error(t, err)
+
+	_, err = ParseData([]byte{0x0a, 0x05, 0x01})
+	assert.Error(t, err)
+}
+
+func TestTop(t *testing.T) {
+	p, err := ParseFile(testProfile)
+	assert.NoError(t, err)
+
+	index, err := p.SampleIndex("")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, index)
+
+	// The totals match those reported by go tool pprof in PPROF-EXAMPLES.MD
+	assert.Equal(t, int64(790*time.Millisecond), p.Total(index))
+	stats := p.Top(index)
+	assert.Equal(t, int64(0), statFor(stats, "imageprocessing.ProcessImageGrayscaleOptimized").Flat)
+	assert.Equal(t, int64(420*time.Millisecond), statFor(stats, "imageprocessing.ProcessImageGrayscaleOptimized").Cum)
+	assert.Equal(t, int64(370*time.Millisecond), statFor(stats, "imageprocessing.toGrayscaleConcurrent").Cum)
+
+	var buf bytes.Buffer
+	p.WriteTop(&buf, index, 5)
+	assert.Contains(t, buf.String(), "Showing top 5 nodes")
+	assert.Contains(t, buf.String(), "jpeg.(*decoder).reconstructBlock")
+}
+
+func TestWriteList(t *testing.T) {
+	p, err := ParseFile(testProfile)
+	assert.NoError(t, err)
+	index, _ := p.SampleIndex("cpu")
+
+	var buf bytes.Buffer
+	p.WriteList(&buf, index, regexp.MustCompile("ProcessImageGrayscaleOptimized"))
+	output := buf.String()
+	assert.Contains(t, output, "ROUTINE ======================== imageprocessing.ProcessImageGrayscaleOptimized")
+	assert.Contains(t, output, "420ms (flat, cum) 53.16% of Total")
+	assert.Contains(t, output, "290ms")
+	assert.Contains(t, output, "130ms")
+
+	_, err = p.SampleIndex("alloc_space")
+	assert.Error(t, err)
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "430ms", FormatValue(int64(430*time.Millisecond), "nanoseconds"))
+	assert.Equal(t, "-20ms", FormatValue(int64(-20*time.Millisecond), "nanoseconds"))
+	assert.Equal(t, "12.50s", FormatValue(int64(12500*time.Millisecond), "nanoseconds"))
+	assert.Equal(t, "1.50MB", FormatValue(3<<19, "bytes"))
+	assert.Equal(t, "42", FormatValue(42, "count"))
+}
+
+func TestCompare(t *testing.T) {
+	p, err := ParseFile(testProfile)
+	assert.NoError(t, err)
+
+	// A profile diffed against itself has no deltas
+	same, err := Compare(p, p, "", NormalizeNone)
+	assert.NoError(t, err)
+	for _, fd := range same.Functions {
+		assert.Equal(t, int64(0), fd.FlatDelta, fd.Name)
+		assert.Equal(t, int64(0), fd.CumDelta, fd.Name)
+	}
+
+	base, err := ParseFile(testSharpen)
+	assert.NoError(t, err)
+	optimized, err := ParseFile(testOptimized)
+	assert.NoError(t, err)
+
+	diff, err := Compare(base, optimized, "cpu", NormalizeSamples)
+	assert.NoError(t, err)
+	assert.Equal(t, diff.BaseTotal, diff.NewTotal)
+	assert.Equal(t, "imageprocessing.ProcessImageSharpen", diff.Functions[0].Name) // The work moved out of it entirely
+	assert.Equal(t, -diff.Functions[0].BaseCum, diff.Functions[0].CumDelta)
+
+	_, err = Compare(base, optimized, "", Normalization("bogus"))
+	assert.Error(t, err)
+
+	var text bytes.Buffer
+	diff.WriteText(&text, 5)
+	assert.Contains(t, text.String(), "normalized by samples")
+	assert.Contains(t, text.String(), "imageprocessing.sharpenConcurrent")
+
+	var encoded bytes.Buffer
+	assert.NoError(t, diff.WriteJSON(&encoded))
+	var decoded Diff
+	assert.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+	assert.Equal(t, len(diff.Functions), len(decoded.Functions))
+}
+
+func TestTree(t *testing.T) {
+	p, err := ParseFile(testProfile)
+	assert.NoError(t, err)
+	index, _ := p.SampleIndex("")
+
+	root := p.Tree(index)
+	assert.Equal(t, p.Total(index), root.Value)
+
+	// Every node's value is its own samples plus those of its children
+	var check func(n *Node)
+	check = func(n *Node) {
+		sum := n.Self
+		for _, c := range n.Children {
+			sum += c.Value
+			check(c)
+		}
+		assert.Equal(t, n.Value, sum, n.Name)
+	}
+	check(root)
+}
+
+func TestFocusLabel(t *testing.T) {
+	p := &Profile{
+		SampleTypes: []ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		Samples: []*Sample{
+			{Values: []int64{10}, Labels: map[string][]string{"stage": {"process"}, "worker": {"0"}}},
+			{Values: []int64{20}, Labels: map[string][]string{"stage": {"process"}, "worker": {"1"}}},
+			{Values: []int64{40}, Labels: map[string][]string{"stage": {"encode"}}},
+			{Values: []int64{80}},
+		},
+	}
+
+	assert.Equal(t, int64(30), p.FocusLabel("stage", regexp.MustCompile("^process$")).Total(0))
+	assert.Equal(t, int64(20), p.FocusLabel("worker", regexp.MustCompile("^1$")).Total(0))
+	assert.Equal(t, int64(0), p.FocusLabel("rows", regexp.MustCompile(".")).Total(0))
+	assert.Len(t, p.Samples, 4)
+}
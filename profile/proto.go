@@ -0,0 +1,135 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Protocol buffer wire types used by profile.proto.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("profile: truncated protobuf message")
+
+// decoder reads protocol buffer fields from an encoded message, one at a time.
+//
+// Notes:
+// - Only the subset of the wire format used by profile.proto is supported. Unknown fields are skipped.
+type decoder struct {
+	data []byte
+	pos  int
+
+	field int
+	wire  int
+	u64   uint64
+	bytes []byte
+}
+
+// next advances to the next field in the message.
+//
+// Returns:
+// - bool: False once the end of the message has been reached.
+// - error: If the message is malformed, it returns the error. Otherwise, it returns nil.
+func (d *decoder) next() (bool, error) {
+	if d.pos >= len(d.data) {
+		return false, nil
+	}
+	key, err := d.varint()
+	if err != nil {
+		return false, err
+	}
+	d.field = int(key >> 3)
+	d.wire = int(key & 7)
+
+	switch d.wire {
+	case wireVarint:
+		d.u64, err = d.varint()
+	case wireFixed64:
+		if d.pos+8 > len(d.data) {
+			return false, errTruncated
+		}
+		d.u64 = 0
+		for i := 7; i >= 0; i-- {
+			d.u64 = d.u64<<8 | uint64(d.data[d.pos+i])
+		}
+		d.pos += 8
+	case wireFixed32:
+		if d.pos+4 > len(d.data) {
+			return false, errTruncated
+		}
+		d.u64 = 0
+		for i := 3; i >= 0; i-- {
+			d.u64 = d.u64<<8 | uint64(d.data[d.pos+i])
+		}
+		d.pos += 4
+	case wireBytes:
+		var n uint64
+		n, err = d.varint()
+		if err == nil && uint64(len(d.data)-d.pos) < n {
+			err = errTruncated
+		}
+		if err == nil {
+			d.bytes = d.data[d.pos : d.pos+int(n)]
+			d.pos += int(n)
+		}
+	default:
+		err = fmt.Errorf("profile: unsupported wire type %d", d.wire)
+	}
+	return err == nil, err
+}
+
+// varint reads a single base 128 varint from the message.
+func (d *decoder) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if d.pos >= len(d.data) {
+			return 0, errTruncated
+		}
+		b := d.data[d.pos]
+		d.pos++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("profile: varint overflow")
+}
+
+// uint64s returns the values of a repeated integer field, which may be encoded packed or unpacked.
+//
+// Parameters:
+// - dst: The values read so far for this field; the current field's values are appended to it.
+//
+// Returns:
+// - []uint64: dst with the current field's values appended.
+// - error: If a packed field is malformed, it returns the error. Otherwise, it returns nil.
+func (d *decoder) uint64s(dst []uint64) ([]uint64, error) {
+	if d.wire != wireBytes {
+		return append(dst, d.u64), nil
+	}
+	packed := decoder{data: d.bytes}
+	for packed.pos < len(packed.data) {
+		v, err := packed.varint()
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, v)
+	}
+	return dst, nil
+}
+
+// int64s returns the values of a repeated int64 field, which may be encoded packed or unpacked.
+func (d *decoder) int64s(dst []int64) ([]int64, error) {
+	values, err := d.uint64s(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		dst = append(dst, int64(v))
+	}
+	return dst, nil
+}
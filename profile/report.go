@@ -0,0 +1,311 @@
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// FunctionStat is the flat and cumulative value of a single function.
+type FunctionStat struct {
+	Name     string
+	Filename string
+	Flat     int64
+	Cum      int64
+}
+
+// LineStat is the flat and cumulative value of a single source line of a function.
+type LineStat struct {
+	Line int64
+	Flat int64
+	Cum  int64
+}
+
+// Top returns the flat and cumulative value of every function in the profile, sorted by flat value.
+//
+// Parameters:
+// - index: The sample value to aggregate, as returned by SampleIndex.
+//
+// Returns:
+// - []FunctionStat: One entry per function, with ties broken by cumulative value and then name.
+//
+// Notes:
+// - Flat is the value of samples where the function was running. Cum also includes samples where it was on the stack.
+// - A function that appears more than once in a stack (recursion) is only counted once towards its cum value.
+func (p *Profile) Top(index int) []FunctionStat {
+	stats := map[string]*FunctionStat{}
+	stat := func(f *Function) *FunctionStat {
+		name := f.ShortName()
+		s, ok := stats[name]
+		if !ok {
+			s = &FunctionStat{Name: name, Filename: f.Filename}
+			stats[name] = s
+		}
+		return s
+	}
+
+	for _, s := range p.Samples {
+		if index >= len(s.Values) {
+			continue
+		}
+		value := s.Values[index]
+		seen := map[string]bool{}
+		for i, loc := range s.Locations {
+			for j, line := range loc.Lines {
+				fs := stat(line.Function)
+				if i == 0 && j == 0 {
+					fs.Flat += value
+				}
+				if !seen[fs.Name] {
+					seen[fs.Name] = true
+					fs.Cum += value
+				}
+			}
+		}
+	}
+
+	result := make([]FunctionStat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Flat != result[j].Flat {
+			return result[i].Flat > result[j].Flat
+		}
+		if result[i].Cum != result[j].Cum {
+			return result[i].Cum > result[j].Cum
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Lines returns the flat and cumulative value of every sampled source line of the functions matching a pattern.
+//
+// Parameters:
+// - index: The sample value to aggregate, as returned by SampleIndex.
+// - pattern: Regular expression matched against the short function name, as used by the pprof list command.
+//
+// Returns:
+// - map[string]map[int64]*LineStat: Line statistics, keyed by short function name and then line number.
+// - map[string]*Function: The matching functions, keyed by short function name.
+func (p *Profile) Lines(index int, pattern *regexp.Regexp) (map[string]map[int64]*LineStat, map[string]*Function) {
+	lines := map[string]map[int64]*LineStat{}
+	functions := map[string]*Function{}
+
+	for _, s := range p.Samples {
+		if index >= len(s.Values) {
+			continue
+		}
+		value := s.Values[index]
+		seen := map[string]bool{}
+		for i, loc := range s.Locations {
+			for j, line := range loc.Lines {
+				name := line.Function.ShortName()
+				if !pattern.MatchString(name) {
+					continue
+				}
+				if _, ok := functions[name]; !ok {
+					functions[name] = line.Function
+					lines[name] = map[int64]*LineStat{}
+				}
+				ls, ok := lines[name][line.Line]
+				if !ok {
+					ls = &LineStat{Line: line.Line}
+					lines[name][line.Line] = ls
+				}
+				if i == 0 && j == 0 {
+					ls.Flat += value
+				}
+				key := fmt.Sprintf("%s:%d", name, line.Line)
+				if !seen[key] {
+					seen[key] = true
+					ls.Cum += value
+				}
+			}
+		}
+	}
+	return lines, functions
+}
+
+// WriteTop writes a top-N summary in the same layout as the go tool pprof top command.
+//
+// Parameters:
+// - w: The writer to print the summary to.
+// - index: The sample value to summarise, as returned by SampleIndex.
+// - n: The number of functions to print. Zero or less prints every function.
+func (p *Profile) WriteTop(w io.Writer, index int, n int) {
+	total := p.Total(index)
+	stats := p.Top(index)
+	if n <= 0 || n > len(stats) {
+		n = len(stats)
+	}
+
+	unit := p.SampleTypes[index].Unit
+	var shown int64
+	for _, s := range stats[:n] {
+		shown += s.Flat
+	}
+	fmt.Fprintf(w, "Showing top %d nodes out of %d, accounting for %s, %s of %s total\n",
+		n, len(stats), FormatValue(shown, unit), percent(shown, total), FormatValue(total, unit))
+
+	tw := tabwriter.NewWriter(w, 0, 1, 1, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "flat\tflat%%\tsum%%\tcum\tcum%%\t\n")
+	var sum int64
+	for _, s := range stats[:n] {
+		sum += s.Flat
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t  %s\n",
+			FormatValue(s.Flat, unit), percent(s.Flat, total), percent(sum, total),
+			FormatValue(s.Cum, unit), percent(s.Cum, total), s.Name)
+	}
+	tw.Flush()
+}
+
+// WriteList writes a per-line listing of the functions matching a pattern, like the go tool pprof list command.
+//
+// Parameters:
+// - w: The writer to print the listing to.
+// - index: The sample value to list, as returned by SampleIndex.
+// - pattern: Regular expression matched against the short function name.
+//
+// Notes:
+// - Source is read from the filenames recorded in the profile. If a file cannot be read, only sampled lines are printed.
+func (p *Profile) WriteList(w io.Writer, index int, pattern *regexp.Regexp) {
+	total := p.Total(index)
+	unit := p.SampleTypes[index].Unit
+	lines, functions := p.Lines(index, pattern)
+	tops := map[string]FunctionStat{}
+	for _, s := range p.Top(index) {
+		tops[s.Name] = s
+	}
+
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := functions[name]
+		stats := lines[name]
+		first, last := f.StartLine, int64(0)
+		for line := range stats {
+			if first == 0 || line < first {
+				first = line
+			}
+			if line > last {
+				last = line
+			}
+		}
+
+		fmt.Fprintf(w, "ROUTINE ======================== %s in %s\n", name, f.Filename)
+		fmt.Fprintf(w, "%10s %10s (flat, cum) %s of Total\n", FormatValue(tops[name].Flat, unit), FormatValue(tops[name].Cum, unit), percent(tops[name].Cum, total))
+
+		source := readLines(f.Filename, first, last+2)
+		for line := first; line <= last+2; line++ {
+			ls, sampled := stats[line]
+			text, ok := source[line]
+			if !sampled && !ok {
+				continue
+			}
+			flatText, cumText := ".", "."
+			if sampled {
+				flatText, cumText = dot(ls.Flat, unit), dot(ls.Cum, unit)
+			}
+			fmt.Fprintf(w, "%10s %10s %6d:%s\n", flatText, cumText, line, text)
+		}
+	}
+}
+
+// readLines reads the given range of lines from a source file, returning nothing if the file cannot be read.
+func readLines(filename string, first, last int64) map[int64]string {
+	lines := map[int64]string{}
+	f, err := openSource(filename)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := int64(1); scanner.Scan() && n <= last; n++ {
+		if n >= first {
+			lines[n] = scanner.Text()
+		}
+	}
+	return lines
+}
+
+// openSource opens a source file recorded in a profile. Profiles record absolute paths from the machine that
+// wrote them, so if the file is not found, leading directories are trimmed until a path relative to the current
+// directory exists (for example /home/matt/project/imageprocessing/grayscale.go -> imageprocessing/grayscale.go).
+func openSource(filename string) (*os.File, error) {
+	f, err := os.Open(filename)
+	if err == nil {
+		return f, nil
+	}
+	parts := strings.Split(filepath.ToSlash(filename), "/")
+	for i := 1; i < len(parts); i++ {
+		if f, err := os.Open(filepath.FromSlash(strings.Join(parts[i:], "/"))); err == nil {
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+// dot formats a value for a listing, using "." for zero as go tool pprof does.
+func dot(v int64, unit string) string {
+	if v == 0 {
+		return "."
+	}
+	return FormatValue(v, unit)
+}
+
+// percent formats v as a percentage of total.
+func percent(v, total int64) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.2f%%", float64(v)/float64(total)*100)
+}
+
+// FormatValue formats a sample value in its unit, e.g. nanoseconds as "430ms" and bytes as "12.50MB".
+func FormatValue(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		d := time.Duration(v)
+		abs := d
+		if abs < 0 {
+			abs = -abs
+		}
+		switch {
+		case d == 0:
+			return "0"
+		case abs >= 10*time.Second:
+			return fmt.Sprintf("%.2fs", d.Seconds())
+		case abs >= time.Millisecond:
+			return fmt.Sprintf("%.4gms", float64(d)/float64(time.Millisecond))
+		default:
+			return d.String()
+		}
+	case "bytes":
+		switch {
+		case v >= 1<<30 || v <= -1<<30:
+			return fmt.Sprintf("%.2fGB", float64(v)/(1<<30))
+		case v >= 1<<20 || v <= -1<<20:
+			return fmt.Sprintf("%.2fMB", float64(v)/(1<<20))
+		case v >= 1<<10 || v <= -1<<10:
+			return fmt.Sprintf("%.2fkB", float64(v)/(1<<10))
+		default:
+			return fmt.Sprintf("%dB", v)
+		}
+	default:
+		return fmt.Sprint(v)
+	}
+}
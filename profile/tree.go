@@ -0,0 +1,65 @@
+package profile
+
+import "sort"
+
+// Node is a function in the call tree of a profile, as drawn by a flame graph.
+type Node struct {
+	Name     string  `json:"name"`
+	Value    int64   `json:"value"`
+	Self     int64   `json:"self"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Tree merges every stack in the profile into a single call tree rooted at a synthetic "root" node.
+//
+// Parameters:
+// - index: The sample value to aggregate, as returned by SampleIndex.
+//
+// Returns:
+// - *Node: The root of the tree. Its value is the profile total.
+//
+// Notes:
+// - Stacks are merged by short function name, and inlined functions are expanded into their own frames.
+// - Children are sorted by name, so the same profile always produces the same layout.
+func (p *Profile) Tree(index int) *Node {
+	root := &Node{Name: "root"}
+	children := map[*Node]map[string]*Node{}
+
+	for _, s := range p.Samples {
+		if index >= len(s.Values) || s.Values[index] == 0 {
+			continue
+		}
+		value := s.Values[index]
+		node := root
+		node.Value += value
+		for i := len(s.Locations) - 1; i >= 0; i-- {
+			lines := s.Locations[i].Lines
+			for j := len(lines) - 1; j >= 0; j-- {
+				name := lines[j].Function.ShortName()
+				if children[node] == nil {
+					children[node] = map[string]*Node{}
+				}
+				child, ok := children[node][name]
+				if !ok {
+					child = &Node{Name: name}
+					children[node][name] = child
+					node.Children = append(node.Children, child)
+				}
+				child.Value += value
+				node = child
+			}
+		}
+		node.Self += value
+	}
+
+	sortTree(root)
+	return root
+}
+
+// sortTree sorts the children of every node by name.
+func sortTree(n *Node) {
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	for _, c := range n.Children {
+		sortTree(c)
+	}
+}
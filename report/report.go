@@ -0,0 +1,268 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/profile"
+	"github.com/mwiater/golangpprof/runtimestats"
+	"github.com/mwiater/golangpprof/sweep"
+)
+
+// Session is everything captured during one run of the binary, to be rendered as a single HTML report.
+type Session struct {
+	Title   string
+	Started time.Time
+	Results []common.FunctionResult
+	Sweep   []sweep.Point
+
+	// Profiles lists additional .pprof files to include, beyond those referenced by Results.
+	Profiles []string
+}
+
+// resultRow is a FunctionResult as displayed in the results table.
+type resultRow struct {
+	common.FunctionResult
+	Gain           string
+	ProcessingTime float64
+	Throughput     float64
+
+	// Runtime is only set for results with runtime metrics.
+	Runtime *runtimeView
+}
+
+// runtimeView is the GC and scheduler summary of a result as displayed in the runtime table.
+type runtimeView struct {
+	runtimestats.Summary
+	GCMilliseconds float64
+	GCPercent      float64
+	PeakHeapMB     float64
+	HeapChart      template.HTML
+}
+
+// profileView is a parsed profile as handed to the flame graph script.
+type profileView struct {
+	Name       string        `json:"name"`
+	Path       string        `json:"path"`
+	SampleType string        `json:"sampleType"`
+	Unit       string        `json:"unit"`
+	Total      string        `json:"total"`
+	Tree       *profile.Node `json:"tree"`
+}
+
+// page is the data the report template is executed with.
+type page struct {
+	Title     string
+	Generated string
+	Results   []resultRow
+	Runtime   bool
+	Sweep     []sweep.Point
+	SweepSVG  template.HTML
+	SweepText string
+	Profiles  []profileView
+	Errors    []string
+}
+
+// DefaultPath returns a timestamped report path in ./pprof, so each session gets its own file.
+func DefaultPath(started time.Time) string {
+	return "./pprof/report-" + started.Format("20060102-150405") + ".html"
+}
+
+// Save renders the session report and writes it to the specified path.
+//
+// Parameters:
+// - path: Path where the HTML report will be saved.
+// - s: The session to render.
+//
+// Returns:
+// - error: If any error occurs while rendering or writing, it returns the error. Otherwise, it returns nil.
+func Save(path string, s Session) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return Write(f, s)
+}
+
+// Write renders the session as a self-contained HTML report.
+//
+// Parameters:
+// - w: The writer to render the report to.
+// - s: The session to render.
+//
+// Returns:
+// - error: If rendering fails, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - The report includes the results table, the GC overhead and heap size of each function when runtime metrics
+//     were sampled, the scaling table and chart (if a sweep was run), and a flame graph
+//     and icicle view for every CPU and heap profile. All styles and scripts are inlined, so it can be viewed offline.
+//   - A profile that cannot be parsed is listed as an error in the report rather than failing the whole report.
+func Write(w io.Writer, s Session) error {
+	p := page{
+		Title:     s.Title,
+		Generated: s.Started.Format(time.RFC1123),
+		Results:   resultRows(s.Results),
+		Sweep:     s.Sweep,
+	}
+	if p.Title == "" {
+		p.Title = "golangpprof report"
+	}
+	for _, row := range p.Results {
+		if row.Runtime != nil {
+			p.Runtime = true
+		}
+	}
+
+	if len(s.Sweep) > 0 {
+		var svg, table bytes.Buffer
+		if err := sweep.WriteSVG(&svg, s.Sweep); err != nil {
+			return err
+		}
+		sweep.WriteTable(&table, s.Sweep)
+		p.SweepSVG = template.HTML(svg.String())
+		p.SweepText = table.String()
+	}
+
+	for _, path := range profilePaths(s) {
+		view, err := loadProfile(path)
+		if err != nil {
+			p.Errors = append(p.Errors, err.Error())
+			continue
+		}
+		p.Profiles = append(p.Profiles, view)
+	}
+
+	return pageTemplate.Execute(w, p)
+}
+
+// resultRows computes the derived columns of the results table.
+//
+// Notes:
+//   - As in common.PrintResults, an "...Optimized" function's performance gain is relative to the function
+//     of the same name without the suffix, when both were run.
+func resultRows(results []common.FunctionResult) []resultRow {
+	durations := map[string]float64{}
+	for _, r := range results {
+		durations[r.FunctionName] = r.Duration
+	}
+
+	var rows []resultRow
+	for _, r := range results {
+		if r.FunctionName == "" {
+			continue
+		}
+		row := resultRow{
+			FunctionResult: r,
+			Gain:           "(baseline)",
+			ProcessingTime: float64(r.Stages[imageprocessing.StageProcess].Duration) / float64(time.Millisecond),
+			Throughput:     common.ThroughputPerDay(r.FileSize, r.Duration),
+		}
+		if len(r.Metrics.Samples) > 0 {
+			summary := r.Metrics.Summary()
+			row.Runtime = &runtimeView{
+				Summary:        summary,
+				GCMilliseconds: summary.CPU.GC * 1000,
+				GCPercent:      summary.GCOverhead * 100,
+				PeakHeapMB:     float64(summary.PeakHeapBytes) / (1 << 20),
+				HeapChart:      sparkline(r.Metrics.HeapSeries()),
+			}
+		}
+		if strings.HasSuffix(r.FunctionName, "Optimized") {
+			row.Gain = "-"
+			if base, ok := durations[strings.TrimSuffix(r.FunctionName, "Optimized")]; ok && r.Duration > 0 {
+				row.Gain = fmt.Sprintf("%.2fx", base/r.Duration)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// sparkline renders a series of values as a small inline SVG line chart, scaled from zero to the largest value.
+func sparkline(values []uint64) template.HTML {
+	const width, height = 160.0, 24.0
+	if len(values) == 0 {
+		return ""
+	}
+	var max uint64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+	var points strings.Builder
+	for i, v := range values {
+		x := 0.0
+		if len(values) > 1 {
+			x = width * float64(i) / float64(len(values)-1)
+		}
+		y := height - height*float64(v)/float64(max)
+		fmt.Fprintf(&points, "%.1f,%.1f ", x, y)
+	}
+	return template.HTML(fmt.Sprintf(`<svg width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f"><polyline fill="none" stroke="#c33" stroke-width="1.5" points="%s"/></svg>`,
+		width, height, width, height, strings.TrimSpace(points.String())))
+}
+
+// profilePaths lists the CPU and heap profiles of the session's results, followed by any extra profiles.
+func profilePaths(s Session) []string {
+	var paths []string
+	for _, r := range s.Results {
+		if r.CPUProfilePath != "" {
+			paths = append(paths, r.CPUProfilePath)
+		}
+		if r.HeapProfilePath != "" {
+			paths = append(paths, r.HeapProfilePath)
+		}
+	}
+	return append(paths, s.Profiles...)
+}
+
+// loadProfile parses a profile and builds its call tree.
+//
+// Notes:
+//   - Heap profiles are shown by alloc_space, since the boxing allocations in the processing loops are freed long
+//     before the profile is written and would not appear in the default inuse_space view.
+func loadProfile(path string) (profileView, error) {
+	p, err := profile.ParseFile(path)
+	if err != nil {
+		return profileView{}, err
+	}
+
+	sampleType := ""
+	for _, st := range p.SampleTypes {
+		if st.Type == "alloc_space" {
+			sampleType = st.Type
+		}
+	}
+	index, err := p.SampleIndex(sampleType)
+	if err != nil {
+		return profileView{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	st := p.SampleTypes[index]
+	return profileView{
+		Name:       strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Path:       path,
+		SampleType: st.Type,
+		Unit:       st.Unit,
+		Total:      profile.FormatValue(p.Total(index), st.Unit),
+		Tree:       p.Tree(index),
+	}, nil
+}
@@ -0,0 +1,74 @@
+package report
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/runtimestats"
+	"github.com/mwiater/golangpprof/sweep"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testProfile     = "../pprof-examples/cpu-ProcessImageGrayscaleOptimized.pprof"
+	nonExistentFile = "../pprof-examples/nope.pprof"
+)
+
+func TestResultRows(t *testing.T) {
+	rows := resultRows([]common.FunctionResult{
+		{FunctionName: "Function1", FileSize: 1000, Duration: 10},
+		{FunctionName: "Function1Optimized", FileSize: 1000, Duration: 5},
+		{},
+		{FunctionName: "Function2Optimized", FileSize: 1000, Duration: 5},
+	})
+
+	assert.Len(t, rows, 3)
+	assert.Equal(t, "(baseline)", rows[0].Gain)
+	assert.Equal(t, "2.00x", rows[1].Gain)
+	assert.Equal(t, "-", rows[2].Gain)
+	assert.Equal(t, common.ThroughputPerDay(1000, 10), rows[0].Throughput)
+	assert.Nil(t, rows[0].Runtime)
+}
+
+func TestResultRowsRuntime(t *testing.T) {
+	series := runtimestats.Series{Samples: []runtimestats.Sample{
+		{HeapBytes: 1 << 20, CPU: runtimestats.CPUClasses{Total: 1, User: 1, Idle: 0}},
+		{Elapsed: time.Second, HeapBytes: 4 << 20, GCCycles: 2, CPU: runtimestats.CPUClasses{Total: 3, User: 2, GC: 0.5, Idle: 0.5}},
+	}}
+	rows := resultRows([]common.FunctionResult{{FunctionName: "Function1", Duration: 1000, Metrics: series}})
+
+	assert.NotNil(t, rows[0].Runtime)
+	assert.Equal(t, uint64(2), rows[0].Runtime.GCCycles)
+	assert.InDelta(t, 33.3, rows[0].Runtime.GCPercent, 0.1)
+	assert.Equal(t, 4.0, rows[0].Runtime.PeakHeapMB)
+	assert.Contains(t, string(rows[0].Runtime.HeapChart), "<polyline")
+}
+
+func TestWrite(t *testing.T) {
+	session := Session{
+		Title:   "Test <Session>",
+		Started: time.Date(2023, 9, 30, 10, 27, 0, 0, time.UTC),
+		Results: []common.FunctionResult{
+			{FunctionName: "ProcessImageGrayscaleOptimized", FileSize: 5598865, Duration: 501, CPUProfilePath: testProfile},
+		},
+		Sweep: []sweep.Point{
+			{Operation: "ProcessImageGrayscaleOptimized", Workers: 1, MaxProcs: 1, Duration: 800, Speedup: 1},
+			{Operation: "ProcessImageGrayscaleOptimized", Workers: 2, MaxProcs: 2, Duration: 500, Speedup: 1.6},
+		},
+		Profiles: []string{nonExistentFile},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, Write(&buf, session))
+	html := buf.String()
+
+	assert.Contains(t, html, "Test &lt;Session&gt;")
+	assert.Contains(t, html, "<td>ProcessImageGrayscaleOptimized</td>")
+	assert.Contains(t, html, "<svg")
+	assert.Contains(t, html, `"name":"cpu-ProcessImageGrayscaleOptimized"`)
+	assert.Contains(t, html, `"name":"imageprocessing.toGrayscaleConcurrent"`)
+	assert.Contains(t, html, "nope.pprof") // Reported as an error, not a failure
+	assert.NotContains(t, html, "<script src")
+}
@@ -0,0 +1,182 @@
+package report
+
+import "html/template"
+
+// pageTemplate is the self-contained HTML report. Styles and the flame graph script are inlined so that the
+// report has no external dependencies and can be opened offline.
+var pageTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+h1 { margin-bottom: 4px; }
+.generated { color: #777; margin-top: 0; }
+table { border-collapse: collapse; margin: 12px 0 24px; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+pre { background: #f6f6f6; padding: 8px; overflow-x: auto; }
+.error { color: #b00; }
+.profile { margin-bottom: 32px; }
+.controls button { margin-right: 6px; }
+.controls button.active { font-weight: bold; }
+.flame { position: relative; width: 100%; overflow: hidden; border: 1px solid #ddd; margin-top: 8px; }
+.frame { position: absolute; height: 17px; line-height: 17px; font-size: 11px; overflow: hidden; white-space: nowrap;
+  box-sizing: border-box; border: 1px solid #fff; padding: 0 3px; cursor: pointer; }
+.frame:hover { border-color: #000; }
+.details { font-family: monospace; min-height: 1.2em; margin-top: 4px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="generated">Generated {{.Generated}}</p>
+
+{{if .Results}}
+<h2>Results</h2>
+<table>
+<tr><th>Function</th><th>File Size</th><th>Execution Time</th><th>Performance Gain</th><th>Processing Time</th><th>Bytes Allocated</th><th>Allocations</th><th>Bytes/Pixel</th><th>Allocs/Pixel</th><th>Peak Heap</th><th>GCs</th><th>Throughput (GB/day)</th></tr>
+{{range .Results}}<tr><td>{{.FunctionName}}</td><td>{{.FileSize}} Bytes</td><td>{{printf "%.0f" .Duration}}ms</td><td>{{.Gain}}</td><td>{{printf "%.0f" .ProcessingTime}}ms</td><td>{{.BytesAllocated}}</td><td>{{.Allocations}}</td><td>{{printf "%.1f" .BytesPerPixel}}</td><td>{{printf "%.2f" .AllocsPerPixel}}</td><td>{{.PeakHeap}}</td><td>{{.NumGC}}</td><td>{{printf "%.2f" .Throughput}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{if .Runtime}}
+<h2>Runtime</h2>
+<p>Sampled from runtime/metrics while each function ran. GC overhead is the share of non-idle CPU time spent on garbage collection.</p>
+<table>
+<tr><th>Function</th><th>GC Cycles</th><th>GC Pauses</th><th>GC Pause Time</th><th>GC CPU</th><th>GC Overhead</th><th>Peak Heap</th><th>Peak Goroutines</th><th>Sched Latency p50 / p99</th><th>Heap Size</th></tr>
+{{range .Results}}{{if .Runtime}}<tr><td>{{.FunctionName}}</td>{{with .Runtime}}<td>{{.GCCycles}}</td><td>{{.GCPauses}}</td><td>{{.GCPauseTotal}}</td><td>{{printf "%.1f" .GCMilliseconds}}ms</td><td>{{printf "%.1f" .GCPercent}}%</td><td>{{printf "%.1f" .PeakHeapMB}}MB</td><td>{{.PeakGoroutines}}</td><td>{{.SchedLatencyP50}} / {{.SchedLatencyP99}}</td><td>{{.HeapChart}}</td>{{end}}</tr>
+{{end}}{{end}}</table>
+{{end}}
+
+{{if .Sweep}}
+<h2>Scaling</h2>
+{{.SweepSVG}}
+<pre>{{.SweepText}}</pre>
+{{end}}
+
+{{range .Errors}}<p class="error">{{.}}</p>
+{{end}}
+
+{{if .Profiles}}
+<h2>Profiles</h2>
+<p>Click a frame to zoom into it, and click the bottom (or top) frame to zoom back out.</p>
+{{range $i, $p := .Profiles}}
+<div class="profile" id="profile-{{$i}}">
+<h3>{{$p.Name}}</h3>
+<div>{{$p.Path}}: {{$p.SampleType}}, total {{$p.Total}}</div>
+<div class="controls"><button class="active" data-view="flame">Flame graph</button><button data-view="icicle">Icicle</button></div>
+<div class="details"></div>
+<div class="flame"></div>
+</div>
+{{end}}
+{{end}}
+
+<script>
+var profiles = {{.Profiles}};
+
+(function () {
+  var rowHeight = 18;
+
+  function formatValue(v, unit) {
+    if (unit === "nanoseconds") {
+      return (v / 1e6).toFixed(v >= 1e7 ? 0 : 2) + "ms";
+    }
+    if (unit === "bytes") {
+      if (v >= 1 << 20) { return (v / (1 << 20)).toFixed(2) + "MB"; }
+      if (v >= 1 << 10) { return (v / (1 << 10)).toFixed(2) + "kB"; }
+      return v + "B";
+    }
+    return String(v);
+  }
+
+  function color(name) {
+    var hash = 0;
+    for (var i = 0; i < name.length; i++) { hash = (hash * 31 + name.charCodeAt(i)) | 0; }
+    var hue = name.indexOf("runtime.") === 0 ? 200 : 20 + Math.abs(hash) % 40;
+    return "hsl(" + hue + ", 80%, " + (60 + Math.abs(hash >> 8) % 20) + "%)";
+  }
+
+  function depth(node) {
+    var d = 0;
+    (node.children || []).forEach(function (c) { d = Math.max(d, depth(c)); });
+    return d + 1;
+  }
+
+  function render(container, view) {
+    var el = container.querySelector(".flame");
+    var details = container.querySelector(".details");
+    var p = view.profile;
+    var zoom = view.zoom;
+    var total = p.tree.value || 1;
+    var rows = view.ancestors.length + depth(zoom);
+    el.innerHTML = "";
+    el.style.height = (rows * rowHeight) + "px";
+
+    function top(level) {
+      return view.mode === "icicle" ? level * rowHeight : (rows - level - 1) * rowHeight;
+    }
+
+    function frame(node, level, left, width, onClick) {
+      if (width < 0.05) { return; }
+      var div = document.createElement("div");
+      div.className = "frame";
+      div.style.left = left + "%";
+      div.style.width = width + "%";
+      div.style.top = top(level) + "px";
+      div.style.background = color(node.name);
+      div.textContent = node.name;
+      var text = node.name + ": " + formatValue(node.value, p.unit) + " (" + (node.value / total * 100).toFixed(2) + "%), self " + formatValue(node.self, p.unit);
+      div.title = text;
+      div.onmouseover = function () { details.textContent = text; };
+      div.onclick = onClick;
+      el.appendChild(div);
+    }
+
+    view.ancestors.forEach(function (node, level) {
+      frame(node, level, 0, 100, function () {
+        view.zoom = node;
+        view.ancestors = view.ancestors.slice(0, level);
+        render(container, view);
+      });
+    });
+
+    function walk(node, level, left, width) {
+      frame(node, level, left, width, function () {
+        if (node === view.zoom) { return; }
+        var path = [];
+        (function find(n, trail) {
+          if (n === node) { path = trail; return true; }
+          return (n.children || []).some(function (c) { return find(c, trail.concat([n])); });
+        })(p.tree, []);
+        view.ancestors = path;
+        view.zoom = node;
+        render(container, view);
+      });
+      var offset = left;
+      (node.children || []).forEach(function (c) {
+        var w = node.value ? width * c.value / node.value : 0;
+        walk(c, level + 1, offset, w);
+        offset += w;
+      });
+    }
+    walk(zoom, view.ancestors.length, 0, 100);
+  }
+
+  (profiles || []).forEach(function (p, i) {
+    var container = document.getElementById("profile-" + i);
+    var view = { profile: p, zoom: p.tree, ancestors: [], mode: "flame" };
+    container.querySelectorAll(".controls button").forEach(function (button) {
+      button.onclick = function () {
+        view.mode = button.getAttribute("data-view");
+        container.querySelectorAll(".controls button").forEach(function (b) { b.classList.toggle("active", b === button); });
+        render(container, view);
+      };
+    });
+    render(container, view);
+  });
+})();
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,476 @@
+// Package runtimestats samples runtime/metrics while a function runs, producing a time series of heap size,
+// goroutine count, GC activity and CPU time by class, and summarises the GC overhead of the run.
+package runtimestats
+
+import (
+	"math"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is the sampling interval used when none is given.
+const DefaultInterval = 10 * time.Millisecond
+
+// MaxSamples bounds the samples a series holds. Once it is reached, every other sample is dropped and the interval
+// of the series doubles, so that a long run keeps a series of constant size covering all of it.
+const MaxSamples = 2048
+
+// Names of the runtime/metrics read by the sampler. Metrics missing from the running Go version are skipped.
+const (
+	metricHeapBytes      = "/memory/classes/heap/objects:bytes"
+	metricHeapGoal       = "/gc/heap/goal:bytes"
+	metricGoroutines     = "/sched/goroutines:goroutines"
+	metricGCCycles       = "/gc/cycles/total:gc-cycles"
+	metricGCPauses       = "/sched/pauses/total/gc:seconds"
+	metricGCPausesLegacy = "/gc/pauses:seconds"
+	metricSchedLatencies = "/sched/latencies:seconds"
+	metricCPUTotal       = "/cpu/classes/total:cpu-seconds"
+	metricCPUUser        = "/cpu/classes/user:cpu-seconds"
+	metricCPUGC          = "/cpu/classes/gc/total:cpu-seconds"
+	metricCPUScavenge    = "/cpu/classes/scavenge/total:cpu-seconds"
+	metricCPUIdle        = "/cpu/classes/idle:cpu-seconds"
+)
+
+// CPUClasses is the runtime's estimate of CPU time spent in each class, in seconds, since the program started.
+type CPUClasses struct {
+	Total    float64 `json:"total"`
+	User     float64 `json:"user"`
+	GC       float64 `json:"gc"`
+	Scavenge float64 `json:"scavenge"`
+	Idle     float64 `json:"idle"`
+}
+
+// Sub returns the CPU time spent in each class between an earlier reading and this one.
+func (c CPUClasses) Sub(earlier CPUClasses) CPUClasses {
+	return CPUClasses{
+		Total:    c.Total - earlier.Total,
+		User:     c.User - earlier.User,
+		GC:       c.GC - earlier.GC,
+		Scavenge: c.Scavenge - earlier.Scavenge,
+		Idle:     c.Idle - earlier.Idle,
+	}
+}
+
+// Sample is a single reading of the runtime's metrics.
+type Sample struct {
+	// Elapsed is the time since sampling started.
+	Elapsed    time.Duration `json:"elapsed"`
+	HeapBytes  uint64        `json:"heapBytes"`
+	HeapGoal   uint64        `json:"heapGoal"`
+	Goroutines uint64        `json:"goroutines"`
+
+	// GCCycles and GCPauses are cumulative since the program started.
+	GCCycles uint64 `json:"gcCycles"`
+	GCPauses uint64 `json:"gcPauses"`
+
+	CPU CPUClasses `json:"cpu"`
+}
+
+// Histogram is a distribution of durations, in seconds, as reported by runtime/metrics.
+type Histogram struct {
+	// Counts holds the number of values in each bucket.
+	Counts []uint64 `json:"counts"`
+	// Buckets holds the boundaries of the buckets; bucket i covers [Buckets[i], Buckets[i+1]).
+	// The first and last boundaries may be -Inf and +Inf.
+	Buckets []float64 `json:"buckets"`
+}
+
+// Series is the time series recorded while a function ran.
+type Series struct {
+	// Interval is the time between two samples, which doubles each time the series is downsampled.
+	Interval time.Duration `json:"interval"`
+	Samples  []Sample      `json:"samples"`
+
+	// PeakHeapBytes and PeakGoroutines are the largest values read during the run, including those of the samples
+	// dropped when the series was downsampled.
+	PeakHeapBytes  uint64 `json:"peakHeapBytes"`
+	PeakGoroutines uint64 `json:"peakGoroutines"`
+
+	// GCPauses and SchedLatencies are the distributions of stop-the-world GC pauses and of the time goroutines
+	// spent runnable before running, over the whole run.
+	GCPauses       Histogram `json:"gcPauses"`
+	SchedLatencies Histogram `json:"schedLatencies"`
+}
+
+// Summary is the GC and scheduler overhead of a run, derived from its Series.
+type Summary struct {
+	Duration       time.Duration
+	GCCycles       uint64
+	GCPauses       uint64
+	GCPauseTotal   time.Duration
+	GCPauseMax     time.Duration
+	PeakHeapBytes  uint64
+	PeakGoroutines uint64
+	CPU            CPUClasses
+
+	// GCOverhead is the fraction of non-idle CPU time spent on garbage collection.
+	GCOverhead float64
+
+	SchedLatencyP50 time.Duration
+	SchedLatencyP99 time.Duration
+}
+
+// Sampler reads runtime/metrics at a fixed interval until stopped.
+type Sampler struct {
+	interval time.Duration
+	start    time.Time
+	samples  []metrics.Sample
+	index    map[string]int
+
+	mu     sync.Mutex
+	series Series
+
+	// reads counts the samples read, of which one in every stride is kept once the series has been downsampled.
+	reads, stride int
+
+	// The histograms of the first and latest samples, from which the series' histograms are computed when the
+	// sampler stops, rather than on every sample.
+	firstPauses, firstLatencies *metrics.Float64Histogram
+	lastPauses, lastLatencies   *metrics.Float64Histogram
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// Start begins sampling runtime metrics in a background goroutine.
+//
+// Parameters:
+// - interval: Time between samples. DefaultInterval is used if it is not positive.
+//
+// Returns:
+// - *Sampler: The running sampler. Call Stop to end sampling and collect the series.
+//
+// Notes:
+//   - A sample is always taken immediately, and another when the sampler is stopped, so even calls shorter
+//     than the interval produce a series covering the whole run.
+//   - The sampler's own goroutine is included in the goroutine count.
+func Start(interval time.Duration) *Sampler {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	s := &Sampler{
+		interval: interval,
+		stride:   1,
+		start:    time.Now(),
+		index:    map[string]int{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	supported := map[string]bool{}
+	for _, d := range metrics.All() {
+		supported[d.Name] = true
+	}
+	for _, name := range []string{
+		metricHeapBytes, metricHeapGoal, metricGoroutines, metricGCCycles, metricGCPauses, metricGCPausesLegacy,
+		metricSchedLatencies, metricCPUTotal, metricCPUUser, metricCPUGC, metricCPUScavenge, metricCPUIdle,
+	} {
+		if name == metricGCPausesLegacy && supported[metricGCPauses] {
+			continue
+		}
+		if supported[name] {
+			s.index[name] = len(s.samples)
+			s.samples = append(s.samples, metrics.Sample{Name: name})
+		}
+	}
+	s.series.Interval = interval
+
+	s.read()
+	go s.run()
+	return s
+}
+
+// Stop ends sampling, takes a final sample and returns the recorded series. It is safe to call more than once.
+func (s *Sampler) Stop() Series {
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.done
+		s.readFinal()
+
+		s.mu.Lock()
+		s.series.GCPauses = subHistogram(s.lastPauses, s.firstPauses)
+		s.series.SchedLatencies = subHistogram(s.lastLatencies, s.firstLatencies)
+		s.mu.Unlock()
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.series
+}
+
+// run samples at the configured interval until the sampler is stopped.
+func (s *Sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.read()
+		}
+	}
+}
+
+// read takes a sample and appends it to the series, downsampling it once it holds MaxSamples. The histograms of the
+// first and latest samples are kept, in buffers reused between samples.
+func (s *Sampler) read() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sample(false)
+}
+
+// readFinal takes the last sample, which is kept whatever the stride so that the series covers the whole run.
+func (s *Sampler) readFinal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sample(true)
+}
+
+// sample takes a sample. s.mu must be held.
+func (s *Sampler) sample(final bool) {
+	metrics.Read(s.samples)
+	sample := Sample{
+		Elapsed:    time.Since(s.start),
+		HeapBytes:  s.uint64(metricHeapBytes),
+		HeapGoal:   s.uint64(metricHeapGoal),
+		Goroutines: s.uint64(metricGoroutines),
+		GCCycles:   s.uint64(metricGCCycles),
+		CPU: CPUClasses{
+			Total:    s.float64(metricCPUTotal),
+			User:     s.float64(metricCPUUser),
+			GC:       s.float64(metricCPUGC),
+			Scavenge: s.float64(metricCPUScavenge),
+			Idle:     s.float64(metricCPUIdle),
+		},
+	}
+
+	pauses := s.histogram(metricGCPauses)
+	if pauses == nil {
+		pauses = s.histogram(metricGCPausesLegacy)
+	}
+	latencies := s.histogram(metricSchedLatencies)
+	if s.firstPauses == nil && s.firstLatencies == nil {
+		s.firstPauses, s.firstLatencies = copyHistogram(nil, pauses), copyHistogram(nil, latencies)
+	}
+	s.lastPauses, s.lastLatencies = copyHistogram(s.lastPauses, pauses), copyHistogram(s.lastLatencies, latencies)
+	if pauses != nil {
+		sample.GCPauses = Histogram{Counts: pauses.Counts}.Count()
+	}
+
+	if sample.HeapBytes > s.series.PeakHeapBytes {
+		s.series.PeakHeapBytes = sample.HeapBytes
+	}
+	if sample.Goroutines > s.series.PeakGoroutines {
+		s.series.PeakGoroutines = sample.Goroutines
+	}
+	s.reads++
+	if !final && (s.reads-1)%s.stride != 0 {
+		return
+	}
+	if len(s.series.Samples) >= MaxSamples {
+		s.series.Samples = downsample(s.series.Samples)
+		s.series.Interval *= 2
+		s.stride *= 2
+	}
+	s.series.Samples = append(s.series.Samples, sample)
+}
+
+// downsample keeps every other sample, starting with the first, in place.
+func downsample(samples []Sample) []Sample {
+	kept := samples[:0]
+	for i := 0; i < len(samples); i += 2 {
+		kept = append(kept, samples[i])
+	}
+	return kept
+}
+
+// uint64 returns the value of an integer metric, or 0 if it is not supported.
+func (s *Sampler) uint64(name string) uint64 {
+	i, ok := s.index[name]
+	if !ok || s.samples[i].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s.samples[i].Value.Uint64()
+}
+
+// float64 returns the value of a floating point metric, or 0 if it is not supported.
+func (s *Sampler) float64(name string) float64 {
+	i, ok := s.index[name]
+	if !ok || s.samples[i].Value.Kind() != metrics.KindFloat64 {
+		return 0
+	}
+	return s.samples[i].Value.Float64()
+}
+
+// histogram returns the value of a histogram metric, or nil if it is not supported.
+func (s *Sampler) histogram(name string) *metrics.Float64Histogram {
+	i, ok := s.index[name]
+	if !ok || s.samples[i].Value.Kind() != metrics.KindFloat64Histogram {
+		return nil
+	}
+	return s.samples[i].Value.Float64Histogram()
+}
+
+// copyHistogram copies a histogram, since metrics.Read may reuse its memory, into dst if it is set so that its
+// memory is reused too.
+func copyHistogram(dst, h *metrics.Float64Histogram) *metrics.Float64Histogram {
+	if h == nil {
+		return nil
+	}
+	if dst == nil {
+		dst = &metrics.Float64Histogram{}
+	}
+	dst.Counts = append(dst.Counts[:0], h.Counts...)
+	dst.Buckets = append(dst.Buckets[:0], h.Buckets...)
+	return dst
+}
+
+// subHistogram returns the values added to a cumulative histogram since an earlier reading.
+func subHistogram(h, earlier *metrics.Float64Histogram) Histogram {
+	if h == nil {
+		return Histogram{}
+	}
+	out := Histogram{
+		Counts:  append([]uint64(nil), h.Counts...),
+		Buckets: append([]float64(nil), h.Buckets...),
+	}
+	if earlier != nil && len(earlier.Counts) == len(out.Counts) {
+		for i := range out.Counts {
+			out.Counts[i] -= earlier.Counts[i]
+		}
+	}
+	return out
+}
+
+// Count returns the number of values in the histogram.
+func (h Histogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	return n
+}
+
+// Sum estimates the total of the values in the histogram, taking each value as the midpoint of its bucket.
+func (h Histogram) Sum() time.Duration {
+	var sum float64
+	for i, c := range h.Counts {
+		if c > 0 {
+			sum += float64(c) * h.midpoint(i)
+		}
+	}
+	return seconds(sum)
+}
+
+// Max returns the upper boundary of the highest non-empty bucket, an upper bound on the largest value.
+func (h Histogram) Max() time.Duration {
+	for i := len(h.Counts) - 1; i >= 0; i-- {
+		if h.Counts[i] > 0 {
+			return seconds(h.upper(i))
+		}
+	}
+	return 0
+}
+
+// Quantile estimates a quantile of the values in the histogram.
+//
+// Parameters:
+// - q: The quantile, between 0 and 1, e.g. 0.99 for the 99th percentile.
+//
+// Returns:
+//   - time.Duration: The upper boundary of the bucket containing the quantile, or 0 if the histogram is empty.
+func (h Histogram) Quantile(q float64) time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= rank {
+			return seconds(h.upper(i))
+		}
+	}
+	return seconds(h.upper(len(h.Counts) - 1))
+}
+
+// upper returns the upper boundary of bucket i, using the lower boundary for the unbounded last bucket.
+func (h Histogram) upper(i int) float64 {
+	if math.IsInf(h.Buckets[i+1], 1) {
+		return h.Buckets[i]
+	}
+	return h.Buckets[i+1]
+}
+
+// midpoint returns the middle of bucket i, using the finite boundary for unbounded buckets.
+func (h Histogram) midpoint(i int) float64 {
+	lo, hi := h.Buckets[i], h.Buckets[i+1]
+	switch {
+	case math.IsInf(lo, -1):
+		return math.Max(hi, 0)
+	case math.IsInf(hi, 1):
+		return lo
+	}
+	return (lo + hi) / 2
+}
+
+// seconds converts fractional seconds to a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Summary computes the GC and scheduler overhead of the run from its first and last samples.
+//
+// Returns:
+// - Summary: The summary, or the zero Summary if the series has no samples.
+//
+// Notes:
+//   - The runtime's CPU class figures are estimates, only comparable with each other. GCOverhead compares
+//     GC time with user, GC and scavenger time, so it is not diluted by idle Ps when GOMAXPROCS exceeds the
+//     parallelism of the function.
+func (s Series) Summary() Summary {
+	if len(s.Samples) == 0 {
+		return Summary{}
+	}
+	first, last := s.Samples[0], s.Samples[len(s.Samples)-1]
+	sum := Summary{
+		Duration:        last.Elapsed - first.Elapsed,
+		GCCycles:        last.GCCycles - first.GCCycles,
+		GCPauses:        s.GCPauses.Count(),
+		GCPauseTotal:    s.GCPauses.Sum(),
+		GCPauseMax:      s.GCPauses.Max(),
+		CPU:             last.CPU.Sub(first.CPU),
+		SchedLatencyP50: s.SchedLatencies.Quantile(0.5),
+		SchedLatencyP99: s.SchedLatencies.Quantile(0.99),
+		PeakHeapBytes:   s.PeakHeapBytes,
+		PeakGoroutines:  s.PeakGoroutines,
+	}
+	for _, sample := range s.Samples {
+		if sample.HeapBytes > sum.PeakHeapBytes {
+			sum.PeakHeapBytes = sample.HeapBytes
+		}
+		if sample.Goroutines > sum.PeakGoroutines {
+			sum.PeakGoroutines = sample.Goroutines
+		}
+	}
+	if busy := sum.CPU.Total - sum.CPU.Idle; busy > 0 {
+		sum.GCOverhead = sum.CPU.GC / busy
+	}
+	return sum
+}
+
+// HeapSeries returns the heap size of each sample, for plotting.
+func (s Series) HeapSeries() []uint64 {
+	heap := make([]uint64, len(s.Samples))
+	for i, sample := range s.Samples {
+		heap[i] = sample.HeapBytes
+	}
+	return heap
+}
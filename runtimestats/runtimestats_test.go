@@ -0,0 +1,85 @@
+package runtimestats
+
+import (
+	"math"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	sampler := Start(time.Millisecond)
+
+	var keep [][]byte
+	for i := 0; i < 64; i++ {
+		keep = append(keep, make([]byte, 1<<20))
+		if i%16 == 0 {
+			runtime.GC()
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	series := sampler.Stop()
+	runtime.KeepAlive(keep)
+
+	assert.Equal(t, time.Millisecond, series.Interval)
+	assert.True(t, len(series.Samples) >= 2)
+	assert.True(t, series.Samples[0].Elapsed < series.Samples[len(series.Samples)-1].Elapsed)
+
+	summary := series.Summary()
+	assert.True(t, summary.GCCycles >= 4)
+	assert.True(t, summary.GCPauses > 0)
+	assert.True(t, summary.PeakHeapBytes >= 32<<20)
+	assert.True(t, summary.PeakGoroutines >= 2)
+	assert.True(t, summary.GCOverhead >= 0 && summary.GCOverhead <= 1)
+
+	// Stopping again returns the same series
+	assert.Equal(t, len(series.Samples), len(sampler.Stop().Samples))
+}
+
+// TestSamplerBounded ensures that a long run keeps at most MaxSamples, spread over the whole run, along with the
+// peaks of the samples it dropped.
+func TestSamplerBounded(t *testing.T) {
+	sampler := Start(time.Hour)
+	for i := 0; i < 3*MaxSamples; i++ {
+		sampler.read()
+	}
+	series := sampler.Stop()
+	assert.True(t, len(series.Samples) <= MaxSamples)
+	assert.True(t, len(series.Samples) > MaxSamples/2)
+	assert.Equal(t, 4*time.Hour, series.Interval)
+	assert.True(t, series.PeakGoroutines >= 2)
+
+	samples := make([]Sample, 8)
+	for i := range samples {
+		samples[i].Elapsed = time.Duration(i)
+	}
+	kept := downsample(samples)
+	assert.Equal(t, []Sample{{Elapsed: 0}, {Elapsed: 2}, {Elapsed: 4}, {Elapsed: 6}}, kept)
+
+	series = Series{Samples: []Sample{{HeapBytes: 1}, {HeapBytes: 2}}, PeakHeapBytes: 10, PeakGoroutines: 3}
+	summary := series.Summary()
+	assert.Equal(t, uint64(10), summary.PeakHeapBytes)
+	assert.Equal(t, uint64(3), summary.PeakGoroutines)
+}
+
+func TestHistogram(t *testing.T) {
+	h := Histogram{
+		Counts:  []uint64{0, 5, 4, 1},
+		Buckets: []float64{math.Inf(-1), 0.001, 0.002, 0.004, math.Inf(1)},
+	}
+
+	assert.Equal(t, uint64(10), h.Count())
+	assert.Equal(t, 2*time.Millisecond, h.Quantile(0.5))
+	assert.Equal(t, 4*time.Millisecond, h.Quantile(0.9))
+	assert.Equal(t, 4*time.Millisecond, h.Quantile(0.99))
+	assert.Equal(t, 4*time.Millisecond, h.Max())
+	// 5 x 1.5ms + 4 x 3ms + 1 x 4ms
+	assert.InDelta(t, float64(23500*time.Microsecond), float64(h.Sum()), float64(time.Microsecond))
+	assert.Equal(t, time.Duration(0), Histogram{}.Quantile(0.5))
+}
+
+func TestSummaryEmpty(t *testing.T) {
+	assert.Equal(t, Summary{}, Series{}.Summary())
+}
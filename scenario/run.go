@@ -0,0 +1,218 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/export"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/metrics"
+)
+
+// Result is the outcome of running the scenario's operations on one input with one variant.
+type Result struct {
+	Variant Variant
+	Input   string
+
+	// Results holds one FunctionResult per operation, in the order of the scenario's operations.
+	Results []common.FunctionResult
+}
+
+// Run runs every operation of the scenario on every input, once per variant, and prints a results table for each
+// variant and input.
+//
+// Returns:
+// - []Result: One result per variant and input, in the order they were run.
+// - error: If an input does not exist, a directory cannot be created or an operation fails, it returns the error. Otherwise, it returns nil.
+//
+// Dependencies:
+// - common.WrapFile: Profiles each run.
+//
+// Notes:
+//   - Profiles are written to ProfileDir, in a subdirectory per variant and per input when the scenario has more
+//     than one, so that runs do not overwrite each other's profiles. With repeats, each operation's profile is
+//     that of its last run.
+//   - The profile settings of the common package, imageprocessing.NumRoutines and GOMAXPROCS are restored once the
+//     scenario completes.
+func (s *Scenario) Run() ([]Result, error) {
+	for _, input := range s.Inputs {
+		if _, err := os.Stat(input); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(s.OutputDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	defer s.configure()()
+
+	var results []Result
+	for _, variant := range s.Variants {
+		for _, input := range s.Inputs {
+			dir := s.profileDir(variant, input)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, err
+			}
+			setProfileDir(dir)
+
+			fmt.Printf("Scenario %s, variant %s: %s\n\n", s.Name, variant.Name, input)
+			result, err := s.runVariant(variant, input)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// runVariant runs the operations on one input with the variant's worker count and GOMAXPROCS value, and prints
+// their results table. The operations are recorded in the metrics under the variant's name.
+//
+// Returns:
+// - Result: The results of the operations.
+// - error: If an operation fails, it returns the error, naming the operation. Otherwise, it returns nil.
+func (s *Scenario) runVariant(variant Variant, input string) (Result, error) {
+	defer metrics.Default.SetVariant(variant.Name)()
+	defaultRoutines := imageprocessing.NumRoutines
+	defer func() { imageprocessing.NumRoutines = defaultRoutines }()
+	if variant.MaxProcs > 0 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(variant.MaxProcs))
+	}
+
+	result := Result{Variant: variant, Input: input}
+	for _, op := range s.Operations {
+		imageprocessing.NumRoutines = defaultRoutines
+		if variant.Workers > 0 {
+			imageprocessing.NumRoutines = variant.Workers
+		}
+		if op.Workers > 0 {
+			imageprocessing.NumRoutines = op.Workers
+		}
+
+		operation, _ := imageprocessing.LookupOperation(op.Name)
+		timed := common.WrapFile(operation.Func)
+		runs := make([]common.FunctionResult, s.Repeats)
+		for i := range runs {
+			fmt.Println("Profiling: " + common.FunctionName(operation.Func) + "()")
+			run, err := timed(context.Background(), input, operation.OutputPath(s.OutputDir))
+			if err != nil {
+				return result, fmt.Errorf("%s on %s: %w", op.Name, input, err)
+			}
+			runs[i] = run
+			fmt.Print("  ...Complete\n\n")
+		}
+		result.Results = append(result.Results, median(runs))
+	}
+
+	// The Concurrency column shows the variant's worker count
+	imageprocessing.NumRoutines = defaultRoutines
+	if variant.Workers > 0 {
+		imageprocessing.NumRoutines = variant.Workers
+	}
+	s.printResults(result)
+	return result, nil
+}
+
+// configure applies the scenario's profile settings to the common package, and returns a func that restores them.
+func (s *Scenario) configure() func() {
+	cpu, heap, exporters := common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters
+	top, list, tagFocus := common.SummaryTopN, common.SummaryList, common.SummaryTagFocus
+
+	common.CaptureCPUProfile, common.CaptureHeapProfile = false, false
+	for _, profile := range s.Profiles {
+		switch profile {
+		case "cpu":
+			common.CaptureCPUProfile = true
+		case "heap":
+			common.CaptureHeapProfile = true
+		}
+	}
+	common.SummaryTopN, common.SummaryList, common.SummaryTagFocus = s.Top, s.List, s.TagFocus
+
+	return func() {
+		common.CaptureCPUProfile, common.CaptureHeapProfile, common.ProfileExporters = cpu, heap, exporters
+		common.SummaryTopN, common.SummaryList, common.SummaryTagFocus = top, list, tagFocus
+	}
+}
+
+// profileDir returns the directory the profiles of a variant and input are written to.
+func (s *Scenario) profileDir(variant Variant, input string) string {
+	dir := s.ProfileDir
+	if len(s.Variants) > 1 {
+		dir = filepath.Join(dir, variant.Name)
+	}
+	if len(s.Inputs) > 1 {
+		dir = filepath.Join(dir, inputName(input))
+	}
+	return dir
+}
+
+// BaselineResults returns the results of every run, named so that each variant and input has its own baseline.
+//
+// Parameters:
+// - results: The results returned by Run.
+//
+// Returns:
+// - []common.FunctionResult: The results, each named <FunctionName>[/<variant>][/<input>].
+//
+// Notes:
+//   - The variant and input are only added to the names when the scenario has more than one, so a scenario with a
+//     single variant and input shares its baselines with the profile command.
+func (s *Scenario) BaselineResults(results []Result) []common.FunctionResult {
+	var named []common.FunctionResult
+	for _, r := range results {
+		for _, result := range r.Results {
+			if len(s.Variants) > 1 {
+				result.FunctionName += "/" + r.Variant.Name
+			}
+			if len(s.Inputs) > 1 {
+				result.FunctionName += "/" + inputName(r.Input)
+			}
+			named = append(named, result)
+		}
+	}
+	return named
+}
+
+// setProfileDir replaces the filesystem exporters of the common package with one writing to dir, keeping any
+// other exporters.
+func setProfileDir(dir string) {
+	exporters := []export.Exporter{export.Filesystem{Dir: dir}}
+	for _, exporter := range common.ProfileExporters {
+		if _, ok := exporter.(export.Filesystem); !ok {
+			exporters = append(exporters, exporter)
+		}
+	}
+	common.ProfileExporters = exporters
+}
+
+// printResults prints the results table of a variant and input, one slot per imageprocessing.Operations entry.
+//
+// Notes:
+// - If an operation is listed more than once in the scenario, only its last result is printed.
+func (s *Scenario) printResults(result Result) {
+	var slots [4]common.FunctionResult
+	for i, r := range result.Results {
+		slots[imageprocessing.OperationIndex(s.Operations[i].Name)] = r
+	}
+	common.PrintResults(slots[0], slots[1], slots[2], slots[3])
+}
+
+// median returns the run with the median duration.
+func median(runs []common.FunctionResult) common.FunctionResult {
+	sorted := append([]common.FunctionResult(nil), runs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Duration < sorted[j].Duration })
+	return sorted[len(sorted)/2]
+}
+
+// inputName returns the file name of an input without its extension.
+func inputName(input string) string {
+	base := filepath.Base(input)
+	return base[:len(base)-len(filepath.Ext(base))]
+}
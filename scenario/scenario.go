@@ -0,0 +1,243 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario describes a profiling session: the images to process, the operations to run on them, the variants to
+// compare, and which profiles, baselines and reports to capture.
+type Scenario struct {
+	Name        string `yaml:"name" json:"name"`
+	Description string `yaml:"description" json:"description"`
+
+	// Inputs are the JPEG images every operation is run on.
+	Inputs []string `yaml:"inputs" json:"inputs"`
+
+	// OutputDir is the directory the processed images are written to.
+	OutputDir string `yaml:"outputDir" json:"outputDir"`
+
+	// Operations are run in order, once per variant and input.
+	Operations []Operation `yaml:"operations" json:"operations"`
+
+	// Variants are the configurations the operations are compared across, e.g. 4 workers and 1 worker.
+	Variants []Variant `yaml:"variants" json:"variants"`
+
+	// Repeats is the number of times each operation is run; the run with the median duration is reported.
+	Repeats int `yaml:"repeats" json:"repeats"`
+
+	// Profiles lists the profiles captured for each operation: cpu and/or heap.
+	Profiles []string `yaml:"profiles" json:"profiles"`
+
+	// ProfileDir is the directory the profiles are written to.
+	ProfileDir string `yaml:"profileDir" json:"profileDir"`
+
+	// Top, List and TagFocus select the profile summaries printed after each CPU profile, as the -top, -list and
+	// -tagfocus flags do.
+	Top      int    `yaml:"top" json:"top"`
+	List     string `yaml:"list" json:"list"`
+	TagFocus string `yaml:"tagfocus" json:"tagfocus"`
+
+	Baseline Baseline `yaml:"baseline" json:"baseline"`
+
+	// Report writes an HTML report of the session to ReportPath, or to a timestamped file in ProfileDir.
+	Report     bool   `yaml:"report" json:"report"`
+	ReportPath string `yaml:"reportPath" json:"reportPath"`
+}
+
+// Operation is an operation of the scenario, by its imageprocessing.Operations name.
+//
+// Notes:
+//   - In a scenario file, an operation is either its name or a mapping with a name and parameters, e.g.
+//     {name: sharpen-optimized, workers: 2}.
+type Operation struct {
+	Name string `yaml:"name" json:"name"`
+
+	// Workers overrides the variant's worker count for this operation.
+	Workers int `yaml:"workers" json:"workers"`
+}
+
+// Variant is a configuration the scenario's operations are run with.
+type Variant struct {
+	Name string `yaml:"name" json:"name"`
+
+	// Workers is the number of goroutines the optimized operations use; 0 keeps imageprocessing.NumRoutines.
+	Workers int `yaml:"workers" json:"workers"`
+
+	// MaxProcs is the GOMAXPROCS value the operations run with; 0 keeps the current value.
+	MaxProcs int `yaml:"maxprocs" json:"maxprocs"`
+}
+
+// Baseline selects the baseline file the scenario's results are checked against or saved to.
+type Baseline struct {
+	Path   string `yaml:"path" json:"path"`
+	Check  bool   `yaml:"check" json:"check"`
+	Update bool   `yaml:"update" json:"update"`
+}
+
+// UnmarshalYAML decodes an operation from either its name or a mapping.
+func (op *Operation) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*op = Operation{}
+		return value.Decode(&op.Name)
+	}
+	// value.Decode does not inherit the decoder's KnownFields setting, so unknown keys are rejected here
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			if key := value.Content[i].Value; key != "name" && key != "workers" {
+				return fmt.Errorf("line %d: unknown operation field %q", value.Content[i].Line, key)
+			}
+		}
+	}
+	type plain Operation
+	return value.Decode((*plain)(op))
+}
+
+// UnmarshalJSON decodes an operation from either its name or an object.
+func (op *Operation) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*op = Operation{}
+		return json.Unmarshal(data, &op.Name)
+	}
+	type plain Operation
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(op))
+}
+
+// Load reads a scenario file, fills in its defaults and validates it.
+//
+// Parameters:
+// - path: Path to the scenario. Files ending in .json are read as JSON, and any other file as YAML.
+//
+// Returns:
+// - *Scenario: The scenario, named after the file if it has no name.
+// - error: If the file cannot be read or parsed, or the scenario is invalid, it returns the error. Otherwise, it returns nil.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		format = "json"
+	}
+
+	s, err := Parse(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return s, nil
+}
+
+// Parse decodes a scenario, fills in its defaults and validates it.
+//
+// Parameters:
+// - data: The encoded scenario.
+// - format: The encoding of data: yaml or json.
+//
+// Returns:
+// - *Scenario: The scenario.
+// - error: If data cannot be decoded, contains unknown fields, or the scenario is invalid, it returns the error. Otherwise, it returns nil.
+func Parse(data []byte, format string) (*Scenario, error) {
+	s := &Scenario{}
+	switch format {
+	case "yaml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(s); err != nil {
+			return nil, err
+		}
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(s); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown scenario format %q", format)
+	}
+
+	s.setDefaults()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// setDefaults fills in the fields the scenario leaves empty, matching the defaults of the profile command.
+func (s *Scenario) setDefaults() {
+	if len(s.Inputs) == 0 {
+		s.Inputs = []string{imageprocessing.DefaultInputPath}
+	}
+	if s.OutputDir == "" {
+		s.OutputDir = imageprocessing.DefaultOutputDir
+	}
+	if len(s.Operations) == 0 {
+		for _, name := range imageprocessing.OperationNames() {
+			s.Operations = append(s.Operations, Operation{Name: name})
+		}
+	}
+	if len(s.Variants) == 0 {
+		s.Variants = []Variant{{Name: "default"}}
+	}
+	if s.Repeats == 0 {
+		s.Repeats = 1
+	}
+	if s.Profiles == nil {
+		s.Profiles = []string{"cpu"}
+	}
+	if s.ProfileDir == "" {
+		s.ProfileDir = "./pprof"
+	}
+}
+
+// Validate checks that the scenario only refers to known operations and profiles, and that its variants can be
+// told apart.
+//
+// Returns:
+// - error: The first problem found. Otherwise, it returns nil.
+func (s *Scenario) Validate() error {
+	for _, op := range s.Operations {
+		if _, ok := imageprocessing.LookupOperation(op.Name); !ok {
+			return fmt.Errorf("unknown operation %q (expected one of %s)", op.Name, strings.Join(imageprocessing.OperationNames(), ", "))
+		}
+		if op.Workers < 0 {
+			return fmt.Errorf("operation %s: workers must not be negative", op.Name)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, v := range s.Variants {
+		if v.Name == "" {
+			return fmt.Errorf("every variant needs a name")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("duplicate variant %q", v.Name)
+		}
+		names[v.Name] = true
+		if v.Workers < 0 || v.MaxProcs < 0 {
+			return fmt.Errorf("variant %s: workers and maxprocs must not be negative", v.Name)
+		}
+	}
+
+	for _, profile := range s.Profiles {
+		if profile != "cpu" && profile != "heap" {
+			return fmt.Errorf("unknown profile %q (expected cpu or heap)", profile)
+		}
+	}
+	if s.Repeats < 1 {
+		return fmt.Errorf("repeats must be positive")
+	}
+	return nil
+}
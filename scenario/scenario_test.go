@@ -0,0 +1,153 @@
+package scenario
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/internal/testimage"
+	"github.com/stretchr/testify/assert"
+)
+
+const testYAML = `
+name: workers
+inputs: [a.jpg, b.jpg]
+operations:
+  - grayscale
+  - name: sharpen-optimized
+    workers: 3
+variants:
+  - name: four
+    workers: 4
+  - name: one
+    workers: 1
+    maxprocs: 1
+profiles: [heap]
+list: toGrayscaleConcurrent
+baseline:
+  check: true
+`
+
+const testJSON = `{
+  "operations": ["grayscale", {"name": "sharpen-optimized", "workers": 3}],
+  "repeats": 3
+}`
+
+// TestParse ensures that operations can be given by name or with parameters, and that defaults are filled in.
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(testYAML), "yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "workers", s.Name)
+	assert.Equal(t, []Operation{{Name: "grayscale"}, {Name: "sharpen-optimized", Workers: 3}}, s.Operations)
+	assert.Equal(t, []Variant{{Name: "four", Workers: 4}, {Name: "one", Workers: 1, MaxProcs: 1}}, s.Variants)
+	assert.Equal(t, []string{"heap"}, s.Profiles)
+	assert.Equal(t, "toGrayscaleConcurrent", s.List)
+	assert.True(t, s.Baseline.Check)
+	assert.Equal(t, 1, s.Repeats)
+	assert.Equal(t, imageprocessing.DefaultOutputDir, s.OutputDir)
+
+	s, err = Parse([]byte(testJSON), "json")
+	assert.NoError(t, err)
+	assert.Equal(t, []Operation{{Name: "grayscale"}, {Name: "sharpen-optimized", Workers: 3}}, s.Operations)
+	assert.Equal(t, []Variant{{Name: "default"}}, s.Variants)
+	assert.Equal(t, []string{imageprocessing.DefaultInputPath}, s.Inputs)
+	assert.Equal(t, []string{"cpu"}, s.Profiles)
+	assert.Equal(t, 3, s.Repeats)
+	assert.Equal(t, "./pprof", s.ProfileDir)
+
+	s, err = Parse([]byte("repeats: 2\n"), "yaml")
+	assert.NoError(t, err)
+	assert.Len(t, s.Operations, len(imageprocessing.Operations))
+}
+
+// TestParseErrors ensures that unknown fields, operations and profiles, and ambiguous variants, are rejected.
+func TestParseErrors(t *testing.T) {
+	for name, tc := range map[string]struct{ data, format, err string }{
+		"unknown field":           {"repeat: 2\n", "yaml", "field repeat not found"},
+		"unknown operation field": {"operations:\n  - name: grayscale\n    worker: 2\n", "yaml", `unknown operation field "worker"`},
+		"unknown json field":      {`{"operations": [{"name": "grayscale", "worker": 2}]}`, "json", `unknown field "worker"`},
+		"unknown operation":       {"operations: [blur]\n", "yaml", `unknown operation "blur"`},
+		"unknown profile":         {`{"profiles": ["block"]}`, "json", `unknown profile "block"`},
+		"duplicate variant":       {"variants: [{name: a}, {name: a, workers: 2}]\n", "yaml", `duplicate variant "a"`},
+		"unnamed variant":         {"variants: [{workers: 2}]\n", "yaml", "needs a name"},
+		"negative repeats":        {"repeats: -1\n", "yaml", "repeats must be positive"},
+		"unknown format":          {"", "toml", `unknown scenario format "toml"`},
+	} {
+		_, err := Parse([]byte(tc.data), tc.format)
+		assert.ErrorContains(t, err, tc.err, name)
+	}
+}
+
+// TestLoad ensures that the format is chosen by extension, and that an unnamed scenario is named after its file.
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "unnamed.json")
+	assert.NoError(t, os.WriteFile(path, []byte(testJSON), 0o644))
+
+	s, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "unnamed", s.Name)
+
+	for _, path := range []string{"../scenarios/single-proc.yaml", "../scenarios/article.json"} {
+		_, err := Load(path)
+		assert.NoError(t, err, path)
+	}
+}
+
+// TestRun ensures that every variant and input is run, each writing its profiles to its own directory, and that
+// the global settings are restored afterwards.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		testimage.WriteJPEG(t, filepath.Join(dir, name))
+	}
+	s, err := Parse([]byte(testYAML), "yaml")
+	assert.NoError(t, err)
+	s.Inputs = []string{filepath.Join(dir, "a.jpg"), filepath.Join(dir, "b.jpg")}
+	s.OutputDir = filepath.Join(dir, "outputs")
+	s.ProfileDir = filepath.Join(dir, "pprof")
+
+	routines, cpu := imageprocessing.NumRoutines, common.CaptureCPUProfile
+	results, err := s.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, routines, imageprocessing.NumRoutines)
+	assert.Equal(t, cpu, common.CaptureCPUProfile)
+	assert.Equal(t, "", common.SummaryList)
+
+	assert.Len(t, results, 4)
+	assert.Equal(t, "four", results[0].Variant.Name)
+	assert.Equal(t, s.Inputs[1], results[1].Input)
+	assert.Equal(t, "one", results[2].Variant.Name)
+	assert.Equal(t, "ProcessImageGrayscale", results[0].Results[0].FunctionName)
+	assert.Equal(t, "ProcessImageSharpenOptimized", results[0].Results[1].FunctionName)
+
+	assert.FileExists(t, filepath.Join(dir, "pprof", "one", "b", "heap-ProcessImageSharpenOptimized.pprof"))
+	assert.NoFileExists(t, filepath.Join(dir, "pprof", "one", "b", "cpu-ProcessImageSharpenOptimized.pprof"))
+	assert.FileExists(t, filepath.Join(dir, "outputs", "sharpenProcessedOptimized.jpg"))
+
+	named := s.BaselineResults(results)
+	assert.Len(t, named, 8)
+	assert.Equal(t, "ProcessImageGrayscale/four/a", named[0].FunctionName)
+	assert.Equal(t, "ProcessImageSharpenOptimized/one/b", named[7].FunctionName)
+
+	s.Inputs = []string{filepath.Join(dir, "missing.jpg")}
+	_, err = s.Run()
+	assert.Error(t, err)
+
+	// A corrupt input fails the run with an error rather than a panic
+	corrupt := filepath.Join(dir, "corrupt.jpg")
+	assert.NoError(t, os.WriteFile(corrupt, []byte("not a jpeg"), 0o644))
+	s.Inputs = []string{corrupt}
+	_, err = s.Run()
+	assert.ErrorContains(t, err, "grayscale on "+corrupt)
+	assert.Equal(t, cpu, common.CaptureCPUProfile)
+}
+
+// TestMedian ensures that the run with the median duration is reported.
+func TestMedian(t *testing.T) {
+	runs := []common.FunctionResult{{Duration: 30}, {Duration: 10}, {Duration: 20}}
+	assert.Equal(t, 20.0, median(runs).Duration)
+	assert.Equal(t, 30.0, runs[0].Duration)
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// format is an output format of the service.
+type format struct {
+	name      string
+	mediaType string
+	encode    func(w io.Writer, img image.Image) error
+}
+
+// formats lists the output formats, in order of preference when the client accepts several equally. Every one of
+// them is also decoded, as the image packages register their decoders with the image package.
+var formats = []format{
+	{name: "jpeg", mediaType: "image/jpeg", encode: func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) }},
+	{name: "png", mediaType: "image/png", encode: png.Encode},
+	{name: "gif", mediaType: "image/gif", encode: func(w io.Writer, img image.Image) error { return gif.Encode(w, img, nil) }},
+}
+
+// formatNames returns the names of the formats, for error messages.
+func formatNames() []string {
+	names := make([]string, len(formats))
+	for i, f := range formats {
+		names[i] = f.name
+	}
+	return names
+}
+
+// negotiate selects the output format of a request.
+//
+// Parameters:
+// - name: The format query parameter, which takes precedence over the Accept header. "jpg" is accepted for jpeg.
+// - accept: The Accept header, e.g. "image/png, image/*;q=0.5".
+// - inputFormat: The format of the posted image, as returned by image.Decode, which is used when the client accepts it as much as any other.
+//
+// Returns:
+// - format: The output format.
+// - error: A *requestError with 400 Bad Request for an unknown format parameter, or 406 Not Acceptable if the client accepts none of the formats. Otherwise, it returns nil.
+func negotiate(name, accept, inputFormat string) (format, error) {
+	if name != "" {
+		if name == "jpg" {
+			name = "jpeg"
+		}
+		for _, f := range formats {
+			if f.name == name {
+				return f, nil
+			}
+		}
+		return format{}, statusError(http.StatusBadRequest, "unknown format %q (expected %s)", name, strings.Join(formatNames(), ", "))
+	}
+
+	ranges := parseAccept(accept)
+	best, bestQ := -1, 0.0
+	for i, f := range formats {
+		q := quality(ranges, f.mediaType)
+		if q > bestQ || (q == bestQ && q > 0 && f.name == inputFormat) {
+			best, bestQ = i, q
+		}
+	}
+	if best < 0 {
+		return format{}, statusError(http.StatusNotAcceptable, "none of the accepted types can be produced (available: %s)", strings.Join(formatNames(), ", "))
+	}
+	return formats[best], nil
+}
+
+// mediaRange is a media range of an Accept header, with its quality.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header. An empty header accepts anything.
+//
+// Notes:
+// - Malformed ranges are ignored, and a missing or malformed q parameter counts as 1.
+func parseAccept(accept string) []mediaRange {
+	if strings.TrimSpace(accept) == "" {
+		return []mediaRange{{mediaType: "*/*", q: 1}}
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// quality returns the quality the client gives a media type: that of the most specific range matching it, or 0 if
+// none does.
+func quality(ranges []mediaRange, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	major := mediaType[:strings.IndexByte(mediaType, '/')]
+	for _, r := range ranges {
+		s := -1
+		switch r.mediaType {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
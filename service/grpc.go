@@ -0,0 +1,308 @@
+package service
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../service/servicepb/service.proto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/live"
+	"github.com/mwiater/golangpprof/service/servicepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ChunkSize is the size of the chunks ProcessStream streams results in, in bytes.
+const ChunkSize = 64 << 10
+
+// grpcMessageOverhead is the room left in the largest message the gRPC server accepts for the fields around the
+// image of a ProcessRequest.
+const grpcMessageOverhead = 64 << 10
+
+// GRPC returns a gRPC server with the service's ImageProcessor registered:
+//   - Process: Runs an image sent in a single message through a pipeline, as POST /process does, and returns the
+//     result in a single message.
+//   - Upload: Runs an image uploaded in chunks through a pipeline, and returns the result in a single message.
+//   - ProcessStream: Runs an image uploaded in chunks through a pipeline, streaming the progress of each stage, then
+//     the result in chunks of ChunkSize.
+//
+// Parameters:
+// - opts: Options of the server, e.g. credentials. They are applied after the service's own.
+//
+// Returns:
+// - *grpc.Server: The server, which is not serving yet.
+//
+// Notes:
+//   - The largest message the server accepts is set from MaxBytes, so that Process takes the same images as
+//     POST /process. Uploads are checked against MaxBytes as their chunks arrive.
+//   - The results of Process and Upload are bounded by the client's receive limit, 4 MiB by default, beyond which
+//     the call fails with ResourceExhausted on the client. Clients expecting larger results must raise it with
+//     grpc.MaxCallRecvMsgSize, or use ProcessStream, whose chunks fit the default limit.
+//   - Errors are returned with the gRPC code matching the status code POST /process answers with:
+//     InvalidArgument for invalid requests, ResourceExhausted for images over the limits, and DeadlineExceeded
+//     for images that take longer than Timeout to process.
+func (s *Service) GRPC(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(int(s.cfg.MaxBytes) + grpcMessageOverhead)}, opts...)
+	server := grpc.NewServer(opts...)
+	servicepb.RegisterImageProcessorServer(server, &grpcService{s: s})
+	return server
+}
+
+// grpcService implements the ImageProcessor gRPC service on top of a Service.
+type grpcService struct {
+	servicepb.UnimplementedImageProcessorServer
+	s *Service
+}
+
+// Process implements ImageProcessor.Process.
+func (g *grpcService) Process(ctx context.Context, req *servicepb.ProcessRequest) (*servicepb.ProcessResponse, error) {
+	return g.process(ctx, "Process", req.GetPipeline(), req.GetImage(), nil)
+}
+
+// Upload implements ImageProcessor.Upload.
+func (g *grpcService) Upload(stream servicepb.ImageProcessor_UploadServer) error {
+	start := time.Now()
+	pipeline, body, err := g.s.receive(stream)
+	if err != nil {
+		g.s.recordPipeline(pipeline, int64(len(body)), 0, time.Since(start), err)
+		return g.s.grpcError(err)
+	}
+	response, err := g.process(stream.Context(), "Upload", pipeline, body, nil)
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(response)
+}
+
+// ProcessStream implements ImageProcessor.ProcessStream.
+//
+// Notes:
+//   - Progress is not reported while the image is uploaded, so that a client that only reads the stream once its
+//     upload is complete cannot stall it.
+func (g *grpcService) ProcessStream(stream servicepb.ImageProcessor_ProcessStreamServer) error {
+	start := time.Now()
+	pipeline, body, err := g.s.receive(stream)
+	if err != nil {
+		g.s.recordPipeline(pipeline, int64(len(body)), 0, time.Since(start), err)
+		return g.s.grpcError(err)
+	}
+
+	// A failed send means the client went away, which cancels the stream's context and so the processing
+	progress := func(p *servicepb.Progress) {
+		stream.Send(&servicepb.ProcessEvent{Event: &servicepb.ProcessEvent_Progress{Progress: p}})
+	}
+	response, err := g.process(stream.Context(), "ProcessStream", pipeline, body, progress)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&servicepb.ProcessEvent{Event: &servicepb.ProcessEvent_Result{Result: response.Result}}); err != nil {
+		return err
+	}
+	for image := response.Image; len(image) > 0; {
+		n := len(image)
+		if n > ChunkSize {
+			n = ChunkSize
+		}
+		if err := stream.Send(&servicepb.ProcessEvent{Event: &servicepb.ProcessEvent_Chunk{Chunk: image[:n]}}); err != nil {
+			return err
+		}
+		image = image[n:]
+	}
+	return nil
+}
+
+// process checks an image against the limits of the service, then processes it or returns its cached result.
+//
+// Parameters:
+// - ctx: The context of the call, which cancels the processing of the image.
+// - method: The name of the RPC, shown on the status page of -serve.
+// - pipeline: The operations and output format of the image.
+// - body: The encoded image.
+// - progress: If set, is called once the image is accepted and after each stage of its processing.
+//
+// Returns:
+// - *servicepb.ProcessResponse: The processed image.
+// - error: A gRPC status error. Otherwise, it returns nil.
+func (g *grpcService) process(ctx context.Context, method string, pipeline *servicepb.Pipeline, body []byte, progress func(*servicepb.Progress)) (*servicepb.ProcessResponse, error) {
+	start := time.Now()
+	end := live.Begin("gRPC " + method + " ops=" + strings.Join(pipeline.GetOperations(), ","))
+	result, contentType, cached, err := g.s.processPipeline(ctx, pipeline, body, progress)
+	end(int64(len(body)), err)
+	g.s.recordPipeline(pipeline, int64(len(body)), int64(len(result)), time.Since(start), err)
+	if err != nil {
+		return nil, g.s.grpcError(err)
+	}
+
+	return &servicepb.ProcessResponse{
+		Result: &servicepb.Result{ContentType: contentType, Size: int64(len(result)), Cached: cached},
+		Image:  result,
+	}, nil
+}
+
+// processPipeline accepts an image sent over gRPC and runs it through its pipeline, within the timeout of the
+// service.
+//
+// Returns:
+// - []byte: The encoded result, which must not be modified as it may be shared with the cache.
+// - string: The media type of the result.
+// - bool: Whether the result was found in the cache.
+// - error: A *requestError for invalid requests, or the error of runCached. Otherwise, it returns nil.
+func (s *Service) processPipeline(ctx context.Context, pipeline *servicepb.Pipeline, body []byte, progress func(*servicepb.Progress)) ([]byte, string, bool, error) {
+	ops, err := imageprocessing.ParseOperations(strings.Join(pipeline.GetOperations(), ","))
+	if err != nil {
+		return nil, "", false, statusError(http.StatusBadRequest, "invalid operations: %v", err)
+	}
+	if int64(len(body)) > s.cfg.MaxBytes {
+		return nil, "", false, statusError(http.StatusRequestEntityTooLarge, "image is larger than %d bytes", s.cfg.MaxBytes)
+	}
+	a, err := s.inspect(body, ops, pipeline.GetFormat(), "")
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	if progress == nil {
+		progress = func(*servicepb.Progress) {}
+	}
+	total := int32(len(ops))
+	progress(&servicepb.Progress{Stage: servicepb.Stage_STAGE_RECEIVED, BytesReceived: int64(len(body)), OperationsTotal: total})
+	stages := map[stage]servicepb.Stage{
+		stageDecoded:   servicepb.Stage_STAGE_DECODED,
+		stageProcessed: servicepb.Stage_STAGE_PROCESSED,
+		stageEncoded:   servicepb.Stage_STAGE_ENCODED,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	result, cached, err := s.runCached(ctx, a, func(st stage, done int) {
+		progress(&servicepb.Progress{Stage: stages[st], BytesReceived: int64(len(body)), OperationsDone: int32(done), OperationsTotal: total})
+	})
+	return result, a.output.mediaType, cached, err
+}
+
+// uploadStream is the receiving side of the Upload and ProcessStream streams.
+type uploadStream interface {
+	Recv() (*servicepb.UploadRequest, error)
+}
+
+// receive reads a chunked upload: the pipeline, then the chunks of the image until the client closes the stream.
+//
+// Returns:
+// - *servicepb.Pipeline: The pipeline, or nil if the first message was not one.
+// - []byte: The image, as far as it was read.
+// - error: A *requestError if the messages are out of order or the image is larger than MaxBytes, or the error of the stream. Otherwise, it returns nil.
+func (s *Service) receive(stream uploadStream) (*servicepb.Pipeline, []byte, error) {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return nil, nil, statusError(http.StatusBadRequest, "empty upload, the first message must be the pipeline")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	pipeline := first.GetPipeline()
+	if pipeline == nil {
+		return nil, nil, statusError(http.StatusBadRequest, "the first message must be the pipeline")
+	}
+
+	var body []byte
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return pipeline, body, nil
+		}
+		if err != nil {
+			return pipeline, body, err
+		}
+		if message.GetPipeline() != nil {
+			return pipeline, body, statusError(http.StatusBadRequest, "the pipeline must only be sent in the first message")
+		}
+		if int64(len(body)+len(message.GetChunk())) > s.cfg.MaxBytes {
+			return pipeline, body, statusError(http.StatusRequestEntityTooLarge, "image is larger than %d bytes", s.cfg.MaxBytes)
+		}
+		body = append(body, message.GetChunk()...)
+	}
+}
+
+// recordPipeline records a call in the metrics registry, unless its operations are invalid, as record does for
+// HTTP requests.
+func (s *Service) recordPipeline(pipeline *servicepb.Pipeline, bytesIn, bytesOut int64, elapsed time.Duration, err error) {
+	ops, opsErr := imageprocessing.ParseOperations(strings.Join(pipeline.GetOperations(), ","))
+	if opsErr != nil {
+		return
+	}
+	s.observe(imageprocessing.PipelineName(ops), bytesIn, bytesOut, elapsed, err)
+}
+
+// grpcError converts an error to a gRPC status error, with the code matching the status code POST /process
+// answers with.
+func (s *Service) grpcError(err error) error {
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		if reqErr.code == http.StatusRequestEntityTooLarge {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "processing timed out after %s", s.cfg.Timeout)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// GRPCServer is a running gRPC image processing service.
+type GRPCServer struct {
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// StartGRPC starts the gRPC service in the background.
+//
+// Parameters:
+// - addr: The address to listen on. Use port 0 to pick a free port.
+// - cfg: The limits of the service.
+//
+// Returns:
+// - *GRPCServer: The running server.
+// - error: If the address cannot be listened on, it returns the error. Otherwise, it returns nil.
+func StartGRPC(addr string, cfg Config) (*GRPCServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &GRPCServer{server: New(cfg).GRPC(), listener: listener}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *GRPCServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops the server, waiting for in-progress calls until the context is done, and then cancelling them.
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/jobs"
+	"github.com/mwiater/golangpprof/live"
+)
+
+// JobProcessor returns the func a job queue processes the service's jobs with, so that jobs submitted to
+// POST /jobs are processed as POST /process would process them.
+//
+// Parameters:
+// - cfg: The limits of the service, of which Timeout bounds the processing of each job, and its cache.
+//
+// Returns:
+// - jobs.ProcessFunc: Decodes a job's image, runs it through the job's operations and encodes it in the job's format.
+func JobProcessor(cfg Config) jobs.ProcessFunc {
+	return New(cfg).processJob
+}
+
+// WebhookClient returns the client a job queue posts the service's webhooks with. It refuses to connect to
+// loopback, private and link-local addresses, such as the cloud metadata endpoint, unless their host is one of the
+// WebhookHosts, so that API clients cannot make the service send requests into its own network.
+//
+// Parameters:
+// - cfg: The service's configuration, of which WebhookHosts are the hosts allowed on any address.
+//
+// Returns:
+// - *http.Client: The client, with jobs.DefaultWebhookTimeout.
+//
+// Notes:
+//   - Addresses are checked once host names are resolved, when the connection is made, so that neither a host name
+//     resolving to an internal address nor a redirect to one gets through.
+//   - Proxies from the environment are not used, as the address checked would be the proxy's.
+func WebhookClient(cfg Config) *http.Client {
+	allowed := webhookHosts(cfg.WebhookHosts)
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+			return fmt.Errorf("webhook address %s is not allowed", host)
+		}
+		return nil
+	}}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && allowed[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		return guarded.DialContext(ctx, network, addr)
+	}
+	return &http.Client{Timeout: jobs.DefaultWebhookTimeout, Transport: transport}
+}
+
+// checkWebhook returns an error if a webhook is not an http or https URL, or is posted to a loopback, private or
+// link-local address that is not one of the WebhookHosts.
+//
+// Notes:
+//   - Only IP addresses and localhost are checked here, as host names are checked by WebhookClient once resolved.
+func (s *Service) checkWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook: %s is not an http or https URL", webhook)
+	}
+	host := strings.ToLower(u.Hostname())
+	if webhookHosts(s.cfg.WebhookHosts)[host] {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && internalIP(ip)) {
+		return fmt.Errorf("invalid webhook: %s is a loopback, private or link-local address, which is not allowed", host)
+	}
+	return nil
+}
+
+// webhookHosts returns the set of WebhookHosts, in lower case.
+func webhookHosts(hosts []string) map[string]bool {
+	allowed := map[string]bool{}
+	for _, host := range hosts {
+		allowed[strings.ToLower(strings.Trim(host, "[]"))] = true
+	}
+	return allowed
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10, which some clouds serve their metadata on.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// internalIP reports whether an address is one webhooks must not reach by default: unspecified, loopback, private,
+// shared, link-local or multicast.
+func internalIP(ip net.IP) bool {
+	return ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// processJob processes one job, which was checked against the limits of the service when it was submitted.
+func (s *Service) processJob(ctx context.Context, job jobs.Job, input []byte) ([]byte, string, error) {
+	start := time.Now()
+	ops, err := imageprocessing.ParseOperations(job.Operations)
+	if err != nil {
+		return nil, "", err
+	}
+	output, err := negotiate(job.Format, "", "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	end := live.Begin("job " + job.ID + " ops=" + job.Operations)
+	result, _, err := s.runCached(ctx, accepted{body: input, ops: ops, output: output}, nil)
+	end(int64(len(input)), err)
+	s.observe(job.Operations, int64(len(input)), int64(len(result)), time.Since(start), err)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, output.mediaType, nil
+}
+
+// serveJobs handles the job routes:
+//   - POST /jobs?ops=...: Submits the posted image as a job, and answers 202 Accepted with the job.
+//   - GET /jobs: Lists every job.
+//   - GET /jobs/{id}: Returns the state of a job.
+//   - GET /jobs/{id}/result: Returns the processed image of a job that is done.
+//   - DELETE /jobs/{id}: Cancels a job.
+func (s *Service) serveJobs(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	id, resource, _ := strings.Cut(path, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		s.submitJob(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.cfg.Jobs.Jobs())
+	case id == "":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, r.Method+" is not allowed, use GET or POST", http.StatusMethodNotAllowed)
+	case resource == "result" && r.Method == http.MethodGet:
+		s.jobResult(w, id)
+	case resource == "result":
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, r.Method+" is not allowed, use GET", http.StatusMethodNotAllowed)
+	case resource != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet:
+		job, err := s.cfg.Jobs.Status(id)
+		if err != nil {
+			jobError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case r.Method == http.MethodDelete:
+		s.cancelJob(w, id)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, r.Method+" is not allowed, use GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// submitJob handles POST /jobs. The image is checked against the limits of the service before the job is queued,
+// so that invalid requests are answered right away, as they are by POST /process.
+//
+// Notes:
+//   - The output format is the format query parameter, or the format of the posted image. The Accept header is not
+//     used, as it applies to the JSON response.
+//   - The priority query parameter orders the queue, and the webhook query parameter is an http or https URL the
+//     job is posted to once it has finished. Webhooks to loopback, private and link-local addresses are refused,
+//     unless their host is one of the WebhookHosts.
+func (s *Service) submitJob(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	priority := 0
+	if value := query.Get("priority"); value != "" {
+		var err error
+		if priority, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "invalid priority: "+value+" is not an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	webhook := query.Get("webhook")
+	if webhook != "" {
+		if err := s.checkWebhook(webhook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	a, err := s.accept(r, "")
+	if err != nil {
+		code := http.StatusBadRequest
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			code = reqErr.code
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	job, err := s.cfg.Jobs.Submit(jobs.Request{
+		Operations: imageprocessing.PipelineName(a.ops),
+		Format:     a.output.name,
+		Priority:   priority,
+		Webhook:    webhook,
+		Input:      a.body,
+	})
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// jobResult handles GET /jobs/{id}/result.
+func (s *Service) jobResult(w http.ResponseWriter, id string) {
+	data, job, err := s.cfg.Jobs.Result(id)
+	if errors.Is(err, jobs.ErrNotDone) {
+		http.Error(w, "job is "+string(job.Status), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", job.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// cancelJob handles DELETE /jobs/{id}. A running job is answered with 202 Accepted, as it is cancelled once its
+// operations notice.
+func (s *Service) cancelJob(w http.ResponseWriter, id string) {
+	job, err := s.cfg.Jobs.Cancel(id)
+	if err != nil {
+		jobError(w, err)
+		return
+	}
+	code := http.StatusOK
+	if job.Status == jobs.StatusRunning {
+		code = http.StatusAccepted
+	}
+	writeJSON(w, code, job)
+}
+
+// jobError answers a request with the status code of a job queue error.
+func jobError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, jobs.ErrFinished):
+		code = http.StatusConflict
+	case errors.Is(err, jobs.ErrQueueFull), errors.Is(err, jobs.ErrClosed):
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// writeJSON answers a request with a JSON document.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/metrics"
+)
+
+// httpMetrics counts the requests to /process.
+type httpMetrics struct {
+	mu       sync.Mutex
+	requests map[int]int64 // status code -> requests
+	bytesIn  int64
+	bytesOut int64
+	seconds  float64
+}
+
+// newHTTPMetrics returns empty metrics.
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{requests: map[int]int64{}}
+}
+
+// observe records a completed request.
+func (m *httpMetrics) observe(code int, bytesIn, bytesOut int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[code]++
+	m.bytesIn += bytesIn
+	m.bytesOut += bytesOut
+	m.seconds += elapsed.Seconds()
+}
+
+// serve writes the metrics in the Prometheus text exposition format.
+func (m *httpMetrics) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.requests))
+	for code := range m.requests {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	requests := make([]int64, len(codes))
+	for i, code := range codes {
+		requests[i] = m.requests[code]
+	}
+	bytesIn, bytesOut, seconds := m.bytesIn, m.bytesOut, m.seconds
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	fmt.Fprintln(w, "# HELP golangpprof_http_requests_total Requests to /process, by status code.")
+	fmt.Fprintln(w, "# TYPE golangpprof_http_requests_total counter")
+	for i, code := range codes {
+		fmt.Fprintf(w, "golangpprof_http_requests_total{code=\"%d\"} %d\n", code, requests[i])
+	}
+	fmt.Fprintln(w, "# HELP golangpprof_http_request_bytes_total Bytes of images posted to /process.")
+	fmt.Fprintln(w, "# TYPE golangpprof_http_request_bytes_total counter")
+	fmt.Fprintf(w, "golangpprof_http_request_bytes_total %d\n", bytesIn)
+	fmt.Fprintln(w, "# HELP golangpprof_http_response_bytes_total Bytes of processed images returned by /process.")
+	fmt.Fprintln(w, "# TYPE golangpprof_http_response_bytes_total counter")
+	fmt.Fprintf(w, "golangpprof_http_response_bytes_total %d\n", bytesOut)
+	fmt.Fprintln(w, "# HELP golangpprof_http_request_seconds_total Time spent handling requests to /process.")
+	fmt.Fprintln(w, "# TYPE golangpprof_http_request_seconds_total counter")
+	fmt.Fprintf(w, "golangpprof_http_request_seconds_total %g\n", seconds)
+}
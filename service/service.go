@@ -0,0 +1,450 @@
+// Package service runs the image operations as an HTTP microservice: an image posted to /process is decoded,
+// run through a pipeline of operations and returned in the requested format, entirely in memory. The same pipelines
+// are served over gRPC by the ImageProcessor service defined in servicepb.
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mwiater/golangpprof/cache"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/jobs"
+	"github.com/mwiater/golangpprof/live"
+	"github.com/mwiater/golangpprof/metrics"
+)
+
+// Defaults of the Config limits.
+const (
+	DefaultAddr      = "localhost:8080"
+	DefaultMaxBytes  = 32 << 20
+	DefaultMaxPixels = 100_000_000
+	DefaultTimeout   = 30 * time.Second
+)
+
+// StatusClientClosedRequest is recorded in the metrics for requests whose client went away before the response was
+// written, following the nginx convention.
+const StatusClientClosedRequest = 499
+
+// Config holds the limits of the service.
+type Config struct {
+	// MaxBytes is the largest request body accepted, in bytes. It defaults to DefaultMaxBytes.
+	MaxBytes int64
+
+	// MaxPixels is the largest image accepted, in pixels, checked before the image is decoded so that a small file
+	// cannot expand into a huge image. It defaults to DefaultMaxPixels.
+	MaxPixels int64
+
+	// Timeout bounds the decoding, processing and encoding of each request. It defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Metrics is the registry the requests with valid operations are recorded in, under the pipeline's name, and
+	// whose metrics are appended to GET /metrics. It defaults to metrics.Default.
+	Metrics *metrics.Registry
+
+	// Jobs, if set, is the queue the job routes submit to. Its jobs should be processed with JobProcessor, and its
+	// webhooks posted with WebhookClient.
+	Jobs *jobs.Queue
+
+	// WebhookHosts are the host names or IP addresses job webhooks may be posted to even though they are loopback,
+	// private or link-local addresses, which are refused otherwise.
+	WebhookHosts []string
+
+	// Cache, if set, holds the processed images, so that the same operations on the same image are answered without
+	// processing it again. Its stats are appended to GET /metrics.
+	Cache *cache.Cache
+}
+
+// Service handles the requests of the image processing service.
+type Service struct {
+	cfg     Config
+	metrics *httpMetrics
+}
+
+// New returns a service with the given limits, filling in the defaults of the ones left at zero.
+func New(cfg Config) *Service {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	if cfg.MaxPixels <= 0 {
+		cfg.MaxPixels = DefaultMaxPixels
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.Default
+	}
+	return &Service{cfg: cfg, metrics: newHTTPMetrics()}
+}
+
+// Handler returns the service's routes:
+//   - POST /process?ops=grayscale,sharpen: Runs the posted image through the operations, in order, and returns the
+//     result. The output format is selected by the format query parameter (jpeg, png or gif) or, without it, by the
+//     Accept header, and defaults to the format of the posted image.
+//   - GET /metrics: The request, byte and latency counters, followed by the metrics of the registry, in the
+//     Prometheus text format.
+//   - /jobs: If Jobs is set, submits images to be processed asynchronously, and returns their status and result.
+//     See serveJobs.
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/process", s.process)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	if s.cfg.Jobs != nil {
+		mux.HandleFunc("/jobs", s.serveJobs)
+		mux.HandleFunc("/jobs/", s.serveJobs)
+	}
+	return mux
+}
+
+// serveMetrics handles GET /metrics.
+func (s *Service) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.serve(w, r)
+	s.cfg.Metrics.WriteText(w)
+	if s.cfg.Cache != nil {
+		cache.WriteText(w, s.cfg.Cache.Stats())
+	}
+}
+
+// requestError is an error answered with an HTTP status code.
+type requestError struct {
+	code int
+	err  error
+}
+
+// Error returns the message the request is answered with.
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// statusError returns a requestError answered with the given status code and message.
+func statusError(code int, format string, args ...interface{}) error {
+	return &requestError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// process handles POST /process.
+func (s *Service) process(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.fail(w, r, start, 0, statusError(http.StatusMethodNotAllowed, "%s is not allowed, use POST", r.Method))
+		return
+	}
+
+	end := live.Begin("POST /process?ops=" + r.URL.Query().Get("ops"))
+	body, output, err := s.handle(r)
+	end(int64(len(body)), err)
+	if err != nil {
+		s.record(r, int64(len(body)), 0, time.Since(start), err)
+		s.fail(w, r, start, int64(len(body)), err)
+		return
+	}
+
+	elapsed := time.Since(start)
+	w.Header().Set("Content-Type", output.contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(output.body.Len()))
+	w.Header().Set("Vary", "Accept")
+	if output.cache != "" {
+		w.Header().Set("X-Cache", output.cache)
+	}
+	w.Header().Set("Server-Timing", fmt.Sprintf("process;dur=%.1f", float64(elapsed.Microseconds())/1000))
+	w.WriteHeader(http.StatusOK)
+	written, _ := output.body.WriteTo(w)
+	s.metrics.observe(http.StatusOK, int64(len(body)), written, elapsed)
+	s.record(r, int64(len(body)), written, elapsed, nil)
+}
+
+// record records a request in the metrics registry, unless its operations are invalid, so that the operation
+// label only ever holds known pipelines.
+func (s *Service) record(r *http.Request, bytesIn, bytesOut int64, elapsed time.Duration, err error) {
+	ops, opsErr := imageprocessing.ParseOperations(r.URL.Query().Get("ops"))
+	if opsErr != nil {
+		return
+	}
+	s.observe(imageprocessing.PipelineName(ops), bytesIn, bytesOut, elapsed, err)
+}
+
+// observe records a processed image in the metrics registry, under the name of its pipeline.
+//
+// Notes:
+//   - Invalid requests are recorded with their status text as the error type, e.g. "request entity too large".
+func (s *Service) observe(operation string, bytesIn, bytesOut int64, elapsed time.Duration, err error) {
+	o := metrics.Observation{
+		Operation: operation,
+		BytesIn:   bytesIn,
+		BytesOut:  bytesOut,
+		Duration:  elapsed,
+		Err:       err,
+	}
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		o.ErrorType = strings.ToLower(http.StatusText(reqErr.code))
+	}
+	s.cfg.Metrics.Observe(o)
+}
+
+// response is a processed image, encoded in the negotiated format.
+type response struct {
+	contentType string
+	body        *bytes.Buffer
+
+	// cache is "hit" or "miss" if the service has a cache.
+	cache string
+}
+
+// handle reads, decodes, processes and encodes the image of a request.
+//
+// Returns:
+// - []byte: The request body, as far as it was read.
+// - response: The processed image.
+// - error: A *requestError for invalid requests, or the context's error if the request timed out or was cancelled. Otherwise, it returns nil.
+func (s *Service) handle(r *http.Request) ([]byte, response, error) {
+	accepted, err := s.accept(r, r.Header.Get("Accept"))
+	if err != nil {
+		return accepted.body, response{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.Timeout)
+	defer cancel()
+	result, hit, err := s.runCached(ctx, accepted, nil)
+	if err != nil {
+		return accepted.body, response{}, err
+	}
+	output := response{contentType: accepted.output.mediaType, body: bytes.NewBuffer(result)}
+	if s.cfg.Cache != nil {
+		output.cache = "miss"
+		if hit {
+			output.cache = "hit"
+		}
+	}
+	return accepted.body, output, nil
+}
+
+// accepted is a request that passed the checks of accept, ready to be processed.
+type accepted struct {
+	body   []byte
+	ops    []imageprocessing.Operation
+	output format
+}
+
+// accept reads the image of a request and checks it against the limits of the service, without decoding it.
+//
+// Parameters:
+// - r: The request, with the operations and format in its query parameters, and the image as its body.
+// - acceptHeader: The Accept header the output format is negotiated with, or "" for the format of the image.
+//
+// Returns:
+// - accepted: The request body, as far as it was read, along with the parsed operations and output format.
+// - error: A *requestError for invalid requests, or the error reading the body. Otherwise, it returns nil.
+func (s *Service) accept(r *http.Request, acceptHeader string) (accepted, error) {
+	ops, err := imageprocessing.ParseOperations(r.URL.Query().Get("ops"))
+	if err != nil {
+		return accepted{}, statusError(http.StatusBadRequest, "invalid ops: %v", err)
+	}
+	if r.ContentLength > s.cfg.MaxBytes {
+		return accepted{}, statusError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", s.cfg.MaxBytes)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBytes+1))
+	if err != nil {
+		return accepted{body: body}, err
+	}
+	if int64(len(body)) > s.cfg.MaxBytes {
+		return accepted{body: body}, statusError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", s.cfg.MaxBytes)
+	}
+	return s.inspect(body, ops, r.URL.Query().Get("format"), acceptHeader)
+}
+
+// inspect checks an image against the pixel limit of the service, without decoding it, and selects its output
+// format.
+//
+// Parameters:
+// - body: The encoded image, within the size limit of the service.
+// - ops: The operations the image is run through.
+// - formatName: The requested output format, or "" to negotiate it with acceptHeader.
+// - acceptHeader: The Accept header the output format is negotiated with, or "" for the format of the image.
+//
+// Returns:
+// - accepted: The image, along with its operations and output format.
+// - error: A *requestError for invalid images and formats. Otherwise, it returns nil.
+func (s *Service) inspect(body []byte, ops []imageprocessing.Operation, formatName, acceptHeader string) (accepted, error) {
+	config, inputFormat, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return accepted{body: body}, decodeError(err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > s.cfg.MaxPixels {
+		return accepted{body: body}, statusError(http.StatusRequestEntityTooLarge, "image has %d pixels, more than the %d allowed", pixels, s.cfg.MaxPixels)
+	}
+	output, err := negotiate(formatName, acceptHeader, inputFormat)
+	if err != nil {
+		return accepted{body: body}, err
+	}
+	return accepted{body: body, ops: ops, output: output}, nil
+}
+
+// stage is a step of run, reported to its progress func.
+type stage int
+
+const (
+	// stageDecoded is reported once the image is decoded.
+	stageDecoded stage = iota
+
+	// stageProcessed is reported after each operation, with the number of operations done.
+	stageProcessed
+
+	// stageEncoded is reported once the result is encoded.
+	stageEncoded
+)
+
+// runCached returns the cached result of an accepted image if there is one, and otherwise runs it and caches its
+// result.
+//
+// Parameters:
+// - ctx: Cancels the processing of the image.
+// - a: The accepted image.
+// - progress: If set, is called after each stage of run. It is not called for cached results.
+//
+// Returns:
+// - []byte: The encoded result, which must not be modified as it may be shared with the cache.
+// - bool: Whether the result was found in the cache.
+// - error: The error of run. Otherwise, it returns nil.
+func (s *Service) runCached(ctx context.Context, a accepted, progress func(stage, int)) ([]byte, bool, error) {
+	if s.cfg.Cache == nil {
+		buf, err := s.run(ctx, a, progress)
+		if err != nil {
+			return nil, false, err
+		}
+		return buf.Bytes(), false, nil
+	}
+
+	key := cache.Key(cache.Checksum(a.body), cache.Spec(map[string]string{"ops": imageprocessing.PipelineName(a.ops), "format": a.output.name}))
+	if result, _, ok := s.cfg.Cache.Get(key); ok {
+		return result, true, nil
+	}
+	buf, err := s.run(ctx, a, progress)
+	if err != nil {
+		return nil, false, err
+	}
+	s.cfg.Cache.Put(key, buf.Bytes())
+	return buf.Bytes(), false, nil
+}
+
+// run decodes an accepted image, runs it through its operations and encodes the result in its output format.
+//
+// Parameters:
+// - ctx: Cancels the processing of the image.
+// - a: The accepted image.
+// - progress: If set, is called after each stage, with the number of operations done so far.
+//
+// Returns:
+// - *bytes.Buffer: The encoded result.
+// - error: A *requestError if the image cannot be decoded, or the context's error if it is done before the result is encoded. Otherwise, it returns nil.
+func (s *Service) run(ctx context.Context, a accepted, progress func(stage, int)) (*bytes.Buffer, error) {
+	if progress == nil {
+		progress = func(stage, int) {}
+	}
+	img, _, err := image.Decode(bytes.NewReader(a.body))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	progress(stageDecoded, 0)
+	for i := range a.ops {
+		processed, err := imageprocessing.Pipeline(ctx, a.ops[i:i+1], img)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		img = processed
+		progress(stageProcessed, i+1)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := a.output.encode(&buf, img); err != nil {
+		return nil, err
+	}
+	progress(stageEncoded, len(a.ops))
+	return &buf, nil
+}
+
+// decodeError classifies an error decoding the posted image: an unknown format is unsupported, and anything else
+// is a malformed image.
+func decodeError(err error) error {
+	if errors.Is(err, image.ErrFormat) {
+		return statusError(http.StatusUnsupportedMediaType, "unsupported image format (expected %s)", strings.Join(formatNames(), ", "))
+	}
+	return statusError(http.StatusBadRequest, "invalid image: %v", err)
+}
+
+// fail answers a request with the status code of its error, and records it in the metrics.
+//
+// Notes:
+//   - Requests that time out are answered with 503 Service Unavailable. Requests whose client went away are not
+//     answered, and are recorded as StatusClientClosedRequest.
+func (s *Service) fail(w http.ResponseWriter, r *http.Request, start time.Time, bytesIn int64, err error) {
+	code := http.StatusInternalServerError
+	message := err.Error()
+	var reqErr *requestError
+	switch {
+	case errors.As(err, &reqErr):
+		code = reqErr.code
+	case r.Context().Err() != nil:
+		s.metrics.observe(StatusClientClosedRequest, bytesIn, 0, time.Since(start))
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusServiceUnavailable
+		message = fmt.Sprintf("processing timed out after %s", s.cfg.Timeout)
+	}
+	http.Error(w, message, code)
+	s.metrics.observe(code, bytesIn, 0, time.Since(start))
+}
+
+// Server is a running image processing service.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Start starts the service in the background.
+//
+// Parameters:
+// - addr: The address to listen on, such as DefaultAddr. Use port 0 to pick a free port.
+// - cfg: The limits of the service.
+//
+// Returns:
+// - *Server: The running server.
+// - error: If the address cannot be listened on, it returns the error. Otherwise, it returns nil.
+func Start(addr string, cfg Config) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		server:   &http.Server{Handler: New(cfg).Handler(), ReadHeaderTimeout: 10 * time.Second},
+		listener: listener,
+	}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Shutdown stops the server, waiting for in-progress requests until the context is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,571 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mwiater/golangpprof/cache"
+	"github.com/mwiater/golangpprof/internal/testimage"
+	"github.com/mwiater/golangpprof/jobs"
+	"github.com/mwiater/golangpprof/metrics"
+	"github.com/mwiater/golangpprof/service/servicepb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// post sends a request to the handler and returns the response.
+func post(t *testing.T, handler http.Handler, target, accept string, body []byte) *http.Response {
+	request := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder.Result()
+}
+
+// TestProcess ensures that posted images are processed and returned in the negotiated format.
+func TestProcess(t *testing.T) {
+	handler := New(Config{}).Handler()
+	jpegImage := testimage.JPEG(t)
+	pngImage := testimage.Encode(t, png.Encode)
+
+	cases := []struct {
+		name   string
+		target string
+		accept string
+		body   []byte
+		format string
+	}{
+		{name: "same format as the input", target: "/process?ops=grayscale,sharpen", body: jpegImage, format: "jpeg"},
+		{name: "png input", target: "/process?ops=sharpen-optimized", accept: "*/*", body: pngImage, format: "png"},
+		{name: "accept header", target: "/process?ops=grayscale", accept: "text/html, image/png;q=0.9, image/*;q=0.1", body: jpegImage, format: "png"},
+		{name: "format parameter", target: "/process?ops=grayscale&format=gif", accept: "image/png", body: jpegImage, format: "gif"},
+		{name: "jpg alias", target: "/process?ops=grayscale&format=jpg", body: pngImage, format: "jpeg"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response := post(t, handler, c.target, c.accept, c.body)
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, "image/"+c.format, response.Header.Get("Content-Type"))
+			assert.Contains(t, response.Header.Get("Server-Timing"), "process;dur=")
+
+			img, format, err := image.Decode(response.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, c.format, format)
+			if err == nil {
+				assert.Equal(t, image.Rect(0, 0, 40, 30), img.Bounds())
+			}
+		})
+	}
+}
+
+// TestProcessErrors ensures that invalid requests are answered with the matching status code.
+func TestProcessErrors(t *testing.T) {
+	jpegImage := testimage.JPEG(t)
+	handler := New(Config{MaxBytes: int64(len(jpegImage))}).Handler()
+
+	cases := []struct {
+		name   string
+		config *Config
+		target string
+		accept string
+		body   []byte
+		code   int
+	}{
+		{name: "unknown operation", target: "/process?ops=blur", body: jpegImage, code: http.StatusBadRequest},
+		{name: "no operations", target: "/process", body: jpegImage, code: http.StatusBadRequest},
+		{name: "unknown format", target: "/process?ops=grayscale&format=bmp", body: jpegImage, code: http.StatusBadRequest},
+		{name: "not acceptable", target: "/process?ops=grayscale", accept: "text/html, image/webp", body: jpegImage, code: http.StatusNotAcceptable},
+		{name: "too large", target: "/process?ops=grayscale", body: append(jpegImage, 0), code: http.StatusRequestEntityTooLarge},
+		{name: "too many pixels", config: &Config{MaxPixels: 40*30 - 1}, target: "/process?ops=grayscale", body: jpegImage, code: http.StatusRequestEntityTooLarge},
+		{name: "not an image", target: "/process?ops=grayscale", body: []byte("hello"), code: http.StatusUnsupportedMediaType},
+		{name: "truncated image", target: "/process?ops=grayscale", body: jpegImage[:len(jpegImage)/2], code: http.StatusBadRequest},
+		{name: "timeout", config: &Config{Timeout: time.Nanosecond}, target: "/process?ops=grayscale-optimized", body: jpegImage, code: http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := handler
+			if c.config != nil {
+				h = New(*c.config).Handler()
+			}
+			response := post(t, h, c.target, c.accept, c.body)
+			assert.Equal(t, c.code, response.StatusCode)
+			body, _ := io.ReadAll(response.Body)
+			assert.NotEmpty(t, strings.TrimSpace(string(body)))
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/process?ops=grayscale", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	assert.Equal(t, http.MethodPost, recorder.Header().Get("Allow"))
+}
+
+// TestMetrics ensures that requests are counted by status code, with the bytes they read and wrote.
+func TestMetrics(t *testing.T) {
+	registry := metrics.NewRegistry(metrics.DefaultBuckets)
+	handler := New(Config{Metrics: registry}).Handler()
+	jpegImage := testimage.JPEG(t)
+	post(t, handler, "/process?ops=grayscale", "", jpegImage)
+	post(t, handler, "/process?ops=grayscale", "", jpegImage)
+	post(t, handler, "/process?ops=blur", "", jpegImage)
+	post(t, handler, "/process?ops=grayscale", "", []byte("hello"))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	text := recorder.Body.String()
+	assert.Contains(t, text, "# TYPE golangpprof_http_requests_total counter\n")
+	assert.Contains(t, text, `golangpprof_http_requests_total{code="200"} 2`)
+	assert.Contains(t, text, `golangpprof_http_requests_total{code="400"} 1`)
+	assert.Contains(t, text, "golangpprof_http_request_bytes_total ")
+	assert.NotContains(t, text, "golangpprof_http_response_bytes_total 0\n")
+
+	// Requests with valid operations are also recorded in the registry, by pipeline
+	assert.Contains(t, text, `golangpprof_images_processed_total{operation="grayscale",variant="default"} 2`)
+	assert.Contains(t, text, `golangpprof_errors_total{operation="grayscale",variant="default",type="unsupported media type"} 1`)
+	assert.Contains(t, text, `golangpprof_operation_duration_seconds_count{operation="grayscale",variant="default"} 3`)
+	assert.NotContains(t, text, `operation="blur"`)
+}
+
+// TestProcessCache ensures that the same operations on the same image are answered from the cache, and that the
+// cache stats are served with the metrics.
+func TestProcessCache(t *testing.T) {
+	c, err := cache.New(cache.Config{})
+	assert.NoError(t, err)
+	handler := New(Config{Cache: c, Metrics: metrics.NewRegistry(metrics.DefaultBuckets)}).Handler()
+	jpegImage := testimage.JPEG(t)
+
+	first := post(t, handler, "/process?ops=grayscale,sharpen", "", jpegImage)
+	assert.Equal(t, "miss", first.Header.Get("X-Cache"))
+	second := post(t, handler, "/process?ops=grayscale,sharpen", "", jpegImage)
+	assert.Equal(t, http.StatusOK, second.StatusCode)
+	assert.Equal(t, "hit", second.Header.Get("X-Cache"))
+	firstBody, _ := io.ReadAll(first.Body)
+	secondBody, _ := io.ReadAll(second.Body)
+	assert.NotEmpty(t, firstBody)
+	assert.Equal(t, firstBody, secondBody)
+
+	// Another format or pipeline is another result
+	assert.Equal(t, "miss", post(t, handler, "/process?ops=grayscale,sharpen&format=png", "", jpegImage).Header.Get("X-Cache"))
+	assert.Equal(t, "miss", post(t, handler, "/process?ops=sharpen,grayscale", "", jpegImage).Header.Get("X-Cache"))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(), `golangpprof_cache_hits_total{tier="memory"} 1`)
+	assert.Contains(t, recorder.Body.String(), "golangpprof_cache_misses_total 3\n")
+
+	// Without a cache, responses have no X-Cache header
+	assert.Empty(t, post(t, New(Config{}).Handler(), "/process?ops=grayscale", "", jpegImage).Header.Get("X-Cache"))
+}
+
+// TestWebhookClient ensures that webhooks are not posted to internal addresses, even through a host name, unless
+// their host is allowed.
+func TestWebhookClient(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(receiver.URL, "http://"))
+
+	_, err := WebhookClient(Config{}).Post(receiver.URL, "application/json", nil)
+	assert.ErrorContains(t, err, "webhook address 127.0.0.1 is not allowed")
+	_, err = WebhookClient(Config{WebhookHosts: []string{"example.com"}}).Post("http://localhost:"+port, "application/json", nil)
+	assert.ErrorContains(t, err, "is not allowed")
+
+	response, err := WebhookClient(Config{WebhookHosts: []string{"127.0.0.1"}}).Post(receiver.URL, "application/json", nil)
+	if assert.NoError(t, err) {
+		response.Body.Close()
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+	}
+
+	s := New(Config{WebhookHosts: []string{"Internal.Example"}})
+	assert.NoError(t, s.checkWebhook("https://internal.example/done"))
+	assert.NoError(t, s.checkWebhook("https://example.com/done"))
+	assert.Error(t, s.checkWebhook("http://10.0.0.1/done"))
+	assert.Error(t, s.checkWebhook("http://100.100.100.200/done"))
+	assert.Error(t, s.checkWebhook("http://[::ffff:127.0.0.1]/done"))
+}
+
+// TestJobs ensures that images submitted as jobs are processed in the background, and that their status and result
+// can be retrieved, with a webhook notified once they are done.
+func TestJobs(t *testing.T) {
+	hooks := make(chan jobs.Job, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job jobs.Job
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&job))
+		hooks <- job
+	}))
+	defer receiver.Close()
+
+	registry := metrics.NewRegistry(metrics.DefaultBuckets)
+	cfg := Config{Metrics: registry, WebhookHosts: []string{"127.0.0.1"}}
+	queue, err := jobs.Open(jobs.Config{Dir: t.TempDir(), Process: JobProcessor(cfg), Concurrency: 1, Client: WebhookClient(cfg)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer queue.Close(context.Background())
+	cfg.Jobs = queue
+	handler := New(cfg).Handler()
+	jpegImage := testimage.JPEG(t)
+
+	response := post(t, handler, "/jobs?ops=grayscale,sharpen&format=png&priority=2&webhook="+url.QueryEscape(receiver.URL), "image/jpeg", jpegImage)
+	assert.Equal(t, http.StatusAccepted, response.StatusCode)
+	var job jobs.Job
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&job))
+	assert.Equal(t, "/jobs/"+job.ID, response.Header.Get("Location"))
+	assert.Equal(t, "grayscale,sharpen", job.Operations)
+	assert.Equal(t, "png", job.Format)
+	assert.Equal(t, 2, job.Priority)
+
+	select {
+	case hooked := <-hooks:
+		assert.Equal(t, job.ID, hooked.ID)
+		assert.Equal(t, jobs.StatusDone, hooked.Status)
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"status": "done"`)
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/result", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	img, format, err := image.Decode(recorder.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+	if err == nil {
+		assert.Equal(t, image.Rect(0, 0, 40, 30), img.Bounds())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var listed []jobs.Job
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&listed))
+	assert.Len(t, listed, 1)
+
+	var text bytes.Buffer
+	assert.NoError(t, registry.WriteText(&text))
+	assert.Contains(t, text.String(), `golangpprof_images_processed_total{operation="grayscale,sharpen",variant="default"} 1`)
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		body   []byte
+		code   int
+	}{
+		{name: "unknown operation", method: http.MethodPost, target: "/jobs?ops=blur", body: jpegImage, code: http.StatusBadRequest},
+		{name: "not an image", method: http.MethodPost, target: "/jobs?ops=grayscale", body: []byte("hello"), code: http.StatusUnsupportedMediaType},
+		{name: "invalid priority", method: http.MethodPost, target: "/jobs?ops=grayscale&priority=high", body: jpegImage, code: http.StatusBadRequest},
+		{name: "invalid webhook", method: http.MethodPost, target: "/jobs?ops=grayscale&webhook=file:///etc/passwd", body: jpegImage, code: http.StatusBadRequest},
+		{name: "metadata webhook", method: http.MethodPost, target: "/jobs?ops=grayscale&webhook=http://169.254.169.254/latest", body: jpegImage, code: http.StatusBadRequest},
+		{name: "localhost webhook", method: http.MethodPost, target: "/jobs?ops=grayscale&webhook=http://localhost:9000/done", body: jpegImage, code: http.StatusBadRequest},
+		{name: "private webhook", method: http.MethodPost, target: "/jobs?ops=grayscale&webhook=http://[fd00::1]/done", body: jpegImage, code: http.StatusBadRequest},
+		{name: "unknown job", method: http.MethodGet, target: "/jobs/nope", code: http.StatusNotFound},
+		{name: "unknown job result", method: http.MethodGet, target: "/jobs/nope/result", code: http.StatusNotFound},
+		{name: "unknown resource", method: http.MethodGet, target: "/jobs/" + job.ID + "/input", code: http.StatusNotFound},
+		{name: "cancel finished job", method: http.MethodDelete, target: "/jobs/" + job.ID, code: http.StatusConflict},
+		{name: "method not allowed", method: http.MethodPut, target: "/jobs/" + job.ID, code: http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(c.method, c.target, bytes.NewReader(c.body)))
+			assert.Equal(t, c.code, recorder.Code)
+		})
+	}
+
+	// Without a queue, the job routes are not served
+	recorder = httptest.NewRecorder()
+	New(Config{}).Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+// TestNegotiate ensures that the most specific media range decides a format's quality, and that ties go to the
+// input format.
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		accept string
+		input  string
+		want   string
+	}{
+		{accept: "", input: "png", want: "png"},
+		{accept: "", input: "webp", want: "jpeg"},
+		{accept: "image/*", input: "gif", want: "gif"},
+		{accept: "image/*, image/gif;q=0", input: "gif", want: "jpeg"},
+		{accept: "image/png;q=0.5, image/jpeg;q=0.4", input: "jpeg", want: "png"},
+		{accept: "image/png;q=oops, image/jpeg;q=0.4", input: "jpeg", want: "png"},
+		{accept: "image/jpeg;q=0.5, */*;q=0.9", input: "jpeg", want: "png"},
+	}
+	for _, c := range cases {
+		f, err := negotiate("", c.accept, c.input)
+		assert.NoError(t, err, c.accept)
+		assert.Equal(t, c.want, f.name, c.accept)
+	}
+
+	_, err := negotiate("", "image/*;q=0", "jpeg")
+	assert.Error(t, err)
+}
+
+// TestStart ensures that the server answers requests on the address it listens on, and shuts down.
+func TestStart(t *testing.T) {
+	server, err := Start("localhost:0", Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	response, err := http.Post("http://"+server.Addr()+"/process?ops=grayscale", "image/jpeg", bytes.NewReader(testimage.JPEG(t)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		response.Body.Close()
+	}
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
+
+// dialGRPC serves the service's gRPC API over an in-memory connection, and returns a client connected to it.
+func dialGRPC(t *testing.T, cfg Config) servicepb.ImageProcessorClient {
+	listener := bufconn.Listen(1 << 20)
+	server := New(cfg).GRPC()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return servicepb.NewImageProcessorClient(conn)
+}
+
+// encodeNoiseImage returns a PNG of random pixels, which compresses badly so that it spans several chunks.
+func encodeNoiseImage(t *testing.T) []byte {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	random.Read(img.Pix)
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+// uploadRequests splits an image into the messages of a chunked upload.
+func uploadRequests(pipeline *servicepb.Pipeline, body []byte, chunkSize int) []*servicepb.UploadRequest {
+	requests := []*servicepb.UploadRequest{{Data: &servicepb.UploadRequest_Pipeline{Pipeline: pipeline}}}
+	for len(body) > 0 {
+		n := len(body)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		requests = append(requests, &servicepb.UploadRequest{Data: &servicepb.UploadRequest_Chunk{Chunk: body[:n]}})
+		body = body[n:]
+	}
+	return requests
+}
+
+// processStream uploads an image to ProcessStream, and returns the progress, the result and the chunks it streams.
+func processStream(t *testing.T, client servicepb.ImageProcessorClient, requests []*servicepb.UploadRequest) ([]*servicepb.Progress, *servicepb.Result, [][]byte, error) {
+	stream, err := client.ProcessStream(context.Background())
+	if !assert.NoError(t, err) {
+		return nil, nil, nil, err
+	}
+	for _, request := range requests {
+		if err := stream.Send(request); err != nil {
+			break
+		}
+	}
+	assert.NoError(t, stream.CloseSend())
+
+	var progress []*servicepb.Progress
+	var result *servicepb.Result
+	var chunks [][]byte
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return progress, result, chunks, nil
+		}
+		if err != nil {
+			return progress, result, chunks, err
+		}
+		switch {
+		case event.GetProgress() != nil:
+			progress = append(progress, event.GetProgress())
+		case event.GetResult() != nil:
+			result = event.GetResult()
+		default:
+			chunks = append(chunks, event.GetChunk())
+		}
+	}
+}
+
+// TestGRPC ensures that images sent over gRPC, in a single message or in chunks, are processed as they are by
+// POST /process, and that ProcessStream reports the progress of each stage before streaming the result in chunks.
+func TestGRPC(t *testing.T) {
+	registry := metrics.NewRegistry(metrics.DefaultBuckets)
+	client := dialGRPC(t, Config{Metrics: registry})
+	jpegImage := testimage.JPEG(t)
+
+	response, err := client.Process(context.Background(), &servicepb.ProcessRequest{
+		Pipeline: &servicepb.Pipeline{Operations: []string{"grayscale", "sharpen"}},
+		Image:    jpegImage,
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "image/jpeg", response.GetResult().GetContentType())
+		assert.Equal(t, int64(len(response.GetImage())), response.GetResult().GetSize())
+		assert.False(t, response.GetResult().GetCached())
+		img, format, err := image.Decode(bytes.NewReader(response.GetImage()))
+		assert.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, image.Rect(0, 0, 40, 30), img.Bounds())
+	}
+
+	upload, err := client.Upload(context.Background())
+	if assert.NoError(t, err) {
+		for _, request := range uploadRequests(&servicepb.Pipeline{Operations: []string{"grayscale"}, Format: "png"}, jpegImage, 100) {
+			assert.NoError(t, upload.Send(request))
+		}
+		response, err := upload.CloseAndRecv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "image/png", response.GetResult().GetContentType())
+			_, format, err := image.Decode(bytes.NewReader(response.GetImage()))
+			assert.NoError(t, err)
+			assert.Equal(t, "png", format)
+		}
+	}
+
+	noise := encodeNoiseImage(t)
+	pipeline := &servicepb.Pipeline{Operations: []string{"grayscale", "sharpen-optimized"}, Format: "png"}
+	progress, result, chunks, err := processStream(t, client, uploadRequests(pipeline, noise, 16<<10))
+	if assert.NoError(t, err) {
+		var stages []servicepb.Stage
+		for _, p := range progress {
+			stages = append(stages, p.GetStage())
+			assert.Equal(t, int64(len(noise)), p.GetBytesReceived())
+			assert.Equal(t, int32(2), p.GetOperationsTotal())
+		}
+		assert.Equal(t, []servicepb.Stage{
+			servicepb.Stage_STAGE_RECEIVED,
+			servicepb.Stage_STAGE_DECODED,
+			servicepb.Stage_STAGE_PROCESSED,
+			servicepb.Stage_STAGE_PROCESSED,
+			servicepb.Stage_STAGE_ENCODED,
+		}, stages)
+		assert.Equal(t, int32(1), progress[2].GetOperationsDone())
+		assert.Equal(t, int32(2), progress[4].GetOperationsDone())
+
+		assert.Equal(t, "image/png", result.GetContentType())
+		assert.True(t, len(chunks) > 1)
+		joined := bytes.Join(chunks, nil)
+		assert.Equal(t, result.GetSize(), int64(len(joined)))
+		for _, chunk := range chunks {
+			assert.True(t, len(chunk) <= ChunkSize)
+		}
+		img, _, err := image.Decode(bytes.NewReader(joined))
+		assert.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, 400, 400), img.Bounds())
+	}
+
+	var buf bytes.Buffer
+	registry.WriteText(&buf)
+	assert.Contains(t, buf.String(), `golangpprof_images_processed_total{operation="grayscale,sharpen",variant="default"} 1`)
+	assert.Contains(t, buf.String(), `golangpprof_images_processed_total{operation="grayscale,sharpen-optimized",variant="default"} 1`)
+}
+
+// TestGRPCCache ensures that gRPC calls share the cache of the service, and report their cached results.
+func TestGRPCCache(t *testing.T) {
+	c, err := cache.New(cache.Config{})
+	assert.NoError(t, err)
+	client := dialGRPC(t, Config{Cache: c, Metrics: metrics.NewRegistry(metrics.DefaultBuckets)})
+	request := &servicepb.ProcessRequest{Pipeline: &servicepb.Pipeline{Operations: []string{"sharpen"}}, Image: testimage.JPEG(t)}
+
+	first, err := client.Process(context.Background(), request)
+	assert.NoError(t, err)
+	assert.False(t, first.GetResult().GetCached())
+	second, err := client.Process(context.Background(), request)
+	assert.NoError(t, err)
+	assert.True(t, second.GetResult().GetCached())
+	assert.Equal(t, first.GetImage(), second.GetImage())
+
+	// A cached result is streamed right after the upload is received
+	progress, result, chunks, err := processStream(t, client, uploadRequests(request.Pipeline, request.Image, 1<<10))
+	assert.NoError(t, err)
+	if assert.Len(t, progress, 1) {
+		assert.Equal(t, servicepb.Stage_STAGE_RECEIVED, progress[0].GetStage())
+	}
+	assert.True(t, result.GetCached())
+	assert.Equal(t, first.GetImage(), bytes.Join(chunks, nil))
+}
+
+// TestGRPCErrors ensures that invalid calls fail with the gRPC code matching the status code of POST /process.
+func TestGRPCErrors(t *testing.T) {
+	jpegImage := testimage.JPEG(t)
+	grayscale := &servicepb.Pipeline{Operations: []string{"grayscale"}}
+
+	cases := []struct {
+		name     string
+		config   Config
+		requests []*servicepb.UploadRequest
+		code     codes.Code
+	}{
+		{name: "unknown operation", requests: uploadRequests(&servicepb.Pipeline{Operations: []string{"blur"}}, jpegImage, 1<<10), code: codes.InvalidArgument},
+		{name: "no operations", requests: uploadRequests(&servicepb.Pipeline{}, jpegImage, 1<<10), code: codes.InvalidArgument},
+		{name: "unknown format", requests: uploadRequests(&servicepb.Pipeline{Operations: []string{"grayscale"}, Format: "bmp"}, jpegImage, 1<<10), code: codes.InvalidArgument},
+		{name: "no pipeline", requests: uploadRequests(grayscale, jpegImage, 1<<10)[1:], code: codes.InvalidArgument},
+		{name: "second pipeline", requests: append(uploadRequests(grayscale, jpegImage, 1<<10), uploadRequests(grayscale, nil, 1)...), code: codes.InvalidArgument},
+		{name: "empty upload", code: codes.InvalidArgument},
+		{name: "too large", config: Config{MaxBytes: int64(len(jpegImage)) - 1}, requests: uploadRequests(grayscale, jpegImage, 100), code: codes.ResourceExhausted},
+		{name: "too many pixels", config: Config{MaxPixels: 40*30 - 1}, requests: uploadRequests(grayscale, jpegImage, 1<<10), code: codes.ResourceExhausted},
+		{name: "not an image", requests: uploadRequests(grayscale, []byte("hello"), 1<<10), code: codes.InvalidArgument},
+		{name: "timeout", config: Config{Timeout: time.Nanosecond}, requests: uploadRequests(&servicepb.Pipeline{Operations: []string{"grayscale-optimized"}}, jpegImage, 1<<10), code: codes.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := dialGRPC(t, c.config)
+			_, _, _, err := processStream(t, client, c.requests)
+			assert.Equal(t, c.code, status.Code(err), err)
+			assert.NotEmpty(t, status.Convert(err).Message())
+		})
+	}
+
+	// Process takes the image in a single message, which the server refuses beyond MaxBytes
+	client := dialGRPC(t, Config{MaxBytes: 1 << 10})
+	_, err := client.Process(context.Background(), &servicepb.ProcessRequest{Pipeline: grayscale, Image: make([]byte, 1<<20)})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+// TestStartGRPC ensures that the gRPC server answers calls on the address it listens on, and shuts down.
+func TestStartGRPC(t *testing.T) {
+	server, err := StartGRPC("localhost:0", Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := grpc.NewClient(server.Addr(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if assert.NoError(t, err) {
+		_, err := servicepb.NewImageProcessorClient(conn).Process(context.Background(), &servicepb.ProcessRequest{
+			Pipeline: &servicepb.Pipeline{Operations: []string{"grayscale"}},
+			Image:    testimage.JPEG(t),
+		})
+		assert.NoError(t, err)
+		conn.Close()
+	}
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
@@ -0,0 +1,216 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: service/servicepb/service.proto
+
+// Package golangpprof.service is the gRPC API of the image processing service. It runs the same pipelines, with the
+// same limits, cache and metrics, as POST /process.
+
+package servicepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ImageProcessor_Process_FullMethodName       = "/golangpprof.service.ImageProcessor/Process"
+	ImageProcessor_Upload_FullMethodName        = "/golangpprof.service.ImageProcessor/Upload"
+	ImageProcessor_ProcessStream_FullMethodName = "/golangpprof.service.ImageProcessor/ProcessStream"
+)
+
+// ImageProcessorClient is the client API for ImageProcessor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ImageProcessor runs images through a pipeline of operations, entirely in memory.
+type ImageProcessorClient interface {
+	// Process runs an image sent in a single message through a pipeline, and returns the result in a single message.
+	// The image is bounded by the largest message the server accepts, so large images are better uploaded in chunks
+	// with Upload or ProcessStream.
+	//
+	// As the result is returned in a single message, results larger than the client's receive limit, 4 MiB by
+	// default, fail with RESOURCE_EXHAUSTED. Clients expecting large results must raise it, e.g. with
+	// grpc.MaxCallRecvMsgSize in Go, or use ProcessStream, which streams the result in chunks.
+	Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Upload runs an image uploaded in chunks through a pipeline. The first message is the pipeline, and every one
+	// after it a chunk of the image. The result is returned once the client closes the stream, in a single message,
+	// so the client's receive limit applies to it as for Process.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, ProcessResponse], error)
+	// ProcessStream runs an image uploaded in chunks, as for Upload, through a pipeline, and streams the progress of
+	// each stage while it is processed. The result is then streamed as a Result, followed by the image in chunks.
+	ProcessStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UploadRequest, ProcessEvent], error)
+}
+
+type imageProcessorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewImageProcessorClient(cc grpc.ClientConnInterface) ImageProcessorClient {
+	return &imageProcessorClient{cc}
+}
+
+func (c *imageProcessorClient) Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, ImageProcessor_Process_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *imageProcessorClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, ProcessResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ImageProcessor_ServiceDesc.Streams[0], ImageProcessor_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, ProcessResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ImageProcessor_UploadClient = grpc.ClientStreamingClient[UploadRequest, ProcessResponse]
+
+func (c *imageProcessorClient) ProcessStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[UploadRequest, ProcessEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &ImageProcessor_ServiceDesc.Streams[1], ImageProcessor_ProcessStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, ProcessEvent]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ImageProcessor_ProcessStreamClient = grpc.BidiStreamingClient[UploadRequest, ProcessEvent]
+
+// ImageProcessorServer is the server API for ImageProcessor service.
+// All implementations must embed UnimplementedImageProcessorServer
+// for forward compatibility.
+//
+// ImageProcessor runs images through a pipeline of operations, entirely in memory.
+type ImageProcessorServer interface {
+	// Process runs an image sent in a single message through a pipeline, and returns the result in a single message.
+	// The image is bounded by the largest message the server accepts, so large images are better uploaded in chunks
+	// with Upload or ProcessStream.
+	//
+	// As the result is returned in a single message, results larger than the client's receive limit, 4 MiB by
+	// default, fail with RESOURCE_EXHAUSTED. Clients expecting large results must raise it, e.g. with
+	// grpc.MaxCallRecvMsgSize in Go, or use ProcessStream, which streams the result in chunks.
+	Process(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Upload runs an image uploaded in chunks through a pipeline. The first message is the pipeline, and every one
+	// after it a chunk of the image. The result is returned once the client closes the stream, in a single message,
+	// so the client's receive limit applies to it as for Process.
+	Upload(grpc.ClientStreamingServer[UploadRequest, ProcessResponse]) error
+	// ProcessStream runs an image uploaded in chunks, as for Upload, through a pipeline, and streams the progress of
+	// each stage while it is processed. The result is then streamed as a Result, followed by the image in chunks.
+	ProcessStream(grpc.BidiStreamingServer[UploadRequest, ProcessEvent]) error
+	mustEmbedUnimplementedImageProcessorServer()
+}
+
+// UnimplementedImageProcessorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedImageProcessorServer struct{}
+
+func (UnimplementedImageProcessorServer) Process(context.Context, *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Process not implemented")
+}
+func (UnimplementedImageProcessorServer) Upload(grpc.ClientStreamingServer[UploadRequest, ProcessResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedImageProcessorServer) ProcessStream(grpc.BidiStreamingServer[UploadRequest, ProcessEvent]) error {
+	return status.Errorf(codes.Unimplemented, "method ProcessStream not implemented")
+}
+func (UnimplementedImageProcessorServer) mustEmbedUnimplementedImageProcessorServer() {}
+func (UnimplementedImageProcessorServer) testEmbeddedByValue()                        {}
+
+// UnsafeImageProcessorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ImageProcessorServer will
+// result in compilation errors.
+type UnsafeImageProcessorServer interface {
+	mustEmbedUnimplementedImageProcessorServer()
+}
+
+func RegisterImageProcessorServer(s grpc.ServiceRegistrar, srv ImageProcessorServer) {
+	// If the following call pancis, it indicates UnimplementedImageProcessorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ImageProcessor_ServiceDesc, srv)
+}
+
+func _ImageProcessor_Process_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ImageProcessorServer).Process(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ImageProcessor_Process_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ImageProcessorServer).Process(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ImageProcessor_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ImageProcessorServer).Upload(&grpc.GenericServerStream[UploadRequest, ProcessResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ImageProcessor_UploadServer = grpc.ClientStreamingServer[UploadRequest, ProcessResponse]
+
+func _ImageProcessor_ProcessStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ImageProcessorServer).ProcessStream(&grpc.GenericServerStream[UploadRequest, ProcessEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type ImageProcessor_ProcessStreamServer = grpc.BidiStreamingServer[UploadRequest, ProcessEvent]
+
+// ImageProcessor_ServiceDesc is the grpc.ServiceDesc for ImageProcessor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ImageProcessor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "golangpprof.service.ImageProcessor",
+	HandlerType: (*ImageProcessorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Process",
+			Handler:    _ImageProcessor_Process_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _ImageProcessor_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ProcessStream",
+			Handler:       _ImageProcessor_ProcessStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "service/servicepb/service.proto",
+}
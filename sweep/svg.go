@@ -0,0 +1,151 @@
+package sweep
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	chartWidth   = 720
+	chartHeight  = 420
+	chartMargin  = 60
+	legendWidth  = 240
+	legendHeight = 18
+)
+
+// chartColors is the palette cycled through for each series in the chart.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// series is a single line in the scaling chart: one operation at one GOMAXPROCS value.
+type series struct {
+	label  string
+	points []Point
+}
+
+// SaveSVG renders the scaling curve of the sweep results to an SVG file.
+//
+// Parameters:
+// - path: Path where the SVG chart will be saved.
+// - points: The points returned by Run.
+//
+// Returns:
+// - error: If any error occurs while writing, it returns the error. Otherwise, it returns nil.
+func SaveSVG(path string, points []Point) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return WriteSVG(f, points)
+}
+
+// WriteSVG renders the scaling curve of the sweep results as an SVG chart of speedup against worker count.
+//
+// Parameters:
+// - w: The writer to render the SVG to.
+// - points: The points returned by Run.
+//
+// Returns:
+// - error: If any error occurs while writing, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+// - Each operation and GOMAXPROCS value is drawn as its own line, alongside a dashed line for ideal linear scaling.
+func WriteSVG(w io.Writer, points []Point) error {
+	var lines []series
+	index := map[string]int{}
+	maxWorkers, maxSpeedup := 1, 1.0
+	for _, pt := range points {
+		label := fmt.Sprintf("%s (GOMAXPROCS=%d)", pt.Operation, pt.MaxProcs)
+		i, ok := index[label]
+		if !ok {
+			i = len(lines)
+			index[label] = i
+			lines = append(lines, series{label: label})
+		}
+		lines[i].points = append(lines[i].points, pt)
+		if pt.Workers > maxWorkers {
+			maxWorkers = pt.Workers
+		}
+		if pt.Speedup > maxSpeedup {
+			maxSpeedup = pt.Speedup
+		}
+	}
+	if float64(maxWorkers) < maxSpeedup {
+		maxSpeedup = float64(maxWorkers)
+	}
+	maxSpeedup = float64(int(maxSpeedup) + 1)
+
+	plotWidth := float64(chartWidth - 2*chartMargin)
+	plotHeight := float64(chartHeight - 2*chartMargin)
+	x := func(workers float64) float64 {
+		if maxWorkers == 1 {
+			return chartMargin
+		}
+		return chartMargin + (workers-1)/float64(maxWorkers-1)*plotWidth
+	}
+	y := func(speedup float64) float64 {
+		return chartHeight - chartMargin - speedup/maxSpeedup*plotHeight
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n", chartWidth+legendWidth, chartHeight)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	fmt.Fprintf(&b, `<text x="%d" y="24" font-size="16">Speedup by worker count</text>`+"\n", chartMargin)
+
+	// Axes and grid
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black"/>`+"\n", chartMargin, chartHeight-chartMargin, chartWidth-chartMargin, chartHeight-chartMargin)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="black"/>`+"\n", chartMargin, chartMargin, chartMargin, chartHeight-chartMargin)
+	for s := 0.0; s <= maxSpeedup; s++ {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`+"\n", chartMargin, y(s), chartWidth-chartMargin, y(s))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%.0fx</text>`+"\n", chartMargin-6, y(s)+4, s)
+	}
+	for _, workers := range workerTicks(points) {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%d</text>`+"\n", x(float64(workers)), chartHeight-chartMargin+18, workers)
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">Workers</text>`+"\n", chartWidth/2, chartHeight-chartMargin+40)
+	fmt.Fprintf(&b, `<text x="16" y="%d" text-anchor="middle" transform="rotate(-90 16 %d)">Speedup</text>`+"\n", chartHeight/2, chartHeight/2)
+
+	// Ideal linear scaling, up to the last worker count or the top of the plot, whichever comes first
+	ideal := float64(maxWorkers)
+	if maxSpeedup < ideal {
+		ideal = maxSpeedup
+	}
+	fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#999" stroke-dasharray="4 4"/>`+"\n", x(1), y(1), x(ideal), y(ideal))
+
+	for i, line := range lines {
+		color := chartColors[i%len(chartColors)]
+		var coords []string
+		for _, pt := range line.points {
+			coords = append(coords, fmt.Sprintf("%.1f,%.1f", x(float64(pt.Workers)), y(pt.Speedup)))
+		}
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`+"\n", color, strings.Join(coords, " "))
+		for _, pt := range line.points {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%d workers: %.1fms, %.2fx</title></circle>`+"\n",
+				x(float64(pt.Workers)), y(pt.Speedup), color, pt.Workers, pt.Duration, pt.Speedup)
+		}
+		legendY := chartMargin + i*legendHeight
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`+"\n", chartWidth, legendY, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`+"\n", chartWidth+18, legendY+10, html.EscapeString(line.label))
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// workerTicks returns the distinct worker counts of the points, in the order they were first seen.
+func workerTicks(points []Point) []int {
+	var ticks []int
+	seen := map[int]bool{}
+	for _, pt := range points {
+		if !seen[pt.Workers] {
+			seen[pt.Workers] = true
+			ticks = append(ticks, pt.Workers)
+		}
+	}
+	return ticks
+}
@@ -0,0 +1,257 @@
+package sweep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mwiater/golangpprof/common"
+	"github.com/mwiater/golangpprof/imageprocessing"
+)
+
+// Operation is an image processing function to be swept across worker counts and GOMAXPROCS values.
+type Operation struct {
+	Name       string
+	Fn         common.WrappedImageProcessingFunction
+	OutputPath string
+}
+
+// Config describes the matrix of worker counts and GOMAXPROCS values to run.
+type Config struct {
+	Workers  []int
+	MaxProcs []int
+	Repeats  int
+}
+
+// Point is the measurement of one operation at one worker count and GOMAXPROCS value.
+type Point struct {
+	Operation      string
+	Workers        int
+	MaxProcs       int
+	Duration       float64
+	Speedup        float64
+	SerialFraction float64
+}
+
+// Run executes every operation across the configured matrix and records the time and speedup per point.
+//
+// Parameters:
+// - ops: The operations to sweep.
+// - inputPath: Path to the source image passed to every operation.
+// - cfg: The worker counts, GOMAXPROCS values and repeat count to use.
+//
+// Returns:
+// - []Point: One point per operation, GOMAXPROCS value and worker count.
+// - error: If any operation fails, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+// - Speedup is relative to a run with 1 worker and GOMAXPROCS=1, which is always measured first.
+// - The median of Repeats runs is recorded for each point, to dampen noise from the rest of the system.
+// - imageprocessing.NumRoutines and GOMAXPROCS are restored once the sweep completes.
+func Run(ops []Operation, inputPath string, cfg Config) ([]Point, error) {
+	originalRoutines := imageprocessing.NumRoutines
+	originalProcs := runtime.GOMAXPROCS(0)
+	defer func() {
+		imageprocessing.NumRoutines = originalRoutines
+		runtime.GOMAXPROCS(originalProcs)
+	}()
+
+	var points []Point
+	for _, op := range ops {
+		fmt.Println("Sweeping: " + op.Name + "()")
+		serial, err := measure(op, inputPath, 1, 1, cfg.Repeats)
+		if err != nil {
+			return nil, err
+		}
+		for _, procs := range cfg.MaxProcs {
+			for _, workers := range cfg.Workers {
+				duration := serial
+				if workers != 1 || procs != 1 {
+					duration, err = measure(op, inputPath, workers, procs, cfg.Repeats)
+					if err != nil {
+						return nil, err
+					}
+				}
+				speedup := 1.0
+				if duration > 0 {
+					speedup = serial / duration
+				}
+				points = append(points, Point{
+					Operation:      op.Name,
+					Workers:        workers,
+					MaxProcs:       procs,
+					Duration:       duration,
+					Speedup:        speedup,
+					SerialFraction: KarpFlatt(speedup, parallelism(workers, procs)),
+				})
+			}
+		}
+		fmt.Println("  ...Complete")
+	}
+	fmt.Println()
+	return points, nil
+}
+
+// measure runs an operation repeats times with the given worker count and GOMAXPROCS value.
+//
+// Returns:
+// - float64: The median execution time in milliseconds.
+// - error: If the operation fails, it returns the error. Otherwise, it returns nil.
+func measure(op Operation, inputPath string, workers, procs, repeats int) (float64, error) {
+	if repeats < 1 {
+		repeats = 1
+	}
+	imageprocessing.NumRoutines = workers
+	runtime.GOMAXPROCS(procs)
+
+	durations := make([]float64, 0, repeats)
+	for i := 0; i < repeats; i++ {
+		start := time.Now()
+		if _, err := op.Fn(context.Background(), inputPath, op.OutputPath); err != nil {
+			return 0, err
+		}
+		durations = append(durations, float64(time.Since(start).Microseconds())/1000)
+	}
+	sort.Float64s(durations)
+	return durations[len(durations)/2], nil
+}
+
+// parallelism returns the number of workers that can actually run at the same time.
+func parallelism(workers, procs int) int {
+	if workers < procs {
+		return workers
+	}
+	return procs
+}
+
+// KarpFlatt estimates the serial fraction of a program from a single measured speedup, by solving Amdahl's law for it.
+//
+// Parameters:
+// - speedup: The measured speedup over the serial run.
+// - p: The number of processors the work could run on.
+//
+// Returns:
+// - float64: The experimentally determined serial fraction, or 0 when p is 1 (undefined).
+func KarpFlatt(speedup float64, p int) float64 {
+	if p <= 1 || speedup <= 0 {
+		return 0
+	}
+	pf := float64(p)
+	return (1/speedup - 1/pf) / (1 - 1/pf)
+}
+
+// AmdahlFit estimates a single serial fraction for an operation from all of its points using least squares.
+//
+// Parameters:
+// - points: The points of a single operation.
+//
+// Returns:
+// - float64: The serial fraction f that best fits 1/S = f + (1-f)/p across the points, or 0 if no point ran in parallel.
+func AmdahlFit(points []Point) float64 {
+	var sumXY, sumXX float64
+	for _, pt := range points {
+		p := parallelism(pt.Workers, pt.MaxProcs)
+		if p <= 1 || pt.Speedup <= 0 {
+			continue
+		}
+		x := 1 - 1/float64(p)
+		y := 1/pt.Speedup - 1/float64(p)
+		sumXY += x * y
+		sumXX += x * x
+	}
+	if sumXX == 0 {
+		return 0
+	}
+	return sumXY / sumXX
+}
+
+// byOperation groups points by operation name, keeping the order in which operations were swept.
+func byOperation(points []Point) ([]string, map[string][]Point) {
+	var names []string
+	groups := map[string][]Point{}
+	for _, pt := range points {
+		if _, ok := groups[pt.Operation]; !ok {
+			names = append(names, pt.Operation)
+		}
+		groups[pt.Operation] = append(groups[pt.Operation], pt)
+	}
+	return names, groups
+}
+
+// PrintTable prints the sweep results in a tabulated format, followed by the Amdahl's law estimate for each operation.
+//
+// Parameters:
+// - points: The points returned by Run.
+func PrintTable(points []Point) {
+	WriteTable(os.Stdout, points)
+}
+
+// WriteTable writes the sweep results in a tabulated format to w.
+//
+// Parameters:
+// - w: The writer to print the table to.
+// - points: The points returned by Run.
+func WriteTable(w io.Writer, points []Point) {
+	tw := tabwriter.NewWriter(w, 10, 1, 3, ' ', tabwriter.Debug)
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", "Function", "GOMAXPROCS", "Workers", "Execution Time", "Speedup", "Serial Fraction")
+	for _, pt := range points {
+		serial := "-"
+		if parallelism(pt.Workers, pt.MaxProcs) > 1 {
+			serial = fmt.Sprintf("%.3f", pt.SerialFraction)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1fms\t%.2fx\t%s\n", pt.Operation, pt.MaxProcs, pt.Workers, pt.Duration, pt.Speedup, serial)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	names, groups := byOperation(points)
+	for _, name := range names {
+		f := AmdahlFit(groups[name])
+		limit := "unbounded"
+		if f > 0 {
+			limit = fmt.Sprintf("%.2fx", 1/f)
+		}
+		fmt.Fprintf(w, "%s: estimated serial fraction %.3f (max speedup %s)\n", name, f, limit)
+	}
+	fmt.Fprintln(w)
+}
+
+// ParseCounts parses a comma separated list of positive integers, such as "1,2,4,8".
+//
+// Parameters:
+// - s: The list to parse.
+//
+// Returns:
+// - []int: The parsed counts.
+// - error: If any entry is not a positive integer, it returns the error. Otherwise, it returns nil.
+func ParseCounts(s string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid count %q: must be a positive integer", field)
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+// DefaultCounts returns the powers of two from 1 up to and including max (and max itself if it is not a power of two).
+func DefaultCounts(max int) []int {
+	var counts []int
+	for n := 1; n < max; n *= 2 {
+		counts = append(counts, n)
+	}
+	return append(counts, max)
+}
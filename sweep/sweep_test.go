@@ -0,0 +1,82 @@
+package sweep
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/stretchr/testify/assert"
+)
+
+// seenRoutines collects the worker count mockFunction was run with on each call.
+var seenRoutines []int
+
+// mockFunction records the worker count it was run with instead of processing an image.
+func mockFunction(ctx context.Context, input, output string) (int64, error) {
+	seenRoutines = append(seenRoutines, imageprocessing.NumRoutines)
+	return 12345, nil
+}
+
+func TestKarpFlatt(t *testing.T) {
+	assert.Equal(t, 0.0, KarpFlatt(2, 1))
+	assert.InDelta(t, 0.0, KarpFlatt(4, 4), 1e-9)   // Perfectly parallel
+	assert.InDelta(t, 1.0, KarpFlatt(1, 4), 1e-9)   // Entirely serial
+	assert.InDelta(t, 0.2, KarpFlatt(2.5, 4), 1e-9) // 1/2.5 = 0.2 + 0.8/4
+}
+
+func TestAmdahlFit(t *testing.T) {
+	// Speedups generated from Amdahl's law with a serial fraction of 0.25
+	var points []Point
+	for _, p := range []int{1, 2, 4, 8} {
+		points = append(points, Point{Operation: "Function1", Workers: p, MaxProcs: p, Speedup: 1 / (0.25 + 0.75/float64(p))})
+	}
+	assert.InDelta(t, 0.25, AmdahlFit(points), 1e-9)
+}
+
+func TestParseCounts(t *testing.T) {
+	counts, err := ParseCounts("1, 2,4,,8")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 4, 8}, counts)
+
+	_, err = ParseCounts("1,zero")
+	assert.Error(t, err)
+
+	assert.Equal(t, []int{1, 2, 4, 6}, DefaultCounts(6))
+	assert.Equal(t, []int{1}, DefaultCounts(1))
+}
+
+func TestRun(t *testing.T) {
+	original := imageprocessing.NumRoutines
+	seenRoutines = nil
+
+	ops := []Operation{{Name: "mockFunction", Fn: mockFunction}}
+	points, err := Run(ops, "input.jpg", Config{Workers: []int{1, 2}, MaxProcs: []int{1, 2}, Repeats: 1})
+	assert.NoError(t, err)
+	assert.Len(t, points, 4)
+	assert.Equal(t, []int{1, 2, 1, 2}, seenRoutines) // Serial run, then (1,2) (2,1) (2,2); (1,1) reuses the serial run
+	assert.Equal(t, original, imageprocessing.NumRoutines)
+
+	var table bytes.Buffer
+	WriteTable(&table, points)
+	assert.Contains(t, table.String(), "mockFunction")
+	assert.Contains(t, table.String(), "estimated serial fraction")
+
+	var svg bytes.Buffer
+	assert.NoError(t, WriteSVG(&svg, points))
+	assert.True(t, strings.HasPrefix(svg.String(), "<svg"))
+	assert.Contains(t, svg.String(), "mockFunction (GOMAXPROCS=2)")
+}
+
+// TestWriteSVGIdeal ensures that the ideal scaling line ends at the last worker count, or at the top of the plot if
+// the measured speedups are far from ideal.
+func TestWriteSVGIdeal(t *testing.T) {
+	var svg bytes.Buffer
+	assert.NoError(t, WriteSVG(&svg, []Point{{Operation: "op", Workers: 1, MaxProcs: 4, Speedup: 1}, {Operation: "op", Workers: 4, MaxProcs: 4, Speedup: 3.8}}))
+	assert.Contains(t, svg.String(), `x2="660.0" y2="60.0" stroke="#999"`)
+
+	svg.Reset()
+	assert.NoError(t, WriteSVG(&svg, []Point{{Operation: "op", Workers: 1, MaxProcs: 8, Speedup: 1}, {Operation: "op", Workers: 8, MaxProcs: 8, Speedup: 1.5}}))
+	assert.Contains(t, svg.String(), `x2="145.7" y2="60.0" stroke="#999"`)
+}
@@ -0,0 +1,188 @@
+//go:build linux
+
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that may mean a file is new or complete: files and directories created, files
+// closed after writing, and files and directories moved into a watched directory. Files and directories deleted or
+// moved out are also selected, so that the watcher can forget them.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+// inotifyRemoved selects the events of inotifyMask for files and directories that are gone.
+const inotifyRemoved = syscall.IN_DELETE | syscall.IN_MOVED_FROM
+
+// inotify finds changes with Linux inotify. Every directory of the tree is watched, as inotify is not recursive.
+type inotify struct {
+	dir     string
+	skipDir func(dir string) bool
+	file    *os.File
+	fd      int // file's descriptor; calling file.Fd() would switch it back to blocking mode
+
+	mu      sync.Mutex
+	watches map[int]string // watch descriptor -> slash separated directory, relative to dir
+}
+
+// newNotifier sets up inotify watches on every directory of the tree.
+//
+// Returns:
+// - notifier: The notifier, which queues events until run is called.
+// - error: If inotify is unavailable or a directory cannot be watched, e.g. because the watch limit is reached, it returns the error. Otherwise, it returns nil.
+func newNotifier(dir string, skipDir func(dir string) bool) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// A non-blocking descriptor is added to the runtime poller, so that closing the file unblocks a pending read
+	n := &inotify{dir: dir, skipDir: skipDir, file: os.NewFile(uintptr(fd), "inotify"), fd: fd, watches: map[int]string{}}
+	if _, err := n.addTree("."); err != nil {
+		n.file.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// addTree watches a directory and every directory below it.
+//
+// Parameters:
+// - rel: The slash separated directory, relative to the watched directory.
+//
+// Returns:
+// - []string: The files found in the tree, which may have been created before their directory was watched.
+// - error: If a directory cannot be watched, it returns the error. Otherwise, it returns nil.
+func (n *inotify) addTree(rel string) ([]string, error) {
+	var files []string
+	root := filepath.Join(n.dir, filepath.FromSlash(rel))
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may already have been removed again
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		r, err := filepath.Rel(n.dir, p)
+		if err != nil {
+			return err
+		}
+		r = filepath.ToSlash(r)
+
+		if !d.IsDir() {
+			if d.Type().IsRegular() {
+				files = append(files, r)
+			}
+			return nil
+		}
+		if r != "." && n.skipDir(p) {
+			return filepath.SkipDir
+		}
+		// The directory is watched before it is listed, so no file created in it can be missed
+		wd, err := syscall.InotifyAddWatch(n.fd, p, inotifyMask)
+		if err != nil {
+			return fmt.Errorf("inotify: watch %s: %w", p, err)
+		}
+		n.mu.Lock()
+		n.watches[wd] = r
+		n.mu.Unlock()
+		return nil
+	})
+	return files, err
+}
+
+// run reads events until ctx is cancelled, sending the files that were created, written or moved in, and the files
+// and directories that were deleted or moved out.
+//
+// Notes:
+//   - New directories are watched as they appear, and the files already in them are sent.
+//   - If the kernel's event queue overflows, every file of the tree is sent, so that no change is lost.
+func (n *inotify) run(ctx context.Context, changes chan<- string) error {
+	go func() {
+		<-ctx.Done()
+		n.file.Close()
+	}()
+
+	send := func(rels ...string) bool {
+		for _, rel := range rels {
+			select {
+			case changes <- rel:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("inotify: %w", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				files, err := n.addTree(".")
+				if err != nil {
+					return err
+				}
+				if !send(files...) {
+					return nil
+				}
+				continue
+			}
+
+			n.mu.Lock()
+			dir, ok := n.watches[int(event.Wd)]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.watches, int(event.Wd))
+			}
+			n.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			rel := path.Join(dir, name)
+			if event.Mask&syscall.IN_ISDIR == 0 || event.Mask&inotifyRemoved != 0 {
+				if !send(rel) {
+					return nil
+				}
+				continue
+			}
+			if n.skipDir(filepath.Join(n.dir, filepath.FromSlash(rel))) {
+				continue
+			}
+			files, err := n.addTree(rel)
+			if err != nil {
+				return err
+			}
+			if !send(files...) {
+				return nil
+			}
+		}
+	}
+}
+
+// close closes the inotify descriptor, which removes every watch.
+func (n *inotify) close() error {
+	return n.file.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package watch
+
+// newNotifier returns errUnsupported, as native notifications are only implemented with Linux inotify. The
+// directory is polled instead.
+func newNotifier(dir string, skipDir func(dir string) bool) (notifier, error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,95 @@
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// poller finds changes by walking the directory tree at a fixed interval and comparing each file's size and
+// modification time with the previous walk.
+type poller struct {
+	dir      string
+	skipDir  func(dir string) bool
+	interval time.Duration
+	seen     map[string]fileState
+}
+
+// newPoller returns a notifier polling the directory tree every interval.
+func newPoller(dir string, skipDir func(dir string) bool, interval time.Duration) *poller {
+	return &poller{dir: dir, skipDir: skipDir, interval: interval, seen: map[string]fileState{}}
+}
+
+// run polls the directory until ctx is cancelled, sending the files that were created, changed or removed since the
+// previous walk.
+//
+// Notes:
+//   - A walk that fails, e.g. because a directory was removed while it was walked, is retried at the next interval
+//     rather than stopping the watcher.
+func (p *poller) run(ctx context.Context, changes chan<- string) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		for _, rel := range p.scan() {
+			select {
+			case changes <- rel:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// scan walks the directory tree and returns the files whose state differs from the previous walk, including the
+// files that are gone.
+func (p *poller) scan() []string {
+	current := map[string]fileState{}
+	var changed []string
+	filepath.WalkDir(p.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != p.dir && p.skipDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(p.dir, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		state := fileState{size: info.Size(), modTime: info.ModTime()}
+		current[rel] = state
+		if p.seen[rel] != state {
+			changed = append(changed, rel)
+		}
+		return nil
+	})
+	for rel := range p.seen {
+		if _, ok := current[rel]; !ok {
+			changed = append(changed, rel)
+		}
+	}
+	p.seen = current
+	return changed
+}
+
+// close does nothing, as polling holds no resources between walks.
+func (p *poller) close() error {
+	return nil
+}
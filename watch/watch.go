@@ -0,0 +1,380 @@
+// Package watch processes the images dropped into a directory as they appear, running each one through a batch
+// pipeline once it has been completely written.
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mwiater/golangpprof/batch"
+	"github.com/mwiater/golangpprof/imageprocessing"
+)
+
+// Defaults of the Config durations.
+const (
+	DefaultSettle       = time.Second
+	DefaultPollInterval = time.Second
+)
+
+// errUnsupported is returned by newNotifier on platforms without a native notification API.
+var errUnsupported = errors.New("file notifications are not supported on this platform")
+
+// Config describes what to watch and how to process the images that appear.
+type Config struct {
+	// Batch is the pipeline each new image is run through. Its InputDir is the watched directory, and its Include
+	// and Exclude patterns select the images to process, as they do for batch.Run.
+	Batch batch.Config
+
+	// Settle is how long an image's size and modification time must stay unchanged before it is processed, so that
+	// images that are still being written are not picked up. It defaults to DefaultSettle.
+	Settle time.Duration
+
+	// Poll forces polling even where native notifications are available, e.g. on network filesystems that do not
+	// deliver them. PollInterval is the time between two scans, and defaults to DefaultPollInterval.
+	Poll         bool
+	PollInterval time.Duration
+}
+
+// notifier sends the paths, relative to the watched directory, of the files that may have been created, changed or
+// removed, and of the directories that may have been removed.
+type notifier interface {
+	run(ctx context.Context, changes chan<- string) error
+	close() error
+}
+
+// Watcher processes the images that appear in a directory tree.
+type Watcher struct {
+	cfg      Config
+	notifier notifier
+	method   string
+	skip     string
+
+	mu      sync.Mutex
+	summary batch.Summary
+}
+
+// fileState is what is compared to tell whether a file is still being written.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pendingFile is a file waiting for its state to settle.
+type pendingFile struct {
+	state fileState
+	since time.Time
+}
+
+// New starts watching the input directory of the configuration.
+//
+// Parameters:
+// - cfg: What to watch and how to process the images that appear.
+//
+// Returns:
+// - *Watcher: The watcher, which processes nothing until Run is called. Changes made in the meantime are not lost.
+// - error: If the configuration is invalid or the directory cannot be watched, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - Native notifications (inotify) are used on Linux, and the directory is polled elsewhere, when Poll is set, or
+//     when notifications cannot be set up, e.g. because the inotify watch limit is reached.
+func New(cfg Config) (*Watcher, error) {
+	if len(cfg.Batch.Operations) == 0 {
+		return nil, errors.New("no operations to run")
+	}
+	if cfg.Settle <= 0 {
+		cfg.Settle = DefaultSettle
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if info, err := os.Stat(cfg.Batch.InputDir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", cfg.Batch.InputDir)
+	}
+	if _, err := batch.Find(cfg.Batch.InputDir, cfg.Batch.OutputDir, cfg.Batch.Include, cfg.Batch.Exclude); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{cfg: cfg}
+	if cfg.Batch.OutputDir != "" {
+		if abs, err := filepath.Abs(cfg.Batch.OutputDir); err == nil {
+			w.skip = abs
+		}
+	}
+	if !cfg.Poll {
+		n, err := newNotifier(cfg.Batch.InputDir, w.skipDir)
+		if err == nil {
+			w.notifier, w.method = n, "inotify"
+			return w, nil
+		}
+		if !errors.Is(err, errUnsupported) {
+			w.method = "polling (" + err.Error() + ")"
+		}
+	}
+	w.notifier = newPoller(cfg.Batch.InputDir, w.skipDir, cfg.PollInterval)
+	if w.method == "" {
+		w.method = "polling"
+	}
+	w.method += " every " + cfg.PollInterval.String()
+	return w, nil
+}
+
+// Method describes how the directory is watched, e.g. "inotify" or "polling every 1s".
+func (w *Watcher) Method() string {
+	return w.method
+}
+
+// Summary returns the totals of the images processed so far. Its Items only holds the images that failed.
+func (w *Watcher) Summary() batch.Summary {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	summary := w.summary
+	summary.Items = append([]batch.Item(nil), w.summary.Items...)
+	return summary
+}
+
+// Run processes the images already in the directory and then every image that appears or changes, until ctx is
+// cancelled.
+//
+// Parameters:
+// - ctx: Stops watching. The images being processed are cancelled, and Run returns once they have completed.
+//
+// Returns:
+// - batch.Summary: The totals of the images processed, with Elapsed the time spent watching. Its Items only holds the images that failed.
+// - error: If the directory can no longer be watched, it returns the error. Otherwise, it returns nil.
+//
+// Notes:
+//   - An image is processed once its size and modification time have been unchanged for Settle, and again whenever
+//     it changes after that. With a manifest in the batch configuration, images that are already done are skipped,
+//     so restarting the watcher does not reprocess the whole directory.
+//   - The images are processed by a pool of Batch.Concurrency goroutines, and OnItem is called with each outcome.
+func (w *Watcher) Run(ctx context.Context) (batch.Summary, error) {
+	defer w.notifier.close()
+	cfg := w.cfg.Batch
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Workers > 0 {
+		defer func(routines int) { imageprocessing.NumRoutines = routines }(imageprocessing.NumRoutines)
+		imageprocessing.NumRoutines = cfg.Workers
+	}
+	w.mu.Lock()
+	w.summary = batch.Summary{Concurrency: cfg.Concurrency, Workers: imageprocessing.NumRoutines}
+	w.mu.Unlock()
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changes := make(chan string, 64)
+	errs := make(chan error, 1)
+	go func() { errs <- w.notifier.run(ctx, changes) }()
+
+	// The notifier only reports changes, so the images already in the directory are queued up front
+	existing, err := batch.Find(cfg.InputDir, cfg.OutputDir, cfg.Include, cfg.Exclude)
+	if err != nil {
+		return w.Summary(), err
+	}
+
+	ready := make(chan string)
+	done := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range ready {
+				item := batch.Process(ctx, cfg, rel)
+				// Images interrupted by Run returning are not failures; they are processed again on the next run
+				if ctx.Err() == nil || !errors.Is(item.Err, context.Canceled) {
+					w.add(item)
+				}
+				select {
+				case done <- rel:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	pending := map[string]*pendingFile{}
+	processed := map[string]fileState{}
+	inFlight := map[string]fileState{}
+	var queue []string
+	for _, rel := range existing {
+		w.track(pending, rel)
+	}
+
+	ticker := time.NewTicker(w.tick())
+	defer ticker.Stop()
+	for {
+		var next chan string
+		var head string
+		if len(queue) > 0 {
+			next, head = ready, queue[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			err = nil
+		case err = <-errs:
+			if ctx.Err() != nil {
+				err = nil
+			} else if err == nil {
+				err = errors.New("watcher stopped")
+			}
+		case rel := <-changes:
+			if !w.exists(rel) {
+				forget(processed, rel)
+			}
+			if w.matches(rel) {
+				w.track(pending, rel)
+			}
+			continue
+		case <-ticker.C:
+			queue = append(queue, w.settled(pending, processed, inFlight)...)
+			continue
+		case next <- head:
+			queue = queue[1:]
+			continue
+		case rel := <-done:
+			// An image removed while it was processed is not remembered, as its removal was already handled
+			if w.exists(rel) {
+				processed[rel] = inFlight[rel]
+			}
+			delete(inFlight, rel)
+			// The image may have changed while it was processed, in which case it is queued again once it settles
+			w.track(pending, rel)
+			continue
+		}
+
+		cancel()
+		close(ready)
+		wg.Wait()
+		summary := w.Summary()
+		summary.Elapsed = time.Since(start)
+		return summary, err
+	}
+}
+
+// add counts an item towards the summary, keeping it if it failed.
+func (w *Watcher) add(item batch.Item) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.summary.Add(item)
+	if item.Err != nil {
+		w.summary.Items = append(w.summary.Items, item)
+	}
+}
+
+// tick returns how often pending files are checked: a quarter of Settle, so that an image is processed at most a
+// quarter of Settle after it settled.
+func (w *Watcher) tick() time.Duration {
+	tick := w.cfg.Settle / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	return tick
+}
+
+// matches reports whether a changed file is an image the batch configuration selects.
+func (w *Watcher) matches(rel string) bool {
+	// Hidden files are skipped, as many tools write to a hidden temporary file that is renamed once complete
+	if rel == "" || strings.HasPrefix(path.Base(rel), ".") {
+		return false
+	}
+	if w.skipDir(filepath.Dir(filepath.Join(w.cfg.Batch.InputDir, filepath.FromSlash(rel)))) {
+		return false
+	}
+	return batch.Match(rel, w.cfg.Batch.Include, w.cfg.Batch.Exclude)
+}
+
+// skipDir reports whether a directory is the output directory or inside it, so that results are not reprocessed.
+func (w *Watcher) skipDir(dir string) bool {
+	if w.skip == "" {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	return abs == w.skip || strings.HasPrefix(abs, w.skip+string(filepath.Separator))
+}
+
+// track starts or restarts the settle period of a file, from its current state.
+func (w *Watcher) track(pending map[string]*pendingFile, rel string) {
+	state, ok := w.stat(rel)
+	if !ok {
+		delete(pending, rel)
+		return
+	}
+	if p, ok := pending[rel]; ok && p.state == state {
+		return
+	}
+	pending[rel] = &pendingFile{state: state, since: time.Now()}
+}
+
+// settled returns the pending files whose state has not changed for Settle, and removes them from pending.
+//
+// Notes:
+//   - Files that are being processed stay pending until they complete, and files whose state is the one they were
+//     last processed in are dropped, so that a file is not processed twice for the same content.
+func (w *Watcher) settled(pending map[string]*pendingFile, processed, inFlight map[string]fileState) []string {
+	now := time.Now()
+	var ready []string
+	for rel, p := range pending {
+		state, ok := w.stat(rel)
+		_, busy := inFlight[rel]
+		switch {
+		case !ok:
+			delete(pending, rel)
+		case state != p.state:
+			p.state, p.since = state, now
+		case now.Sub(p.since) < w.cfg.Settle, busy:
+		case processed[rel] == state:
+			delete(pending, rel)
+		default:
+			delete(pending, rel)
+			inFlight[rel] = state
+			ready = append(ready, rel)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// exists reports whether a file or directory reported by the notifier is still there.
+func (w *Watcher) exists(rel string) bool {
+	_, err := os.Lstat(filepath.Join(w.cfg.Batch.InputDir, filepath.FromSlash(rel)))
+	return !os.IsNotExist(err)
+}
+
+// forget drops a removed file, or every file of a removed directory, from the states images were last processed
+// in, so that they do not accumulate while the watcher runs.
+func forget(processed map[string]fileState, rel string) {
+	delete(processed, rel)
+	prefix := rel + "/"
+	for file := range processed {
+		if strings.HasPrefix(file, prefix) {
+			delete(processed, file)
+		}
+	}
+}
+
+// stat returns the state of a regular file.
+func (w *Watcher) stat(rel string) (fileState, bool) {
+	info, err := os.Stat(filepath.Join(w.cfg.Batch.InputDir, filepath.FromSlash(rel)))
+	if err != nil || !info.Mode().IsRegular() {
+		return fileState{}, false
+	}
+	return fileState{size: info.Size(), modTime: info.ModTime()}, true
+}
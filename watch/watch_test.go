@@ -0,0 +1,193 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mwiater/golangpprof/batch"
+	"github.com/mwiater/golangpprof/imageprocessing"
+	"github.com/mwiater/golangpprof/internal/testimage"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitItem returns the next processed image, failing the test if none arrives in time.
+func waitItem(t *testing.T, items <-chan batch.Item) batch.Item {
+	select {
+	case item := <-items:
+		return item
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an image to be processed")
+		return batch.Item{}
+	}
+}
+
+// TestWatch ensures that existing and new images are processed once they are completely written, with native
+// notifications and with polling, and that the output directory and other files are ignored.
+func TestWatch(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		poll := poll
+		name := "notify"
+		if poll {
+			name = "poll"
+		}
+		t.Run(name, func(t *testing.T) {
+			data := testimage.JPEG(t)
+			dir := t.TempDir()
+			out := filepath.Join(dir, "out")
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "existing.jpg"), data, 0o644))
+			ops, _ := imageprocessing.ParseOperations("grayscale")
+
+			items := make(chan batch.Item, 10)
+			w, err := New(Config{
+				Batch: batch.Config{
+					InputDir:   dir,
+					OutputDir:  out,
+					Operations: ops,
+					OnItem:     func(item batch.Item) { items <- item },
+				},
+				Settle:       150 * time.Millisecond,
+				Poll:         poll,
+				PollInterval: 20 * time.Millisecond,
+			})
+			assert.NoError(t, err)
+			if poll {
+				assert.Equal(t, "polling every 20ms", w.Method())
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			type result struct {
+				summary batch.Summary
+				err     error
+			}
+			results := make(chan result, 1)
+			go func() {
+				summary, err := w.Run(ctx)
+				results <- result{summary, err}
+			}()
+
+			item := waitItem(t, items)
+			assert.Equal(t, "existing.jpg", item.Path)
+			assert.NoError(t, item.Err)
+			assert.FileExists(t, filepath.Join(out, "existing.jpg"))
+
+			// An image written in two parts, with a pause shorter than Settle, is only processed once complete
+			assert.NoError(t, os.MkdirAll(filepath.Join(dir, "new"), 0o755))
+			f, err := os.Create(filepath.Join(dir, "new", "slow.jpg"))
+			assert.NoError(t, err)
+			_, err = f.Write(data[:len(data)/2])
+			assert.NoError(t, err)
+			assert.NoError(t, f.Sync())
+			time.Sleep(60 * time.Millisecond)
+			_, err = f.Write(data[len(data)/2:])
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0o644))
+
+			item = waitItem(t, items)
+			assert.Equal(t, "new/slow.jpg", item.Path)
+			assert.NoError(t, item.Err)
+			assert.Equal(t, int64(40*30), item.Pixels)
+
+			// Nothing else is processed: not the text file, nor the results written to the output directory
+			select {
+			case item := <-items:
+				t.Errorf("unexpected image processed: %s", item.Path)
+			case <-time.After(400 * time.Millisecond):
+			}
+
+			// A removed image is forgotten, so the same content put back in its place is processed again
+			info, err := os.Stat(filepath.Join(dir, "existing.jpg"))
+			assert.NoError(t, err)
+			assert.NoError(t, os.Remove(filepath.Join(dir, "existing.jpg")))
+			time.Sleep(100 * time.Millisecond)
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, "existing.jpg"), data, 0o644))
+			assert.NoError(t, os.Chtimes(filepath.Join(dir, "existing.jpg"), info.ModTime(), info.ModTime()))
+			assert.Equal(t, "existing.jpg", waitItem(t, items).Path)
+
+			cancel()
+			r := <-results
+			assert.NoError(t, r.err)
+			assert.Equal(t, 3, r.summary.Processed)
+			assert.Equal(t, 0, r.summary.Failed)
+			assert.Empty(t, r.summary.Items)
+			assert.True(t, r.summary.Elapsed > 0)
+		})
+	}
+}
+
+// TestWatchReprocess ensures that an image is processed again when it changes, and that a restarted watcher skips
+// the images its manifest records as done.
+func TestWatchReprocess(t *testing.T) {
+	data := testimage.JPEG(t)
+	dir := t.TempDir()
+	out := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "one.jpg"), data, 0o644))
+	ops, _ := imageprocessing.ParseOperations("grayscale")
+	manifest, err := batch.OpenManifest(filepath.Join(out, ".batch-manifest.jsonl"))
+	assert.NoError(t, err)
+	defer manifest.Close()
+
+	items := make(chan batch.Item, 10)
+	cfg := Config{
+		Batch:  batch.Config{InputDir: dir, OutputDir: out, Operations: ops, Manifest: manifest, OnItem: func(item batch.Item) { items <- item }},
+		Settle: 50 * time.Millisecond,
+	}
+	w, err := New(cfg)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	assert.False(t, waitItem(t, items).Skipped)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "one.jpg"), []byte("corrupted"), 0o644))
+	item := waitItem(t, items)
+	assert.ErrorContains(t, item.Err, "decode: ")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "one.jpg"), data, 0o644))
+	item = waitItem(t, items)
+	assert.NoError(t, item.Err)
+	assert.False(t, item.Skipped, "the manifest records the corrupted content as failed")
+	cancel()
+	<-done
+
+	w, err = New(cfg)
+	assert.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+	item = waitItem(t, items)
+	assert.NoError(t, item.Err)
+	assert.True(t, item.Skipped)
+}
+
+// TestForget ensures that a removed file, or the files of a removed directory, are forgotten.
+func TestForget(t *testing.T) {
+	processed := map[string]fileState{"a.jpg": {size: 1}, "dir/b.jpg": {size: 2}, "dir/sub/c.jpg": {size: 3}, "dirt.jpg": {size: 4}}
+	forget(processed, "a.jpg")
+	assert.Len(t, processed, 3)
+	forget(processed, "dir")
+	assert.Equal(t, map[string]fileState{"dirt.jpg": {size: 4}}, processed)
+}
+
+// TestNew ensures that invalid configurations are rejected.
+func TestNew(t *testing.T) {
+	ops, _ := imageprocessing.ParseOperations("grayscale")
+	dir := t.TempDir()
+
+	_, err := New(Config{Batch: batch.Config{InputDir: dir}})
+	assert.Error(t, err)
+	_, err = New(Config{Batch: batch.Config{InputDir: filepath.Join(dir, "missing"), Operations: ops}})
+	assert.Error(t, err)
+	_, err = New(Config{Batch: batch.Config{InputDir: dir, Operations: ops, Include: []string{"["}}})
+	assert.Error(t, err)
+
+	w, err := New(Config{Batch: batch.Config{InputDir: dir, Operations: ops}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, w.Method())
+	assert.NoError(t, w.notifier.close())
+}